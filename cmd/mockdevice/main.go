@@ -0,0 +1,342 @@
+// Command mockdevice pretends to be a fleet of sensors: each simulated device
+// POSTs synthetic readings to the server at a shared rate for a while, over
+// TLS with an optional client certificate or API key, and a summary of the
+// answers is printed at the end. It behaves the way real firmware should,
+// backing off when the server sends Retry-After, which makes it a load
+// generator for the rate limiting and queue features too.
+//
+//    go run ./cmd/mockdevice -target https://localhost -insecure -devices 50 -rate 200 -duration 1m
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/fxamacker/cbor/v2"
+    "golang.org/x/time/rate"
+    "google.golang.org/protobuf/proto"
+
+    "github.com/mytechnotalent/IoT/sensor"
+    "github.com/mytechnotalent/IoT/sensor/sensorpb"
+)
+
+// config holds the command-line settings.
+type config struct {
+    Target     string
+    Type       string
+    Devices    int
+    Prefix     string
+    Rate       float64
+    Duration   time.Duration
+    Cert       string
+    CA         string
+    Insecure   bool
+    APIKey     string
+    CBOR       bool
+    Proto      bool
+    Timeout    time.Duration
+    RetryAfter bool
+    Verbose    bool
+}
+
+// endpoints maps -type to the path the server serves it on.
+var endpoints = map[string]string{
+    "temp": "/sensor/temp",
+    "door": "/sensor/door",
+}
+
+func parseConfig(args []string) (config, error) {
+    var cfg config
+    fs := flag.NewFlagSet("mockdevice", flag.ContinueOnError)
+    fs.StringVar(&cfg.Target, "target", "https://localhost", "server to send readings to; a URL without a path gets the -type endpoint")
+    fs.StringVar(&cfg.Type, "type", "temp", "kind of device to simulate: temp or door")
+    fs.IntVar(&cfg.Devices, "devices", 1, "number of simulated devices, each with its own device_id")
+    fs.StringVar(&cfg.Prefix, "prefix", "mock-", "device_id prefix; devices are numbered from 1, e.g. mock-001")
+    fs.Float64Var(&cfg.Rate, "rate", 1, "readings per second across all devices (0 is as fast as the server answers)")
+    fs.DurationVar(&cfg.Duration, "duration", 10*time.Second, "how long to send for (0 runs until interrupted)")
+    fs.StringVar(&cfg.Cert, "cert", "", "client certificate and key as cert.pem,key.pem, for servers started with -clientca")
+    fs.StringVar(&cfg.CA, "ca", "", "PEM CA bundle to verify the server certificate with, instead of the system roots")
+    fs.BoolVar(&cfg.Insecure, "insecure", false, "skip TLS certificate verification, e.g. for the self-signed ssl/ certificate")
+    fs.StringVar(&cfg.APIKey, "api-key", os.Getenv("IOT_API_KEY"), "API key sent as \"Authorization: Bearer <key>\", falls back to $IOT_API_KEY")
+    fs.BoolVar(&cfg.CBOR, "cbor", false, "send readings as CBOR instead of JSON")
+    fs.BoolVar(&cfg.Proto, "proto", false, "send readings as protobuf (sensor/sensorpb) instead of JSON")
+    fs.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "timeout for each request")
+    fs.BoolVar(&cfg.RetryAfter, "retry-after", true, "pause a device for the Retry-After the server sends with 429 and 503, as firmware should")
+    fs.BoolVar(&cfg.Verbose, "v", false, "print every request that does not get a 2xx")
+    if err := fs.Parse(args); err != nil {
+        return cfg, err
+    }
+
+    u, err := url.Parse(cfg.Target)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return cfg, fmt.Errorf("invalid -target %q: want an http or https URL", cfg.Target)
+    }
+    if u.Path == "" || u.Path == "/" {
+        path, ok := endpoints[cfg.Type]
+        if !ok {
+            return cfg, fmt.Errorf("invalid -type %q: use temp or door", cfg.Type)
+        }
+        cfg.Target = strings.TrimSuffix(cfg.Target, "/") + path
+    }
+    if cfg.CBOR && cfg.Proto {
+        return cfg, errors.New("-cbor and -proto cannot both be set")
+    }
+    if cfg.Devices < 1 || cfg.Rate < 0 || cfg.Duration < 0 {
+        return cfg, errors.New("invalid -devices/-rate/-duration: at least one device, rate and duration not negative")
+    }
+    return cfg, nil
+}
+
+// newClient builds the HTTP client with the TLS settings from cfg.
+func newClient(cfg config) (*http.Client, error) {
+    tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+    if cfg.Cert != "" {
+        certFile, keyFile, ok := strings.Cut(cfg.Cert, ",")
+        if !ok {
+            return nil, fmt.Errorf("invalid -cert %q: want cert.pem,key.pem", cfg.Cert)
+        }
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("error loading client certificate: %v", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    if cfg.CA != "" {
+        pem, err := ioutil.ReadFile(cfg.CA)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", cfg.CA)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    return &http.Client{
+        Timeout: cfg.Timeout,
+        Transport: &http.Transport{
+            TLSClientConfig:     tlsConfig,
+            MaxIdleConnsPerHost: cfg.Devices,
+        },
+    }, nil
+}
+
+// device is one simulated sensor and the state its readings drift from.
+type device struct {
+    id   string
+    temp float64
+    open bool
+    seq  uint64
+}
+
+// next returns the device's next reading: the temperature wanders by up to
+// half a degree and the door changes state now and then. Readings are
+// numbered from 1 in seq, so the server can tell which ones went missing.
+func (d *device) next(kind string) sensor.Reading {
+    d.seq++
+    seq := d.seq
+    r := sensor.Reading{DeviceID: d.id, Seq: &seq, Timestamp: time.Now().Unix()}
+    switch kind {
+    case "door":
+        if rand.Intn(10) == 0 {
+            d.open = !d.open
+        }
+        open := d.open
+        r.Open = &open
+    default:
+        d.temp += rand.Float64() - 0.5
+        temp := float64(int(d.temp*10)) / 10
+        r.Temp = &temp
+    }
+    return r
+}
+
+// stats counts the answers across all devices.
+type stats struct {
+    mu       sync.Mutex
+    statuses map[int]int
+    errors   int
+    paused   time.Duration
+    total    time.Duration
+    slowest  time.Duration
+}
+
+func (s *stats) record(status int, took time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.statuses[status]++
+    s.total += took
+    if took > s.slowest {
+        s.slowest = took
+    }
+}
+
+// report prints the summary and returns the exit status: 0 only if every
+// reading got a 2xx.
+func (s *stats) report(w io.Writer, elapsed time.Duration) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    sent, ok := 0, 0
+    var codes []int
+    for code, n := range s.statuses {
+        codes = append(codes, code)
+        sent += n
+        if code/100 == 2 {
+            ok += n
+        }
+    }
+    sort.Ints(codes)
+    fmt.Fprintf(w, "sent %d readings in %s (%.1f/s)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+    for _, code := range codes {
+        fmt.Fprintf(w, "  %d %-22s %d\n", code, http.StatusText(code), s.statuses[code])
+    }
+    if s.errors > 0 {
+        fmt.Fprintf(w, "  transport errors           %d\n", s.errors)
+    }
+    if sent > 0 {
+        fmt.Fprintf(w, "latency mean %s, max %s\n", (s.total / time.Duration(sent)).Round(time.Microsecond), s.slowest.Round(time.Microsecond))
+    }
+    if s.paused > 0 {
+        fmt.Fprintf(w, "devices paused for Retry-After: %s in total\n", s.paused.Round(time.Millisecond))
+    }
+    if ok != sent || s.errors > 0 {
+        return 1
+    }
+    return 0
+}
+
+func main() {
+    cfg, err := parseConfig(os.Args[1:])
+    if errors.Is(err, flag.ErrHelp) {
+        os.Exit(0)
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error parsing configuration:", err)
+        os.Exit(2)
+    }
+    client, err := newClient(cfg)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error configuring TLS:", err)
+        os.Exit(2)
+    }
+    os.Exit(run(cfg, client))
+}
+
+// run starts one goroutine per device and waits for them to finish.
+func run(cfg config, client *http.Client) int {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    if cfg.Duration > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+        defer cancel()
+    }
+    limiter := rate.NewLimiter(rate.Inf, 1)
+    if cfg.Rate > 0 {
+        limiter = rate.NewLimiter(rate.Limit(cfg.Rate), 1)
+    }
+
+    fmt.Printf("%d %s devices sending to %s\n", cfg.Devices, cfg.Type, cfg.Target)
+    s := &stats{statuses: make(map[int]int)}
+    start := time.Now()
+    var wg sync.WaitGroup
+    for i := 1; i <= cfg.Devices; i++ {
+        d := &device{id: fmt.Sprintf("%s%03d", cfg.Prefix, i), temp: 18 + rand.Float64()*6}
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for limiter.Wait(ctx) == nil {
+                wait := send(ctx, client, cfg, d, s)
+                if wait > 0 && cfg.RetryAfter {
+                    s.mu.Lock()
+                    s.paused += wait
+                    s.mu.Unlock()
+                    select {
+                    case <-time.After(wait):
+                    case <-ctx.Done():
+                        return
+                    }
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    return s.report(os.Stdout, time.Since(start))
+}
+
+// send POSTs one reading from d and records the answer. It returns how long
+// the server asked the device to wait before sending again, if at all.
+func send(ctx context.Context, client *http.Client, cfg config, d *device, s *stats) time.Duration {
+    reading := d.next(cfg.Type)
+    contentType := "application/json"
+    var body []byte
+    var err error
+    switch {
+    case cfg.CBOR:
+        contentType = "application/cbor"
+        body, err = cbor.Marshal(reading)
+    case cfg.Proto:
+        contentType = "application/x-protobuf"
+        body, err = proto.Marshal(&sensorpb.Reading{DeviceId: reading.DeviceID, Temp: reading.Temp, Open: reading.Open, Seq: reading.Seq, Ts: reading.Timestamp})
+    default:
+        body, err = json.Marshal(reading)
+    }
+    if err != nil {
+        panic(err)
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Target, bytes.NewReader(body))
+    if err != nil {
+        panic(err)
+    }
+    req.Header.Set("Content-Type", contentType)
+    req.Header.Set("X-Device-ID", d.id)
+    if cfg.APIKey != "" {
+        req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+    }
+
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        // Requests cut off by the end of the run are not the server's fault
+        if ctx.Err() == nil {
+            s.mu.Lock()
+            s.errors++
+            s.mu.Unlock()
+            if cfg.Verbose {
+                fmt.Fprintf(os.Stderr, "%s: %v\n", d.id, err)
+            }
+        }
+        return 0
+    }
+    msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+    resp.Body.Close()
+    s.record(resp.StatusCode, time.Since(start))
+    if resp.StatusCode/100 != 2 && cfg.Verbose {
+        fmt.Fprintf(os.Stderr, "%s: %s %s\n", d.id, resp.Status, bytes.TrimSpace(msg))
+    }
+    if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+        if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+            return time.Duration(secs) * time.Second
+        }
+    }
+    return 0
+}
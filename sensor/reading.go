@@ -0,0 +1,34 @@
+// Package sensor holds the reading format shared by the server in src/ and
+// the programs that talk to it, such as cmd/mockdevice.
+package sensor
+
+import "fmt"
+
+// Reading is the JSON document a device POSTs, e.g. {"device_id":"abc","temp":21.5,"ts":1700000000},
+// or the equivalent CBOR map.
+// Which measurement fields are required depends on the device type. Seq is
+// optional: a device that numbers its readings 1, 2, 3... lets the server notice
+// the ones that never arrived.
+type Reading struct {
+    DeviceID  string   `json:"device_id"`
+    Temp      *float64 `json:"temp,omitempty"`
+    Open      *bool    `json:"open,omitempty"`
+    Seq       *uint64  `json:"seq,omitempty"`
+    Timestamp int64    `json:"ts"`
+}
+
+// MissingField is the error for a required field absent from a reading.
+func MissingField(name string) error {
+    return fmt.Errorf("missing required field %q", name)
+}
+
+// Validate reports the first common required field that is missing from the reading.
+func (r Reading) Validate() error {
+    switch {
+    case r.DeviceID == "":
+        return MissingField("device_id")
+    case r.Timestamp == 0:
+        return MissingField("ts")
+    }
+    return nil
+}
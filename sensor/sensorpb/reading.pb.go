@@ -0,0 +1,174 @@
+// The protobuf form of sensor.Reading, for devices that send
+// application/x-protobuf. Regenerate reading.pb.go after changing it:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative sensor/sensorpb/reading.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: sensor/sensorpb/reading.proto
+
+package sensorpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Reading is one measurement from a device. Which of temp and open is
+// required depends on the endpoint, as for JSON readings.
+type Reading struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Identifies the device, as device_id does in JSON.
+	DeviceId string `protobuf:"bytes,1,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`
+	// Temperature, for /sensor/temp.
+	Temp *float64 `protobuf:"fixed64,2,opt,name=temp,proto3,oneof" json:"temp,omitempty"`
+	// Whether the door is open, for /sensor/door.
+	Open *bool `protobuf:"varint,3,opt,name=open,proto3,oneof" json:"open,omitempty"`
+	// Seconds since the Unix epoch.
+	Ts int64 `protobuf:"varint,4,opt,name=ts,proto3" json:"ts,omitempty"`
+	// The device's count of readings, as seq does in JSON.
+	Seq           *uint64 `protobuf:"varint,5,opt,name=seq,proto3,oneof" json:"seq,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reading) Reset() {
+	*x = Reading{}
+	mi := &file_sensor_sensorpb_reading_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reading) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reading) ProtoMessage() {}
+
+func (x *Reading) ProtoReflect() protoreflect.Message {
+	mi := &file_sensor_sensorpb_reading_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reading.ProtoReflect.Descriptor instead.
+func (*Reading) Descriptor() ([]byte, []int) {
+	return file_sensor_sensorpb_reading_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Reading) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+func (x *Reading) GetTemp() float64 {
+	if x != nil && x.Temp != nil {
+		return *x.Temp
+	}
+	return 0
+}
+
+func (x *Reading) GetOpen() bool {
+	if x != nil && x.Open != nil {
+		return *x.Open
+	}
+	return false
+}
+
+func (x *Reading) GetTs() int64 {
+	if x != nil {
+		return x.Ts
+	}
+	return 0
+}
+
+func (x *Reading) GetSeq() uint64 {
+	if x != nil && x.Seq != nil {
+		return *x.Seq
+	}
+	return 0
+}
+
+var File_sensor_sensorpb_reading_proto protoreflect.FileDescriptor
+
+const file_sensor_sensorpb_reading_proto_rawDesc = "" +
+	"\n" +
+	"\x1dsensor/sensorpb/reading.proto\x12\riot.sensor.v1\"\x99\x01\n" +
+	"\aReading\x12\x1b\n" +
+	"\tdevice_id\x18\x01 \x01(\tR\bdeviceId\x12\x17\n" +
+	"\x04temp\x18\x02 \x01(\x01H\x00R\x04temp\x88\x01\x01\x12\x17\n" +
+	"\x04open\x18\x03 \x01(\bH\x01R\x04open\x88\x01\x01\x12\x0e\n" +
+	"\x02ts\x18\x04 \x01(\x03R\x02ts\x12\x15\n" +
+	"\x03seq\x18\x05 \x01(\x04H\x02R\x03seq\x88\x01\x01B\a\n" +
+	"\x05_tempB\a\n" +
+	"\x05_openB\x06\n" +
+	"\x04_seqB/Z-github.com/mytechnotalent/IoT/sensor/sensorpbb\x06proto3"
+
+var (
+	file_sensor_sensorpb_reading_proto_rawDescOnce sync.Once
+	file_sensor_sensorpb_reading_proto_rawDescData []byte
+)
+
+func file_sensor_sensorpb_reading_proto_rawDescGZIP() []byte {
+	file_sensor_sensorpb_reading_proto_rawDescOnce.Do(func() {
+		file_sensor_sensorpb_reading_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_sensor_sensorpb_reading_proto_rawDesc), len(file_sensor_sensorpb_reading_proto_rawDesc)))
+	})
+	return file_sensor_sensorpb_reading_proto_rawDescData
+}
+
+var file_sensor_sensorpb_reading_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_sensor_sensorpb_reading_proto_goTypes = []any{
+	(*Reading)(nil), // 0: iot.sensor.v1.Reading
+}
+var file_sensor_sensorpb_reading_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_sensor_sensorpb_reading_proto_init() }
+func file_sensor_sensorpb_reading_proto_init() {
+	if File_sensor_sensorpb_reading_proto != nil {
+		return
+	}
+	file_sensor_sensorpb_reading_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_sensor_sensorpb_reading_proto_rawDesc), len(file_sensor_sensorpb_reading_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_sensor_sensorpb_reading_proto_goTypes,
+		DependencyIndexes: file_sensor_sensorpb_reading_proto_depIdxs,
+		MessageInfos:      file_sensor_sensorpb_reading_proto_msgTypes,
+	}.Build()
+	File_sensor_sensorpb_reading_proto = out.File
+	file_sensor_sensorpb_reading_proto_goTypes = nil
+	file_sensor_sensorpb_reading_proto_depIdxs = nil
+}
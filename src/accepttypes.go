@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "mime"
+    "strings"
+)
+
+// mediaOctetStream is what an upload without a Content-Type is taken to be.
+const mediaOctetStream = "application/octet-stream"
+
+// typeAllowlist is the set of media types the server takes on top of what
+// each device type accepts. Built from -accept-types it also covers
+// /upload/file; by default it is every type some endpoint parses and leaves
+// uploads alone.
+type typeAllowlist struct {
+    types    []string
+    explicit bool
+}
+
+// knownMediaTypes lists the media types the device types parse, plus NDJSON
+// streams of JSON readings, in the order the device types name them.
+func knownMediaTypes() []string {
+    var types []string
+    seen := make(map[string]bool)
+    add := func(mt string) {
+        if !seen[mt] {
+            seen[mt] = true
+            types = append(types, mt)
+        }
+    }
+    for _, dt := range deviceTypes {
+        for _, mt := range dt.ContentTypes {
+            add(mt)
+        }
+        if dt.accepts(mediaJSON) {
+            add(mediaNDJSON)
+        }
+    }
+    return types
+}
+
+// newTypeAllowlist parses a comma-separated -accept-types list, or returns
+// the default for an empty one.
+func newTypeAllowlist(list string) (*typeAllowlist, error) {
+    if strings.TrimSpace(list) == "" {
+        return &typeAllowlist{types: knownMediaTypes()}, nil
+    }
+    known := make(map[string]bool)
+    for _, mt := range knownMediaTypes() {
+        known[mt] = true
+    }
+    t := &typeAllowlist{explicit: true}
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        mt, params, err := mime.ParseMediaType(entry)
+        if err != nil || len(params) > 0 || !strings.Contains(mt, "/") || strings.Contains(mt, "*") {
+            return nil, fmt.Errorf("invalid -accept-types entry %q: want a media type such as application/json", entry)
+        }
+        if !known[mt] {
+            slog.Warn("accepted media type is not parsed by any device type, only uploads take it", "type", mt)
+        }
+        t.types = append(t.types, mt)
+    }
+    if len(t.types) == 0 {
+        return nil, fmt.Errorf("-accept-types lists no media types")
+    }
+    return t, nil
+}
+
+// allows reports whether the server takes bodies of media type mt.
+func (t *typeAllowlist) allows(mt string) bool {
+    for _, allowed := range t.types {
+        if allowed == mt {
+            return true
+        }
+    }
+    return false
+}
+
+// forType returns the media types the endpoint of dt takes here.
+func (t *typeAllowlist) forType(dt deviceType) []string {
+    var types []string
+    for _, mt := range dt.ContentTypes {
+        if t.allows(mt) {
+            types = append(types, mt)
+        }
+    }
+    if dt.accepts(mediaJSON) && t.allows(mediaNDJSON) {
+        types = append(types, mediaNDJSON)
+    }
+    return types
+}
+
+// String lists the types the server accepts.
+func (t *typeAllowlist) String() string {
+    return strings.Join(t.types, ", ")
+}
+
+// refusal is the 415 message for the endpoint of dt: prefix and the types it
+// takes, or the server's list when -accept-types leaves it none.
+func (t *typeAllowlist) refusal(prefix string, dt deviceType) string {
+    types := t.forType(dt)
+    if len(types) == 0 {
+        return "This endpoint takes none of the content types this server accepts: " + t.String()
+    }
+    return prefix + strings.Join(types, ", ")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// statusRecorder captures the status code and body size written through an http.ResponseWriter.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    if s.status == 0 {
+        s.status = code
+    }
+    s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+    if s.status == 0 {
+        s.status = http.StatusOK
+    }
+    n, err := s.ResponseWriter.Write(b)
+    s.bytes += int64(n)
+    return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for Flush and deadlines.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// Hijack lets a WebSocket upgrade take over the connection; it is logged as a 101.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+    if err == nil && s.status == 0 {
+        s.status = http.StatusSwitchingProtocols
+    }
+    return conn, rw, err
+}
+
+// accessLog writes one Apache combined log line per request, followed by the
+// handling time in microseconds (Apache's %D) and the request ID, so standard
+// analyzers can parse it.
+type accessLog struct {
+    mu sync.Mutex
+    w  io.Writer
+    c  io.Closer
+}
+
+// openAccessLog opens path for appending; "-" means stdout.
+func openAccessLog(path string) (*accessLog, error) {
+    if path == "-" {
+        return &accessLog{w: os.Stdout}, nil
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &accessLog{w: f, c: f}, nil
+}
+
+// middleware records every request passing through next.
+func (l *accessLog) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        l.write(r, rec.status, rec.bytes, start, time.Since(start))
+    })
+}
+
+// write formats and appends a single combined-format line.
+func (l *accessLog) write(r *http.Request, status int, size int64, start time.Time, elapsed time.Duration) {
+    user := clientName(r)
+    if user == "" {
+        user = "-"
+    }
+    bytes := "-"
+    if size > 0 {
+        bytes = fmt.Sprint(size)
+    }
+    line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %q %q %d %s\n",
+        remoteIP(r),
+        strings.ReplaceAll(user, " ", "_"),
+        start.Format("02/Jan/2006:15:04:05 -0700"),
+        r.Method,
+        r.URL.RequestURI(),
+        r.Proto,
+        status,
+        bytes,
+        orDash(r.Referer()),
+        orDash(r.UserAgent()),
+        elapsed.Microseconds(),
+        orDash(requestID(r.Context())),
+    )
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    io.WriteString(l.w, line)
+}
+
+// orDash returns "-" for empty log fields, as Apache does.
+func orDash(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+// Close closes the log file, if any.
+func (l *accessLog) Close() error {
+    if l.c == nil {
+        return nil
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.c.Close()
+}
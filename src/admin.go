@@ -0,0 +1,129 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// adminAccess decides who may use the /admin endpoints, from -admin: "local"
+// admits loopback clients, and any other entry is a client certificate CN.
+type adminAccess struct {
+    local      bool
+    cns        map[string]bool
+    trustProxy bool
+}
+
+// parseAdmin reads the comma-separated -admin list; CNs need mtls (-clientca).
+func parseAdmin(list string, mtls, trustProxy bool) (*adminAccess, error) {
+    ad := &adminAccess{cns: make(map[string]bool), trustProxy: trustProxy}
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        switch entry {
+        case "":
+        case "local":
+            ad.local = true
+        default:
+            ad.cns[entry] = true
+        }
+    }
+    if !ad.local && len(ad.cns) == 0 {
+        return nil, fmt.Errorf("-admin lists nobody")
+    }
+    if len(ad.cns) > 0 && !mtls {
+        return nil, fmt.Errorf("-admin client certificate CNs need -clientca")
+    }
+    return ad, nil
+}
+
+// String describes who is admitted, for -check and the startup log.
+func (ad *adminAccess) String() string {
+    var who []string
+    if ad.local {
+        who = append(who, "loopback clients")
+    }
+    var cns []string
+    for cn := range ad.cns {
+        cns = append(cns, "CN "+cn)
+    }
+    sort.Strings(cns)
+    return strings.Join(append(who, cns...), ", ")
+}
+
+// permits reports whether r comes from an administrator. Behind a proxy the
+// loopback check uses the address the proxy reports, so -trust-proxy must be
+// set there or every client would look local.
+func (ad *adminAccess) permits(r *http.Request) bool {
+    if ad.local {
+        if ip := net.ParseIP(clientIP(r, ad.trustProxy)); ip != nil && ip.IsLoopback() {
+            return true
+        }
+    }
+    return ad.cns[clientName(r)]
+}
+
+// middleware answers 403 to anyone -admin does not admit.
+func (ad *adminAccess) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !ad.permits(r) {
+            slog.WarnContext(r.Context(), "rejected admin request", "remote_addr", r.RemoteAddr, "client_cn", clientName(r), "path", r.URL.Path)
+            writeError(w, http.StatusForbidden, "Forbidden")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// reloadNotes describes the outcome of a reload for the audit log: the error,
+// or each part that changed and how.
+func reloadNotes(changes []reloadChange, err error) map[string]string {
+    notes := make(map[string]string)
+    if err != nil {
+        notes["error"] = err.Error()
+        return notes
+    }
+    if len(changes) == 0 {
+        notes["changes"] = "none"
+    }
+    for _, c := range changes {
+        var what []string
+        for _, s := range c.Added {
+            what = append(what, "+"+s)
+        }
+        for _, s := range c.Removed {
+            what = append(what, "-"+s)
+        }
+        what = append(what, c.Changed...)
+        notes[c.Part] = strings.Join(what, ", ")
+    }
+    return notes
+}
+
+// reloadResponse is the body of a successful POST /admin/reload.
+type reloadResponse struct {
+    Status  string         `json:"status"`
+    Changes []reloadChange `json:"changes"`
+}
+
+// handleReload applies the configuration files as they are now on disk, as
+// SIGHUP does, and answers with what changed. If any file fails to load,
+// nothing is applied and the error is returned.
+func (a *app) handleReload(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+    slog.InfoContext(r.Context(), "reloading configuration", "source", "admin", "remote_addr", r.RemoteAddr, "client_cn", clientName(r))
+    changes, err := a.reload()
+    for k, v := range reloadNotes(changes, err) {
+        auditNote(r.Context(), k, v)
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "error reloading configuration, keeping previous configuration", "err", err)
+        writeError(w, http.StatusUnprocessableEntity, "Reload failed, configuration unchanged: "+err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, reloadResponse{Status: "ok", Changes: changes})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// auditGenesis is the prev hash of the first entry of an audit log.
+const auditGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// auditEntry is one line of the -audit-log: who did what, and how it turned
+// out. Hash is the SHA-256 of the entry's JSON without it, and Prev the hash
+// of the entry before, so editing, removing or reordering any entry breaks
+// every hash after it.
+type auditEntry struct {
+    Seq        int64             `json:"seq"`
+    Time       time.Time         `json:"time"`
+    Identity   string            `json:"identity"`
+    RemoteAddr string            `json:"remote_addr,omitempty"`
+    RequestID  string            `json:"request_id,omitempty"`
+    Action     string            `json:"action"`
+    Detail     map[string]string `json:"detail,omitempty"`
+    Status     int               `json:"status,omitempty"`
+    Result     string            `json:"result"`
+    Prev       string            `json:"prev"`
+    Hash       string            `json:"hash,omitempty"`
+}
+
+// sum returns the hash of e, which covers every field but Hash itself.
+func (e auditEntry) sum() (string, error) {
+    e.Hash = ""
+    b, err := json.Marshal(e)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog appends administrative actions to an append-only file, kept
+// apart from the data and the server log so it can be handed to an auditor
+// as it is.
+type auditLog struct {
+    path string
+
+    mu   sync.Mutex
+    f    *os.File
+    seq  int64
+    prev string
+}
+
+// openAuditLog opens path for appending, continuing the hash chain of the
+// entries already in it. A file that does not verify is refused rather than
+// extended, so tampering is never papered over by new entries.
+func openAuditLog(path string) (*auditLog, error) {
+    l := &auditLog{path: path, prev: auditGenesis}
+    if f, err := os.Open(path); err == nil {
+        last, err := verifyAudit(f, nil)
+        f.Close()
+        if err != nil {
+            return nil, fmt.Errorf("%v; move the file aside to start a new chain", err)
+        }
+        if last != nil {
+            l.seq, l.prev = last.Seq, last.Hash
+        }
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+    l.f = f
+    return l, nil
+}
+
+// verifyAudit checks the hash chain of the audit log read from r, calling
+// each for every entry if it is not nil, and returns the last entry, or nil
+// for an empty log.
+func verifyAudit(r io.Reader, each func(auditEntry)) (*auditEntry, error) {
+    var last *auditEntry
+    prev := auditGenesis
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for line := 1; scanner.Scan(); line++ {
+        var e auditEntry
+        if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+            return last, fmt.Errorf("audit log entry on line %d is not valid JSON: %v", line, err)
+        }
+        if e.Prev != prev {
+            return last, fmt.Errorf("audit log entry on line %d does not follow the one before: the chain is broken", line)
+        }
+        sum, err := e.sum()
+        if err != nil {
+            return last, err
+        }
+        if e.Hash != sum {
+            return last, fmt.Errorf("audit log entry on line %d does not match its hash: it was changed", line)
+        }
+        if each != nil {
+            each(e)
+        }
+        prev = e.Hash
+        last = &e
+    }
+    if err := scanner.Err(); err != nil {
+        return last, fmt.Errorf("error reading audit log: %v", err)
+    }
+    return last, nil
+}
+
+// record chains e onto the log and writes it to disk before returning.
+func (l *auditLog) record(e auditEntry) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    e.Seq = l.seq + 1
+    e.Time = time.Now().UTC()
+    e.Prev = l.prev
+    sum, err := e.sum()
+    if err != nil {
+        return err
+    }
+    e.Hash = sum
+    b, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    if _, err := l.f.Write(append(b, '\n')); err != nil {
+        return err
+    }
+    if err := l.f.Sync(); err != nil {
+        return err
+    }
+    l.seq, l.prev = e.Seq, e.Hash
+    return nil
+}
+
+// auditNotesKey carries the detail a handler adds to its request's entry.
+type auditNotesKey struct{}
+
+// auditNote adds key to the audit log entry of the request ctx belongs to,
+// so a handler can say what it changed. It does nothing without -audit-log.
+func auditNote(ctx context.Context, key, value string) {
+    if notes, ok := ctx.Value(auditNotesKey{}).(map[string]string); ok {
+        notes[key] = value
+    }
+}
+
+// middleware records every request to next once it has been answered,
+// rejected ones included. Plain GET and HEAD requests only report state and
+// are left out, unless reads is set because they hand out data.
+func (l *auditLog) middleware(reads bool, identity func(*http.Request) string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !reads && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        notes := make(map[string]string)
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditNotesKey{}, notes)))
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        e := auditEntry{
+            Identity:   identity(r),
+            RemoteAddr: r.RemoteAddr,
+            RequestID:  requestID(r.Context()),
+            Action:     r.Method + " " + r.URL.Path,
+            Status:     rec.status,
+            Result:     auditResult(rec.status),
+        }
+        if len(notes) > 0 {
+            e.Detail = notes
+        }
+        if err := l.record(e); err != nil {
+            slog.ErrorContext(r.Context(), "error writing audit log", "file", l.path, "action", e.Action, "err", err)
+        }
+    })
+}
+
+// auditResult sums up a reply's status for the audit log.
+func auditResult(status int) string {
+    switch {
+    case status < 300:
+        return "ok"
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        return "rejected"
+    }
+    return "failed"
+}
+
+// Close closes the file.
+func (l *auditLog) Close() error {
+    return l.f.Close()
+}
+
+// auditIdentity names who sent r: the client certificate CN, or the
+// fingerprint of a valid API key, or "local" for a loopback client that -admin
+// admits without either.
+func (a *app) auditIdentity(r *http.Request) string {
+    if cn := clientName(r); cn != "" {
+        return "CN " + cn
+    }
+    if token, ok := bearerToken(r); ok && a.keys != nil && a.keys.valid(token) {
+        return "key " + fingerprint([]byte(token))
+    }
+    if ip := net.ParseIP(clientIP(r, a.cfg.TrustProxy)); ip != nil && ip.IsLoopback() {
+        return "local"
+    }
+    return "anonymous"
+}
+
+// adminEndpoint guards an /admin endpoint with the route's authentication and
+// -admin, recording it in the -audit-log when there is one.
+func (a *app) adminEndpoint(reads bool, h http.HandlerFunc) http.Handler {
+    next := a.authenticate(a.admin.middleware(h))
+    if a.audit == nil {
+        return next
+    }
+    return a.audit.middleware(reads, a.auditIdentity, next)
+}
+
+// runAudit verifies an audit log and lists its entries with -v, exiting 1 if
+// the chain is broken.
+func runAudit(args []string) int {
+    fs := flag.NewFlagSet("iot audit", flag.ContinueOnError)
+    path := fs.String("audit-log", "", "audit log written by -audit-log to verify")
+    verbose := fs.Bool("v", false, "print every entry")
+    if err := fs.Parse(args); err != nil {
+        if errors.Is(err, flag.ErrHelp) {
+            return 0
+        }
+        return 2
+    }
+    if *path == "" {
+        fmt.Fprintln(os.Stderr, "Error parsing audit configuration: -audit-log is required")
+        return 2
+    }
+
+    f, err := os.Open(*path)
+    if err != nil {
+        slog.Error("error opening audit log", "file", *path, "err", err)
+        return 1
+    }
+    defer f.Close()
+
+    var each func(auditEntry)
+    if *verbose {
+        each = func(e auditEntry) {
+            detail := make([]string, 0, len(e.Detail))
+            for k, v := range e.Detail {
+                detail = append(detail, k+"="+v)
+            }
+            sort.Strings(detail)
+            fmt.Printf("%d %s %s %s %s %d %s\n", e.Seq, e.Time.Format(time.RFC3339), e.Identity, e.Action, e.Result, e.Status, strings.Join(detail, " "))
+        }
+    }
+    last, err := verifyAudit(f, each)
+    if err != nil {
+        slog.Error("audit log does not verify", "file", *path, "err", err)
+        return 1
+    }
+    if last == nil {
+        slog.Info("audit log is empty", "file", *path)
+        return 0
+    }
+    slog.Info("audit log verified", "file", *path, "entries", last.Seq, "last_hash", last.Hash)
+    return 0
+}
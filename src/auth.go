@@ -0,0 +1,122 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/subtle"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "sync/atomic"
+)
+
+// keySet is the set of API keys allowed to submit data.
+type keySet map[string]struct{}
+
+// loadKeys reads one API key per line from path, ignoring blank lines and # comments.
+func loadKeys(path string) (keySet, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    keys := keySet{}
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        keys[line] = struct{}{}
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("no keys found in %s", path)
+    }
+    return keys, nil
+}
+
+// valid reports whether key is in the set, comparing against every entry in
+// constant time so the response time does not leak how much of a key matched.
+func (k keySet) valid(key string) bool {
+    ok := 0
+    for candidate := range k {
+        ok |= subtle.ConstantTimeCompare([]byte(candidate), []byte(key))
+    }
+    return ok == 1
+}
+
+// apiKeys serves the -keyfile keys and lets a reload swap them while requests
+// are being checked.
+type apiKeys struct {
+    path string
+    set  atomic.Pointer[keySet]
+}
+
+// newAPIKeys loads the keys from path.
+func newAPIKeys(path string) (*apiKeys, error) {
+    keys, err := loadKeys(path)
+    if err != nil {
+        return nil, err
+    }
+    k := &apiKeys{path: path}
+    k.set.Store(&keys)
+    return k, nil
+}
+
+// valid reports whether key is one of the current keys.
+func (k *apiKeys) valid(key string) bool {
+    return k.set.Load().valid(key)
+}
+
+// current returns the keys being accepted.
+func (k *apiKeys) current() keySet {
+    return *k.set.Load()
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+    scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+        return "", false
+    }
+    return strings.TrimSpace(token), true
+}
+
+// hasClientCert reports whether the request presented a certificate that verified against the client CA.
+func hasClientCert(r *http.Request) bool {
+    return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// clientName returns the CommonName of the verified client certificate, or "" if there is none.
+func clientName(r *http.Request) string {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+        return ""
+    }
+    return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// verifiedDeviceKey is the context key authenticate stores the device id
+// under once the device's -authdb secret has passed.
+type verifiedDeviceKey struct{}
+
+// withVerifiedDevice returns ctx noting that id proved its identity.
+func withVerifiedDevice(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, verifiedDeviceKey{}, id)
+}
+
+// verifiedDevice names the device making r by what it proved: its verified
+// client certificate CN, or the id whose -authdb secret it presented. It is ""
+// before authentication, and for a client known only by an API key or a
+// header, since anyone may send any X-Device-ID.
+func verifiedDevice(r *http.Request) string {
+    if cn := clientName(r); cn != "" {
+        return cn
+    }
+    id, _ := r.Context().Value(verifiedDeviceKey{}).(string)
+    return id
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+    "sync"
+    "time"
+
+    _ "github.com/jackc/pgx/v5/stdlib"
+    "golang.org/x/sync/singleflight"
+    _ "modernc.org/sqlite"
+)
+
+const (
+    authDBQueryTimeout = 2 * time.Second // one lookup, so a slow database cannot hold requests
+    authDBCacheMax     = 100000          // cached devices before expired entries are swept
+)
+
+// errAuthUnavailable means the database could not be asked and nothing was cached for the device.
+var errAuthUnavailable = errors.New("device database unavailable")
+
+// authDB checks device id/secret pairs against a SQL table, e.g.
+//
+//  CREATE TABLE devices (device_id TEXT PRIMARY KEY, secret TEXT NOT NULL);
+//
+// Answers, including "no such device", are cached for ttl. When the database is
+// down an expired entry is still used; a device with no entry at all is refused.
+type authDB struct {
+    db       *sql.DB
+    query    string
+    keyQuery string // optional; returns the device's payload key
+    ttl      time.Duration
+    group    singleflight.Group
+
+    mu    sync.Mutex
+    cache map[string]authEntry
+}
+
+// authEntry is a cached lookup; found is false for a device the table does not have.
+type authEntry struct {
+    secret  string
+    key     string // hex AES key for encrypted bodies, "" for plaintext
+    found   bool
+    fetched time.Time
+}
+
+// openAuthDB connects to dsn, which selects the driver: postgres://... or
+// postgresql://... use PostgreSQL, sqlite:<path> uses a SQLite file. query takes
+// the device id as its only parameter and returns its secret; keyQuery, if
+// set, takes the same parameter and returns its payload key.
+func openAuthDB(dsn, query, keyQuery string, ttl time.Duration) (*authDB, error) {
+    driver, source, err := authDBDriver(dsn)
+    if err != nil {
+        return nil, err
+    }
+    db, err := sql.Open(driver, source)
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := db.PingContext(ctx); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error connecting to device database: %v", err)
+    }
+    return &authDB{db: db, query: query, keyQuery: keyQuery, ttl: ttl, cache: make(map[string]authEntry)}, nil
+}
+
+// authDBDriver maps a -authdb DSN to a database/sql driver name and data source.
+func authDBDriver(dsn string) (string, string, error) {
+    switch {
+    case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+        return "pgx", dsn, nil
+    case strings.HasPrefix(dsn, "sqlite:"):
+        return "sqlite", strings.TrimPrefix(dsn, "sqlite:"), nil
+    }
+    return "", "", fmt.Errorf("unsupported -authdb %q: use postgres://... or sqlite:<path>", dsn)
+}
+
+// valid reports whether secret belongs to device, or errAuthUnavailable if
+// that cannot be known right now.
+func (d *authDB) valid(device, secret string) (bool, error) {
+    entry, err := d.lookup(device)
+    if err != nil {
+        return false, err
+    }
+    return entry.found && subtle.ConstantTimeCompare([]byte(entry.secret), []byte(secret)) == 1, nil
+}
+
+// lookup returns the cached entry for device, refreshing it from the database
+// once it is older than ttl. Concurrent misses for one device share a query.
+func (d *authDB) lookup(device string) (authEntry, error) {
+    d.mu.Lock()
+    cached, ok := d.cache[device]
+    d.mu.Unlock()
+    if ok && time.Since(cached.fetched) < d.ttl {
+        return cached, nil
+    }
+
+    v, err, _ := d.group.Do(device, func() (any, error) {
+        return d.fetch(device)
+    })
+    if err != nil {
+        if ok {
+            slog.Warn("device database unavailable, using cached credentials", "device_id", device, "age", time.Since(cached.fetched).Round(time.Second).String(), "err", err)
+            return cached, nil
+        }
+        slog.Error("device database unavailable", "device_id", device, "err", err)
+        return authEntry{}, errAuthUnavailable
+    }
+    return v.(authEntry), nil
+}
+
+// fetch queries the database for device and caches the answer.
+func (d *authDB) fetch(device string) (authEntry, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), authDBQueryTimeout)
+    defer cancel()
+
+    entry := authEntry{found: true, fetched: time.Now()}
+    err := d.db.QueryRowContext(ctx, d.query, device).Scan(&entry.secret)
+    if errors.Is(err, sql.ErrNoRows) {
+        entry.found = false
+    } else if err != nil {
+        return authEntry{}, err
+    }
+    if entry.found && d.keyQuery != "" {
+        var key sql.NullString
+        err := d.db.QueryRowContext(ctx, d.keyQuery, device).Scan(&key)
+        if err != nil && !errors.Is(err, sql.ErrNoRows) {
+            return authEntry{}, err
+        }
+        entry.key = key.String
+    }
+
+    // Unknown ids are cached too, so sweep before made-up ones can grow the cache without bound
+    d.mu.Lock()
+    if len(d.cache) >= authDBCacheMax {
+        for id, e := range d.cache {
+            if time.Since(e.fetched) >= d.ttl {
+                delete(d.cache, id)
+            }
+        }
+    }
+    if entry.found || len(d.cache) < authDBCacheMax {
+        d.cache[device] = entry
+    }
+    d.mu.Unlock()
+    return entry, nil
+}
+
+// Close closes the database connection pool.
+func (d *authDB) Close() error {
+    return d.db.Close()
+}
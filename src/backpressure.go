@@ -0,0 +1,136 @@
+package main
+
+import (
+    "log/slog"
+    "math"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    loadWindow     = 10 * time.Second // span over which the sink error rate is measured
+    loadMinSamples = 10               // sink writes a window needs before its error rate counts
+)
+
+// loadMonitor tells devices to back off with 503 and Retry-After while the
+// server is overloaded: the worker queue has filled past the high-water mark,
+// or too many sink writes are failing. It switches back only once the queue
+// has drained below the low-water mark, or the error rate has fallen below half
+// its threshold, so acceptance does not flap around a single level.
+type loadMonitor struct {
+    queue     *workQueue
+    high, low float64 // queue fill fractions; high 0 ignores the queue
+    errRate   float64 // failing fraction of sink writes; 0 ignores errors
+
+    mu       sync.Mutex
+    backlog  bool // queue above high, until it falls to low
+    failing  bool // sink error rate above errRate, until it falls below half
+    start    time.Time
+    writes   int // sink writes and failures in the current window
+    failures int
+    drained  float64 // writes per second in the last full window
+}
+
+// newLoadMonitor watches queue, which may be nil when readings are stored synchronously.
+func newLoadMonitor(queue *workQueue, high, low, errRate float64) *loadMonitor {
+    return &loadMonitor{queue: queue, high: high, low: low, errRate: errRate, start: time.Now()}
+}
+
+// observe records the outcome of storing one reading through the sinks.
+func (l *loadMonitor) observe(ok bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.roll(time.Now())
+    l.writes++
+    if !ok {
+        l.failures++
+    }
+}
+
+// roll closes the current window once it is loadWindow old and updates the
+// error state and drain rate from it. Caller holds mu.
+func (l *loadMonitor) roll(now time.Time) {
+    elapsed := now.Sub(l.start)
+    if elapsed < loadWindow {
+        return
+    }
+    l.drained = float64(l.writes) / elapsed.Seconds()
+    if l.errRate > 0 {
+        rate := 0.0
+        if l.writes > 0 {
+            rate = float64(l.failures) / float64(l.writes)
+        }
+        switch {
+        case !l.failing && l.writes >= loadMinSamples && rate >= l.errRate:
+            l.failing = true
+            slog.Warn("sinks failing, devices told to back off", "error_rate", rate, "threshold", l.errRate, "writes", l.writes)
+        case l.failing && (l.writes < loadMinSamples || rate < l.errRate/2):
+            // Too few writes to tell also ends it, so the sinks get probed again
+            l.failing = false
+            slog.Info("sink error rate recovered, accepting readings again", "error_rate", rate, "writes", l.writes)
+        }
+    }
+    l.start, l.writes, l.failures = now, 0, 0
+}
+
+// overloaded reports whether new readings should be refused and, if so, how
+// long the device should wait before trying again.
+func (l *loadMonitor) overloaded() (time.Duration, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    l.roll(now)
+
+    pending := 0
+    if l.queue != nil && l.high > 0 {
+        pending = len(l.queue.jobs)
+        fill := float64(pending) / float64(cap(l.queue.jobs))
+        switch {
+        case !l.backlog && fill >= l.high:
+            l.backlog = true
+            slog.Warn("processing queue above high-water mark, devices told to back off", "pending", pending, "fill", fill, "high", l.high)
+        case l.backlog && fill <= l.low:
+            l.backlog = false
+            slog.Info("processing queue below low-water mark, accepting readings again", "pending", pending, "fill", fill, "low", l.low)
+        }
+    }
+
+    switch {
+    case l.backlog && l.drained > 0:
+        // Long enough for the workers to clear what is queued at their recent pace
+        return time.Duration(math.Ceil(float64(pending)/l.drained)) * time.Second, true
+    case l.backlog:
+        return 5 * time.Second, true
+    case l.failing:
+        // The error state is next re-evaluated when the window closes
+        return loadWindow - now.Sub(l.start), true
+    }
+    return 0, false
+}
+
+// active reports whether devices are currently being told to back off.
+func (l *loadMonitor) active() bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.backlog || l.failing
+}
+
+// refuse answers 503 with Retry-After and reports true while the server is
+// overloaded, before the reading's body is read.
+func (l *loadMonitor) refuse(w http.ResponseWriter) bool {
+    wait, ok := l.overloaded()
+    if !ok {
+        return false
+    }
+    secs := int(math.Ceil(wait.Seconds()))
+    if secs < 1 {
+        secs = 1
+    } else if secs > 60 {
+        secs = 60
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    writeError(w, http.StatusServiceUnavailable, "Server overloaded, retry later")
+    return true
+}
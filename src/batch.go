@@ -0,0 +1,123 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+)
+
+// batchResult is the outcome of one element of a batch, in request order.
+type batchResult struct {
+    Index        int      `json:"index"`
+    Status       int      `json:"status"`
+    Deduplicated bool     `json:"deduplicated,omitempty"`
+    Error        string   `json:"error,omitempty"`
+    Details      []string `json:"details,omitempty"`
+}
+
+// isBatch reports whether a JSON body is an array of readings rather than a single object.
+func isBatch(body []byte) bool {
+    trimmed := bytes.TrimLeft(body, " \t\r\n")
+    return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// splitBatch decodes a JSON array one element at a time, stopping once it has
+// more than limit, so an oversized batch is refused without decoding the rest.
+func splitBatch(body []byte, limit int) ([]json.RawMessage, error) {
+    dec := json.NewDecoder(bytes.NewReader(body))
+    if _, err := dec.Token(); err != nil {
+        return nil, err
+    }
+    var elems []json.RawMessage
+    for dec.More() {
+        var elem json.RawMessage
+        if err := dec.Decode(&elem); err != nil {
+            return nil, err
+        }
+        elems = append(elems, elem)
+        if len(elems) > limit {
+            return elems, nil
+        }
+    }
+    if _, err := dec.Token(); err != nil {
+        return nil, err
+    }
+    if _, err := dec.Token(); err != io.EOF {
+        return nil, errors.New("invalid data after top-level value")
+    }
+    return elems, nil
+}
+
+// handleBatch processes a JSON array of readings element by element. Every
+// element gets its own status so valid readings are stored even when others
+// are rejected, and the request as a whole is answered with 207 Multi-Status.
+func (a *app) handleBatch(w http.ResponseWriter, r *http.Request, o origin, dt deviceType, body []byte) {
+    elems, err := splitBatch(body, a.cfg.MaxBatch)
+    if err != nil {
+        slog.WarnContext(r.Context(), "malformed batch", "remote_addr", r.RemoteAddr, "bytes", len(body), "err", err)
+        a.deadLetter(o, dt, "malformed batch: "+err.Error(), body)
+        writeError(w, http.StatusBadRequest, "Malformed batch: "+err.Error())
+        return
+    }
+    if len(elems) > a.cfg.MaxBatch {
+        slog.WarnContext(r.Context(), "batch too large", "remote_addr", r.RemoteAddr, "readings", fmt.Sprintf("more than %d", a.cfg.MaxBatch), "limit", a.cfg.MaxBatch)
+        writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch exceeds %d readings", a.cfg.MaxBatch))
+        return
+    }
+
+    results := make([]batchResult, len(elems))
+    stored := 0
+    for i, elem := range elems {
+        _, out, err := a.accept(r.Context(), o, dt, elem)
+        results[i] = a.batchElementResult(i, out, err)
+        if err == nil {
+            stored++
+        }
+    }
+    slog.InfoContext(r.Context(), "processed batch", "remote_addr", r.RemoteAddr, "readings", len(elems), "accepted", stored)
+    writeJSON(w, http.StatusMultiStatus, withServerTime(response{Status: "multi", Received: len(body), Results: results}, 0))
+}
+
+// batchElementResult maps the outcome of accepting one element to the status
+// a single-reading request would have received.
+func (a *app) batchElementResult(i int, out outcome, err error) batchResult {
+    switch {
+    case err == nil && out == outcomeQueued:
+        return batchResult{Index: i, Status: a.cfg.AcceptStatus}
+    case err == nil && out == outcomeDeduplicated:
+        return batchResult{Index: i, Status: http.StatusOK, Deduplicated: true}
+    case err == nil:
+        return batchResult{Index: i, Status: http.StatusOK}
+    }
+    // Declared past the success cases, since each errors.As target escapes
+    var invalid *invalidReadingError
+    var violation *schemaError
+    var failed *transformError
+    var unavailable *sinkUnavailableError
+    var stale *staleReadingError
+    switch {
+    case errors.As(err, &stale):
+        return batchResult{Index: i, Status: http.StatusConflict, Error: "Reading is older than the newest from this device"}
+    case errors.As(err, &violation):
+        return batchResult{Index: i, Status: http.StatusUnprocessableEntity, Error: "Reading does not match schema", Details: violation.Details}
+    case errors.As(err, &invalid):
+        return batchResult{Index: i, Status: http.StatusBadRequest, Error: "Invalid sensor reading: " + err.Error()}
+    case errors.As(err, &failed):
+        return batchResult{Index: i, Status: http.StatusInternalServerError, Error: "Error transforming reading"}
+    case errors.As(err, &unavailable):
+        return batchResult{Index: i, Status: http.StatusServiceUnavailable, Error: "Storage unavailable, retry later"}
+    case errors.Is(err, errMaintenance):
+        return batchResult{Index: i, Status: http.StatusServiceUnavailable, Error: "Server in maintenance, retry later"}
+    case errors.Is(err, errQueueFull):
+        return batchResult{Index: i, Status: http.StatusServiceUnavailable, Error: "Server busy, retry later"}
+    case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+        return batchResult{Index: i, Status: http.StatusServiceUnavailable, Error: "Processing cancelled, retry later"}
+    }
+    slog.Error("error storing batched reading", "index", i, "err", err)
+    return batchResult{Index: i, Status: http.StatusInternalServerError, Error: "Error storing reading"}
+}
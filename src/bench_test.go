@@ -0,0 +1,94 @@
+package main
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// benchServerFlags are server flags for the benchmarks, so a change can be
+// measured with the features it touches turned on.
+var benchServerFlags = flag.String("server-flags", "", "server flags for the benchmarks, e.g. \"-workers 4 -redact temp\"")
+
+// benchCase is one request the benchmarks send through the handler.
+type benchCase struct {
+    name    string
+    path    string
+    ctype   string
+    body    []byte
+    headers map[string]string
+}
+
+// benchCases are the requests that dominate a real deployment: small JSON
+// readings, large bodies such as camera images, and batches.
+func benchCases() []benchCase {
+    small := []byte(`{"device_id":"bench-001","temp":21.5,"ts":1700000000}`)
+
+    image := make([]byte, 512<<10)
+    copy(image, "\xff\xd8\xff\xe0")
+
+    var batch bytes.Buffer
+    batch.WriteByte('[')
+    for i := 0; i < 100; i++ {
+        if i > 0 {
+            batch.WriteByte(',')
+        }
+        fmt.Fprintf(&batch, `{"device_id":"bench-%03d","temp":%d.5,"ts":%d}`, i, 15+i%10, 1700000000+i)
+    }
+    batch.WriteByte(']')
+
+    return []benchCase{
+        {name: "small-json", path: "/sensor/temp", ctype: mediaJSON, body: small},
+        {name: "large-body", path: "/upload/image", ctype: "image/jpeg", body: image, headers: map[string]string{"X-Device-ID": "cam-01"}},
+        {name: "batch", path: "/sensor/temp", ctype: mediaJSON, body: batch.Bytes()},
+    }
+}
+
+// serveBench sends one request of case c through handler and returns the status.
+func serveBench(handler http.Handler, c benchCase) int {
+    r := httptest.NewRequest(http.MethodPost, c.path, bytes.NewReader(c.body))
+    r.Header.Set("Content-Type", c.ctype)
+    for k, v := range c.headers {
+        r.Header.Set(k, v)
+    }
+    w := httptest.NewRecorder()
+    w.Body = nil // the response bodies are not needed, only their cost
+    handler.ServeHTTP(w, r)
+    return w.Code
+}
+
+// BenchmarkHandler pushes each case through the full handler chain
+// in-process, with the noop sink and no network.
+func BenchmarkHandler(b *testing.B) {
+    a := newTestApp(b, strings.Fields(*benchServerFlags)...)
+    handler := a.handler()
+
+    // Logs are discarded, but formatting them still costs what it does in production
+    var lvl slog.Level
+    if err := lvl.UnmarshalText([]byte(strings.ToUpper(a.cfg.LogLevel))); err != nil {
+        b.Fatalf("-loglevel: %v", err)
+    }
+    defer slog.SetDefault(slog.Default())
+    slog.SetDefault(slog.New(requestIDHandler{slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: lvl})}))
+
+    for _, c := range benchCases() {
+        b.Run(c.name, func(b *testing.B) {
+            // One request first, so a case the configuration rejects fails rather than is timed
+            if got := serveBench(handler, c); got < 200 || got > 299 {
+                b.Fatalf("got status %d; check -server-flags", got)
+            }
+            b.ReportAllocs()
+            b.SetBytes(int64(len(c.body)))
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                serveBench(handler, c)
+            }
+        })
+    }
+}
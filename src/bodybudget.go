@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/sync/semaphore"
+)
+
+// bodyBudget caps the bytes that request bodies being read at once may hold
+// in memory, whatever the number of connections. Each request reserves what
+// its body can cost before reading it, and waits a little for room when the
+// budget is spent.
+type bodyBudget struct {
+    sem      *semaphore.Weighted
+    size     int64
+    wait     time.Duration
+    inFlight atomic.Int64
+}
+
+// newBodyBudget returns a budget of size bytes; requests wait up to wait for room.
+func newBodyBudget(size int64, wait time.Duration) *bodyBudget {
+    return &bodyBudget{sem: semaphore.NewWeighted(size), size: size, wait: wait}
+}
+
+// weight is what reading r's body may cost: its Content-Length when it is
+// sent uncompressed, otherwise the whole maxBody it may inflate or stream to.
+// A body larger than the budget still reserves only the whole budget.
+func (b *bodyBudget) weight(r *http.Request, encoding string, maxBody int64) int64 {
+    n := maxBody
+    if encoding != "gzip" && r.ContentLength >= 0 && r.ContentLength < n {
+        n = r.ContentLength
+    }
+    if n > b.size {
+        n = b.size
+    }
+    return n
+}
+
+// acquire reserves n bytes for the request, answering 503 and reporting false
+// if they do not free up within b.wait. On success the caller must call the
+// returned release once the body is no longer needed.
+func (b *bodyBudget) acquire(w http.ResponseWriter, r *http.Request, n int64) (func(), bool) {
+    if n <= 0 {
+        return func() {}, true
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), b.wait)
+    defer cancel()
+    if err := b.sem.Acquire(ctx, n); err != nil {
+        slog.WarnContext(r.Context(), "body memory budget spent, rejecting request", "remote_addr", r.RemoteAddr, "bytes", n, "in_flight", b.inFlight.Load(), "budget", b.size)
+        w.Header().Set("Retry-After", "1")
+        writeError(w, http.StatusServiceUnavailable, "Server busy, retry later")
+        return nil, false
+    }
+    b.inFlight.Add(n)
+    return func() {
+        b.inFlight.Add(-n)
+        b.sem.Release(n)
+    }, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// errBreakerOpen is what a sink behind an open breaker fails with, at once.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Breaker states, as exported on /metrics.
+const (
+    breakerClosed   = 0 // writes go through
+    breakerHalfOpen = 1 // one probe write is in flight; the rest fail fast
+    breakerOpen     = 2 // every write fails fast until the cooldown is over
+)
+
+// breakerSink stops calling a remote sink that keeps failing, so requests
+// fail in microseconds instead of waiting out every timeout and retry. After
+// failures consecutive transient errors it opens; once cooldown has passed,
+// the next write is let through as a probe, and its outcome closes the breaker
+// or opens it for another cooldown. Readings refused meanwhile are
+// dead-lettered like any other the sink could not take.
+type breakerSink struct {
+    Sink
+    name     string
+    failures int
+    cooldown time.Duration
+
+    mu       sync.Mutex
+    state    int
+    failed   int       // consecutive transient failures while closed
+    openedAt time.Time // when the breaker last opened
+}
+
+// newBreakerSink wraps sink in a closed breaker.
+func newBreakerSink(sink Sink, name string, failures int, cooldown time.Duration) *breakerSink {
+    return &breakerSink{Sink: sink, name: name, failures: failures, cooldown: cooldown}
+}
+
+// Store writes j through the breaker.
+func (b *breakerSink) Store(ctx context.Context, j job) error {
+    if !b.allow() {
+        return &sinkUnavailableError{errBreakerOpen}
+    }
+    err := b.Sink.Store(ctx, j)
+    b.record(ctx, err)
+    return err
+}
+
+// allow reports whether a write may go to the sink now, turning an open
+// breaker whose cooldown is over into a half-open one with this write as its probe.
+func (b *breakerSink) allow() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case breakerOpen:
+        if time.Since(b.openedAt) < b.cooldown {
+            return false
+        }
+        b.state = breakerHalfOpen
+        slog.Info("sink circuit breaker half-open, probing", "sink", b.name)
+        return true
+    case breakerHalfOpen:
+        return false
+    }
+    return true
+}
+
+// record updates the breaker with the outcome of a write. Errors the sink
+// marks permanent mean it is up and answering, so they count as success; a
+// write abandoned because its request went away counts for nothing.
+func (b *breakerSink) record(ctx context.Context, err error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if err != nil && ctx.Err() != nil {
+        if b.state == breakerHalfOpen {
+            // Let the next write probe instead
+            b.state = breakerOpen
+        }
+        return
+    }
+    var perm *permanentError
+    if err == nil || errors.As(err, &perm) {
+        if b.state != breakerClosed {
+            slog.Info("sink circuit breaker closed, sink recovered", "sink", b.name)
+        }
+        b.state, b.failed = breakerClosed, 0
+        return
+    }
+    switch b.state {
+    case breakerHalfOpen:
+        b.state, b.openedAt = breakerOpen, time.Now()
+        slog.Warn("sink circuit breaker probe failed, staying open", "sink", b.name, "cooldown", b.cooldown.String(), "err", err)
+    case breakerClosed:
+        b.failed++
+        if b.failed >= b.failures {
+            b.state, b.openedAt = breakerOpen, time.Now()
+            slog.Error("sink circuit breaker opened, failing writes fast", "sink", b.name, "failures", b.failed, "cooldown", b.cooldown.String(), "err", err)
+        }
+    }
+}
+
+// current returns the breaker state.
+func (b *breakerSink) current() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.state
+}
+
+// Close closes the wrapped sink if it needs closing.
+func (b *breakerSink) Close() error {
+    if c, ok := b.Sink.(io.Closer); ok {
+        return c.Close()
+    }
+    return nil
+}
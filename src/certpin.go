@@ -0,0 +1,148 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// certPins admits only client certificates whose SHA-256 fingerprint is in
+// the -cert-fingerprints file, on top of the CA check, so a device whose
+// certificate leaked can be shut out without waiting for a CRL. The file is
+// reloaded on SIGHUP.
+type certPins struct {
+    path string
+
+    mu   sync.RWMutex
+    pins map[string]string // hex fingerprint to its label, if any
+}
+
+// loadCertPins reads the fingerprints from path.
+func loadCertPins(path string) (*certPins, error) {
+    p := &certPins{path: path}
+    pins, err := p.load()
+    if err != nil {
+        return nil, err
+    }
+    p.set(pins)
+    return p, nil
+}
+
+// load reads and checks the file without applying it. Each line is a
+// fingerprint, in hex with or without colons, optionally followed by a label
+// naming the device; blank lines and lines starting with # are ignored.
+func (p *certPins) load() (map[string]string, error) {
+    data, err := ioutil.ReadFile(p.path)
+    if err != nil {
+        return nil, err
+    }
+    pins := make(map[string]string)
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := strings.Fields(line)
+        fp, ok := parseFingerprint(fields[0])
+        if !ok {
+            return nil, fmt.Errorf("%s:%d: want a SHA-256 fingerprint of 64 hex digits", p.path, n)
+        }
+        pins[fp] = strings.Join(fields[1:], " ")
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("error reading %s: %v", p.path, err)
+    }
+    return pins, nil
+}
+
+// parseFingerprint normalizes a fingerprint as openssl prints it, or as bare
+// hex, to lowercase hex without colons.
+func parseFingerprint(s string) (string, bool) {
+    s = strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(s), "sha256:"), ":", "")
+    if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+        return "", false
+    }
+    return s, true
+}
+
+// set replaces the pinned fingerprints with pins.
+func (p *certPins) set(pins map[string]string) {
+    p.mu.Lock()
+    p.pins = pins
+    p.mu.Unlock()
+    if len(pins) == 0 {
+        slog.Warn("certificate fingerprint file is empty, every client certificate will be refused", "file", p.path)
+        return
+    }
+    slog.Info("loaded certificate fingerprints", "file", p.path, "pins", len(pins))
+}
+
+// current returns the fingerprints in effect.
+func (p *certPins) current() map[string]string {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    return p.pins
+}
+
+// certFingerprint returns the SHA-256 fingerprint of cert in lowercase hex.
+func certFingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return hex.EncodeToString(sum[:])
+}
+
+// allowed reports whether cert is pinned, with its fingerprint.
+func (p *certPins) allowed(cert *x509.Certificate) (string, bool) {
+    fp := certFingerprint(cert)
+    _, ok := p.current()[fp]
+    return fp, ok
+}
+
+// verifyConnection returns a tls.Config.VerifyConnection callback that fails
+// the handshake for an unpinned client certificate and logs the fingerprint
+// of every accepted one, then calls next, if any. VerifyConnection also runs
+// on resumed sessions, which VerifyPeerCertificate does not. Clients without
+// a certificate are left to the per-route authentication.
+func (p *certPins) verifyConnection(next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+    return func(cs tls.ConnectionState) error {
+        if len(cs.PeerCertificates) > 0 {
+            leaf := cs.PeerCertificates[0]
+            fp, ok := p.allowed(leaf)
+            if !ok {
+                slog.Warn("UNPINNED client certificate rejected", "fingerprint", fp, "cn", leaf.Subject.CommonName, "issuer", leaf.Issuer.CommonName)
+                return fmt.Errorf("client certificate %s is not in the fingerprint allowlist", fp)
+            }
+            slog.Info("accepted pinned client certificate", "fingerprint", fp, "cn", leaf.Subject.CommonName, "resumed", cs.DidResume)
+        }
+        if next != nil {
+            return next(cs)
+        }
+        return nil
+    }
+}
+
+// middleware refuses requests on connections whose certificate was unpinned
+// by a reload after the handshake, and closes them, so removing a fingerprint
+// takes effect at once rather than when the device reconnects.
+func (p *certPins) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+            if fp, ok := p.allowed(r.TLS.PeerCertificates[0]); !ok {
+                slog.WarnContext(r.Context(), "refusing request from unpinned client certificate", "remote_addr", r.RemoteAddr, "fingerprint", fp)
+                w.Header().Set("Connection", "close")
+                writeError(w, http.StatusForbidden, "Client certificate is no longer allowed")
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "log/slog"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// certReloader serves the -cert files (or the ssl directory) through
+// GetCertificate and swaps in new certificates when the files change, so a
+// rotated certificate is picked up without a restart. A bad new pair is logged
+// and the previous certificates keep being served.
+type certReloader struct {
+    pairs      []certPair
+    passphrase string
+    certs      atomic.Pointer[[]tls.Certificate]
+
+    mu     sync.Mutex
+    stamps map[string]fileStamp // last seen state of each file
+
+    done chan struct{}
+}
+
+// fileStamp is what polling compares to notice a changed file.
+type fileStamp struct {
+    modTime time.Time
+    size    int64
+}
+
+// certFiles returns the certificate files loadCertificates reads, or nil when
+// the certificate comes from the environment or is generated by -dev and so
+// cannot change on disk.
+func certFiles(cfg Config) []certPair {
+    if cfg.TLSCertPEM != "" || cfg.TLSKeyPEM != "" {
+        return nil
+    }
+    if len(cfg.Certs) > 0 {
+        return cfg.Certs
+    }
+    if cfg.Dev && !fileExists(defaultCertPair.CertFile) && !fileExists(defaultCertPair.KeyFile) {
+        return nil
+    }
+    return []certPair{defaultCertPair}
+}
+
+// newCertReloader starts serving certs, already loaded from pairs, and checks
+// the files for changes every interval.
+func newCertReloader(pairs []certPair, passphrase string, certs []tls.Certificate, interval time.Duration) *certReloader {
+    c := &certReloader{pairs: pairs, passphrase: passphrase, done: make(chan struct{})}
+    c.certs.Store(&certs)
+    c.stamps = c.stat()
+    go c.refresh(interval)
+    return c
+}
+
+// getCertificate is a tls.Config.GetCertificate callback. Like crypto/tls with
+// a static list it picks the first certificate the client supports, falling
+// back to the first one.
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return pickCertificate(*c.certs.Load(), hello), nil
+}
+
+// current returns the certificates being served.
+func (c *certReloader) current() []tls.Certificate {
+    return *c.certs.Load()
+}
+
+// pickCertificate returns the first of certs the client supports, or the first.
+func pickCertificate(certs []tls.Certificate, hello *tls.ClientHelloInfo) *tls.Certificate {
+    for i := range certs {
+        if hello.SupportsCertificate(&certs[i]) == nil {
+            return &certs[i]
+        }
+    }
+    return &certs[0]
+}
+
+// stat records the current state of every certificate and key file.
+func (c *certReloader) stat() map[string]fileStamp {
+    stamps := make(map[string]fileStamp)
+    for _, pair := range c.pairs {
+        for _, path := range []string{pair.CertFile, pair.KeyFile} {
+            if fi, err := os.Stat(path); err == nil {
+                stamps[path] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+            }
+        }
+    }
+    return stamps
+}
+
+// reload loads the files again if any of them changed since the last check, or
+// always when force is set.
+func (c *certReloader) reload(force bool) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    stamps := c.stat()
+    if !force && sameStamps(stamps, c.stamps) {
+        return nil
+    }
+    // Remember the new state even on failure, so a bad pair is reported once
+    // and tried again when the files next change
+    c.stamps = stamps
+
+    certs, err := c.load()
+    if err != nil {
+        return err
+    }
+    c.set(certs)
+    return nil
+}
+
+// load reads every pair without serving them.
+func (c *certReloader) load() ([]tls.Certificate, error) {
+    var certs []tls.Certificate
+    for _, pair := range c.pairs {
+        cert, err := loadCertificate(pair, c.passphrase)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", pair.CertFile, err)
+        }
+        certs = append(certs, cert)
+    }
+    return certs, nil
+}
+
+// commit serves certs loaded outside the polling loop, so that the next poll
+// does not load the same files again.
+func (c *certReloader) commit(certs []tls.Certificate) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.stamps = c.stat()
+    c.set(certs)
+}
+
+// set starts serving certs. The caller holds c.mu.
+func (c *certReloader) set(certs []tls.Certificate) {
+    c.certs.Store(&certs)
+    for _, cert := range certs {
+        slog.Info("reloaded TLS certificate", "names", cert.Leaf.DNSNames, "not_after", cert.Leaf.NotAfter)
+    }
+}
+
+// sameStamps reports whether two stat results are identical.
+func sameStamps(a, b map[string]fileStamp) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for path, s := range a {
+        if t, ok := b[path]; !ok || !s.modTime.Equal(t.modTime) || s.size != t.size {
+            return false
+        }
+    }
+    return true
+}
+
+// refresh checks the files every interval until Close.
+func (c *certReloader) refresh(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if err := c.reload(false); err != nil {
+                slog.Error("error reloading TLS certificate, keeping previous certificate", "err", err)
+            }
+        case <-c.done:
+            return
+        }
+    }
+}
+
+// Close stops the refresh goroutine.
+func (c *certReloader) Close() {
+    close(c.done)
+}
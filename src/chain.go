@@ -0,0 +1,181 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// serverMiddleware is the default order of the middleware every request
+// passes through, outermost first:
+//
+//  headers      -header and -hsts, on every response, errors included
+//  requestid    X-Request-ID, so everything after it can log the id
+//  accesslog    -accesslog
+//  tracing      -otlp-endpoint
+//  compress     -compress; must come before respsign, so signatures cover
+//               the body before compression
+//  respsign     -response-key
+//  lifetime     -max-conn-lifetime
+//  pins         -cert-fingerprints, for pins removed after the handshake
+//
+// -server-middleware reorders them or leaves some out.
+var serverMiddleware = []string{"headers", "requestid", "accesslog", "tracing", "compress", "respsign", "lifetime", "pins"}
+
+// ingestMiddleware is the default order of the middleware in front of the
+// ingestion endpoints, outermost first:
+//
+//  cors         -cors-origins, so preflights are answered before anything else
+//  metrics      the iot_http_* metrics
+//  chaos        -chaos; before anything that keeps state, so a failed
+//               request leaves none behind
+//  maxheaders   -max-headers
+//  ipfilter     -allow-cidr and -deny-cidr
+//  ratelimit    -rate and -device-limits
+//  auth         the credentials -route-auth asks for
+//  idempotency  Idempotency-Key replays, for authenticated devices only
+//
+// -ingest-middleware reorders them or leaves some out.
+var ingestMiddleware = []string{"cors", "metrics", "chaos", "maxheaders", "ipfilter", "ratelimit", "auth", "idempotency"}
+
+// layer is one named middleware of a chain.
+type layer struct {
+    name string
+    wrap func(http.Handler) http.Handler
+}
+
+// chain is the middleware a request passes through, outermost first. Each
+// layer is an ordinary func(http.Handler) http.Handler, so it can be tested
+// around any handler on its own.
+type chain []layer
+
+// newChain orders the configured layers as order lists them. Layers that are
+// configured but left out of order are skipped, with a warning naming the
+// flag, and names in order that are not configured are ignored.
+func newChain(flag string, order []string, configured map[string]func(http.Handler) http.Handler) chain {
+    var c chain
+    listed := make(map[string]bool, len(order))
+    for _, name := range order {
+        listed[name] = true
+        if wrap, ok := configured[name]; ok {
+            c = append(c, layer{name: name, wrap: wrap})
+        }
+    }
+    var skipped []string
+    for name := range configured {
+        if !listed[name] {
+            skipped = append(skipped, name)
+        }
+    }
+    sort.Strings(skipped)
+    for _, name := range skipped {
+        slog.Warn("middleware left out by -"+flag+", its feature is configured but requests skip it", "middleware", name)
+    }
+    return c
+}
+
+// then wraps h in the chain, so the first layer sees the request first.
+func (c chain) then(h http.Handler) http.Handler {
+    for i := len(c) - 1; i >= 0; i-- {
+        h = c[i].wrap(h)
+    }
+    return h
+}
+
+// String lists the layers in order, for -check.
+func (c chain) String() string {
+    if len(c) == 0 {
+        return "none"
+    }
+    names := make([]string, len(c))
+    for i, l := range c {
+        names[i] = l.name
+    }
+    return strings.Join(names, " > ")
+}
+
+// parseMiddleware reads a -server-middleware or -ingest-middleware list: the
+// names from known, each at most once, in the order requests should pass
+// through them.
+func parseMiddleware(flag, list string, known []string) ([]string, error) {
+    var order []string
+    seen := make(map[string]bool)
+    for _, name := range strings.Split(list, ",") {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if name == "" {
+            continue
+        }
+        found := false
+        for _, k := range known {
+            found = found || k == name
+        }
+        if !found {
+            return nil, fmt.Errorf("invalid -%s: unknown middleware %q, use %s", flag, name, strings.Join(known, ", "))
+        }
+        if seen[name] {
+            return nil, fmt.Errorf("invalid -%s: %s given twice", flag, name)
+        }
+        seen[name] = true
+        order = append(order, name)
+    }
+    return order, nil
+}
+
+// serverChain returns the middleware around every route, as configured.
+func (a *app) serverChain() chain {
+    configured := map[string]func(http.Handler) http.Handler{
+        "requestid": withRequestID,
+    }
+    if len(a.cfg.Headers) > 0 {
+        configured["headers"] = func(h http.Handler) http.Handler { return withHeaders(a.cfg.Headers, h) }
+    }
+    if a.access != nil {
+        configured["accesslog"] = a.access.middleware
+    }
+    if a.tracing.enabled() {
+        configured["tracing"] = a.tracing.middleware
+    }
+    if a.cfg.Compress {
+        configured["compress"] = func(h http.Handler) http.Handler { return withCompression(a.cfg.CompressMin, h) }
+    }
+    if a.respSign != nil {
+        configured["respsign"] = a.respSign.middleware
+    }
+    if a.cfg.MaxConnLifetime > 0 {
+        configured["lifetime"] = a.capConnLifetime
+    }
+    if a.pins != nil {
+        configured["pins"] = a.pins.middleware
+    }
+    return newChain("server-middleware", a.cfg.ServerMiddleware, configured)
+}
+
+// ingestChain returns the middleware around the ingestion endpoints, as
+// configured.
+func (a *app) ingestChain() chain {
+    configured := map[string]func(http.Handler) http.Handler{
+        "metrics": a.metrics.instrument,
+        "auth":    a.authenticate,
+    }
+    if a.cfg.CORSOrigins != "" {
+        configured["cors"] = newCORSPolicy(a.cfg.CORSOrigins).middleware
+    }
+    if a.chaos != nil {
+        configured["chaos"] = a.chaos.middleware
+    }
+    if a.cfg.MaxHeaders > 0 {
+        configured["maxheaders"] = func(h http.Handler) http.Handler { return limitHeaders(a.cfg.MaxHeaders, h) }
+    }
+    if a.filter != nil {
+        configured["ipfilter"] = a.filter.middleware
+    }
+    if a.limiter != nil {
+        configured["ratelimit"] = a.limiter.middleware
+    }
+    if a.idem != nil {
+        configured["idempotency"] = a.idem.middleware
+    }
+    return newChain("ingest-middleware", a.cfg.IngestMiddleware, configured)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "log/slog"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// faultInjector delays or fails a fraction of ingestion requests on purpose,
+// for testing how device firmware copes with a slow or failing server. It
+// only exists with -chaos, and every fault it injects is logged at warn level
+// and marked with X-Injected-Fault, so it is never mistaken for a real one.
+type faultInjector struct {
+    delay     time.Duration
+    delayRate float64
+    errorRate float64
+    status    int
+
+    delayed atomic.Int64
+    failed  atomic.Int64
+}
+
+// newFaultInjector returns an injector from the -inject-* settings.
+func newFaultInjector(cfg Config) *faultInjector {
+    return &faultInjector{
+        delay:     cfg.InjectDelay,
+        delayRate: cfg.InjectDelayRate,
+        errorRate: cfg.InjectErrorRate,
+        status:    cfg.InjectStatus,
+    }
+}
+
+// middleware injects the faults in front of next. A delayed request may also
+// fail, so a device sees the slow error its timeout has to cope with. A
+// request that fails never reaches next, so it leaves nothing behind to trip
+// over on retry, such as a stored idempotency key.
+func (f *faultInjector) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if f.delay > 0 && rand.Float64() < f.delayRate {
+            f.delayed.Add(1)
+            w.Header().Add("X-Injected-Fault", "delay")
+            slog.WarnContext(r.Context(), "CHAOS: delaying request", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "delay", f.delay.String())
+            t := time.NewTimer(f.delay)
+            select {
+            case <-t.C:
+            case <-r.Context().Done():
+                t.Stop()
+                return
+            }
+        }
+        if f.errorRate > 0 && rand.Float64() < f.errorRate {
+            f.failed.Add(1)
+            w.Header().Add("X-Injected-Fault", "status")
+            if f.status == http.StatusServiceUnavailable || f.status == http.StatusTooManyRequests {
+                w.Header().Set("Retry-After", "1")
+            }
+            slog.WarnContext(r.Context(), "CHAOS: failing request", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "status", f.status)
+            writeError(w, f.status, "Injected fault: "+strconv.Itoa(f.status)+" "+http.StatusText(f.status))
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
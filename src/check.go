@@ -0,0 +1,290 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// setup checks everything that can be verified without binding a socket and
+// builds the app and TLS configuration. Normal startup and -check both go
+// through here, so a configuration that passes -check fails no later.
+func setup(cfg Config) (*app, *tls.Config, *autocert.Manager, error) {
+    if err := checkUploadDir(cfg.UploadDir); err != nil {
+        return nil, nil, nil, fmt.Errorf("upload directory %s is not writable: %v", cfg.UploadDir, err)
+    }
+
+    a, err := newApp(cfg)
+    if err != nil {
+        return nil, nil, nil, fmt.Errorf("error initializing server: %v", err)
+    }
+
+    // Behind a local proxy on a Unix socket TLS is terminated by the proxy
+    var tlsConfig *tls.Config
+    var manager *autocert.Manager
+    if cfg.Unix == "" {
+        tlsConfig, manager, err = newTLSConfig(cfg)
+        if err != nil {
+            a.Close()
+            return nil, nil, nil, fmt.Errorf("error loading TLS certificate: %v", err)
+        }
+        if a.crl != nil {
+            tlsConfig.VerifyPeerCertificate = a.crl.verifyPeerCertificate
+        }
+        if a.pins != nil {
+            tlsConfig.VerifyConnection = a.pins.verifyConnection(tlsConfig.VerifyConnection)
+        }
+        // Certificates read from files are served through a reloader so rotation needs no restart
+        if pairs := certFiles(cfg); manager == nil && cfg.CertReload > 0 && pairs != nil {
+            a.certs = newCertReloader(pairs, cfg.KeyPassphrase, tlsConfig.Certificates, cfg.CertReload)
+            tlsConfig.Certificates = nil
+            tlsConfig.GetCertificate = a.certs.getCertificate
+        }
+        // Stable ticket keys let devices resume sessions across restarts
+        if cfg.SessionTickets != "" || cfg.SessionTicketKeys != "" {
+            a.tickets, err = newTicketKeys(cfg.SessionTickets, cfg.SessionTicketKeys)
+            if err != nil {
+                a.Close()
+                return nil, nil, nil, fmt.Errorf("error loading session ticket keys: %v", err)
+            }
+            a.tickets.apply(tlsConfig)
+        }
+        // Staples ride on whichever certificate the handshake picks
+        if cfg.OCSP {
+            if a.certs != nil {
+                a.ocsp = newOCSPStapler(a.certs.current)
+            } else {
+                certs := tlsConfig.Certificates
+                a.ocsp = newOCSPStapler(func() []tls.Certificate { return certs })
+                tlsConfig.GetCertificate = staticCertificate(certs)
+                tlsConfig.Certificates = nil
+            }
+            tlsConfig.GetCertificate = a.ocsp.wrap(tlsConfig.GetCertificate)
+        }
+    }
+    return a, tlsConfig, manager, nil
+}
+
+// checkUploadDir verifies that uploads can be written without creating the
+// directory: it must be writable if it exists, and its parent otherwise.
+func checkUploadDir(dir string) error {
+    for dir != "" {
+        fi, err := os.Stat(dir)
+        if os.IsNotExist(err) {
+            parent := filepath.Dir(dir)
+            if parent == dir {
+                return err
+            }
+            dir = parent
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if !fi.IsDir() {
+            return fmt.Errorf("%s is not a directory", dir)
+        }
+        f, err := ioutil.TempFile(dir, ".check-*")
+        if err != nil {
+            return err
+        }
+        f.Close()
+        return os.Remove(f.Name())
+    }
+    return nil
+}
+
+// runCheck validates cfg with setup, writes a summary to w and returns the exit status.
+func runCheck(cfg Config, w io.Writer) int {
+    a, tlsConfig, manager, err := setup(cfg)
+    if err != nil {
+        fmt.Fprintln(w, "configuration invalid:", err)
+        return 1
+    }
+    defer a.Close()
+
+    fmt.Fprintln(w, "configuration OK")
+    if cfg.ConfigFile != "" {
+        fmt.Fprintf(w, "  config:        %s, overridden by the command line\n", cfg.ConfigFile)
+    }
+    if cfg.Unix != "" {
+        fmt.Fprintf(w, "  listen:        unix:%s (plain HTTP)\n", cfg.Unix)
+    } else {
+        fmt.Fprintf(w, "  listen:        %s (TLS >= %s)\n", cfg.Addr, tls.VersionName(cfg.TLSMin))
+    }
+    if cfg.ProxyProtocol {
+        from := "any address"
+        if len(cfg.ProxyProtocolFrom) > 0 {
+            from = cfg.ProxyProtocolFrom.String()
+        }
+        fmt.Fprintf(w, "  proxy:         PROXY protocol header required, from %s\n", from)
+    }
+    switch {
+    case manager != nil:
+        fmt.Fprintf(w, "  certificates:  autocert for %s\n", cfg.AutocertDomain)
+    case a.certs != nil:
+        fmt.Fprintf(w, "  certificates:  %d loaded, checked for changes every %s\n", len(*a.certs.certs.Load()), cfg.CertReload)
+    case tlsConfig != nil:
+        fmt.Fprintf(w, "  certificates:  %d loaded\n", len(tlsConfig.Certificates))
+    }
+    if a.tickets != nil {
+        fmt.Fprintf(w, "  tickets:       %d session ticket keys, the first encrypts new tickets\n", len(a.tickets.keys))
+    }
+    if a.ocsp != nil {
+        fmt.Fprintf(w, "  ocsp:          stapling from each certificate's responder (not contacted by -check)\n")
+    }
+    if cfg.Chaos {
+        faults := []string{"TESTING ONLY"}
+        if cfg.InjectDelay > 0 {
+            faults = append(faults, fmt.Sprintf("%g of ingestion requests delayed %s", cfg.InjectDelayRate, cfg.InjectDelay))
+        }
+        if cfg.InjectErrorRate > 0 {
+            faults = append(faults, fmt.Sprintf("%g of ingestion requests failed with %d", cfg.InjectErrorRate, cfg.InjectStatus))
+        }
+        fmt.Fprintf(w, "  chaos:         %s\n", strings.Join(faults, ", "))
+    }
+    if cfg.Echo {
+        fmt.Fprintf(w, "  sink:          none, -echo is on (TESTING ONLY)\n")
+    } else {
+        for _, spec := range cfg.Sinks {
+            optional := ""
+            if spec.Optional {
+                optional = " (optional, failures do not fail the request)"
+            }
+            fmt.Fprintf(w, "  sink:          %s%s\n", spec.name(), optional)
+            if spec.Kind == "http" && cfg.BreakerFailures > 0 {
+                fmt.Fprintf(w, "  breaker:       opens after %d consecutive failures, probes every %s\n", cfg.BreakerFailures, cfg.BreakerCooldown)
+            }
+        }
+    }
+    if cfg.DataFile != "" {
+        fmt.Fprintf(w, "  data file:     %s\n", cfg.DataFile)
+    }
+    if len(a.ready.required) > 0 {
+        limit := "forever"
+        if cfg.ReadyTimeout > 0 {
+            limit = "up to " + cfg.ReadyTimeout.String()
+        }
+        fmt.Fprintf(w, "  readiness:     /readyz waits %s for %s to connect\n", limit, strings.Join(a.ready.required, ", "))
+    }
+    if a.stale != nil {
+        state := "not saved"
+        if cfg.StaleState != "" {
+            state = "saved to " + cfg.StaleState
+        }
+        fmt.Fprintf(w, "  stale:         %s readings more than %s behind their device's newest or %s ahead of the clock, %s\n", cfg.StaleReadings, cfg.StaleTolerance, cfg.StaleMaxSkew, state)
+    }
+    if a.watch != nil {
+        alerts := "logged"
+        if cfg.WatchdogWebhook != "" {
+            alerts = "logged and sent to " + redactedURL(cfg.WatchdogWebhook)
+        }
+        fmt.Fprintf(w, "  watchdog:      %d devices from %s, alerts %s\n", len(a.watch.current()), cfg.Watchdog, alerts)
+    }
+    if a.queue != nil && a.queue.codel != nil {
+        fmt.Fprintf(w, "  queue delay:   readings refused while queued ones wait over %s for %s\n", cfg.CodelTarget, cfg.CodelInterval)
+    }
+    if a.stats != nil {
+        fmt.Fprintf(w, "  stats:         per-device statistics over %s in buckets of %s\n", a.stats.window(), cfg.StatsBucket)
+    }
+    if a.dedup != nil {
+        fmt.Fprintf(w, "  dedup:         dropping readings within %g of their device's last stored\n", cfg.DedupThreshold)
+    }
+    if a.seq != nil {
+        fmt.Fprintf(w, "  sequence:      counting missing seq numbers, waiting %d places for late ones\n", cfg.SeqWindow)
+    }
+    for _, f := range cfg.Headers {
+        fmt.Fprintf(w, "  header:        %s: %s\n", f.Name, f.Value)
+    }
+    fmt.Fprintf(w, "  middleware:    %s\n", a.serverChain())
+    fmt.Fprintf(w, "  ingestion:     %s\n", a.ingestChain())
+    if a.types.explicit {
+        fmt.Fprintf(w, "  accept types:  %s\n", a.types)
+    }
+    if cfg.Sniff {
+        fmt.Fprintf(w, "  sniff:         untyped and application/octet-stream readings recognized by their first bytes\n")
+    }
+    if a.configs != nil {
+        fmt.Fprintf(w, "  device config: %d devices from %s, sent with replies to readings\n", len(a.configs.current()), cfg.DeviceConfig)
+    }
+    if a.fw != nil {
+        m := a.fw.current()
+        mandatory := ""
+        if m.MinVersion != "" {
+            mandatory = ", mandatory below " + m.MinVersion
+        }
+        fmt.Fprintf(w, "  firmware:      %s from %s announced to older devices%s\n", m.Version, cfg.Firmware, mandatory)
+    }
+    if a.enrich != nil {
+        rules := a.enrich.current()
+        fmt.Fprintf(w, "  enrich:        %d devices and %d patterns from %s, plus server_host %s and received_at\n", len(rules.Devices), len(rules.Patterns), cfg.Enrich, a.enrich.host)
+    }
+    if a.fields != nil {
+        rules := a.fields.current()
+        fmt.Fprintf(w, "  field map:     %d vendors for %d devices and %d patterns from %s\n", len(rules.Vendors), len(rules.Devices), len(rules.Patterns), cfg.FieldMap)
+    }
+    if a.admin != nil {
+        endpoints := "POST /admin/reload, /admin/maintenance, /devices/{id}/commands"
+        if a.recent != nil {
+            endpoints += " and GET /export"
+        }
+        fmt.Fprintf(w, "  admin:         %s for %s\n", endpoints, a.admin)
+    }
+    if a.audit != nil {
+        fmt.Fprintf(w, "  audit log:     %s, %d entries so far\n", cfg.AuditLog, a.audit.seq)
+    }
+    if cfg.Compress {
+        fmt.Fprintf(w, "  compress:      gzip for GET responses of %d bytes or more\n", cfg.CompressMin)
+    }
+    if a.redact != nil {
+        fmt.Fprintf(w, "  redact:        %s masked in logs, stdout and the data file\n", cfg.Redact)
+    }
+    var auth []string
+    if cfg.ClientCA != "" {
+        auth = append(auth, "client certificates")
+    }
+    if cfg.CRL != "" {
+        auth = append(auth, "CRL")
+    }
+    if a.pins != nil {
+        auth = append(auth, fmt.Sprintf("%d pinned certificates", len(a.pins.current())))
+    }
+    if a.keys != nil {
+        auth = append(auth, fmt.Sprintf("%d API keys", len(a.keys.current())))
+    }
+    if a.authdb != nil {
+        auth = append(auth, "device database")
+    }
+    if a.signer != nil {
+        auth = append(auth, "HMAC signatures")
+    }
+    if len(auth) == 0 {
+        auth = append(auth, "none")
+    }
+    fmt.Fprintf(w, "  auth:          %s\n", strings.Join(auth, ", "))
+    if cfg.RouteAuth != "" {
+        for _, rr := range a.routeAuth.rules {
+            fmt.Fprintf(w, "  route auth:    %s needs %s\n", rr.Path, rr.Auth)
+        }
+        fmt.Fprintf(w, "  route auth:    anything else needs %s\n", a.routeAuth.fallback.Auth)
+    }
+    if cfg.MQTTBroker != "" {
+        fmt.Fprintf(w, "  mqtt:          %s (not contacted by -check)\n", cfg.MQTTBroker)
+    }
+    if cfg.KafkaBrokers != "" {
+        fmt.Fprintf(w, "  kafka:         %s topic %s (not contacted by -check)\n", cfg.KafkaBrokers, cfg.KafkaTopic)
+    }
+    if cfg.InfluxURL != "" {
+        fmt.Fprintf(w, "  influxdb:      %s (not contacted by -check)\n", cfg.InfluxURL)
+    }
+    if cfg.SQLitePath != "" {
+        fmt.Fprintf(w, "  sqlite:        %s\n", cfg.SQLitePath)
+    }
+    return 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// errQueueDelay is returned when the worker queue turns a reading away
+// because readings are waiting in it longer than -codel-target. It counts as
+// errQueueFull, so every transport answers it the same way.
+var errQueueDelay = fmt.Errorf("%w: readings wait longer than -codel-target", errQueueFull)
+
+// codel sheds load on the worker queue after Controlled Delay (RFC 8289):
+// it watches how long each reading waited before a worker took it, and once
+// every reading for a whole interval has waited longer than target, it refuses
+// new readings until the wait is back under target or the queue has emptied.
+// A burst the workers absorb within an interval is never refused, while a
+// queue that stays long is drained instead of growing until it is full, so a
+// reading never waits much more than target plus interval.
+//
+// RFC 8289 drops packets at the head of the queue, and ever more often while
+// the delay lasts. The readings already queued have been acknowledged with 202,
+// so they are still stored, and every new reading is refused at the tail
+// instead, while its device can still retry: easing off slowly would let a
+// queue of -queue-depth readings fill long before the delay came down.
+type codel struct {
+    target   time.Duration
+    interval time.Duration
+
+    mu         sync.Mutex
+    firstAbove time.Time // when the wait may count as too long; zero while below target
+    dropping   bool
+    since      int64 // refused when dropping began
+
+    refused atomic.Int64
+}
+
+// newCodel returns a controller keeping the queue wait to target, judged over
+// interval.
+func newCodel(target, interval time.Duration) *codel {
+    return &codel{target: target, interval: interval}
+}
+
+// dequeued updates the state from a reading that waited sojourn before a
+// worker took it at now. empty reports whether that left the queue empty,
+// which ends a dropping state however long the reading waited.
+func (c *codel) dequeued(sojourn time.Duration, empty bool, now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if sojourn < c.target || empty {
+        c.firstAbove = time.Time{}
+        if c.dropping {
+            c.dropping = false
+            slog.Info("processing queue delay back under target, accepting readings again", "sojourn", sojourn.String(), "refused", c.refused.Load()-c.since)
+        }
+        return
+    }
+    if c.firstAbove.IsZero() {
+        c.firstAbove = now.Add(c.interval)
+        return
+    }
+    if !c.dropping && !now.Before(c.firstAbove) {
+        c.dropping = true
+        c.since = c.refused.Load()
+        slog.Warn("processing queue delay above target, refusing readings", "sojourn", sojourn.String(), "target", c.target.String(), "interval", c.interval.String())
+    }
+}
+
+// admit reports whether a reading may be queued.
+func (c *codel) admit() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.dropping {
+        c.refused.Add(1)
+        return false
+    }
+    return true
+}
+
+// active reports whether readings are being refused.
+func (c *codel) active() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.dropping
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "compress/gzip"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// gzipWriters are reused across responses, since each holds several hundred
+// kilobytes of compressor state.
+var gzipWriters = sync.Pool{
+    New: func() any { return gzip.NewWriter(nil) },
+}
+
+// withCompression gzips GET responses of at least min bytes for clients that
+// accept it, such as /export and /devices/{id}/recent read by management
+// tools. Readings are POSTed and get short replies, so they are left alone, as
+// are WebSocket upgrades and responses the handler encoded itself.
+func withCompression(min int, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Accept-Encoding")
+        if !acceptsGzip(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        gw := &gzipResponse{ResponseWriter: w, min: min, status: http.StatusOK}
+        defer gw.finish()
+        next.ServeHTTP(gw, r)
+    })
+}
+
+// acceptsGzip reports whether Accept-Encoding lists gzip without q=0.
+func acceptsGzip(r *http.Request) bool {
+    for _, v := range r.Header.Values("Accept-Encoding") {
+        for _, part := range strings.Split(v, ",") {
+            coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+            if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+                continue
+            }
+            q := 1.0
+            if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+                q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+            }
+            return q > 0
+        }
+    }
+    return false
+}
+
+// gzipResponse holds back the start of a response until it is known to reach
+// min bytes, and then compresses it; a shorter one is sent as it is. A Flush
+// before then starts compressing, since only streamed responses flush.
+type gzipResponse struct {
+    http.ResponseWriter
+    min         int
+    status      int
+    wroteHeader bool
+    decided     bool
+    buf         []byte
+    gz          *gzip.Writer
+}
+
+func (g *gzipResponse) WriteHeader(status int) {
+    if g.wroteHeader {
+        return
+    }
+    g.status, g.wroteHeader = status, true
+    // Informational, 204 and 304 responses have no body to compress
+    if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+        g.start(false)
+    }
+}
+
+func (g *gzipResponse) Write(p []byte) (int, error) {
+    if !g.wroteHeader {
+        g.WriteHeader(http.StatusOK)
+    }
+    if !g.decided {
+        g.buf = append(g.buf, p...)
+        if len(g.buf) < g.min {
+            return len(p), nil
+        }
+        if err := g.start(true); err != nil {
+            return 0, err
+        }
+        return len(p), nil
+    }
+    if g.gz != nil {
+        return g.gz.Write(p)
+    }
+    return g.ResponseWriter.Write(p)
+}
+
+// start sends the header, compressed or not, followed by what was held back.
+// A handler that set its own Content-Encoding is never compressed again.
+func (g *gzipResponse) start(compress bool) error {
+    g.decided = true
+    h := g.ResponseWriter.Header()
+    if compress && h.Get("Content-Encoding") == "" {
+        h.Del("Content-Length")
+        h.Set("Content-Encoding", "gzip")
+        g.gz = gzipWriters.Get().(*gzip.Writer)
+        g.gz.Reset(g.ResponseWriter)
+    }
+    g.ResponseWriter.WriteHeader(g.status)
+    buf := g.buf
+    g.buf = nil
+    if len(buf) == 0 {
+        return nil
+    }
+    if g.gz != nil {
+        _, err := g.gz.Write(buf)
+        return err
+    }
+    _, err := g.ResponseWriter.Write(buf)
+    return err
+}
+
+// Flush sends what has been compressed so far.
+func (g *gzipResponse) Flush() {
+    if !g.decided {
+        if !g.wroteHeader {
+            g.WriteHeader(http.StatusOK)
+        }
+        if !g.decided {
+            g.start(true)
+        }
+    }
+    if g.gz != nil {
+        g.gz.Flush()
+    }
+    http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// finish sends a response that stayed under min bytes as it is, or ends the
+// compressed stream.
+func (g *gzipResponse) finish() {
+    if !g.decided {
+        if !g.wroteHeader {
+            // The handler wrote nothing; net/http sends its own 200
+            return
+        }
+        g.start(false)
+    }
+    if g.gz != nil {
+        g.gz.Close()
+        g.gz.Reset(nil)
+        gzipWriters.Put(g.gz)
+        g.gz = nil
+    }
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines.
+func (g *gzipResponse) Unwrap() http.ResponseWriter {
+    return g.ResponseWriter
+}
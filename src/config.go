@@ -0,0 +1,677 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// defaultAddr is the listen address used when neither -addr nor IOT_ADDR is set.
+const defaultAddr = ":443"
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+    *s = append(*s, v)
+    return nil
+}
+
+// certPair names a certificate file and its private key file.
+type certPair struct {
+    CertFile string
+    KeyFile  string
+}
+
+// parseCertPairs splits each "cert.pem,key.pem" value of -cert.
+func parseCertPairs(values []string) ([]certPair, error) {
+    var pairs []certPair
+    for _, v := range values {
+        certFile, keyFile, ok := strings.Cut(v, ",")
+        if !ok || certFile == "" || keyFile == "" {
+            return nil, fmt.Errorf("invalid -cert %q: want cert.pem,key.pem", v)
+        }
+        pairs = append(pairs, certPair{CertFile: certFile, KeyFile: keyFile})
+    }
+    return pairs, nil
+}
+
+// Config holds the server settings parsed from flags and the environment.
+type Config struct {
+    Addr            string
+    Check           bool
+    ConfigFile      string
+    Unix            string
+    MaxConns        int
+    ShutdownTimeout time.Duration
+    ReadyTimeout    time.Duration
+    DrainTimeout    time.Duration
+    AcceptStatus    int
+    Sinks           sinkList
+    SinkRetries     int
+    SinkBackoff     time.Duration
+    BreakerFailures int
+    BreakerCooldown time.Duration
+    DataFile        string
+    MaxSize         int
+    MaxAge          int
+    MaxBackups      int
+    OverflowBuffer  int64
+    AllowCIDR       cidrList
+    DenyCIDR        cidrList
+    TrustProxy      bool
+    MaxBody         int64
+    SizeBuckets     string
+    AcceptTypes     string
+    Sniff           bool
+    BodyMemory      int64
+    BodyWait        time.Duration
+    Schema          string
+    MaxBatch        int
+    DeadLetter      string
+    ClientCA        string
+    CRL             string
+    CRLRefresh      time.Duration
+    CertPins        string
+    Compress        bool
+    CompressMin     int
+    KeyFile         string
+    KeyPassphrase   string
+    AuthDB          string
+    AuthDBQuery     string
+    AuthDBKeyQuery  string
+    AuthDBTTL       time.Duration
+    RouteAuth       string
+    HMACSecret      string
+    HMACSecretFile  string
+    ResponseKey     string
+    ResponseKeyPEM  string
+    LogLevel        string
+    LogJSON         bool
+    AccessLog       string
+    OTLPEndpoint    string
+    Certs           []certPair
+    CertReload      time.Duration
+    TLSCertPEM      string
+    TLSKeyPEM       string
+    TLSMin          uint16
+    Dev             bool
+    Echo            bool
+    PprofAddr       string
+    AutocertDomain  string
+    AutocertCache   string
+    AutocertHTTP    string
+    HTTPRedirect    bool
+    Headers         headerList
+    HSTS            bool
+
+    ServerMiddleware []string
+    IngestMiddleware []string
+
+    ReadHeaderTimeout time.Duration
+    MaxHeaderBytes    int
+    MaxHeaders        int
+    ReadTimeout       time.Duration
+    WriteTimeout      time.Duration
+    IdleTimeout       time.Duration
+    MaxConnLifetime   time.Duration
+
+    OCSP bool
+
+    SessionTickets    string
+    SessionTicketKeys string // $IOT_SESSION_TICKET_KEYS
+
+    TCPKeepAlive time.Duration
+    TCPNoDelay   bool
+
+    ProxyProtocol     bool
+    ProxyProtocolFrom cidrList
+
+    HTTP2 bool
+    HTTP3 bool
+
+    MQTTBroker   string
+    MQTTTopic    string
+    MQTTClientID string
+    MQTTQoS      byte
+    MQTTUsername string
+    MQTTPassword string
+
+    Rate  float64
+    Burst int
+
+    DeviceLimits string
+    Enrich       string
+    FieldMap     string
+    DeviceConfig string
+    Firmware     string
+
+    Watchdog        string
+    WatchdogWebhook string
+
+    CORSOrigins string
+
+    UploadDir string
+    UploadMax int64
+
+    Workers    int
+    QueueDepth int
+
+    CodelTarget       time.Duration
+    CodelInterval     time.Duration
+    OverloadHigh      float64
+    OverloadLow       float64
+    OverloadErrorRate float64
+
+    TransformTemplate string
+
+    RecentDepth int
+
+    StatsWindow time.Duration
+    StatsBucket time.Duration
+
+    IdempotencySize int
+    IdempotencyTTL  time.Duration
+
+    StaleReadings  string
+    StaleTolerance time.Duration
+    StaleMaxSkew   time.Duration
+    StaleDevices   int
+    StaleState     string
+
+    DedupThreshold float64
+    DedupDevices   int
+    SeqWindow      int
+    SeqDevices     int
+
+    Redact string
+
+    Admin    string
+    AuditLog string
+
+    Chaos           bool
+    InjectDelay     time.Duration
+    InjectDelayRate float64
+    InjectErrorRate float64
+    InjectStatus    int
+
+    InfluxURL    string
+    InfluxToken  string
+    InfluxOrg    string
+    InfluxBucket string
+    InfluxBatch  int
+    InfluxFlush  time.Duration
+    InfluxBuffer int
+
+    KafkaBrokers string
+    KafkaTopic   string
+    KafkaBatch   int
+    KafkaFlush   time.Duration
+
+    SQLitePath string
+}
+
+// envOr returns the value of the environment variable key, or fallback when it is unset or empty.
+func envOr(key, fallback string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return fallback
+}
+
+// validateAddr checks that addr is a host:port pair with a numeric port in range.
+func validateAddr(addr string) error {
+    _, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return fmt.Errorf("invalid listen address %q: %v", addr, err)
+    }
+    n, err := strconv.Atoi(port)
+    if err != nil || n < 0 || n > 65535 {
+        return fmt.Errorf("invalid listen address %q: port must be a number between 0 and 65535", addr)
+    }
+    return nil
+}
+
+// parseConfig parses command-line arguments (without the program name) into a Config.
+func parseConfig(args []string) (Config, error) {
+    var cfg Config
+    fs := flag.NewFlagSet("iot", flag.ContinueOnError)
+
+    // Parse the listen address, preferring the flag over the IOT_ADDR environment variable
+    fs.StringVar(&cfg.Addr, "addr", envOr("IOT_ADDR", defaultAddr), "listen address (host:port), falls back to $IOT_ADDR")
+    fs.StringVar(&cfg.ConfigFile, "config", "", "YAML file of flag values, e.g. \"addr: :8443\", expanding ${VAR} and ${VAR:-default} from the environment; command-line flags win")
+    fs.BoolVar(&cfg.Check, "check", false, "validate the configuration, certificates and files, print a summary and exit 0 or 1 without serving")
+    fs.StringVar(&cfg.Unix, "unix", "", "serve plain HTTP on this Unix domain socket instead of TLS on -addr, for use behind a local reverse proxy")
+    fs.IntVar(&cfg.MaxConns, "maxconns", 0, "maximum simultaneous TCP connections; further accepts wait for a free slot (0 is unlimited)")
+    fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long to wait for in-flight requests to drain on shutdown")
+    fs.DurationVar(&cfg.ReadyTimeout, "ready-timeout", 0, "shut down with an error if the sinks have not connected this long after startup, so the orchestrator restarts the server (0 waits forever)")
+    fs.Var(&cfg.Sinks, "sink", "where readings are stored: "+strings.Join(sinkNames, ", ")+", as kind[=target][,optional]; repeat to store in several at once (default file when -datafile is set, otherwise stdout)")
+    fs.IntVar(&cfg.SinkRetries, "sink-retries", 2, "times a transient sink failure is retried before the device gets 503")
+    fs.DurationVar(&cfg.SinkBackoff, "sink-backoff", 100*time.Millisecond, "base delay between sink retries, doubled each attempt with random jitter")
+    fs.IntVar(&cfg.BreakerFailures, "breaker-failures", 5, "consecutive failed writes after which an http sink's circuit breaker opens and writes fail fast (0 disables)")
+    fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long an open circuit breaker fails writes before letting one through to probe the sink")
+    fs.StringVar(&cfg.DataFile, "datafile", "", "append every received payload to this file as newline-delimited JSON")
+    fs.IntVar(&cfg.MaxSize, "maxsize", 0, "rotate the data file after this many megabytes, compressing the old file (0 disables rotation)")
+    fs.IntVar(&cfg.MaxAge, "maxage", 0, "delete rotated data files older than this many days (0 keeps them)")
+    fs.IntVar(&cfg.MaxBackups, "maxbackups", 0, "keep at most this many rotated data files (0 keeps them all)")
+    fs.Int64Var(&cfg.OverflowBuffer, "overflow-buffer", 16<<20, "bytes of records held in memory while the data file's disk is full (0 fails writes instead)")
+    fs.Int64Var(&cfg.MaxBody, "maxbody", 1<<20, "maximum request body size in bytes")
+    fs.StringVar(&cfg.SizeBuckets, "size-buckets", "", "comma-separated upper bounds in bytes of the GET /stats/sizes buckets (default powers of two from 64 up to -maxbody)")
+    fs.StringVar(&cfg.AcceptTypes, "accept-types", "", "comma-separated media types the server accepts, e.g. application/json,application/cbor; others get 415, including uploads (default every type an endpoint parses)")
+    fs.BoolVar(&cfg.Sniff, "sniff", false, "recognize JSON, CBOR and legacy binary readings sent without a Content-Type or as application/octet-stream by their first bytes, storing anything else raw")
+    fs.Int64Var(&cfg.BodyMemory, "body-memory", 0, "maximum bytes held by request bodies being read at once, across all connections (0 is unlimited)")
+    fs.DurationVar(&cfg.BodyWait, "body-wait", time.Second, "how long a request waits for -body-memory to free up before it gets 503")
+    fs.StringVar(&cfg.TransformTemplate, "transform-template", "", "text/template file rendering each JSON reading into the payload that is stored (stored unchanged when empty)")
+    fs.StringVar(&cfg.DeadLetter, "deadletter", "", "append payloads refused for their content (400/415/422) or that failed to transform to this file, with headers and reason, as newline-delimited JSON")
+    fs.IntVar(&cfg.MaxBatch, "max-batch", 100, "maximum readings in one JSON array POST (0 disables batches)")
+    fs.StringVar(&cfg.Schema, "schema", "", "JSON Schema file every JSON reading must satisfy (validation skipped when empty)")
+    fs.StringVar(&cfg.UploadDir, "upload-dir", "uploads", "directory where /upload/file/{name} stores large uploads")
+    fs.Int64Var(&cfg.UploadMax, "upload-max", 64<<20, "maximum size in bytes of a single large upload")
+    fs.IntVar(&cfg.Workers, "workers", 0, "number of background workers storing readings; 0 stores them synchronously in the handler")
+    fs.IntVar(&cfg.QueueDepth, "queue-depth", 1024, "readings buffered for the workers before devices get 503")
+    fs.DurationVar(&cfg.CodelTarget, "codel-target", 0, "refuse readings with 503 while the -workers queue keeps them waiting longer than this, e.g. 5ms (0 disables)")
+    fs.DurationVar(&cfg.CodelInterval, "codel-interval", 100*time.Millisecond, "how long the queue wait must stay above -codel-target before readings are refused")
+    fs.Float64Var(&cfg.OverloadHigh, "overload-high", 0.8, "fraction of -queue-depth at which devices are told to back off with 503 and Retry-After (0 disables)")
+    fs.Float64Var(&cfg.OverloadLow, "overload-low", 0.5, "fraction of -queue-depth below which readings are accepted again after -overload-high")
+    fs.Float64Var(&cfg.OverloadErrorRate, "overload-error-rate", 0, "fraction of failing sink writes over 10s at which devices are told to back off, e.g. 0.5 (0 disables)")
+    fs.IntVar(&cfg.AcceptStatus, "accept-status", http.StatusAccepted, "status for a reading queued by -workers but not yet stored: 202, or 200 for firmware that retries on anything else")
+    fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "how long shutdown waits for the workers to store queued readings before dead-lettering the rest")
+    fs.IntVar(&cfg.RecentDepth, "recent", 20, "readings kept in memory per device for GET /devices/{id}/recent (0 disables the endpoint)")
+    fs.DurationVar(&cfg.StatsWindow, "stats-window", 0, "sliding window of per-device min/max/avg/count served by GET /devices/{id}/stats, e.g. 1h (0 disables the endpoint)")
+    fs.DurationVar(&cfg.StatsBucket, "stats-bucket", time.Minute, "granularity of -stats-window: readings are summed per bucket, and the oldest bucket expires as a whole")
+    fs.IntVar(&cfg.IdempotencySize, "idempotency-size", 10000, "Idempotency-Key values remembered for deduplicating retries (0 disables)")
+    fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", time.Hour, "how long a retry with the same Idempotency-Key gets the original response")
+    fs.StringVar(&cfg.StaleReadings, "stale-readings", "off", "what to do with a reading older than the newest from its device: off, reject (409 Conflict) or flag (store it and log a warning)")
+    fs.DurationVar(&cfg.StaleTolerance, "stale-tolerance", 0, "how far a reading's ts may go back before -stale-readings treats it as stale, for clock jitter")
+    fs.DurationVar(&cfg.StaleMaxSkew, "stale-max-skew", 5*time.Minute, "how far ahead of the server clock a reading's ts may be before -stale-readings refuses to remember it, and rejects or flags the reading")
+    fs.IntVar(&cfg.StaleDevices, "stale-devices", 10000, "devices whose newest ts is remembered for -stale-readings; the least recently heard from are forgotten")
+    fs.StringVar(&cfg.StaleState, "stale-state", "", "file the newest ts per device is saved to, so -stale-readings survives a restart")
+    fs.Float64Var(&cfg.DedupThreshold, "dedup-threshold", 0, "drop a reading, answering 200 with \"deduplicated\":true, when every numeric field is within this of the last one stored from its device (0 disables)")
+    fs.IntVar(&cfg.DedupDevices, "dedup-devices", 10000, "devices whose last stored reading is remembered for -dedup-threshold; the least recently heard from are forgotten")
+    fs.IntVar(&cfg.SeqWindow, "seq-window", 0, "count readings missing from a device's seq numbers, waiting this many places for late ones, up to 64 (0 disables)")
+    fs.IntVar(&cfg.SeqDevices, "seq-devices", 10000, "devices whose seq numbers are tracked for -seq-window; the least recently heard from are forgotten")
+    fs.StringVar(&cfg.Redact, "redact", "", "comma-separated reading fields masked in the logs, stdout and the data file, e.g. lat,lon,owner.user_id; other sinks get them in full")
+    fs.StringVar(&cfg.ClientCA, "clientca", "", "PEM CA bundle used to require and verify client certificates (mutual TLS)")
+    fs.StringVar(&cfg.CRL, "crl", "", "certificate revocation list (PEM or DER file, or http(s) URL) checked against client certificates; needs -clientca")
+    fs.DurationVar(&cfg.CRLRefresh, "crl-refresh", time.Hour, "how often the -crl list is reloaded")
+    fs.StringVar(&cfg.CertPins, "cert-fingerprints", "", "file of SHA-256 fingerprints; client certificates not listed are refused even if the CA signed them (reloaded on SIGHUP); needs -clientca")
+    fs.StringVar(&cfg.LogLevel, "loglevel", "info", "minimum log level: debug, info, warn or error")
+    fs.BoolVar(&cfg.LogJSON, "logjson", false, "write logs as JSON instead of text")
+    fs.StringVar(&cfg.AccessLog, "accesslog", "", "write an Apache combined-format access log to this file, or - for stdout (disabled when empty)")
+    fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector URL to export request traces to, e.g. http://localhost:4318 (tracing disabled when empty)")
+    fs.Float64Var(&cfg.Rate, "rate", 0, "requests per second allowed per client IP (0 disables rate limiting)")
+    fs.IntVar(&cfg.Burst, "burst", 0, "burst size per client IP (0 means the rate rounded up)")
+    fs.StringVar(&cfg.Firmware, "firmware", "", "YAML or JSON firmware manifest (version, url, sha256, min_version) announced in the reply to a reading from a device whose X-Firmware-Version is older; reloaded on SIGHUP")
+    fs.StringVar(&cfg.DeviceConfig, "device-config", "", "YAML or JSON file of versioned configuration per device, keyed by client certificate CN or device_id, returned in the reply to a reading the device has not applied yet (X-Config-Version); reloaded on SIGHUP")
+    fs.StringVar(&cfg.Enrich, "enrich", "", "YAML or JSON file of metadata fields, such as region, added to each device's readings before storage, keyed by client certificate CN or device_id; reloaded on SIGHUP")
+    fs.StringVar(&cfg.FieldMap, "field-map", "", "YAML or JSON file of vendor profiles renaming the keys their devices send to the reading fields, keyed by client certificate CN or X-Device-ID; reloaded on SIGHUP")
+    fs.StringVar(&cfg.Watchdog, "watchdog", "", "YAML or JSON file of devices to monitor, keyed by client certificate CN or device_id, each with the longest silence allowed, e.g. {silence: 10m}; a device silent for longer raises an alert, cleared when it reports again; reloaded on SIGHUP")
+    fs.StringVar(&cfg.WatchdogWebhook, "watchdog-webhook", "", "URL to POST -watchdog alerts to as JSON, besides logging them")
+    fs.StringVar(&cfg.DeviceLimits, "device-limits", "", "YAML or JSON file of per-device maxbody/rate/burst overrides keyed by client certificate CN, or by the X-Device-ID of a device that passes its -authdb secret; reloaded on SIGHUP")
+    fs.StringVar(&cfg.CORSOrigins, "cors-origins", "", "comma-separated browser origins allowed to POST cross-origin, or * for any (CORS disabled when empty)")
+    fs.StringVar(&cfg.HMACSecret, "hmac-secret", os.Getenv("IOT_HMAC_SECRET"), "shared secret for verifying the X-Signature HMAC-SHA256 of each body, falls back to $IOT_HMAC_SECRET (prefer -hmac-secret-file)")
+    fs.StringVar(&cfg.HMACSecretFile, "hmac-secret-file", "", "file holding the X-Signature shared secret; overrides -hmac-secret")
+    fs.StringVar(&cfg.ResponseKey, "response-key", "", "ed25519 private key (PKCS#8 PEM) for signing every response body in X-Response-Signature; $IOT_RESPONSE_KEY may hold the PEM instead")
+    fs.StringVar(&cfg.KeyFile, "keyfile", "", "file of allowed API keys, one per line, required as \"Authorization: Bearer <key>\"")
+    fs.StringVar(&cfg.RouteAuth, "route-auth", "", "YAML or JSON list of {path, auth} rules giving the credentials each route needs (none, mtls, apikey, device); /healthz, /version and /metrics stay open unless listed, other unlisted routes need every configured method")
+    fs.StringVar(&cfg.AuthDB, "authdb", os.Getenv("IOT_AUTHDB"), "device database DSN, postgres://... or sqlite:<path>; requests then need \"Authorization: Bearer <secret>\" matching their device id; falls back to $IOT_AUTHDB")
+    fs.StringVar(&cfg.AuthDBQuery, "authdb-query", "SELECT secret FROM devices WHERE device_id = $1", "query returning the secret for the device id given as its only parameter")
+    fs.StringVar(&cfg.AuthDBKeyQuery, "authdb-key-query", "", "query returning the hex AES key a device encrypts its bodies with, e.g. SELECT payload_key FROM devices WHERE device_id = $1; enables payload decryption")
+    fs.DurationVar(&cfg.AuthDBTTL, "authdb-ttl", 30*time.Second, "how long device database answers are cached")
+    fs.StringVar(&cfg.KeyPassphrase, "key-passphrase", os.Getenv("IOT_KEY_PASSPHRASE"), "passphrase for encrypted TLS private keys, falls back to $IOT_KEY_PASSPHRASE (prefer the environment)")
+    fs.Var(&cfg.AllowCIDR, "allow-cidr", "only accept ingestion requests from these networks, e.g. 10.0.0.0/8; repeatable or comma-separated")
+    fs.Var(&cfg.DenyCIDR, "deny-cidr", "refuse ingestion requests from these networks; takes precedence over -allow-cidr")
+    fs.BoolVar(&cfg.TrustProxy, "trust-proxy", false, "take the client address from the last X-Forwarded-For entry; only set behind a proxy that appends it")
+    var certs stringList
+    fs.Var(&certs, "cert", "certificate and key as cert.pem,key.pem; repeat for one certificate per SNI hostname (default ssl/server.crt,ssl/server.key)")
+    fs.DurationVar(&cfg.CertReload, "cert-reload", time.Minute, "how often the certificate files are checked for changes and reloaded (0 disables)")
+    fs.StringVar(&cfg.Admin, "admin", "", "who may POST /admin/reload: \"local\" for loopback clients and/or client certificate CNs, comma-separated (off by default)")
+    fs.StringVar(&cfg.AuditLog, "audit-log", "", "append admin actions and SIGHUP reloads to this file as a hash-chained audit trail (disabled when empty)")
+    fs.StringVar(&cfg.PprofAddr, "pprof-addr", "", "serve net/http/pprof on this loopback address, e.g. 127.0.0.1:6060 (off by default)")
+    fs.BoolVar(&cfg.Echo, "echo", false, "TESTING ONLY: validate readings and reply with what was parsed, but store nothing")
+    fs.BoolVar(&cfg.Chaos, "chaos", false, "TESTING ONLY: allow the -inject-* flags to delay and fail ingestion requests on purpose")
+    fs.DurationVar(&cfg.InjectDelay, "inject-delay", 0, "with -chaos, delay -inject-delay-rate of ingestion requests by this long (0 disables)")
+    fs.Float64Var(&cfg.InjectDelayRate, "inject-delay-rate", 1, "with -chaos, fraction of ingestion requests delayed by -inject-delay")
+    fs.Float64Var(&cfg.InjectErrorRate, "inject-error-rate", 0, "with -chaos, fraction of ingestion requests answered with -inject-status instead of being handled (0 disables)")
+    fs.IntVar(&cfg.InjectStatus, "inject-status", http.StatusServiceUnavailable, "with -chaos, status of the requests -inject-error-rate fails")
+    fs.BoolVar(&cfg.Dev, "dev", false, "INSECURE: if ssl/server.crt and ssl/server.key are missing, serve a self-signed certificate for localhost (local development only)")
+    tlsMin := fs.String("tls-min", "1.2", "minimum TLS version to negotiate: 1.0, 1.1, 1.2 or 1.3")
+    fs.StringVar(&cfg.AutocertDomain, "autocert-domain", "", "comma-separated domains to obtain Let's Encrypt certificates for instead of using ssl/")
+    fs.StringVar(&cfg.AutocertCache, "autocert-cache", "autocert-cache", "directory where autocert stores issued certificates")
+    fs.StringVar(&cfg.AutocertHTTP, "autocert-http", ":80", "plain HTTP listen address for ACME HTTP-01 challenges and -http-redirect")
+    fs.StringVar(&cfg.SessionTickets, "session-tickets", "", "file of 32-byte hex keys, one per line, for TLS session tickets so resumption survives restarts; the first encrypts new tickets, reloaded on SIGHUP ($IOT_SESSION_TICKET_KEYS may hold the keys instead)")
+    fs.BoolVar(&cfg.OCSP, "ocsp", false, "staple an OCSP response from each certificate's responder to the handshake, refreshed before it expires")
+    fs.BoolVar(&cfg.HTTPRedirect, "http-redirect", false, "listen on -autocert-http and redirect plain HTTP requests to HTTPS with a 308")
+    fs.Var(&cfg.Headers, "header", "\"Name: value\" header added to every response, e.g. \"Cache-Control: no-store\"; repeatable")
+    fs.BoolVar(&cfg.HSTS, "hsts", false, "send Strict-Transport-Security: "+hstsValue+" on every response")
+
+    // Timeouts keep a device that trickles bytes from holding a connection forever
+    fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "maximum time to read request headers")
+    fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum size of the request line and headers; larger requests get 431")
+    fs.IntVar(&cfg.MaxHeaders, "max-headers", 100, "maximum number of request header lines on ingestion endpoints; more get 431 (0 disables)")
+    fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 30*time.Second, "maximum time to read an entire request, including the body")
+    fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "maximum time from the end of the request headers to the end of the response")
+    fs.BoolVar(&cfg.Compress, "compress", false, "gzip GET responses of at least -compress-min bytes, such as /export, for clients that send Accept-Encoding: gzip")
+    fs.IntVar(&cfg.CompressMin, "compress-min", 1024, "smallest GET response -compress gzips; shorter ones are not worth it")
+    fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 120*time.Second, "how long an idle keep-alive connection stays open")
+    var serverMW, ingestMW string
+    fs.StringVar(&serverMW, "server-middleware", strings.Join(serverMiddleware, ","), "comma-separated middleware every request passes through, outermost first; leave one out to skip it")
+    fs.StringVar(&ingestMW, "ingest-middleware", strings.Join(ingestMiddleware, ","), "comma-separated middleware in front of the ingestion endpoints, outermost first; leave one out to skip it, except auth and ipfilter while their flags are set")
+    fs.DurationVar(&cfg.MaxConnLifetime, "max-conn-lifetime", 0, "close HTTP/1 connections older than this after their current response, and end NDJSON streams after the current line with a summary (0 disables)")
+
+    // TCP keep-alive probes stop carrier NATs from dropping quiet connections
+    fs.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", 15*time.Second, "idle time before a TCP keep-alive probe is sent, and the interval between probes (0 disables)")
+    fs.BoolVar(&cfg.ProxyProtocol, "proxy-protocol", false, "expect a PROXY protocol v1/v2 header from the load balancer on every connection and take the client address from it")
+    fs.Var(&cfg.ProxyProtocolFrom, "proxy-protocol-from", "load balancer networks allowed to connect with -proxy-protocol, e.g. 10.0.0.0/8; others are refused; repeatable or comma-separated")
+    fs.BoolVar(&cfg.TCPNoDelay, "tcp-nodelay", true, "send small responses immediately (TCP_NODELAY); set -tcp-nodelay=false to let the kernel coalesce them")
+
+    fs.BoolVar(&cfg.HTTP2, "http2", true, "negotiate HTTP/2 on the TLS listener (set -http2=false to debug with HTTP/1.1 only)")
+    fs.BoolVar(&cfg.HTTP3, "http3", false, "also serve HTTP/3 over QUIC on the same port (UDP) and advertise it with Alt-Svc")
+
+    // Optional MQTT subscriber feeding the same pipeline as HTTP
+    var qos uint
+    fs.StringVar(&cfg.MQTTBroker, "mqtt-broker", "", "MQTT broker URL to subscribe to, e.g. tcp://localhost:1883 (disabled when empty)")
+    fs.StringVar(&cfg.MQTTTopic, "mqtt-topic", "iot/readings", "MQTT topic filter to subscribe to")
+    fs.StringVar(&cfg.MQTTClientID, "mqtt-client-id", "iot-server", "MQTT client identifier")
+    fs.UintVar(&qos, "mqtt-qos", 1, "MQTT subscription QoS (0, 1 or 2)")
+    fs.StringVar(&cfg.MQTTUsername, "mqtt-username", "", "MQTT username")
+    fs.StringVar(&cfg.MQTTPassword, "mqtt-password", os.Getenv("IOT_MQTT_PASSWORD"), "MQTT password, falls back to $IOT_MQTT_PASSWORD")
+
+    // Optional InfluxDB v2 output
+    fs.StringVar(&cfg.InfluxURL, "influx-url", "", "InfluxDB base URL, e.g. http://localhost:8086 (disabled when empty)")
+    fs.StringVar(&cfg.InfluxToken, "influx-token", os.Getenv("IOT_INFLUX_TOKEN"), "InfluxDB API token, falls back to $IOT_INFLUX_TOKEN")
+    fs.StringVar(&cfg.InfluxOrg, "influx-org", "", "InfluxDB organization")
+    fs.StringVar(&cfg.InfluxBucket, "influx-bucket", "", "InfluxDB bucket")
+    fs.IntVar(&cfg.InfluxBatch, "influx-batch", 500, "maximum points per InfluxDB write")
+    fs.DurationVar(&cfg.InfluxFlush, "influx-flush", 5*time.Second, "how often queued points are written to InfluxDB")
+    fs.IntVar(&cfg.InfluxBuffer, "influx-buffer", 100000, "maximum points kept queued while InfluxDB is unreachable")
+
+    // Optional Kafka output
+    fs.StringVar(&cfg.KafkaBrokers, "kafka-brokers", "", "comma-separated Kafka bootstrap brokers, e.g. kafka1:9092,kafka2:9092 (disabled when empty)")
+    fs.StringVar(&cfg.KafkaTopic, "kafka-topic", "", "Kafka topic readings are published to, keyed by device id")
+    fs.IntVar(&cfg.KafkaBatch, "kafka-batch", 100, "maximum messages per Kafka produce request")
+    fs.DurationVar(&cfg.KafkaFlush, "kafka-flush", time.Second, "longest a message waits for its Kafka batch to fill")
+
+    // Optional embedded SQLite output
+    fs.StringVar(&cfg.SQLitePath, "sqlite-path", "", "SQLite database file readings are also stored in, created with a readings table if missing (disabled when empty)")
+    if err := fs.Parse(args); err != nil {
+        return cfg, err
+    }
+    if cfg.ConfigFile != "" {
+        if err := applyConfigFile(fs, cfg.ConfigFile); err != nil {
+            return cfg, err
+        }
+    }
+
+    if err := validateAddr(cfg.Addr); err != nil {
+        return cfg, err
+    }
+    pairs, err := parseCertPairs(certs)
+    if err != nil {
+        return cfg, err
+    }
+    cfg.Certs = pairs
+
+    // PEM contents injected as secrets take precedence over any certificate files
+    cfg.TLSCertPEM = os.Getenv("IOT_TLS_CERT")
+    cfg.TLSKeyPEM = os.Getenv("IOT_TLS_KEY")
+    cfg.ResponseKeyPEM = os.Getenv("IOT_RESPONSE_KEY")
+    cfg.SessionTicketKeys = os.Getenv("IOT_SESSION_TICKET_KEYS")
+    if cfg.TLSMin, err = parseTLSVersion(*tlsMin); err != nil {
+        return cfg, err
+    }
+
+    if cfg.HSTS {
+        for _, f := range cfg.Headers {
+            if f.Name == "Strict-Transport-Security" {
+                return cfg, fmt.Errorf("-hsts and -header Strict-Transport-Security are mutually exclusive")
+            }
+        }
+        cfg.Headers = append(cfg.Headers, headerField{Name: "Strict-Transport-Security", Value: hstsValue})
+    }
+
+    // A Unix socket replaces the TLS listener, so the TLS-only options make no sense with it
+    if cfg.Unix != "" {
+        set := map[string]bool{}
+        fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+        if set["addr"] || os.Getenv("IOT_ADDR") != "" {
+            return cfg, fmt.Errorf("-unix and -addr are mutually exclusive: choose a Unix socket or the TLS TCP listener")
+        }
+        for _, name := range []string{"cert", "cert-reload", "tls-min", "clientca", "autocert-domain", "http-redirect", "http3", "ocsp", "session-tickets", "tcp-keepalive", "tcp-nodelay"} {
+            if set[name] {
+                return cfg, fmt.Errorf("-%s needs the TLS TCP listener and cannot be combined with -unix", name)
+            }
+        }
+    }
+    switch {
+    case len(cfg.Sinks) == 0 && cfg.DataFile != "":
+        cfg.Sinks = sinkList{{Kind: "file"}}
+    case len(cfg.Sinks) == 0:
+        cfg.Sinks = sinkList{{Kind: "stdout"}}
+    }
+    required := false
+    for _, spec := range cfg.Sinks {
+        if spec.Kind == "file" && cfg.DataFile == "" {
+            return cfg, fmt.Errorf("-sink file needs -datafile")
+        }
+        required = required || !spec.Optional
+    }
+    if !required && cfg.InfluxURL == "" && cfg.KafkaBrokers == "" && cfg.SQLitePath == "" {
+        return cfg, fmt.Errorf("at least one -sink must not be optional")
+    }
+    if cfg.SinkRetries < 0 || cfg.SinkBackoff <= 0 {
+        return cfg, fmt.Errorf("invalid -sink-retries/-sink-backoff: retries must not be negative and the backoff must be positive")
+    }
+    if cfg.BreakerFailures < 0 || cfg.BreakerCooldown <= 0 {
+        return cfg, fmt.Errorf("invalid -breaker-failures/-breaker-cooldown: failures must not be negative and the cooldown must be positive")
+    }
+    if cfg.Unix != "" && (len(cfg.AllowCIDR) > 0 || len(cfg.DenyCIDR) > 0) && !cfg.TrustProxy {
+        return cfg, fmt.Errorf("-allow-cidr and -deny-cidr need -trust-proxy with -unix, which has no client addresses")
+    }
+    if cfg.PprofAddr != "" {
+        if err := loopbackAddr(cfg.PprofAddr); err != nil {
+            return cfg, fmt.Errorf("invalid -pprof-addr: %v", err)
+        }
+    }
+    if cfg.AuthDB != "" && cfg.KeyFile != "" {
+        return cfg, fmt.Errorf("-authdb and -keyfile cannot be combined")
+    }
+    if cfg.AuthDBKeyQuery != "" && cfg.AuthDB == "" {
+        return cfg, fmt.Errorf("-authdb-key-query needs -authdb")
+    }
+    if cfg.AuthDBTTL <= 0 {
+        return cfg, fmt.Errorf("-authdb-ttl must be positive")
+    }
+    if cfg.CRL != "" && cfg.ClientCA == "" {
+        return cfg, fmt.Errorf("-crl needs -clientca")
+    }
+    if cfg.CertPins != "" && cfg.ClientCA == "" {
+        return cfg, fmt.Errorf("-cert-fingerprints needs -clientca")
+    }
+    if cfg.CRLRefresh <= 0 {
+        return cfg, fmt.Errorf("invalid -crl-refresh %s: must be positive", cfg.CRLRefresh)
+    }
+    if cfg.CompressMin < 0 {
+        return cfg, fmt.Errorf("invalid -compress-min %d: must not be negative", cfg.CompressMin)
+    }
+    if cfg.MaxHeaderBytes <= 0 {
+        return cfg, fmt.Errorf("invalid -max-header-bytes %d: must be positive", cfg.MaxHeaderBytes)
+    }
+    if cfg.OCSP && cfg.AutocertDomain != "" {
+        return cfg, fmt.Errorf("-ocsp staples -cert certificates and cannot be combined with -autocert-domain")
+    }
+    if len(cfg.ProxyProtocolFrom) > 0 && !cfg.ProxyProtocol {
+        return cfg, fmt.Errorf("-proxy-protocol-from needs -proxy-protocol")
+    }
+    if len(cfg.ProxyProtocolFrom) > 0 && cfg.Unix != "" {
+        return cfg, fmt.Errorf("-proxy-protocol-from cannot be used with -unix, which has no client addresses")
+    }
+    if cfg.TCPKeepAlive < 0 {
+        return cfg, fmt.Errorf("invalid -tcp-keepalive %s: must not be negative", cfg.TCPKeepAlive)
+    }
+    if cfg.MaxHeaders < 0 {
+        return cfg, fmt.Errorf("invalid -max-headers %d: must not be negative", cfg.MaxHeaders)
+    }
+    if cfg.ServerMiddleware, err = parseMiddleware("server-middleware", serverMW, serverMiddleware); err != nil {
+        return cfg, err
+    }
+    if cfg.IngestMiddleware, err = parseMiddleware("ingest-middleware", ingestMW, ingestMiddleware); err != nil {
+        return cfg, err
+    }
+    // Leaving out a layer that keeps clients out would open the endpoints
+    // without a word beyond a warning, so it is refused while configured
+    listed := make(map[string]bool)
+    for _, name := range cfg.IngestMiddleware {
+        listed[name] = true
+    }
+    if !listed["auth"] {
+        var set []string
+        for _, f := range [][2]string{{"-clientca", cfg.ClientCA}, {"-keyfile", cfg.KeyFile}, {"-authdb", cfg.AuthDB}} {
+            if f[1] != "" {
+                set = append(set, f[0])
+            }
+        }
+        if len(set) > 0 {
+            return cfg, fmt.Errorf("invalid -ingest-middleware: auth is left out, which would open the ingestion endpoints although %s is set", strings.Join(set, " and "))
+        }
+    }
+    if (len(cfg.AllowCIDR) > 0 || len(cfg.DenyCIDR) > 0) && !listed["ipfilter"] {
+        return cfg, fmt.Errorf("invalid -ingest-middleware: ipfilter is left out, which would ignore -allow-cidr and -deny-cidr")
+    }
+    // The same goes for pinning and signing on every route
+    listed = make(map[string]bool)
+    for _, name := range cfg.ServerMiddleware {
+        listed[name] = true
+    }
+    if cfg.CertPins != "" && !listed["pins"] {
+        return cfg, fmt.Errorf("invalid -server-middleware: pins is left out, which would admit certificates not in -cert-fingerprints")
+    }
+    if (cfg.ResponseKey != "" || cfg.ResponseKeyPEM != "") && !listed["respsign"] {
+        return cfg, fmt.Errorf("invalid -server-middleware: respsign is left out, which would send responses unsigned although -response-key or $IOT_RESPONSE_KEY is set")
+    }
+
+    // Signatures must cover the body the handler wrote, not its gzip
+    compress, respsign := -1, -1
+    for i, name := range cfg.ServerMiddleware {
+        switch name {
+        case "compress":
+            compress = i
+        case "respsign":
+            respsign = i
+        }
+    }
+    if compress > respsign && respsign >= 0 {
+        return cfg, fmt.Errorf("invalid -server-middleware: compress must come before respsign")
+    }
+    if cfg.CertReload < 0 {
+        return cfg, fmt.Errorf("invalid -cert-reload %s: must not be negative", cfg.CertReload)
+    }
+    if cfg.MaxConns < 0 {
+        return cfg, fmt.Errorf("invalid -maxconns %d: must not be negative", cfg.MaxConns)
+    }
+    if cfg.MaxBody <= 0 {
+        return cfg, fmt.Errorf("invalid -maxbody %d: must be positive", cfg.MaxBody)
+    }
+    if cfg.BodyMemory < 0 || cfg.BodyWait <= 0 {
+        return cfg, fmt.Errorf("invalid -body-memory/-body-wait: the budget must not be negative and the wait must be positive")
+    }
+    if cfg.OverflowBuffer < 0 {
+        return cfg, fmt.Errorf("-overflow-buffer must not be negative")
+    }
+    if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.MaxBackups < 0 {
+        return cfg, fmt.Errorf("invalid -maxsize/-maxage/-maxbackups: must not be negative")
+    }
+    if cfg.MaxBatch < 0 {
+        return cfg, fmt.Errorf("invalid -max-batch %d: must not be negative", cfg.MaxBatch)
+    }
+    if cfg.UploadMax <= 0 {
+        return cfg, fmt.Errorf("invalid -upload-max %d: must be positive", cfg.UploadMax)
+    }
+    if cfg.AcceptStatus != http.StatusOK && cfg.AcceptStatus != http.StatusAccepted {
+        return cfg, fmt.Errorf("invalid -accept-status %d: use 200 or 202", cfg.AcceptStatus)
+    }
+    if !cfg.Chaos && (cfg.InjectDelay != 0 || cfg.InjectErrorRate != 0) {
+        return cfg, fmt.Errorf("-inject-delay and -inject-error-rate need -chaos, and are for testing only")
+    }
+    if cfg.InjectDelay < 0 || cfg.InjectDelayRate < 0 || cfg.InjectDelayRate > 1 || cfg.InjectErrorRate < 0 || cfg.InjectErrorRate > 1 {
+        return cfg, fmt.Errorf("invalid -inject-delay/-inject-delay-rate/-inject-error-rate: the delay must not be negative and the rates must be between 0 and 1")
+    }
+    if cfg.InjectStatus < 400 || cfg.InjectStatus > 599 {
+        return cfg, fmt.Errorf("invalid -inject-status %d: use an error status from 400 to 599", cfg.InjectStatus)
+    }
+    if cfg.ReadyTimeout < 0 {
+        return cfg, fmt.Errorf("-ready-timeout must not be negative")
+    }
+    if cfg.DrainTimeout <= 0 {
+        return cfg, fmt.Errorf("-drain-timeout must be positive")
+    }
+    if cfg.Workers < 0 || cfg.QueueDepth < 1 {
+        return cfg, fmt.Errorf("invalid -workers/-queue-depth: workers must not be negative and the queue must hold at least one reading")
+    }
+    if cfg.CodelTarget < 0 || cfg.CodelTarget > 0 && (cfg.Workers == 0 || cfg.CodelInterval <= cfg.CodelTarget) {
+        return cfg, fmt.Errorf("invalid -codel-target/-codel-interval: the target needs -workers and must be shorter than the interval")
+    }
+    if cfg.OverloadHigh < 0 || cfg.OverloadHigh > 1 || cfg.OverloadLow < 0 || (cfg.OverloadHigh > 0 && cfg.OverloadLow >= cfg.OverloadHigh) {
+        return cfg, fmt.Errorf("invalid -overload-high %g / -overload-low %g: need 0 <= low < high <= 1", cfg.OverloadHigh, cfg.OverloadLow)
+    }
+    if cfg.OverloadErrorRate < 0 || cfg.OverloadErrorRate > 1 {
+        return cfg, fmt.Errorf("invalid -overload-error-rate %g: must be between 0 and 1", cfg.OverloadErrorRate)
+    }
+    if cfg.StatsWindow < 0 || cfg.StatsBucket <= 0 || cfg.StatsWindow > 0 && (cfg.StatsBucket > cfg.StatsWindow || cfg.StatsWindow/cfg.StatsBucket > 10000) {
+        return cfg, fmt.Errorf("invalid -stats-window/-stats-bucket: the bucket must be positive, no longer than the window, and at most 10000 to a window")
+    }
+    if cfg.RecentDepth < 0 {
+        return cfg, fmt.Errorf("invalid -recent %d: must not be negative", cfg.RecentDepth)
+    }
+    if cfg.IdempotencySize < 0 || cfg.IdempotencyTTL <= 0 {
+        return cfg, fmt.Errorf("invalid -idempotency-size/-idempotency-ttl: size must not be negative and the TTL must be positive")
+    }
+    switch cfg.StaleReadings {
+    case "off", "reject", "flag":
+    default:
+        return cfg, fmt.Errorf("invalid -stale-readings %q: use off, reject or flag", cfg.StaleReadings)
+    }
+    if cfg.StaleTolerance < 0 || cfg.StaleMaxSkew < 0 || cfg.StaleDevices <= 0 {
+        return cfg, fmt.Errorf("invalid -stale-tolerance/-stale-max-skew/-stale-devices: the durations must not be negative and the device count must be positive")
+    }
+    if cfg.StaleState != "" && cfg.StaleReadings == "off" {
+        return cfg, fmt.Errorf("-stale-state needs -stale-readings reject or flag")
+    }
+    if cfg.DedupThreshold < 0 || cfg.DedupDevices <= 0 {
+        return cfg, fmt.Errorf("invalid -dedup-threshold/-dedup-devices: the threshold must not be negative and the device count must be positive")
+    }
+    if cfg.SeqWindow < 0 || cfg.SeqWindow > seqMaxWindow || cfg.SeqDevices <= 0 {
+        return cfg, fmt.Errorf("invalid -seq-window/-seq-devices: the window must be 0 to %d and the device count must be positive", seqMaxWindow)
+    }
+    if cfg.WatchdogWebhook != "" {
+        if cfg.Watchdog == "" {
+            return cfg, fmt.Errorf("-watchdog-webhook needs -watchdog")
+        }
+        u, err := url.Parse(cfg.WatchdogWebhook)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return cfg, fmt.Errorf("invalid -watchdog-webhook: want a URL such as https://host/path")
+        }
+    }
+    if cfg.Rate < 0 || cfg.Burst < 0 {
+        return cfg, fmt.Errorf("invalid -rate/-burst: must not be negative")
+    }
+    if cfg.KafkaBatch <= 0 || cfg.KafkaFlush <= 0 {
+        return cfg, fmt.Errorf("invalid Kafka batching: -kafka-batch and -kafka-flush must be positive")
+    }
+    if cfg.InfluxBatch <= 0 || cfg.InfluxBuffer < cfg.InfluxBatch || cfg.InfluxFlush <= 0 {
+        return cfg, fmt.Errorf("invalid InfluxDB batching: -influx-batch and -influx-flush must be positive and -influx-buffer at least -influx-batch")
+    }
+    if qos > 2 {
+        return cfg, fmt.Errorf("invalid -mqtt-qos %d: must be 0, 1 or 2", qos)
+    }
+    cfg.MQTTQoS = byte(qos)
+    return cfg, nil
+}
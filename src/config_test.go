@@ -0,0 +1,36 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestIngestMiddlewareKeepsAccessControl(t *testing.T) {
+    keyFile := filepath.Join(t.TempDir(), "keys.txt")
+    if err := os.WriteFile(keyFile, []byte("good-key\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name string
+        args []string
+        ok   bool
+    }{
+        {"auth dropped with a keyfile", []string{"-keyfile", keyFile, "-ingest-middleware", "metrics,ratelimit"}, false},
+        {"auth dropped without credentials", []string{"-ingest-middleware", "metrics,ratelimit"}, true},
+        {"ipfilter dropped with -allow-cidr", []string{"-allow-cidr", "10.0.0.0/8", "-ingest-middleware", "metrics,auth"}, false},
+        {"both kept", []string{"-keyfile", keyFile, "-allow-cidr", "10.0.0.0/8", "-ingest-middleware", "ipfilter,auth"}, true},
+        {"pins dropped with -cert-fingerprints", []string{"-clientca", keyFile, "-cert-fingerprints", keyFile, "-server-middleware", "requestid,accesslog"}, false},
+        {"respsign dropped with -response-key", []string{"-response-key", keyFile, "-server-middleware", "requestid,compress"}, false},
+        {"respsign kept with -response-key", []string{"-response-key", keyFile, "-server-middleware", "compress,respsign"}, true},
+        {"optional layers dropped", []string{"-compress", "-server-middleware", "requestid"}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := parseConfig(tt.args)
+            if (err == nil) != tt.ok {
+                t.Errorf("parseConfig error = %v, want ok %v", err, tt.ok)
+            }
+        })
+    }
+}
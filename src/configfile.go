@@ -0,0 +1,121 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// applyConfigFile sets the flags named in the -config file, a YAML map of flag
+// names to values; a repeatable flag such as -sink or -cert takes a list.
+// Flags given on the command line win over the file:
+//
+//  addr: ":8443"
+//  sink: [file, "http=https://collector.example/ingest"]
+//  hmac-secret: ${IOT_HMAC_SECRET}
+//  loglevel: ${IOT_LOGLEVEL:-info}
+//
+// Values are expanded with expandEnv, so the file can be committed without its
+// secrets.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var doc map[string]yaml.Node
+    if err := yaml.Unmarshal(data, &doc); err != nil {
+        return fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    set := make(map[string]bool)
+    fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+    names := make([]string, 0, len(doc))
+    for name := range doc {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var missing []string
+    for _, name := range names {
+        if name == "config" || fs.Lookup(name) == nil {
+            return fmt.Errorf("unknown flag %q in %s", name, path)
+        }
+        node := doc[name]
+        var values []string
+        switch node.Kind {
+        case yaml.ScalarNode:
+            values = []string{node.Value}
+        case yaml.SequenceNode:
+            if err := node.Decode(&values); err != nil {
+                return fmt.Errorf("invalid %s in %s: %v", name, path, err)
+            }
+        default:
+            return fmt.Errorf("invalid %s in %s: want a value or a list of values", name, path)
+        }
+        if set[name] {
+            continue
+        }
+        for _, v := range values {
+            expanded, unset := expandEnv(v)
+            if len(unset) > 0 {
+                missing = append(missing, unset...)
+                continue
+            }
+            if err := fs.Set(name, expanded); err != nil {
+                return fmt.Errorf("invalid %s in %s: %v", name, path, err)
+            }
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("%s refers to environment variables that are not set: %s", path, strings.Join(missing, ", "))
+    }
+    return nil
+}
+
+// expandEnv replaces ${VAR} with the value of VAR and ${VAR:-default} with the
+// value, or default when VAR is unset or empty. "$$" is a literal "$", and a
+// "$" not followed by "{" is left alone. It returns the variables a ${VAR}
+// without a default needed but found unset.
+func expandEnv(s string) (string, []string) {
+    var out strings.Builder
+    var unset []string
+    for {
+        i := strings.IndexByte(s, '$')
+        if i < 0 || i == len(s)-1 {
+            out.WriteString(s)
+            return out.String(), unset
+        }
+        out.WriteString(s[:i])
+        switch s[i+1] {
+        case '$':
+            out.WriteByte('$')
+            s = s[i+2:]
+            continue
+        case '{':
+        default:
+            out.WriteByte('$')
+            s = s[i+1:]
+            continue
+        }
+        end := strings.IndexByte(s[i:], '}')
+        if end < 0 {
+            out.WriteString(s[i:])
+            return out.String(), unset
+        }
+        ref := s[i+2 : i+end]
+        s = s[i+end+1:]
+
+        name, fallback, hasDefault := strings.Cut(ref, ":-")
+        if v, ok := os.LookupEnv(name); ok && (v != "" || !hasDefault) {
+            out.WriteString(v)
+        } else if hasDefault {
+            out.WriteString(fallback)
+        } else {
+            unset = append(unset, name)
+        }
+    }
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+)
+
+// corsPolicy answers browser preflights and tags responses for allowed origins.
+type corsPolicy struct {
+    any     bool
+    origins map[string]struct{}
+}
+
+// newCORSPolicy parses the comma-separated -cors-origins value; "*" allows every origin.
+func newCORSPolicy(list string) *corsPolicy {
+    p := &corsPolicy{origins: make(map[string]struct{})}
+    for _, origin := range strings.Split(list, ",") {
+        origin = strings.TrimSpace(origin)
+        switch origin {
+        case "":
+        case "*":
+            p.any = true
+        default:
+            p.origins[strings.TrimSuffix(origin, "/")] = struct{}{}
+        }
+    }
+    return p
+}
+
+// allowed reports whether origin may make cross-origin requests.
+func (p *corsPolicy) allowed(origin string) bool {
+    if p.any {
+        return true
+    }
+    _, ok := p.origins[origin]
+    return ok
+}
+
+// middleware handles OPTIONS preflights itself, before metrics or rate limiting
+// see them, and adds Access-Control-Allow-Origin to actual responses.
+func (p *corsPolicy) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        if origin == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Origin")
+        if !p.allowed(origin) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+
+        // Preflight: the browser asks before sending the real POST
+        if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Add("Vary", "Access-Control-Request-Method")
+            w.Header().Add("Vary", "Access-Control-Request-Headers")
+            w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, Idempotency-Key, X-Signature, Digest")
+            w.Header().Set("Access-Control-Max-Age", "600")
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
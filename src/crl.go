@@ -0,0 +1,173 @@
+package main
+
+import (
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// crlChecker rejects client certificates whose serial appears on a certificate
+// revocation list. The list is read from a file or fetched from a URL and
+// reloaded periodically, so revoking a device does not need a restart.
+type crlChecker struct {
+    source  string
+    issuers []*x509.Certificate // CAs whose signature a CRL must carry
+
+    mu      sync.RWMutex
+    revoked map[string]struct{} // serial numbers in hex
+    next    time.Time
+
+    done chan struct{}
+}
+
+// newCRLChecker loads the CRL at source, a path or http(s) URL, signed by one
+// of the CAs in the caFile bundle, and reloads it every interval.
+func newCRLChecker(source, caFile string, interval time.Duration) (*crlChecker, error) {
+    issuers, err := parseCertificates(caFile)
+    if err != nil {
+        return nil, fmt.Errorf("error reading client CA %s: %v", caFile, err)
+    }
+    c := &crlChecker{source: source, issuers: issuers, done: make(chan struct{})}
+    if err := c.reload(); err != nil {
+        return nil, err
+    }
+    go c.refresh(interval)
+    return c, nil
+}
+
+// parseCertificates reads every certificate in a PEM bundle.
+func parseCertificates(path string) ([]*x509.Certificate, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var certs []*x509.Certificate
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            break
+        }
+        if block.Type != "CERTIFICATE" {
+            continue
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        certs = append(certs, cert)
+    }
+    if len(certs) == 0 {
+        return nil, errors.New("no certificates found")
+    }
+    return certs, nil
+}
+
+// fetch returns the raw CRL from the file or URL.
+func (c *crlChecker) fetch() ([]byte, error) {
+    if !strings.HasPrefix(c.source, "http://") && !strings.HasPrefix(c.source, "https://") {
+        return ioutil.ReadFile(c.source)
+    }
+    client := &http.Client{Timeout: 30 * time.Second}
+    resp, err := client.Get(c.source)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("fetching CRL: %s", resp.Status)
+    }
+    return ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
+
+// reload fetches and verifies the CRL, then swaps in its revoked serials.
+// On any error the previous list stays in effect.
+func (c *crlChecker) reload() error {
+    raw, err := c.fetch()
+    if err != nil {
+        return fmt.Errorf("error loading CRL %s: %v", c.source, err)
+    }
+    if block, _ := pem.Decode(raw); block != nil {
+        raw = block.Bytes
+    }
+    crl, err := x509.ParseRevocationList(raw)
+    if err != nil {
+        return fmt.Errorf("error parsing CRL %s: %v", c.source, err)
+    }
+
+    // Only trust a list signed by one of the client CAs
+    signed := false
+    for _, issuer := range c.issuers {
+        if crl.CheckSignatureFrom(issuer) == nil {
+            signed = true
+            break
+        }
+    }
+    if !signed {
+        return fmt.Errorf("CRL %s is not signed by any certificate in the client CA bundle", c.source)
+    }
+
+    revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+    for _, entry := range crl.RevokedCertificateEntries {
+        revoked[entry.SerialNumber.Text(16)] = struct{}{}
+    }
+    c.mu.Lock()
+    c.revoked = revoked
+    c.next = crl.NextUpdate
+    c.mu.Unlock()
+    slog.Info("loaded CRL", "source", c.source, "revoked", len(revoked), "next_update", crl.NextUpdate)
+    return nil
+}
+
+// refresh reloads the CRL every interval until Close.
+func (c *crlChecker) refresh(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if err := c.reload(); err != nil {
+                slog.Warn("keeping previous CRL", "err", err)
+            }
+            c.mu.RLock()
+            stale := !c.next.IsZero() && time.Now().After(c.next)
+            c.mu.RUnlock()
+            if stale {
+                slog.Warn("CRL is past its next update time", "source", c.source, "next_update", c.next)
+            }
+        case <-c.done:
+            return
+        }
+    }
+}
+
+// verifyPeerCertificate is a tls.Config.VerifyPeerCertificate callback that
+// fails the handshake when the verified client certificate has been revoked.
+func (c *crlChecker) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    for _, chain := range verifiedChains {
+        if len(chain) == 0 {
+            continue
+        }
+        leaf := chain[0]
+        if _, ok := c.revoked[leaf.SerialNumber.Text(16)]; ok {
+            slog.Warn("REVOKED client certificate rejected", "serial", leaf.SerialNumber.Text(16), "cn", leaf.Subject.CommonName, "issuer", leaf.Issuer.CommonName)
+            return fmt.Errorf("client certificate %s has been revoked", leaf.SerialNumber.Text(16))
+        }
+    }
+    return nil
+}
+
+// Close stops the refresh goroutine.
+func (c *crlChecker) Close() {
+    close(c.done)
+}
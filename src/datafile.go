@@ -0,0 +1,190 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log/slog"
+    "os"
+    "sync"
+    "syscall"
+    "time"
+
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// dataRecord is a single line of the data file.
+type dataRecord struct {
+    Timestamp  time.Time `json:"timestamp"`
+    RemoteAddr string    `json:"remote_addr"`
+    Type       string    `json:"type,omitempty"`
+    RequestID  string    `json:"request_id,omitempty"`
+    Payload    []byte    `json:"payload"` // encoded as base64 so binary sensor data survives
+}
+
+// rotation controls how the data file is rotated; a zero MaxSize disables it.
+type rotation struct {
+    MaxSize    int // megabytes before the file is rotated
+    MaxAge     int // days to keep rotated files, 0 keeps them regardless of age
+    MaxBackups int // rotated files to keep, 0 keeps them all
+}
+
+// overflowRetry is how often a degraded data writer checks whether the disk has room again.
+const overflowRetry = 5 * time.Second
+
+// errOverflowFull means the disk is full and so is the in-memory overflow buffer.
+var errOverflowFull = errors.New("data file disk is full and the overflow buffer is full")
+
+// dataWriter appends received payloads to a file as newline-delimited JSON.
+//
+// When the disk fills up (ENOSPC) the writer degrades: records go to an
+// in-memory buffer of up to overflowMax bytes instead, and are written out in
+// order once the disk takes writes again. Only when that buffer is full does
+// Write fail, so devices are told to back off rather than lose data.
+type dataWriter struct {
+    mu sync.Mutex
+    f  io.WriteCloser
+
+    overflowMax   int64
+    overflow      [][]byte
+    overflowBytes int64
+    degraded      bool
+    torn          bool // the last failed write left part of a line in the file
+    done          chan struct{}
+
+    redact *redactor // masks -redact fields before a payload is written
+}
+
+// openDataWriter opens path for appending, creating it if it does not exist.
+// With rotation enabled the file is handed to lumberjack, which renames it
+// with a timestamp once it reaches MaxSize, gzips the old file and prunes
+// backups beyond MaxAge and MaxBackups. overflow is the most bytes held in
+// memory while the disk is full; 0 fails writes straight away instead.
+func openDataWriter(path string, rot rotation, overflow int64) (*dataWriter, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    d := &dataWriter{f: f, overflowMax: overflow, done: make(chan struct{})}
+    if rot.MaxSize > 0 {
+        // lumberjack opens the file lazily; the open above just surfaces errors at startup
+        f.Close()
+        d.f = &lumberjack.Logger{
+            Filename:   path,
+            MaxSize:    rot.MaxSize,
+            MaxAge:     rot.MaxAge,
+            MaxBackups: rot.MaxBackups,
+            Compress:   true,
+        }
+    }
+    if overflow > 0 {
+        go d.retryFlush(overflowRetry)
+    }
+    return d, nil
+}
+
+// Write serializes one record and appends it as a single line.
+func (d *dataWriter) Write(remoteAddr, requestID, kind string, payload []byte) error {
+    line, err := json.Marshal(dataRecord{
+        Timestamp:  time.Now().UTC(),
+        RemoteAddr: remoteAddr,
+        Type:       kind,
+        RequestID:  requestID,
+        Payload:    payload,
+    })
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+
+    // Hold the lock across the whole line so concurrent requests never interleave
+    // and a rotation never splits a record between two files
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.degraded && !d.flush() {
+        return d.buffer(line)
+    }
+    n, err := d.f.Write(line)
+    if err == nil || d.overflowMax <= 0 || !errors.Is(err, syscall.ENOSPC) {
+        return err
+    }
+    d.torn = n > 0
+    d.degraded = true
+    slog.Warn("data file disk is full, buffering records in memory", "limit_bytes", d.overflowMax, "err", err)
+    return d.buffer(line)
+}
+
+// buffer holds line until the disk has room. The caller holds d.mu.
+func (d *dataWriter) buffer(line []byte) error {
+    if d.overflowBytes+int64(len(line)) > d.overflowMax {
+        return errOverflowFull
+    }
+    d.overflow = append(d.overflow, line)
+    d.overflowBytes += int64(len(line))
+    return nil
+}
+
+// flush writes the overflow buffer out in order and leaves degraded mode,
+// reporting false if the disk is still refusing writes. The caller holds d.mu.
+func (d *dataWriter) flush() bool {
+    // End a line cut short by the full disk so the records after it parse
+    if d.torn {
+        if _, err := d.f.Write([]byte{'\n'}); err != nil {
+            return false
+        }
+        d.torn = false
+    }
+    for len(d.overflow) > 0 {
+        n, err := d.f.Write(d.overflow[0])
+        if err != nil {
+            d.torn = n > 0
+            return false
+        }
+        d.overflowBytes -= int64(len(d.overflow[0]))
+        d.overflow[0] = nil
+        d.overflow = d.overflow[1:]
+    }
+    d.overflow = nil
+    d.degraded = false
+    slog.Info("data file disk has space again, overflow buffer flushed")
+    return true
+}
+
+// retryFlush retries the flush every interval while degraded, so buffered
+// records reach the disk even if no new ones arrive.
+func (d *dataWriter) retryFlush(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            d.mu.Lock()
+            if d.degraded {
+                d.flush()
+            }
+            d.mu.Unlock()
+        case <-d.done:
+            return
+        }
+    }
+}
+
+// overflowState reports whether the writer is degraded and how many bytes it is holding.
+func (d *dataWriter) overflowState() (bool, int64) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.degraded, d.overflowBytes
+}
+
+// Close makes a last attempt to flush any overflow, then closes the underlying file.
+func (d *dataWriter) Close() error {
+    if d.done != nil {
+        close(d.done)
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.degraded && !d.flush() {
+        slog.Error("data file disk still full at shutdown, buffered records lost", "records", len(d.overflow), "bytes", d.overflowBytes)
+    }
+    return d.f.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// deadLetterQueue is how many dead letters may wait for the writer before new ones are dropped.
+const deadLetterQueue = 1024
+
+// deadLetter is a single line of the dead-letter file: a payload the server
+// received but refused or could not process, kept so it can be replayed.
+type deadLetter struct {
+    Timestamp  time.Time   `json:"timestamp"`
+    Transport  string      `json:"transport"`
+    RemoteAddr string      `json:"remote_addr"`
+    Type       string      `json:"type,omitempty"`
+    Reason     string      `json:"reason"`
+    RequestID  string      `json:"request_id,omitempty"`
+    Headers    http.Header `json:"headers,omitempty"`
+    Payload    []byte      `json:"payload"` // raw body, base64 like the data file
+}
+
+// deadLetterWriter appends dead letters to a file as newline-delimited JSON.
+// Records are written by a background goroutine so a slow disk never delays
+// the response to the device.
+type deadLetterWriter struct {
+    f       *os.File
+    records chan deadLetter
+    done    chan struct{}
+
+    mu     sync.RWMutex
+    closed bool
+}
+
+// openDeadLetterWriter opens path for appending, creating it if it does not exist.
+func openDeadLetterWriter(path string) (*deadLetterWriter, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    d := &deadLetterWriter{f: f, records: make(chan deadLetter, deadLetterQueue), done: make(chan struct{})}
+    go d.run()
+    return d, nil
+}
+
+// run writes queued records until Close.
+func (d *deadLetterWriter) run() {
+    defer close(d.done)
+    for rec := range d.records {
+        line, err := json.Marshal(rec)
+        if err == nil {
+            _, err = d.f.Write(append(line, '\n'))
+        }
+        if err != nil {
+            slog.Error("error writing dead-letter file", "remote_addr", rec.RemoteAddr, "err", err)
+        }
+    }
+}
+
+// Add queues rec for writing without blocking; if the writer has fallen behind
+// the record is dropped and logged instead.
+func (d *deadLetterWriter) Add(rec deadLetter) {
+    d.mu.RLock()
+    defer d.mu.RUnlock()
+    if d.closed {
+        return
+    }
+    select {
+    case d.records <- rec:
+    default:
+        slog.Warn("dead-letter queue full, dropping payload", "remote_addr", rec.RemoteAddr, "reason", rec.Reason)
+    }
+}
+
+// Close writes any queued records and closes the underlying file.
+func (d *deadLetterWriter) Close() error {
+    d.mu.Lock()
+    if !d.closed {
+        d.closed = true
+        close(d.records)
+    }
+    d.mu.Unlock()
+    <-d.done
+    return d.f.Close()
+}
+
+// deadLetterHeaders copies h for the dead-letter file with credentials redacted.
+func deadLetterHeaders(h http.Header) http.Header {
+    if h == nil {
+        return nil
+    }
+    h = h.Clone()
+    if h.Get("Authorization") != "" {
+        h.Set("Authorization", "REDACTED")
+    }
+    return h
+}
+
+// deadLetterBody reads what is left of a refused request's body, up to limit,
+// so it can be kept even though the handler never needed to look at it.
+func deadLetterBody(body io.Reader, limit int64) []byte {
+    data, _ := io.ReadAll(io.LimitReader(body, limit))
+    return data
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "container/list"
+    "math"
+    "sync"
+)
+
+// lastStored is the reading last stored from one device, as dedupFilter
+// compares against it.
+type lastStored struct {
+    device string
+    temp   *float64
+    open   *bool
+}
+
+// dedupFilter drops readings that have barely changed since the last one
+// stored from their device: every numeric field within threshold of it and
+// every other field the same. Only readings with a numeric field can be
+// dropped. It remembers size devices, forgetting the least recently heard
+// from, whose next reading is then stored whatever it holds.
+type dedupFilter struct {
+    threshold float64
+    size      int
+
+    mu      sync.Mutex
+    order   *list.List // front is most recently heard from
+    entries map[string]*list.Element
+    dropped uint64
+}
+
+// newDedupFilter returns a filter for size devices.
+func newDedupFilter(threshold float64, size int) *dedupFilter {
+    return &dedupFilter{
+        threshold: threshold,
+        size:      size,
+        order:     list.New(),
+        entries:   make(map[string]*list.Element),
+    }
+}
+
+// duplicate reports whether reading, from device, is close enough to the last
+// one stored from it to drop, and counts it if so.
+func (f *dedupFilter) duplicate(device string, reading SensorReading) bool {
+    if reading.Temp == nil {
+        return false
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    el, ok := f.entries[device]
+    if !ok {
+        return false
+    }
+    f.order.MoveToFront(el)
+    last := el.Value.(*lastStored)
+    if last.temp == nil || math.Abs(*reading.Temp-*last.temp) > f.threshold {
+        return false
+    }
+    if (reading.Open == nil) != (last.open == nil) || reading.Open != nil && *reading.Open != *last.open {
+        return false
+    }
+    f.dropped++
+    return true
+}
+
+// stored records reading as the last one stored from device. It is called
+// only once the sinks took it, so a failed write is not held against a retry.
+func (f *dedupFilter) stored(device string, reading SensorReading) {
+    last := &lastStored{device: device}
+    if reading.Temp != nil {
+        v := *reading.Temp
+        last.temp = &v
+    }
+    if reading.Open != nil {
+        v := *reading.Open
+        last.open = &v
+    }
+
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if el, ok := f.entries[device]; ok {
+        el.Value = last
+        f.order.MoveToFront(el)
+        return
+    }
+    f.entries[device] = f.order.PushFront(last)
+    for f.order.Len() > f.size {
+        oldest := f.order.Back()
+        f.order.Remove(oldest)
+        delete(f.entries, oldest.Value.(*lastStored).device)
+    }
+}
+
+// droppedCount returns how many readings have been dropped.
+func (f *dedupFilter) droppedCount() uint64 {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.dropped
+}
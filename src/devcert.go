@@ -0,0 +1,48 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "time"
+)
+
+// selfSignedCertificate generates an in-memory certificate for localhost and
+// 127.0.0.1 for -dev. Clients cannot verify it, so it is only for local
+// development; it is regenerated on every start and never written to disk.
+func selfSignedCertificate() (tls.Certificate, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+
+    now := time.Now()
+    template := &x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{Organization: []string{"IoT development"}, CommonName: "localhost"},
+        NotBefore:    now.Add(-time.Hour),
+        NotAfter:     now.Add(30 * 24 * time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames:     []string{"localhost"},
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    leaf, err := x509.ParseCertificate(der)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
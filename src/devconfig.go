@@ -0,0 +1,122 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+
+    "gopkg.in/yaml.v3"
+)
+
+// emptyConfig is what a device that is up to date, or has no entry, gets.
+var emptyConfig = json.RawMessage("{}")
+
+// deviceConfig is the configuration waiting for one device. Version must grow
+// with every change so the device can tell it has not applied it yet.
+type deviceConfig struct {
+    Version int            `yaml:"version"`
+    Config  map[string]any `yaml:"config"`
+
+    encoded json.RawMessage // Config as sent, encoded once at load
+}
+
+// deviceConfigFile is the -device-config file:
+//
+//  devices:
+//    temp-07:
+//      version: 3
+//      config: {interval: 60, alarm_above: 30.5}
+type deviceConfigFile struct {
+    Devices map[string]deviceConfig `yaml:"devices"`
+}
+
+// deviceConfigs hands devices their pending configuration in the reply to a
+// reading, keyed by client certificate CN or the reading's device_id. It can
+// be reloaded while the server runs.
+type deviceConfigs struct {
+    path string
+
+    mu      sync.RWMutex
+    devices map[string]deviceConfig
+}
+
+// loadDeviceConfigs reads the configurations from path.
+func loadDeviceConfigs(path string) (*deviceConfigs, error) {
+    c := &deviceConfigs{path: path}
+    devices, err := c.load()
+    if err != nil {
+        return nil, err
+    }
+    c.set(devices)
+    return c, nil
+}
+
+// load reads and checks the file without applying it.
+func (c *deviceConfigs) load() (map[string]deviceConfig, error) {
+    data, err := ioutil.ReadFile(c.path)
+    if err != nil {
+        return nil, err
+    }
+    var f deviceConfigFile
+    if err := yaml.Unmarshal(data, &f); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", c.path, err)
+    }
+    for id, d := range f.Devices {
+        if d.Version < 1 {
+            return nil, fmt.Errorf("invalid configuration for device %q in %s: version must be at least 1", id, c.path)
+        }
+        if d.Config == nil {
+            d.Config = map[string]any{}
+        }
+        if d.encoded, err = json.Marshal(d.Config); err != nil {
+            return nil, fmt.Errorf("invalid configuration for device %q in %s: %v", id, c.path, err)
+        }
+        f.Devices[id] = d
+    }
+    return f.Devices, nil
+}
+
+// set replaces the configurations with devices.
+func (c *deviceConfigs) set(devices map[string]deviceConfig) {
+    c.mu.Lock()
+    c.devices = devices
+    c.mu.Unlock()
+    slog.Info("loaded device configuration", "file", c.path, "devices", len(devices))
+}
+
+// current returns the configurations in effect.
+func (c *deviceConfigs) current() map[string]deviceConfig {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.devices
+}
+
+// pending returns the configuration device id should apply and its version.
+// A device reporting that version, or a later one, gets an empty object with
+// the version; one without an entry gets an empty object and version 0.
+func (c *deviceConfigs) pending(id string, applied int) (json.RawMessage, int) {
+    d, ok := c.current()[id]
+    if !ok {
+        return emptyConfig, 0
+    }
+    if applied >= d.Version {
+        return emptyConfig, d.Version
+    }
+    return d.encoded, d.Version
+}
+
+// appliedConfigVersion is the version the device says it runs, from
+// X-Config-Version; a missing or malformed header counts as none, so the
+// device gets its whole configuration.
+func appliedConfigVersion(r *http.Request) int {
+    v, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("X-Config-Version")))
+    if err != nil || v < 0 {
+        return 0
+    }
+    return v
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// deviceType is one kind of device with its own endpoint and payload rules.
+// Adding a new kind of device is one more entry in deviceTypes; the shared
+// auth, rate limiting, metrics and storage apply to it automatically.
+type deviceType struct {
+    Name         string   // recorded in logs and the data file
+    Path         string   // endpoint the device POSTs to
+    ContentTypes []string // accepted media types
+    Methods      []string // accepted HTTP methods; POST when empty
+    Decode       func(body []byte, o origin) (SensorReading, error)
+}
+
+// deviceTypes lists every ingestion endpoint. The first entry also serves "/"
+// so firmware posting to the root keeps working.
+var deviceTypes = []deviceType{
+    {
+        Name:         "temp",
+        Path:         "/sensor/temp",
+        ContentTypes: []string{mediaJSON, mediaCBOR, mediaLegacy, mediaProtobuf},
+        Decode:       decodeTemp,
+    },
+    {
+        Name:         "door",
+        Path:         "/sensor/door",
+        ContentTypes: []string{mediaJSON, mediaCBOR, mediaLegacy, mediaProtobuf},
+        Decode:       decodeDoor,
+    },
+    {
+        Name:         "image",
+        Path:         "/upload/image",
+        ContentTypes: []string{"image/jpeg", "image/png"},
+        Decode:       decodeImage,
+    },
+}
+
+// methods returns the HTTP methods the device type's endpoint accepts.
+func (d deviceType) methods() []string {
+    if len(d.Methods) == 0 {
+        return []string{http.MethodPost}
+    }
+    return d.Methods
+}
+
+// accepts reports whether the device type takes bodies of the given media type.
+func (d deviceType) accepts(mediaType string) bool {
+    for _, ct := range d.ContentTypes {
+        if ct == mediaType {
+            return true
+        }
+    }
+    return false
+}
+
+// decodeTemp parses a temperature reading, e.g. {"device_id":"abc","temp":21.5,"ts":1700000000}.
+func decodeTemp(body []byte, o origin) (SensorReading, error) {
+    reading, err := parseReading(body, o.MediaType)
+    if err == nil && reading.Temp == nil {
+        err = missingField("temp")
+    }
+    return reading, err
+}
+
+// decodeDoor parses a door contact reading, e.g. {"device_id":"abc","open":true,"ts":1700000000}.
+func decodeDoor(body []byte, o origin) (SensorReading, error) {
+    reading, err := parseReading(body, o.MediaType)
+    if err == nil && reading.Open == nil {
+        err = missingField("open")
+    }
+    return reading, err
+}
+
+// decodeImage accepts an opaque image. The device is identified by its client
+// certificate or the X-Device-ID header, and stamped with the receive time.
+func decodeImage(body []byte, o origin) (SensorReading, error) {
+    deviceID, err := opaqueDevice(o)
+    if err != nil {
+        return SensorReading{}, err
+    }
+    if deviceID == "" {
+        return SensorReading{}, errors.New("missing X-Device-ID header")
+    }
+    if len(body) == 0 {
+        return SensorReading{}, errors.New("empty image")
+    }
+    return SensorReading{DeviceID: deviceID, Timestamp: time.Now().Unix()}, nil
+}
+
+// opaqueDevice names the device an opaque body came from, as originDevice
+// does. With no body to say otherwise, an X-Device-ID naming a different
+// device than the certificate is refused rather than believed.
+func opaqueDevice(o origin) (string, error) {
+    if o.ClientCN != "" && o.DeviceID != "" && o.DeviceID != o.ClientCN {
+        return "", fmt.Errorf("X-Device-ID %q does not match client certificate CN %q", o.DeviceID, o.ClientCN)
+    }
+    return originDevice(o), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestOpaqueDeviceID(t *testing.T) {
+    tests := []struct {
+        name string
+        o    origin
+        want string
+        ok   bool
+    }{
+        {"certificate", origin{ClientCN: "cam-01"}, "cam-01", true},
+        {"header", origin{DeviceID: "cam-02"}, "cam-02", true},
+        {"matching header", origin{ClientCN: "cam-01", DeviceID: "cam-01"}, "cam-01", true},
+        {"header naming another device", origin{ClientCN: "cam-01", DeviceID: "cam-02"}, "", false},
+        {"neither", origin{}, "", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for name, decode := range map[string]func([]byte, origin) (SensorReading, error){"image": decodeImage, "raw": decodeRaw} {
+                reading, err := decode([]byte{0xff, 0xd8}, tt.o)
+                if (err == nil) != tt.ok {
+                    t.Fatalf("%s: err = %v, want ok %v", name, err, tt.ok)
+                }
+                if reading.DeviceID != tt.want {
+                    t.Errorf("%s: device_id = %q, want %q", name, reading.DeviceID, tt.want)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "hash/crc32"
+    "io"
+    "log/slog"
+    "net/http"
+    "strings"
+)
+
+// digestAlgorithms are the Digest header (RFC 3230) algorithms the server
+// checks, strongest first. Each value is the base64 digest of the body as
+// sent, before any Content-Encoding is undone; a CRC may be 8 hex digits.
+var digestAlgorithms = []struct {
+    name string
+    new  func() hash.Hash
+}{
+    {"sha-512", sha512.New},
+    {"sha-256", sha256.New},
+    {"md5", md5.New},
+    {"crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+    {"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// wantDigest is the Want-Digest header sent to a device whose Digest names
+// none of digestAlgorithms, so it can pick one.
+var wantDigest = func() string {
+    names := make([]string, len(digestAlgorithms))
+    for i, alg := range digestAlgorithms {
+        names[i] = alg.name
+    }
+    return strings.Join(names, ", ")
+}()
+
+// errDigestUnsupported is returned when a Digest header names only
+// algorithms the server does not know.
+var errDigestUnsupported = errors.New("no supported algorithm; use one of " + wantDigest)
+
+// bodyDigest is one algorithm from a Digest header, hashing the body as it is
+// read.
+type bodyDigest struct {
+    alg  string
+    want []byte
+    h    hash.Hash
+}
+
+// bodyDigests are every supported digest a request carries, all of which
+// must match. A nil bodyDigests checks nothing.
+type bodyDigests []bodyDigest
+
+// parseDigest reads the values of Digest headers, such as
+// "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=, crc32=1a2b3c4d".
+// Algorithms the server does not know are skipped as long as one is known.
+func parseDigest(values []string) (bodyDigests, error) {
+    var d bodyDigests
+    unknown := false
+    for _, v := range values {
+        for _, part := range strings.Split(v, ",") {
+            part = strings.TrimSpace(part)
+            if part == "" {
+                continue
+            }
+            name, value, ok := strings.Cut(part, "=")
+            if !ok {
+                return nil, fmt.Errorf("%q is not algorithm=value", part)
+            }
+            name = strings.ToLower(strings.TrimSpace(name))
+            found := false
+            for _, alg := range digestAlgorithms {
+                if alg.name != name {
+                    continue
+                }
+                found = true
+                h := alg.new()
+                want, ok := decodeDigest(strings.TrimSpace(value), h.Size())
+                if !ok {
+                    return nil, fmt.Errorf("%s value must be a base64 digest of %d bytes", name, h.Size())
+                }
+                d = append(d, bodyDigest{alg: name, want: want, h: h})
+            }
+            if !found {
+                unknown = true
+            }
+        }
+    }
+    if d == nil && unknown {
+        return nil, errDigestUnsupported
+    }
+    return d, nil
+}
+
+// decodeDigest decodes a digest of size bytes from base64, or from hex for
+// the short CRCs that firmware usually prints that way.
+func decodeDigest(v string, size int) ([]byte, bool) {
+    if b, err := base64.StdEncoding.DecodeString(v); err == nil && len(b) == size {
+        return b, true
+    }
+    if size <= 4 {
+        if b, err := hex.DecodeString(v); err == nil && len(b) == size {
+            return b, true
+        }
+    }
+    return nil, false
+}
+
+// writer returns a writer feeding every digest, to tee the body through.
+func (d bodyDigests) writer() io.Writer {
+    ws := make([]io.Writer, len(d))
+    for i := range d {
+        ws[i] = d[i].h
+    }
+    return io.MultiWriter(ws...)
+}
+
+// verify reports whether every digest matches the body written to it, and if
+// not, the first algorithm that did not with the digest actually received.
+func (d bodyDigests) verify() (string, string, bool) {
+    for _, b := range d {
+        if got := b.h.Sum(nil); !bytes.Equal(got, b.want) {
+            return b.alg, base64.StdEncoding.EncodeToString(got), false
+        }
+    }
+    return "", "", true
+}
+
+// requestDigests parses the Digest headers of r, answering 400 and reporting
+// false if they are malformed or name no algorithm the server knows; then
+// Want-Digest lists the ones it does.
+func requestDigests(w http.ResponseWriter, r *http.Request) (bodyDigests, bool) {
+    d, err := parseDigest(r.Header.Values("Digest"))
+    if err != nil {
+        if errors.Is(err, errDigestUnsupported) {
+            w.Header().Set("Want-Digest", wantDigest)
+        }
+        slog.WarnContext(r.Context(), "rejected request with an invalid Digest header", "remote_addr", r.RemoteAddr, "err", err)
+        writeError(w, http.StatusBadRequest, "Invalid Digest header: "+err.Error())
+        return nil, false
+    }
+    return d, true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// echoResponse is what -echo returns in place of storing a reading: everything
+// the server understood from the request, for debugging device firmware.
+type echoResponse struct {
+    Status      string          `json:"status"` // always "echo"
+    Type        string          `json:"type"`
+    ContentType string          `json:"content_type"`
+    Received    int             `json:"received"`
+    Reading     SensorReading   `json:"reading"`
+    Stored      json.RawMessage `json:"stored,omitempty"` // the -transform-template output, if any
+    Warnings    []string        `json:"warnings,omitempty"`
+}
+
+// writeEcho answers a reading that passed validation with what would have been stored.
+func (a *app) writeEcho(w http.ResponseWriter, r *http.Request, o origin, dt deviceType, reading SensorReading, body []byte) {
+    resp := echoResponse{
+        Status:      "echo",
+        Type:        dt.Name,
+        ContentType: o.MediaType,
+        Received:    len(body),
+        Reading:     reading,
+        Warnings:    echoWarnings(o, dt, reading, body),
+    }
+    if a.transform != nil && dt.accepts(mediaJSON) {
+        if out, err := a.transform.apply(dt, reading); err == nil && json.Valid(out) {
+            resp.Stored = out
+        }
+    }
+    slog.WarnContext(r.Context(), "ECHO MODE: reading not stored", "remote_addr", r.RemoteAddr, "type", dt.Name, "device_id", reading.DeviceID, "warnings", len(resp.Warnings))
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// echoWarnings lists things about an otherwise valid reading that are likely
+// firmware mistakes: fields the server ignores, a timestamp in the wrong unit
+// or far from the server clock, and a device id that disagrees with the headers.
+func echoWarnings(o origin, dt deviceType, reading SensorReading, body []byte) []string {
+    var warnings []string
+    if o.MediaType == mediaJSON && dt.accepts(mediaJSON) {
+        dec := json.NewDecoder(bytes.NewReader(body))
+        dec.DisallowUnknownFields()
+        var strict SensorReading
+        if err := dec.Decode(&strict); err != nil {
+            warnings = append(warnings, strings.TrimPrefix(err.Error(), "json: ")+" is ignored")
+        }
+    }
+    if reading.Timestamp != 0 {
+        skew := time.Since(time.Unix(reading.Timestamp, 0)).Round(time.Second)
+        switch {
+        case reading.Timestamp > 1e11:
+            warnings = append(warnings, "ts looks like milliseconds; it should be seconds since the Unix epoch")
+        case skew < -5*time.Minute || skew > 24*time.Hour:
+            warnings = append(warnings, fmt.Sprintf("ts is %s away from the server clock", skew))
+        }
+    }
+    if o.DeviceID != "" && reading.DeviceID != "" && reading.DeviceID != o.DeviceID {
+        warnings = append(warnings, fmt.Sprintf("device_id %q does not match X-Device-ID %q", reading.DeviceID, o.DeviceID))
+    }
+    if o.ClientCN != "" && reading.DeviceID != "" && reading.DeviceID != o.ClientCN {
+        warnings = append(warnings, fmt.Sprintf("device_id %q does not match client certificate CN %q", reading.DeviceID, o.ClientCN))
+    }
+    return warnings
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "path"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/fxamacker/cbor/v2"
+    "gopkg.in/yaml.v3"
+)
+
+// enrichFile is the -enrich file, mapping devices to the fields added to their
+// readings. An exact device entry comes first; the first pattern matching the
+// device then fills in the fields it did not set:
+//
+//  devices:
+//    temp-07: {region: eu-west, site: dublin}
+//  patterns:
+//    - match: "us-*"
+//      fields: {region: us-east}
+type enrichFile struct {
+    Devices  map[string]map[string]any `yaml:"devices"`
+    Patterns []enrichPattern           `yaml:"patterns"`
+}
+
+// enrichPattern adds fields to every device whose id matches a path.Match glob.
+type enrichPattern struct {
+    Match  string         `yaml:"match"`
+    Fields map[string]any `yaml:"fields"`
+}
+
+// enricher adds metadata to readings before they are stored: the -enrich
+// fields of the device, plus the server's hostname and the time the reading
+// was received. It can be reloaded while the server runs.
+type enricher struct {
+    path string
+    host string
+
+    mu    sync.RWMutex
+    rules enrichFile
+}
+
+// loadEnricher reads the rules from path.
+func loadEnricher(path string) (*enricher, error) {
+    host, err := os.Hostname()
+    if err != nil {
+        return nil, err
+    }
+    e := &enricher{path: path, host: host}
+    rules, err := e.load()
+    if err != nil {
+        return nil, err
+    }
+    e.set(rules)
+    return e, nil
+}
+
+// load reads and checks the file without applying it.
+func (e *enricher) load() (enrichFile, error) {
+    var f enrichFile
+    data, err := ioutil.ReadFile(e.path)
+    if err != nil {
+        return f, err
+    }
+    if err := yaml.Unmarshal(data, &f); err != nil {
+        return f, fmt.Errorf("error parsing %s: %v", e.path, err)
+    }
+    for _, p := range f.Patterns {
+        if _, err := path.Match(p.Match, ""); err != nil || p.Match == "" {
+            return f, fmt.Errorf("invalid pattern %q in %s", p.Match, e.path)
+        }
+    }
+    return f, nil
+}
+
+// set replaces the rules.
+func (e *enricher) set(rules enrichFile) {
+    e.mu.Lock()
+    e.rules = rules
+    e.mu.Unlock()
+    slog.Info("loaded enrichment rules", "file", e.path, "devices", len(rules.Devices), "patterns", len(rules.Patterns))
+}
+
+// current returns the rules in effect.
+func (e *enricher) current() enrichFile {
+    e.mu.RLock()
+    defer e.mu.RUnlock()
+    return e.rules
+}
+
+// fields returns what is added to the readings of device id: its own entry,
+// then the first matching pattern, then the hostname and received time.
+func (e *enricher) fields(id string, received time.Time) map[string]any {
+    rules := e.current()
+    out := make(map[string]any)
+    for k, v := range rules.Devices[id] {
+        out[k] = v
+    }
+    for _, p := range rules.Patterns {
+        if ok, _ := path.Match(p.Match, id); ok {
+            for k, v := range p.Fields {
+                if _, set := out[k]; !set {
+                    out[k] = v
+                }
+            }
+            break
+        }
+    }
+    out["server_host"] = e.host
+    out["received_at"] = received.UTC().Format(time.RFC3339Nano)
+    return out
+}
+
+// apply merges the fields for device id into a JSON or CBOR object body.
+// Fields the device sent itself are kept. A body that is not an object, or
+// not JSON or CBOR at all, is returned as it is.
+func (e *enricher) apply(id string, body []byte, mediaType string, received time.Time) []byte {
+    fields := e.fields(id, received)
+    switch mediaType {
+    case mediaJSON, mediaNDJSON, "":
+        var obj map[string]json.RawMessage
+        if err := json.Unmarshal(body, &obj); err != nil || obj == nil {
+            return body
+        }
+        // Splice the new fields in so the device's own bytes stay as they were
+        names := make([]string, 0, len(fields))
+        for k := range fields {
+            if _, sent := obj[k]; !sent {
+                names = append(names, k)
+            }
+        }
+        sort.Strings(names)
+        var extra bytes.Buffer
+        for _, k := range names {
+            v, err := json.Marshal(fields[k])
+            if err != nil {
+                continue
+            }
+            key, _ := json.Marshal(k)
+            if extra.Len() > 0 || len(obj) > 0 {
+                extra.WriteByte(',')
+            }
+            extra.Write(key)
+            extra.WriteByte(':')
+            extra.Write(v)
+        }
+        trimmed := bytes.TrimRight(body, " \t\r\n")
+        out := make([]byte, 0, len(trimmed)+extra.Len())
+        out = append(out, trimmed[:len(trimmed)-1]...)
+        out = append(out, extra.Bytes()...)
+        return append(out, '}')
+    case mediaCBOR:
+        var obj map[string]any
+        if err := cborToJSON.Unmarshal(body, &obj); err != nil || obj == nil {
+            return body
+        }
+        for k, v := range fields {
+            if _, sent := obj[k]; !sent {
+                obj[k] = v
+            }
+        }
+        out, err := cbor.Marshal(obj)
+        if err != nil {
+            return body
+        }
+        return out
+    }
+    return body
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/fxamacker/cbor/v2"
+    "gopkg.in/yaml.v3"
+)
+
+// fieldMapTargets are the reading fields a vendor's key may be mapped to.
+var fieldMapTargets = []string{"device_id", "temp", "open", "seq", "ts"}
+
+// fieldMapFile is the -field-map file: for each vendor, the keys its devices
+// send and the reading field each stands for, and which devices are whose. An
+// exact device entry comes first, then the first pattern matching the device.
+// A key may be a dotted path into a nested object:
+//
+//  vendors:
+//    acme: {temperature: temp, time: ts}
+//    globex: {t: temp, meta.id: device_id, meta.time: ts}
+//  devices:
+//    temp-07: acme
+//  patterns:
+//    - match: "gx-*"
+//      vendor: globex
+type fieldMapFile struct {
+    Vendors  map[string]map[string]string `yaml:"vendors"`
+    Devices  map[string]string            `yaml:"devices"`
+    Patterns []fieldMapPattern            `yaml:"patterns"`
+}
+
+// fieldMapPattern assigns a vendor to every device whose id matches a
+// path.Match glob.
+type fieldMapPattern struct {
+    Match  string `yaml:"match"`
+    Vendor string `yaml:"vendor"`
+}
+
+// vendor returns the vendor of device id, or "" if it has none.
+func (f fieldMapFile) vendor(id string) string {
+    if v, ok := f.Devices[id]; ok {
+        return v
+    }
+    for _, p := range f.Patterns {
+        if ok, _ := path.Match(p.Match, id); ok {
+            return p.Vendor
+        }
+    }
+    return ""
+}
+
+// fieldMapper renames the keys of readings from devices with a vendor
+// profile to the reading fields before they are decoded, so a vendor's
+// devices can be taken on with a file entry instead of a parser. It can be
+// reloaded while the server runs.
+type fieldMapper struct {
+    path string
+
+    mu    sync.RWMutex
+    rules fieldMapFile
+}
+
+// loadFieldMapper reads the vendor profiles from path.
+func loadFieldMapper(path string) (*fieldMapper, error) {
+    m := &fieldMapper{path: path}
+    rules, err := m.load()
+    if err != nil {
+        return nil, err
+    }
+    m.set(rules)
+    return m, nil
+}
+
+// load reads and checks the file without applying it.
+func (m *fieldMapper) load() (fieldMapFile, error) {
+    var f fieldMapFile
+    data, err := ioutil.ReadFile(m.path)
+    if err != nil {
+        return f, err
+    }
+    if err := yaml.Unmarshal(data, &f); err != nil {
+        return f, fmt.Errorf("error parsing %s: %v", m.path, err)
+    }
+    for vendor, keys := range f.Vendors {
+        for key, field := range keys {
+            if key == "" || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") || strings.Contains(key, "..") {
+                return f, fmt.Errorf("invalid key %q for vendor %s in %s", key, vendor, m.path)
+            }
+            found := false
+            for _, t := range fieldMapTargets {
+                found = found || t == field
+            }
+            if !found {
+                return f, fmt.Errorf("invalid field %q for key %s of vendor %s in %s: use %s", field, key, vendor, m.path, strings.Join(fieldMapTargets, ", "))
+            }
+        }
+    }
+    for id, vendor := range f.Devices {
+        if _, ok := f.Vendors[vendor]; !ok {
+            return f, fmt.Errorf("device %s has unknown vendor %q in %s", id, vendor, m.path)
+        }
+    }
+    for _, p := range f.Patterns {
+        if _, err := path.Match(p.Match, ""); err != nil || p.Match == "" {
+            return f, fmt.Errorf("invalid pattern %q in %s", p.Match, m.path)
+        }
+        if _, ok := f.Vendors[p.Vendor]; !ok {
+            return f, fmt.Errorf("pattern %s has unknown vendor %q in %s", p.Match, p.Vendor, m.path)
+        }
+    }
+    return f, nil
+}
+
+// set replaces the rules.
+func (m *fieldMapper) set(rules fieldMapFile) {
+    m.mu.Lock()
+    m.rules = rules
+    m.mu.Unlock()
+    slog.Info("loaded field mapping", "file", m.path, "vendors", len(rules.Vendors), "devices", len(rules.Devices), "patterns", len(rules.Patterns))
+}
+
+// current returns the rules in effect.
+func (m *fieldMapper) current() fieldMapFile {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    return m.rules
+}
+
+// apply renames the vendor keys in a JSON or CBOR object body from device id
+// and returns it with the vendor, or "" for a device without one. A body that
+// holds both a vendor key and the field it maps to is an error, since either
+// could be the reading. A body that does not decode is returned as it is, for
+// the decoder to reject.
+func (m *fieldMapper) apply(id string, body []byte, mediaType string) ([]byte, string, error) {
+    rules := m.current()
+    vendor := rules.vendor(id)
+    if vendor == "" {
+        return body, "", nil
+    }
+    var obj map[string]any
+    switch mediaType {
+    case mediaJSON, mediaNDJSON, "":
+        // Numbers are kept as sent, so a large ts or seq is not rounded
+        dec := json.NewDecoder(bytes.NewReader(body))
+        dec.UseNumber()
+        if err := dec.Decode(&obj); err != nil || obj == nil {
+            return body, vendor, nil
+        }
+    case mediaCBOR:
+        if err := cborToJSON.Unmarshal(body, &obj); err != nil || obj == nil {
+            return body, vendor, nil
+        }
+    default:
+        return body, vendor, nil
+    }
+
+    keys := rules.Vendors[vendor]
+    names := make([]string, 0, len(keys))
+    for key := range keys {
+        names = append(names, key)
+    }
+    sort.Strings(names)
+    changed := false
+    for _, key := range names {
+        v, ok := takeField(obj, key)
+        if !ok {
+            continue
+        }
+        field := keys[key]
+        if _, dup := obj[field]; dup {
+            return nil, vendor, fmt.Errorf("vendor %s maps %s to %s, but the reading has %s already", vendor, key, field, field)
+        }
+        obj[field] = v
+        changed = true
+    }
+    if !changed {
+        return body, vendor, nil
+    }
+    if mediaType == mediaCBOR {
+        out, err := cbor.Marshal(obj)
+        return out, vendor, err
+    }
+    out, err := json.Marshal(obj)
+    return out, vendor, err
+}
+
+// takeField removes the value at a dotted key from obj and returns it.
+func takeField(obj map[string]any, key string) (any, bool) {
+    parts := strings.Split(key, ".")
+    for _, p := range parts[:len(parts)-1] {
+        next, ok := obj[p].(map[string]any)
+        if !ok {
+            return nil, false
+        }
+        obj = next
+    }
+    last := parts[len(parts)-1]
+    v, ok := obj[last]
+    if ok {
+        delete(obj, last)
+    }
+    return v, ok
+}
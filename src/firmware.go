@@ -0,0 +1,168 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync/atomic"
+
+    "gopkg.in/yaml.v3"
+)
+
+// firmwareManifest is the -firmware file, describing the image devices should
+// run:
+//
+//  version: 2.4.1
+//  url: https://fw.example.com/temp-2.4.1.bin
+//  sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//  min_version: 2.0.0
+type firmwareManifest struct {
+    Version    string `yaml:"version"`
+    URL        string `yaml:"url"`
+    SHA256     string `yaml:"sha256"`
+    MinVersion string `yaml:"min_version"`
+
+    version, min firmwareVersion // parsed at load
+}
+
+// firmwareUpdate is the update object in the reply to a reading from a device
+// running older firmware than the manifest's.
+type firmwareUpdate struct {
+    Version   string `json:"version"`
+    URL       string `json:"url"`
+    SHA256    string `json:"sha256"`
+    Mandatory bool   `json:"mandatory,omitempty"` // the device runs less than min_version
+}
+
+// firmwareVersion is a dotted version such as 2.4.1, compared number by
+// number, so 2.10 is newer than 2.9.
+type firmwareVersion []int
+
+// parseFirmwareVersion reads a version of dot-separated numbers, with an
+// optional leading v.
+func parseFirmwareVersion(s string) (firmwareVersion, error) {
+    s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+    if s == "" {
+        return nil, fmt.Errorf("empty version")
+    }
+    var v firmwareVersion
+    for _, part := range strings.Split(s, ".") {
+        n, err := strconv.Atoi(part)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("invalid version %q: want numbers separated by dots, such as 2.4.1", s)
+        }
+        v = append(v, n)
+    }
+    return v, nil
+}
+
+// less reports whether v is older than o; missing numbers count as 0, so 2.4
+// and 2.4.0 are the same version.
+func (v firmwareVersion) less(o firmwareVersion) bool {
+    for i := 0; i < len(v) || i < len(o); i++ {
+        var a, b int
+        if i < len(v) {
+            a = v[i]
+        }
+        if i < len(o) {
+            b = o[i]
+        }
+        if a != b {
+            return a < b
+        }
+    }
+    return false
+}
+
+// firmwareAnnouncer tells devices about the firmware in the -firmware
+// manifest in the replies to their readings. The manifest can be reloaded
+// while the server runs.
+type firmwareAnnouncer struct {
+    path     string
+    manifest atomic.Pointer[firmwareManifest]
+}
+
+// loadFirmware reads the manifest at path.
+func loadFirmware(path string) (*firmwareAnnouncer, error) {
+    f := &firmwareAnnouncer{path: path}
+    m, err := f.load()
+    if err != nil {
+        return nil, err
+    }
+    f.set(m)
+    return f, nil
+}
+
+// load reads and checks the manifest without applying it.
+func (f *firmwareAnnouncer) load() (*firmwareManifest, error) {
+    data, err := ioutil.ReadFile(f.path)
+    if err != nil {
+        return nil, err
+    }
+    var m firmwareManifest
+    if err := yaml.Unmarshal(data, &m); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", f.path, err)
+    }
+    if m.version, err = parseFirmwareVersion(m.Version); err != nil {
+        return nil, fmt.Errorf("invalid firmware version in %s: %v", f.path, err)
+    }
+    if m.MinVersion != "" {
+        if m.min, err = parseFirmwareVersion(m.MinVersion); err != nil {
+            return nil, fmt.Errorf("invalid firmware min_version in %s: %v", f.path, err)
+        }
+        if m.version.less(m.min) {
+            return nil, fmt.Errorf("invalid firmware manifest %s: min_version %s is newer than version %s", f.path, m.MinVersion, m.Version)
+        }
+    }
+    if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return nil, fmt.Errorf("invalid firmware url %q in %s: want an http or https URL", m.URL, f.path)
+    }
+    if b, err := hex.DecodeString(m.SHA256); err != nil || len(b) != 32 {
+        return nil, fmt.Errorf("invalid firmware sha256 in %s: want 64 hex digits", f.path)
+    }
+    m.SHA256 = strings.ToLower(m.SHA256)
+    return &m, nil
+}
+
+// set replaces the manifest with m.
+func (f *firmwareAnnouncer) set(m *firmwareManifest) {
+    f.manifest.Store(m)
+    slog.Info("loaded firmware manifest", "file", f.path, "version", m.Version, "min_version", m.MinVersion)
+}
+
+// current returns the manifest in effect.
+func (f *firmwareAnnouncer) current() *firmwareManifest {
+    return f.manifest.Load()
+}
+
+// update returns the update for a device reporting running in
+// X-Firmware-Version, or nil if it is up to date. A device that does not say
+// what it runs, or says it in a form the server cannot compare, is told
+// nothing, rather than risk flashing it with the image it already has.
+func (f *firmwareAnnouncer) update(running string) *firmwareUpdate {
+    v, err := parseFirmwareVersion(running)
+    if err != nil {
+        return nil
+    }
+    m := f.current()
+    if !v.less(m.version) {
+        return nil
+    }
+    return &firmwareUpdate{
+        Version:   m.Version,
+        URL:       m.URL,
+        SHA256:    m.SHA256,
+        Mandatory: m.min != nil && v.less(m.min),
+    }
+}
+
+// runningFirmware is the version the device says it runs, from
+// X-Firmware-Version.
+func runningFirmware(r *http.Request) string {
+    return r.Header.Get("X-Firmware-Version")
+}
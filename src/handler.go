@@ -0,0 +1,1077 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// app holds the state shared by the HTTP handlers.
+type app struct {
+    cfg     Config
+    sinks   []configuredSink
+    keys    *apiKeys
+    authdb  *authDB
+    metrics *metrics
+    limiter *ipLimiter
+    queue   *workQueue
+    access  *accessLog
+    schema  *readingSchema
+    idem    *idempotencyCache
+    recent  *recentReadings
+    sizes   *sizeHistogram
+    stats   *aggregator
+    stale   *staleTracker
+    dedup   *dedupFilter
+    ready   *readiness
+    seq     *seqTracker
+    redact  *redactor
+    enrich  *enricher
+    fields  *fieldMapper
+    configs *deviceConfigs
+    fw      *firmwareAnnouncer
+    types   *typeAllowlist
+    watch   *watchdog
+
+    transform *transform
+    dead      *deadLetterWriter
+    tracing   *tracing
+    signer    *hmacSigner
+    respSign  *responseSigner
+    crl       *crlChecker
+    pins      *certPins
+    maint     maintenance
+    certs     *certReloader
+    ocsp      *ocspStapler
+    tickets   *ticketKeys
+    limits    *deviceLimits
+    routeAuth *routeAuth
+    ws        *wsHub
+    filter    *ipFilter
+    load      *loadMonitor
+    bodies    *bodyBudget
+    admin     *adminAccess
+    audit     *auditLog
+    chaos     *faultInjector
+    started   time.Time
+
+    reloadMu sync.Mutex // one reload at a time, from SIGHUP or /admin/reload
+
+    // Cancelled at shutdown, so NDJSON streams finish their current line
+    // and reply instead of holding the drain up
+    streamsEnd context.Context
+    endStreams context.CancelFunc
+}
+
+// newApp opens the data file and loads the API keys named in cfg.
+func newApp(cfg Config) (*app, error) {
+    a := &app{cfg: cfg, metrics: newMetrics(), started: time.Now()}
+    a.streamsEnd, a.endStreams = context.WithCancel(context.Background())
+
+    // Tracing is a no-op unless an OTLP collector is configured
+    t, err := newTracing(cfg.OTLPEndpoint)
+    if err != nil {
+        return nil, err
+    }
+    a.tracing = t
+    if t.enabled() {
+        slog.Info("exporting traces via OTLP", "endpoint", cfg.OTLPEndpoint)
+    }
+
+    // Fields listed in -redact are masked wherever readings are written out in the clear
+    if cfg.Redact != "" {
+        r, err := newRedactor(cfg.Redact)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.redact = r
+    }
+
+    // Only the media types -accept-types lists are taken, by default every one parsed
+    types, err := newTypeAllowlist(cfg.AcceptTypes)
+    if err != nil {
+        a.Close()
+        return nil, err
+    }
+    a.types = types
+
+    // Body sizes are counted for GET /stats/sizes, to help pick -maxbody
+    sizes, err := newSizeHistogram(cfg.SizeBuckets, cfg.MaxBody)
+    if err != nil {
+        a.Close()
+        return nil, err
+    }
+    a.sizes = sizes
+
+    // Open every -sink up front so we never silently drop data
+    var names []string
+    for _, spec := range cfg.Sinks {
+        sink, err := newSink(cfg, spec)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        // A collector that stops answering is cut off instead of stalling every request
+        if spec.Kind == "http" && cfg.BreakerFailures > 0 {
+            b := newBreakerSink(sink, spec.name(), cfg.BreakerFailures, cfg.BreakerCooldown)
+            a.metrics.watchBreaker(b)
+            sink = b
+        }
+        a.sinks = append(a.sinks, configuredSink{Sink: sink, name: spec.name(), optional: spec.Optional})
+        if d, ok := sink.(*dataWriter); ok {
+            d.redact = a.redact
+            if spec.Kind == "file" {
+                a.metrics.watchDataFile(d)
+            }
+        }
+        name := spec.name()
+        if spec.Optional {
+            name += " (optional)"
+        }
+        names = append(names, name)
+    }
+    if cfg.Chaos {
+        a.chaos = newFaultInjector(cfg)
+        a.metrics.watchFaults(a.chaos)
+        slog.Warn("CHAOS MODE: ingestion requests are DELAYED AND FAILED ON PURPOSE; do not run this in production",
+            "delay", cfg.InjectDelay.String(), "delay_rate", cfg.InjectDelayRate, "error_rate", cfg.InjectErrorRate, "status", cfg.InjectStatus)
+    }
+    if cfg.Echo {
+        slog.Warn("ECHO MODE: readings are validated and echoed back but NOTHING IS STORED; do not run this in production")
+    } else {
+        slog.Info("storing readings", "sinks", strings.Join(names, ", "))
+    }
+
+    // Compile the schema once so a bad file stops the server at startup
+    if cfg.Schema != "" {
+        schema, err := compileSchema(cfg.Schema)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error compiling schema %s: %v", cfg.Schema, err)
+        }
+        a.schema = schema
+        slog.Info("validating readings against JSON Schema", "schema", cfg.Schema)
+    }
+
+    // Payloads that cannot be processed are kept here instead of being dropped
+    if cfg.DeadLetter != "" {
+        dead, err := openDeadLetterWriter(cfg.DeadLetter)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error opening dead-letter file %s: %v", cfg.DeadLetter, err)
+        }
+        a.dead = dead
+    }
+
+    // Parse the transform template once; a syntax error stops the server at startup
+    if cfg.TransformTemplate != "" {
+        t, err := loadTransform(cfg.TransformTemplate)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading transform template %s: %v", cfg.TransformTemplate, err)
+        }
+        a.transform = t
+        slog.Info("transforming readings with template", "template", cfg.TransformTemplate)
+    }
+
+    // The access log is kept apart from the structured data logs
+    if cfg.AccessLog != "" {
+        access, err := openAccessLog(cfg.AccessLog)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error opening access log %s: %v", cfg.AccessLog, err)
+        }
+        a.access = access
+    }
+
+    // The admin endpoints exist only for those -admin names
+    if cfg.Admin != "" {
+        admin, err := parseAdmin(cfg.Admin, cfg.ClientCA != "", cfg.TrustProxy)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.admin = admin
+        a.metrics.watchMaintenance(&a.maint)
+        slog.Info("admin endpoints enabled", "admitted", admin.String())
+    }
+    if cfg.AuditLog != "" {
+        audit, err := openAuditLog(cfg.AuditLog)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error opening audit log %s: %v", cfg.AuditLog, err)
+        }
+        a.audit = audit
+    }
+
+    // Load the allowed API keys; without a keyfile the endpoint stays open
+    if cfg.KeyFile != "" {
+        keys, err := newAPIKeys(cfg.KeyFile)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading key file %s: %v", cfg.KeyFile, err)
+        }
+        a.keys = keys
+        slog.Info("API key authentication enabled", "keys", len(keys.current()))
+    }
+
+    // Or look each device's secret up in a database
+    if cfg.AuthDB != "" {
+        db, err := openAuthDB(cfg.AuthDB, cfg.AuthDBQuery, cfg.AuthDBKeyQuery, cfg.AuthDBTTL)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.authdb = db
+        slog.Info("device database authentication enabled", "ttl", cfg.AuthDBTTL.String(), "payload_decryption", cfg.AuthDBKeyQuery != "")
+    }
+
+    // Revoked device certificates are refused during the handshake
+    if cfg.CRL != "" {
+        crl, err := newCRLChecker(cfg.CRL, cfg.ClientCA, cfg.CRLRefresh)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.crl = crl
+    }
+
+    // Pinned devices are admitted only with a certificate listed by fingerprint
+    if cfg.CertPins != "" {
+        pins, err := loadCertPins(cfg.CertPins)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading certificate fingerprints: %v", err)
+        }
+        a.pins = pins
+    }
+
+    // With a shared secret every body must carry a matching X-Signature
+    if cfg.HMACSecret != "" || cfg.HMACSecretFile != "" {
+        secret, err := loadHMACSecret(cfg.HMACSecret, cfg.HMACSecretFile)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading HMAC secret: %v", err)
+        }
+        a.signer = &hmacSigner{secret: secret}
+        slog.Info("HMAC signature verification enabled")
+    }
+
+    // Responses are signed so devices can tell they came from this server
+    if cfg.ResponseKey != "" || cfg.ResponseKeyPEM != "" {
+        key, err := loadResponseKey(cfg.ResponseKey, cfg.ResponseKeyPEM)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading response signing key: %v", err)
+        }
+        a.respSign = &responseSigner{key: key}
+        slog.Info("signing responses with ed25519", "public_key", a.respSign.publicKey())
+    }
+
+    // Individual devices may override the global body size and rate
+    if cfg.DeviceLimits != "" {
+        limits, err := loadDeviceLimits(cfg.DeviceLimits)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading device limits: %v", err)
+        }
+        a.limits = limits
+    }
+
+    // Readings are annotated with the metadata of the device sending them
+    if cfg.Enrich != "" {
+        e, err := loadEnricher(cfg.Enrich)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading enrichment rules: %v", err)
+        }
+        a.enrich = e
+    }
+
+    // Vendor keys are renamed to the reading fields per device
+    if cfg.FieldMap != "" {
+        m, err := loadFieldMapper(cfg.FieldMap)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading field mapping: %v", err)
+        }
+        a.fields = m
+    }
+
+    // Replies to readings carry the configuration waiting for the device
+    if cfg.DeviceConfig != "" {
+        c, err := loadDeviceConfigs(cfg.DeviceConfig)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading device configuration: %v", err)
+        }
+        a.configs = c
+    }
+
+    // And the firmware they should be running
+    if cfg.Firmware != "" {
+        fw, err := loadFirmware(cfg.Firmware)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading firmware manifest: %v", err)
+        }
+        a.fw = fw
+    }
+
+    // Devices that stop reporting raise an alert until they report again
+    if cfg.Watchdog != "" {
+        wd, err := newWatchdog(cfg.Watchdog, cfg.WatchdogWebhook)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading watchdog devices: %v", err)
+        }
+        a.watch = wd
+        a.metrics.watchWatchdog(wd)
+    }
+
+    // Each route needs its own mix of credentials, by default every configured one
+    a.routeAuth = defaultRouteAuth(cfg)
+    if cfg.RouteAuth != "" {
+        ra, err := loadRouteAuth(cfg.RouteAuth, cfg)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error loading route authentication: %v", err)
+        }
+        a.routeAuth = ra
+    }
+
+    // Network allow and deny lists are checked before anything else
+    if len(cfg.AllowCIDR) > 0 || len(cfg.DenyCIDR) > 0 {
+        a.filter = &ipFilter{allow: cfg.AllowCIDR, deny: cfg.DenyCIDR, trustProxy: cfg.TrustProxy}
+        slog.Info("IP filtering enabled", "allow", cfg.AllowCIDR.String(), "deny", cfg.DenyCIDR.String(), "trust_proxy", cfg.TrustProxy)
+    }
+
+    // Per-IP rate limiting is off unless a rate is given or a device has its own
+    if cfg.Rate > 0 || a.limits != nil {
+        a.limiter = newIPLimiter(cfg.Rate, cfg.Burst)
+        a.limiter.devices = a.limits
+        a.limiter.trustProxy = cfg.TrustProxy
+        slog.Info("rate limiting enabled", "rate", cfg.Rate, "burst", a.limiter.burst, "device_limits", cfg.DeviceLimits)
+    }
+
+    // Readings are also written to InfluxDB when configured
+    if cfg.InfluxURL != "" {
+        influx, err := newInfluxSink(cfg)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.sinks = append(a.sinks, configuredSink{Sink: influx, name: "influxdb"})
+        slog.Info("writing readings to InfluxDB", "url", cfg.InfluxURL, "org", cfg.InfluxOrg, "bucket", cfg.InfluxBucket)
+    }
+
+    // And published to Kafka; undeliverable messages end up with the other dead letters
+    if cfg.KafkaBrokers != "" {
+        producer, err := newKafkaSink(cfg, func(j job, err error) {
+            a.deadLetter(j.origin, j.dt, "kafka: "+err.Error(), j.body)
+        })
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.sinks = append(a.sinks, configuredSink{Sink: producer, name: "kafka"})
+        slog.Info("publishing readings to Kafka", "brokers", cfg.KafkaBrokers, "topic", cfg.KafkaTopic)
+    }
+
+    // And kept in a local SQLite file, for gateways without a database server
+    if cfg.SQLitePath != "" {
+        db, err := openSQLiteSink(cfg.SQLitePath)
+        if err != nil {
+            a.Close()
+            return nil, fmt.Errorf("error opening SQLite database %s: %v", cfg.SQLitePath, err)
+        }
+        db.redact = a.redact
+        a.sinks = append(a.sinks, configuredSink{Sink: db, name: "sqlite"})
+        slog.Info("storing readings in SQLite", "path", cfg.SQLitePath)
+    }
+
+    // GET /readyz waits for the sinks that connect lazily, once main starts the checks
+    a.ready = newReadiness(a.sinks, cfg.ReadyTimeout)
+
+    // Retries carrying an Idempotency-Key are answered from this cache
+    if cfg.IdempotencySize > 0 {
+        a.idem = newIdempotencyCache(cfg.IdempotencySize, cfg.IdempotencyTTL)
+    }
+
+    // Readings that go back in time are refused or flagged per device
+    if cfg.StaleReadings != "off" {
+        st, err := newStaleTracker(cfg.StaleDevices, cfg.StaleTolerance, cfg.StaleMaxSkew, cfg.StaleState)
+        if err != nil {
+            a.Close()
+            return nil, err
+        }
+        a.stale = st
+        a.metrics.watchStale(st)
+        slog.Info("checking reading order per device", "action", cfg.StaleReadings, "tolerance", cfg.StaleTolerance, "state", cfg.StaleState)
+    }
+
+    // Readings that barely changed since the last one stored are dropped per device
+    if cfg.DedupThreshold > 0 {
+        a.dedup = newDedupFilter(cfg.DedupThreshold, cfg.DedupDevices)
+        a.metrics.watchDedup(a.dedup)
+    }
+
+    // Readings missing from each device's seq numbers are counted
+    if cfg.SeqWindow > 0 {
+        a.seq = newSeqTracker(cfg.SeqWindow, cfg.SeqDevices)
+        a.metrics.watchSeq(a.seq)
+        slog.Info("counting readings missing from device sequences", "window", cfg.SeqWindow)
+    }
+
+    // The last few readings per device are kept for GET /devices/{id}/recent
+    if cfg.RecentDepth > 0 {
+        a.recent = newRecentReadings(cfg.RecentDepth)
+    }
+
+    // And summed per device over a sliding window for GET /devices/{id}/stats
+    if cfg.StatsWindow > 0 {
+        a.stats = newAggregator(cfg.StatsWindow, cfg.StatsBucket)
+    }
+
+    // Devices holding a WebSocket open can also receive commands
+    var cors *corsPolicy
+    if cfg.CORSOrigins != "" {
+        cors = newCORSPolicy(cfg.CORSOrigins)
+    }
+    a.ws = newWSHub(cors)
+
+    // With workers configured, storage happens off the request path
+    if cfg.Workers > 0 {
+        var delay *codel
+        if cfg.CodelTarget > 0 {
+            delay = newCodel(cfg.CodelTarget, cfg.CodelInterval)
+            a.metrics.watchCodel(delay)
+        }
+        a.queue = newWorkQueue(cfg.QueueDepth, cfg.Workers, delay, a.store, func(j job) {
+            a.deadLetter(j.origin, j.dt, "shutdown: processing queue did not drain within -drain-timeout", j.body)
+        })
+        slog.Info("asynchronous processing enabled", "workers", cfg.Workers, "queue_depth", cfg.QueueDepth)
+    }
+
+    // Devices are told to slow down while the queue is backed up or the sinks are failing
+    if (a.queue != nil && cfg.OverloadHigh > 0) || cfg.OverloadErrorRate > 0 {
+        a.load = newLoadMonitor(a.queue, cfg.OverloadHigh, cfg.OverloadLow, cfg.OverloadErrorRate)
+        a.metrics.watchLoad(a.load)
+    }
+
+    // Bodies in memory are capped as a whole, however many connections are open
+    if cfg.BodyMemory > 0 {
+        a.bodies = newBodyBudget(cfg.BodyMemory, cfg.BodyWait)
+        a.metrics.watchBodies(a.bodies)
+    }
+    return a, nil
+}
+
+// Close releases the files and goroutines held by the app. Queued readings
+// are drained before the sinks they are written to are closed.
+func (a *app) Close() error {
+    // WebSocket readings still in flight go to the queue, so it closes after them
+    if a.ws != nil {
+        a.ws.Close()
+    }
+    if a.queue != nil {
+        a.queue.Close(a.cfg.DrainTimeout)
+    }
+    if a.limiter != nil {
+        a.limiter.Close()
+    }
+    if a.stats != nil {
+        a.stats.Close()
+    }
+    if a.stale != nil {
+        if err := a.stale.Close(); err != nil {
+            slog.Error("error saving stale reading state", "file", a.cfg.StaleState, "err", err)
+        }
+    }
+    if a.watch != nil {
+        a.watch.Close()
+    }
+    if a.crl != nil {
+        a.crl.Close()
+    }
+    if a.certs != nil {
+        a.certs.Close()
+    }
+    if a.ocsp != nil {
+        a.ocsp.Close()
+    }
+    if a.access != nil {
+        a.access.Close()
+    }
+    if a.audit != nil {
+        a.audit.Close()
+    }
+    if a.tracing != nil {
+        a.tracing.Close()
+    }
+    if a.authdb != nil {
+        a.authdb.Close()
+    }
+    if a.ready != nil {
+        a.ready.Close()
+    }
+    var err error
+    for _, sink := range a.sinks {
+        if c, ok := sink.Sink.(io.Closer); ok {
+            if cerr := c.Close(); cerr != nil && err == nil {
+                err = cerr
+            }
+        }
+    }
+
+    // Sinks that flush on Close may still dead-letter what they cannot deliver
+    if a.dead != nil {
+        a.dead.Close()
+    }
+    return err
+}
+
+// handler returns the complete HTTP handler: every route plus the middleware
+// that applies to all of them.
+func (a *app) handler() http.Handler {
+    return a.serverChain().then(a.routes())
+}
+
+// routes registers every endpoint on a new mux.
+func (a *app) routes() *http.ServeMux {
+    ingest := a.ingestChain()
+    mux := http.NewServeMux()
+    mux.Handle("/healthz", a.authenticate(http.HandlerFunc(a.handleHealthz)))
+    mux.Handle("/readyz", a.authenticate(http.HandlerFunc(a.handleReadyz)))
+    mux.Handle("/version", a.authenticate(http.HandlerFunc(handleVersion)))
+    mux.Handle("/metrics", a.authenticate(a.metrics.handler(a.respSign != nil)))
+    mux.Handle("/stats/sizes", a.authenticate(http.HandlerFunc(a.handleSizes)))
+    if a.seq != nil {
+        mux.Handle("/stats/gaps", a.authenticate(http.HandlerFunc(a.handleGaps)))
+    }
+    if a.admin != nil {
+        mux.Handle("/admin/reload", a.adminEndpoint(false, a.handleReload))
+        mux.Handle("/admin/maintenance", a.adminEndpoint(false, a.handleMaintenance))
+        if a.recent != nil {
+            mux.Handle("/export", a.adminEndpoint(true, a.handleExport))
+        }
+        mux.Handle("/devices/{id}/commands", a.adminEndpoint(false, a.handleCommand))
+    }
+    for _, dt := range deviceTypes {
+        mux.Handle(dt.Path, ingest.then(a.ingestHandler(dt)))
+    }
+    mux.Handle("/upload/file/{name}", ingest.then(http.HandlerFunc(a.handleUpload)))
+    mux.Handle("/ws", ingest.then(http.HandlerFunc(a.handleWS)))
+    if a.recent != nil {
+        // Reading back data needs the same credentials as sending it
+        mux.Handle("/devices/{id}/recent", ingest.then(http.HandlerFunc(a.handleRecent)))
+    }
+    if a.stats != nil {
+        mux.Handle("/devices/{id}/stats", ingest.then(http.HandlerFunc(a.handleStats)))
+    }
+
+    // The root keeps accepting temperature readings for existing firmware, and
+    // describes the server to a browser
+    root := deviceTypes[0]
+    root.Methods = []string{http.MethodPost, http.MethodGet, http.MethodHead}
+    mux.Handle("/{$}", a.landing(ingest.then(a.ingestHandler(root))))
+    mux.HandleFunc("/", handleNotFound)
+    return mux
+}
+
+// limitHeaders answers 431 to requests with more than max header lines. The
+// total size is already capped by -max-header-bytes; this stops a header block
+// of many tiny fields that each cost a map entry and a log line.
+func limitHeaders(max int, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        n := 0
+        for _, values := range r.Header {
+            n += len(values)
+        }
+        if n > max {
+            slog.WarnContext(r.Context(), "rejected request with too many headers", "remote_addr", r.RemoteAddr, "headers", n, "limit", max)
+            writeError(w, http.StatusRequestHeaderFieldsTooLarge, fmt.Sprintf("Too many request headers: %d, the limit is %d", n, max))
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// response is the JSON body returned for every ingestion request.
+type response struct {
+    Status       string `json:"status"`
+    Received     int    `json:"received,omitempty"`
+    Deduplicated bool   `json:"deduplicated,omitempty"`
+    SHA256       string `json:"sha256,omitempty"`
+
+    Results []batchResult `json:"results,omitempty"`
+
+    // With -device-config, a reading's reply carries the device's pending
+    // configuration: an empty object once it runs ConfigVersion
+    Config        json.RawMessage `json:"config,omitempty"`
+    ConfigVersion int             `json:"config_version,omitempty"`
+
+    // With -firmware, and the newer firmware when the device runs older
+    Update *firmwareUpdate `json:"update,omitempty"`
+
+    // Success responses carry the server clock so devices without one can set
+    // theirs, and echo the reading's ts so they can work out their skew
+    ServerTime   string `json:"server_time,omitempty"`
+    ServerTimeMS int64  `json:"server_time_ms,omitempty"`
+    DeviceTS     int64  `json:"device_ts,omitempty"`
+}
+
+// withServerTime stamps resp with the current UTC time and the device-reported
+// timestamp, if there was one.
+func withServerTime(resp response, deviceTS int64) response {
+    now := time.Now().UTC()
+    resp.ServerTime = now.Format(time.RFC3339Nano)
+    resp.ServerTimeMS = now.UnixMilli()
+    resp.DeviceTS = deviceTS
+    return resp
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// allowMethods answers OPTIONS with 204 and any method outside methods with
+// 405, both carrying an Allow header listing methods. It reports whether the
+// handler should go on to serve the request.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+    for _, m := range methods {
+        if r.Method == m {
+            return true
+        }
+    }
+    allow := strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", ")
+    w.Header().Set("Allow", allow)
+    if r.Method == http.MethodOptions {
+        w.WriteHeader(http.StatusNoContent)
+        return false
+    }
+    writeError(w, http.StatusMethodNotAllowed, "Method not allowed; use "+strings.Join(methods, " or "))
+    return false
+}
+
+// readBody reads body, transparently decompressing it when encoding is gzip.
+// The limit also applies to the decompressed size so a small gzip bomb cannot
+// expand past it; exceeding it yields an *http.MaxBytesError either way. size
+// is the request's Content-Length, or -1 when it is not known in advance.
+func readBody(body io.Reader, encoding string, limit, size int64) ([]byte, error) {
+    if encoding != "gzip" {
+        // A declared length is read into one exact allocation instead of
+        // growing a slice to it
+        if size >= 0 && size <= limit {
+            data := make([]byte, size)
+            if _, err := io.ReadFull(body, data); err != nil {
+                if errors.Is(err, io.EOF) {
+                    err = io.ErrUnexpectedEOF
+                }
+                return nil, err
+            }
+            return data, nil
+        }
+        return readPooled(body)
+    }
+    gz, err := gzip.NewReader(body)
+    if err != nil {
+        return nil, err
+    }
+    defer gz.Close()
+
+    data, err := readPooled(io.LimitReader(gz, limit+1))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(data)) > limit {
+        return nil, &http.MaxBytesError{Limit: limit}
+    }
+    return data, nil
+}
+
+// bodyBuffers holds the buffers bodies of unknown length are read into.
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBuffer keeps the occasional huge body from pinning its buffer.
+const maxPooledBuffer = 1 << 20
+
+// readPooled reads r to the end through a pooled buffer and returns a copy of
+// exactly the bytes read, since the reading outlives the request.
+func readPooled(r io.Reader) ([]byte, error) {
+    buf := bodyBuffers.Get().(*bytes.Buffer)
+    defer func() {
+        if buf.Cap() <= maxPooledBuffer {
+            buf.Reset()
+            bodyBuffers.Put(buf)
+        }
+    }()
+    if _, err := buf.ReadFrom(r); err != nil {
+        return nil, err
+    }
+    return bytes.Clone(buf.Bytes()), nil
+}
+
+// isCorruptGzip reports whether err came from a malformed gzip stream rather than the connection.
+func isCorruptGzip(err error) bool {
+    var corrupt flate.CorruptInputError
+    return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+        errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt)
+}
+
+// handleHealthz is the liveness probe; deliberately outside the data path and
+// open to unauthenticated callers.
+func (a *app) handleHealthz(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintln(w, "ok")
+}
+
+// handleNotFound answers paths that match no endpoint.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+    writeError(w, http.StatusNotFound, "Not found")
+}
+
+// ingestHandler returns the handler accepting readings for one device type.
+func (a *app) ingestHandler(dt deviceType) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        a.handlePost(w, r, dt)
+    }
+}
+
+// handlePost accepts a reading from a device. Authentication has already been
+// checked by the middleware in ingestChain.
+func (a *app) handlePost(w http.ResponseWriter, r *http.Request, dt deviceType) {
+    // Handle POST requests, or whatever the device type allows
+    if !allowMethods(w, r, dt.methods()...) {
+        return
+    }
+
+    // Nothing is taken during a maintenance window, and the body is not even read
+    if a.maint.refuse(w) {
+        return
+    }
+
+    // Tell devices to back off while the queue is backed up or the sinks are failing
+    if a.load != nil && a.load.refuse(w) {
+        return
+    }
+
+    // Incoming requests are described the same way for storage and dead letters
+    o := origin{
+        Transport:  "https",
+        RemoteAddr: r.RemoteAddr,
+        ClientCN:   clientName(r),
+        DeviceID:   r.Header.Get("X-Device-ID"),
+        MediaType:  mediaType(r),
+        Header:     r.Header,
+        RequestID:  requestID(r.Context()),
+    }
+
+    // The body limit may be raised or lowered for this particular device
+    maxBody := a.maxBody(r)
+
+    // Each device type declares which payload formats it accepts, and
+    // -accept-types may narrow that down for the whole server. With -sniff, a
+    // structured body without a usable Content-Type is recognized once read
+    untyped := r.Header.Get("Content-Type") == "" || o.MediaType == mediaOctetStream
+    sniff := a.cfg.Sniff && untyped && dt.accepts(mediaJSON)
+    if r.Header.Get("Content-Type") == "" && !sniff {
+        writeError(w, http.StatusUnsupportedMediaType, a.types.refusal("Content-Type header is required, one of: ", dt))
+        return
+    }
+    stream := o.MediaType == mediaNDJSON && dt.accepts(mediaJSON)
+    if !sniff && (!dt.accepts(o.MediaType) && !stream || !a.types.allows(o.MediaType)) {
+        if a.dead != nil {
+            a.deadLetter(o, dt, "unsupported Content-Type "+r.Header.Get("Content-Type"), deadLetterBody(r.Body, maxBody))
+        }
+        writeError(w, http.StatusUnsupportedMediaType, a.types.refusal("Content-Type must be one of: ", dt))
+        return
+    }
+
+    // Only identity and gzip bodies are understood
+    encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+    if encoding != "" && encoding != "identity" && encoding != "gzip" {
+        if a.dead != nil {
+            a.deadLetter(o, dt, "unsupported Content-Encoding "+encoding, deadLetterBody(r.Body, maxBody))
+        }
+        writeError(w, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding: "+encoding)
+        return
+    }
+
+    // Room for the body is reserved before any of it is read; a stream keeps
+    // its reservation, the size of its line buffer, until it ends
+    if a.bodies != nil {
+        release, ok := a.bodies.acquire(w, r, a.bodies.weight(r, encoding, maxBody))
+        if !ok {
+            return
+        }
+        defer release()
+    }
+
+    digests, ok := requestDigests(w, r)
+    if !ok {
+        return
+    }
+
+    // NDJSON is processed line by line as it arrives rather than read whole;
+    // a signature, digest or encryption covers the whole body, so it cannot be streamed
+    if stream {
+        if a.signer != nil || a.cfg.AuthDBKeyQuery != "" {
+            writeError(w, http.StatusUnsupportedMediaType, "NDJSON streams cannot be signed or encrypted; send JSON instead")
+            return
+        }
+        if digests != nil {
+            writeError(w, http.StatusBadRequest, "NDJSON streams cannot carry a Digest; send JSON instead")
+            return
+        }
+        a.handleStream(w, r, o, dt, encoding, maxBody)
+        return
+    }
+
+    // A signed endpoint refuses unsigned requests before reading anything
+    var sig []byte
+    if a.signer != nil {
+        var ok bool
+        if sig, ok = signature(r); !ok {
+            slog.WarnContext(r.Context(), "rejected request without a valid X-Signature", "remote_addr", r.RemoteAddr)
+            writeError(w, http.StatusUnauthorized, "Missing or malformed X-Signature")
+            return
+        }
+    }
+
+    // Read the request body, capped so one device cannot exhaust server memory,
+    // hashing the raw bytes for the signature and Digest and keeping a copy of
+    // them when a malformed body may need to be dead-lettered
+    r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+    var src io.Reader = r.Body
+    var raw *bytes.Buffer
+    if a.dead != nil && encoding == "gzip" {
+        raw = new(bytes.Buffer)
+        src = io.TeeReader(src, raw)
+    }
+    var mac hash.Hash
+    if a.signer != nil {
+        mac = a.signer.newMAC()
+        src = io.TeeReader(src, mac)
+    }
+    if digests != nil {
+        src = io.TeeReader(src, digests.writer())
+    }
+    span := a.tracing.child(r.Context(), "read body")
+    body, err := readBody(src, encoding, maxBody, r.ContentLength)
+    span.End()
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            slog.WarnContext(r.Context(), "request body too large", "remote_addr", r.RemoteAddr, "limit", tooLarge.Limit)
+            writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit))
+            return
+        }
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            slog.WarnContext(r.Context(), "timed out reading request body", "remote_addr", r.RemoteAddr)
+            writeError(w, http.StatusRequestTimeout, "Timed out reading request body")
+            return
+        }
+        if encoding == "gzip" && isCorruptGzip(err) {
+            slog.WarnContext(r.Context(), "malformed gzip request body", "remote_addr", r.RemoteAddr, "err", err)
+            if raw != nil {
+                a.deadLetter(o, dt, "malformed gzip body: "+err.Error(), raw.Bytes())
+            }
+            writeError(w, http.StatusBadRequest, "Malformed gzip request body")
+            return
+        }
+        slog.ErrorContext(r.Context(), "error reading request body", "remote_addr", r.RemoteAddr, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error reading request body")
+        return
+    }
+    a.metrics.observeBody(len(body))
+    a.sizes.observe(len(body))
+
+    // Bodies damaged on the way are rejected before any processing, and
+    // before the signature check, which would blame the device's secret
+    if alg, got, ok := digests.verify(); !ok {
+        slog.WarnContext(r.Context(), "rejected request body not matching its Digest", "remote_addr", r.RemoteAddr, "algorithm", alg, "bytes", len(body))
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("Digest mismatch: %s of the body received is %s", alg, got))
+        return
+    }
+
+    // Spoofed or corrupted bodies are rejected before any processing
+    if mac != nil && !a.signer.verify(mac, sig) {
+        slog.WarnContext(r.Context(), "rejected request with mismatched X-Signature", "remote_addr", r.RemoteAddr, "bytes", len(body))
+        writeError(w, http.StatusUnauthorized, "Invalid X-Signature")
+        return
+    }
+
+    // Devices with a payload key encrypt their bodies end to end
+    if a.authdb != nil && a.cfg.AuthDBKeyQuery != "" {
+        ciphertext := body
+        body, err = a.decryptBody(r, ciphertext)
+        var decErr *decryptError
+        switch {
+        case errors.As(err, &decErr):
+            slog.WarnContext(r.Context(), "rejected request body that could not be decrypted", "remote_addr", r.RemoteAddr, "device_id", deviceIdentity(r), "err", err)
+            a.deadLetter(o, dt, err.Error(), ciphertext)
+            writeError(w, http.StatusBadRequest, "Could not decrypt request body: "+err.Error())
+            return
+        case errors.Is(err, errAuthUnavailable):
+            w.Header().Set("Retry-After", "5")
+            writeError(w, http.StatusServiceUnavailable, "Payload key unavailable, retry later")
+            return
+        case err != nil:
+            slog.ErrorContext(r.Context(), "error decrypting request body", "remote_addr", r.RemoteAddr, "err", err)
+            writeError(w, http.StatusInternalServerError, "Error decrypting request body")
+            return
+        }
+    }
+
+    if sniff {
+        if !a.sniffBody(w, r, &o, dt, body) {
+            return
+        }
+    }
+
+    // Legacy binary records are turned into JSON before anything looks at them
+    if o.MediaType == mediaLegacy {
+        converted, err := legacyToJSON(body)
+        if err != nil {
+            slog.WarnContext(r.Context(), "malformed legacy record", "remote_addr", r.RemoteAddr, "bytes", len(body), "err", err)
+            a.deadLetter(o, dt, err.Error(), body)
+            writeError(w, http.StatusBadRequest, "Invalid sensor reading: "+err.Error())
+            return
+        }
+        body, o.MediaType = converted, mediaJSON
+    }
+
+    // So are protobuf readings
+    if o.MediaType == mediaProtobuf {
+        converted, err := protobufToJSON(body, r.Header.Get("Content-Type"))
+        if err != nil {
+            slog.WarnContext(r.Context(), "malformed protobuf reading", "remote_addr", r.RemoteAddr, "bytes", len(body), "err", err)
+            a.deadLetter(o, dt, err.Error(), body)
+            writeError(w, http.StatusBadRequest, "Invalid sensor reading: "+err.Error())
+            return
+        }
+        body, o.MediaType = converted, mediaJSON
+    }
+
+    // A JSON array is a batch of readings, each accepted on its own
+    if a.cfg.MaxBatch > 0 && o.MediaType == mediaJSON && isBatch(body) {
+        a.handleBatch(w, r, o, dt, body)
+        return
+    }
+
+    // Parse, log and store the reading through the pipeline shared with MQTT
+    span = a.tracing.child(r.Context(), "accept reading")
+    reading, out, err := a.accept(r.Context(), o, dt, body)
+    span.End()
+    if a.tracing.enabled() {
+        trace.SpanFromContext(r.Context()).SetAttributes(
+            attribute.String("iot.device_id", reading.DeviceID),
+            attribute.String("iot.device_type", dt.Name),
+            attribute.Int("iot.payload_bytes", len(body)),
+            attribute.Bool("iot.queued", out == outcomeQueued),
+        )
+    }
+    if err != nil {
+        a.writeAcceptError(w, r, err, len(body))
+        return
+    }
+
+    if a.cfg.Echo {
+        a.writeEcho(w, r, o, dt, reading, body)
+        return
+    }
+
+    // Respond to the client with a success status and how much we received;
+    // 202 tells it the reading was queued rather than already stored, unless
+    // -accept-status 200 is set for firmware that treats anything else as failure
+    resp, status := response{Status: "ok", Received: len(body)}, http.StatusOK
+    switch out {
+    case outcomeQueued:
+        resp.Status, status = "accepted", a.cfg.AcceptStatus
+    case outcomeDeduplicated:
+        resp.Deduplicated = true
+    }
+    if a.configs != nil {
+        resp.Config, resp.ConfigVersion = a.configs.pending(readingDevice(o, reading), appliedConfigVersion(r))
+    }
+    if a.fw != nil {
+        resp.Update = a.fw.update(runningFirmware(r))
+    }
+    writeJSON(w, status, withServerTime(resp, reading.Timestamp))
+}
+
+// writeAcceptError answers a request whose reading accept refused or could not
+// store. The error types are only looked for here, off the success path, since
+// each errors.As target escapes to the heap.
+func (a *app) writeAcceptError(w http.ResponseWriter, r *http.Request, err error, size int) {
+    var invalid *invalidReadingError
+    var violation *schemaError
+    var failed *transformError
+    var unavailable *sinkUnavailableError
+    var stale *staleReadingError
+    switch {
+    case errors.As(err, &stale):
+        slog.WarnContext(r.Context(), "rejected out-of-order reading", "remote_addr", r.RemoteAddr, "device_id", stale.DeviceID, "ts", stale.TS, "newest", stale.Newest)
+        writeError(w, http.StatusConflict, "Reading is older than the newest from this device")
+    case errors.As(err, &violation):
+        slog.WarnContext(r.Context(), "reading does not match schema", "remote_addr", r.RemoteAddr, "bytes", size, "errors", violation.Details)
+        writeProblem(w, problem{Status: http.StatusUnprocessableEntity, Detail: "Reading does not match schema", Details: violation.Details})
+    case errors.As(err, &invalid):
+        slog.WarnContext(r.Context(), "invalid sensor reading", "remote_addr", r.RemoteAddr, "bytes", size, "err", err)
+        writeError(w, http.StatusBadRequest, "Invalid sensor reading: "+err.Error())
+    case errors.As(err, &failed):
+        slog.ErrorContext(r.Context(), "error transforming reading", "remote_addr", r.RemoteAddr, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error transforming reading")
+    case errors.Is(err, context.Canceled):
+        // The client went away; there is nobody left to answer
+        slog.WarnContext(r.Context(), "request cancelled during processing", "remote_addr", r.RemoteAddr)
+    case errors.Is(err, context.DeadlineExceeded):
+        slog.WarnContext(r.Context(), "request timed out during processing", "remote_addr", r.RemoteAddr)
+        writeError(w, http.StatusServiceUnavailable, "Processing timed out, retry later")
+    case errors.As(err, &unavailable):
+        slog.ErrorContext(r.Context(), "giving up storing reading", "remote_addr", r.RemoteAddr, "err", err)
+        w.Header().Set("Retry-After", "5")
+        writeError(w, http.StatusServiceUnavailable, "Storage unavailable, retry later")
+    case errors.Is(err, errMaintenance):
+        w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+        writeError(w, http.StatusServiceUnavailable, "Server in maintenance, retry later")
+    case errors.Is(err, errQueueDelay):
+        slog.WarnContext(r.Context(), "processing queue delay above -codel-target, rejecting reading", "remote_addr", r.RemoteAddr)
+        w.Header().Set("Retry-After", "1")
+        writeError(w, http.StatusServiceUnavailable, "Server busy, retry later")
+    case errors.Is(err, errQueueFull):
+        slog.WarnContext(r.Context(), "processing queue full, rejecting reading", "remote_addr", r.RemoteAddr)
+        w.Header().Set("Retry-After", "1")
+        writeError(w, http.StatusServiceUnavailable, "Server busy, retry later")
+    default:
+        slog.ErrorContext(r.Context(), "error storing reading", "remote_addr", r.RemoteAddr, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error storing request body")
+    }
+
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+)
+
+// TestMain keeps the server's logs out of the test output.
+func TestMain(m *testing.M) {
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    os.Exit(m.Run())
+}
+
+// newTestApp returns an app for cfg as parsed from args, storing readings
+// nowhere unless args name a sink.
+func newTestApp(t testing.TB, args ...string) *app {
+    t.Helper()
+    cfg, err := parseConfig(append([]string{"-sink", "noop"}, args...))
+    if err != nil {
+        t.Fatalf("parseConfig: %v", err)
+    }
+    a, err := newApp(cfg)
+    if err != nil {
+        t.Fatalf("newApp: %v", err)
+    }
+    t.Cleanup(func() { a.Close() })
+    return a
+}
+
+func TestHandlerStatus(t *testing.T) {
+    a := newTestApp(t, "-maxbody", "64")
+    h := a.handler()
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        ctype  string
+        body   string
+        status int
+        allow  string
+    }{
+        {"valid temp", http.MethodPost, "/sensor/temp", "application/json", `{"device_id":"t1","temp":21.5,"ts":1700000000}`, http.StatusOK, ""},
+        {"valid door", http.MethodPost, "/sensor/door", "application/json", `{"device_id":"d1","open":true,"ts":1700000000}`, http.StatusOK, ""},
+        {"valid root", http.MethodPost, "/", "application/json", `{"device_id":"t1","temp":21.5,"ts":1700000000}`, http.StatusOK, ""},
+        {"malformed json", http.MethodPost, "/sensor/temp", "application/json", `{"device_id":`, http.StatusBadRequest, ""},
+        {"missing field", http.MethodPost, "/sensor/temp", "application/json", `{"device_id":"t1","ts":1700000000}`, http.StatusBadRequest, ""},
+        {"wrong method", http.MethodGet, "/sensor/temp", "", "", http.StatusMethodNotAllowed, "POST"},
+        {"oversized", http.MethodPost, "/sensor/temp", "application/json", `{"device_id":"` + strings.Repeat("x", 100) + `","temp":1}`, http.StatusRequestEntityTooLarge, ""},
+        {"unknown path", http.MethodPost, "/nope", "application/json", `{}`, http.StatusNotFound, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+            if tt.ctype != "" {
+                r.Header.Set("Content-Type", tt.ctype)
+            }
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+            }
+            if tt.status >= 400 && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/problem+json") {
+                t.Errorf("Content-Type = %q, want application/problem+json", w.Header().Get("Content-Type"))
+            }
+            if tt.allow != "" && !strings.Contains(w.Header().Get("Allow"), tt.allow) {
+                t.Errorf("Allow = %q, want it to list %s", w.Header().Get("Allow"), tt.allow)
+            }
+        })
+    }
+}
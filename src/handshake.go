@@ -0,0 +1,204 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "io"
+    "log/slog"
+    "net"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// handshakeListener completes the TLS handshake of each connection before
+// handing it to the server, so a failed handshake can be logged with what the
+// device offered, which net/http's one-line "TLS handshake error" does not
+// say, and counted by reason in iot_tls_handshake_failures_total. Handshakes
+// run concurrently, so a slow device never holds up the next.
+type handshakeListener struct {
+    net.Listener
+    config  *tls.Config
+    timeout time.Duration
+    metrics *metrics
+
+    hellos sync.Map // raw net.Conn to the *tls.ClientHelloInfo it sent
+
+    conns chan net.Conn
+    errs  chan error
+    done  chan struct{}
+    once  sync.Once
+}
+
+// newHandshakeListener returns a TLS listener on ln for config, giving each
+// handshake at most timeout (0 for no limit).
+func newHandshakeListener(ln net.Listener, config *tls.Config, timeout time.Duration, m *metrics) *handshakeListener {
+    l := &handshakeListener{
+        Listener: ln,
+        config:   config,
+        timeout:  timeout,
+        metrics:  m,
+        conns:    make(chan net.Conn),
+        errs:     make(chan error),
+        done:     make(chan struct{}),
+    }
+    next := config.GetConfigForClient
+    config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+        l.hellos.Store(hello.Conn, hello)
+        if next != nil {
+            return next(hello)
+        }
+        return nil, nil
+    }
+    go l.serve()
+    return l
+}
+
+// serve accepts connections and starts their handshakes until Close.
+func (l *handshakeListener) serve() {
+    for {
+        c, err := l.Listener.Accept()
+        if err != nil {
+            select {
+            case l.errs <- err:
+            case <-l.done:
+                return
+            }
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            continue
+        }
+        go l.handshake(c)
+    }
+}
+
+// handshake passes c on once its handshake succeeds, and logs it otherwise.
+func (l *handshakeListener) handshake(c net.Conn) {
+    defer l.hellos.Delete(c)
+    tc := tls.Server(c, l.config)
+    if l.timeout > 0 {
+        c.SetDeadline(time.Now().Add(l.timeout))
+    }
+    err := tc.Handshake()
+    if err != nil {
+        l.failed(c, err)
+        tc.Close()
+        return
+    }
+    c.SetDeadline(time.Time{})
+    select {
+    case l.conns <- tc:
+    case <-l.done:
+        tc.Close()
+    }
+}
+
+// failed logs and counts a handshake that did not complete.
+func (l *handshakeListener) failed(c net.Conn, err error) {
+    reason := handshakeFailure(err)
+    l.metrics.handshakeFailures.WithLabelValues(reason).Inc()
+
+    args := []any{"remote_addr", c.RemoteAddr().String(), "reason", reason, "err", err}
+    v, ok := l.hellos.Load(c)
+    if !ok {
+        // Port scanners and TCP health checks hang up without a ClientHello
+        level := slog.LevelInfo
+        if reason == "closed" {
+            level = slog.LevelDebug
+        }
+        slog.Log(context.Background(), level, "TLS handshake failed before the ClientHello", args...)
+        return
+    }
+    hello := v.(*tls.ClientHelloInfo)
+    args = append(args,
+        "server_name", hello.ServerName,
+        "versions", tlsVersionNames(hello.SupportedVersions),
+        "ciphers", cipherSuiteNames(hello.CipherSuites),
+        "alpn", strings.Join(hello.SupportedProtos, ","),
+    )
+    slog.Info("TLS handshake failed", args...)
+}
+
+// handshakeFailure sorts a handshake error into the reason it is counted
+// under: version, cipher, certificate, client_alert (the device refused the
+// server, often because its clock makes the certificate look expired),
+// timeout, closed, not_tls or other.
+func handshakeFailure(err error) string {
+    var recordErr tls.RecordHeaderError
+    var certErr *tls.CertificateVerificationError
+    var unknownCA x509.UnknownAuthorityError
+    var netErr net.Error
+    msg := err.Error()
+    switch {
+    case errors.As(err, &recordErr):
+        return "not_tls"
+    case errors.As(err, &netErr) && netErr.Timeout():
+        return "timeout"
+    case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+        return "closed"
+    // A TLS 1.3 client that refuses the certificate sends its alert under
+    // keys the server has not switched to yet, so it arrives as a bad MAC
+    case strings.Contains(msg, "remote error"), strings.Contains(msg, "bad record MAC"):
+        return "client_alert"
+    case errors.As(err, &certErr), errors.As(err, &unknownCA), strings.Contains(msg, "certificate"):
+        return "certificate"
+    case strings.Contains(msg, "version"):
+        return "version"
+    case strings.Contains(msg, "cipher suite"):
+        return "cipher"
+    }
+    return "other"
+}
+
+// tlsVersionNames names the versions a ClientHello offered, newest first as sent.
+func tlsVersionNames(versions []uint16) string {
+    names := make([]string, len(versions))
+    for i, v := range versions {
+        names[i] = tls.VersionName(v)
+    }
+    return strings.Join(names, ",")
+}
+
+// cipherSuiteNames names the cipher suites a ClientHello offered.
+func cipherSuiteNames(suites []uint16) string {
+    names := make([]string, len(suites))
+    for i, s := range suites {
+        names[i] = tls.CipherSuiteName(s)
+    }
+    return strings.Join(names, ",")
+}
+
+// Accept returns the next connection whose handshake has completed.
+func (l *handshakeListener) Accept() (net.Conn, error) {
+    select {
+    case c := <-l.conns:
+        return c, nil
+    case err := <-l.errs:
+        return nil, err
+    case <-l.done:
+        return nil, net.ErrClosed
+    }
+}
+
+// Close stops accepting; connections still in their handshake are closed
+// once it ends.
+func (l *handshakeListener) Close() error {
+    l.once.Do(func() { close(l.done) })
+    return l.Listener.Close()
+}
+
+// handshakeTimeout is the longest a handshake may take before the request
+// timeouts would have cut it off, as net/http itself computes it.
+func handshakeTimeout(cfg Config) time.Duration {
+    var d time.Duration
+    for _, t := range []time.Duration{cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout} {
+        if t > 0 && (d == 0 || t < d) {
+            d = t
+        }
+    }
+    return d
+}
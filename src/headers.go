@@ -0,0 +1,98 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// hstsValue is what -hsts sends: two years, subdomains included. Preloading
+// is left to -header, since it is hard to undo.
+const hstsValue = "max-age=63072000; includeSubDomains"
+
+// managedHeaders are set by net/http or the server itself and cannot be
+// overridden with -header.
+var managedHeaders = map[string]bool{
+    "Connection":        true,
+    "Content-Length":    true,
+    "Keep-Alive":        true,
+    "Proxy-Connection":  true,
+    "Te":                true,
+    "Trailer":           true,
+    "Transfer-Encoding": true,
+    "Upgrade":           true,
+}
+
+// headerList is the repeatable -header flag, checked as each is given.
+type headerList []headerField
+
+// headerField is one "Name: value" response header.
+type headerField struct {
+    Name  string
+    Value string
+}
+
+func (l *headerList) String() string {
+    fields := make([]string, len(*l))
+    for i, f := range *l {
+        fields[i] = f.Name + ": " + f.Value
+    }
+    return strings.Join(fields, ", ")
+}
+
+func (l *headerList) Set(v string) error {
+    name, value, ok := strings.Cut(v, ":")
+    name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+    if !ok || !validHeaderName(name) {
+        return fmt.Errorf("want \"Name: value\" with a valid header name")
+    }
+    if !validHeaderValue(value) {
+        return fmt.Errorf("value of %s contains control characters", name)
+    }
+    name = http.CanonicalHeaderKey(name)
+    if managedHeaders[name] {
+        return fmt.Errorf("%s is managed by the server and cannot be set", name)
+    }
+    *l = append(*l, headerField{Name: name, Value: value})
+    return nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+    if name == "" {
+        return false
+    }
+    for i := 0; i < len(name); i++ {
+        c := name[i]
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// validHeaderValue reports whether value has no control characters but tab.
+func validHeaderValue(value string) bool {
+    for i := 0; i < len(value); i++ {
+        if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+            return false
+        }
+    }
+    return true
+}
+
+// withHeaders sets fields on every response, before the handler runs so an
+// endpoint that sets one of them itself, such as Content-Type, keeps its own.
+// A name given more than once is sent with every value.
+func withHeaders(fields headerList, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h := w.Header()
+        for _, f := range fields {
+            h[f.Name] = append(h[f.Name], f.Value)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "crypto/tls"
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+
+    "github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3 serves handler over QUIC on the UDP side of the TCP listener's
+// port, so both protocols share one port number (TCP 443 and UDP 443).
+func startHTTP3(cfg Config, handler http.Handler, tlsConfig *tls.Config, tcpAddr *net.TCPAddr) (*http3.Server, error) {
+    udpAddr := net.JoinHostPort(tcpAddr.IP.String(), strconv.Itoa(tcpAddr.Port))
+    conn, err := net.ListenPacket("udp", udpAddr)
+    if err != nil {
+        return nil, err
+    }
+
+    server := &http3.Server{
+        Handler:        handler,
+        TLSConfig:      tlsConfig,
+        Port:           tcpAddr.Port,
+        IdleTimeout:    cfg.IdleTimeout,
+        MaxHeaderBytes: cfg.MaxHeaderBytes,
+        Logger:         slog.Default(),
+    }
+    go func() {
+        if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            slog.Error("error serving HTTP/3", "addr", udpAddr, "err", err)
+        }
+    }()
+    slog.Info("HTTP/3 enabled", "addr", conn.LocalAddr().String())
+    return server, nil
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to TCP responses so clients learn they
+// can upgrade to HTTP/3 on the same port.
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoMajor < 3 {
+            h3.SetQUICHeaders(w.Header())
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// addNextProtos advertises h2 (unless HTTP/2 is off) and http/1.1 in ALPN, as
+// ServeTLS would. The listener is wrapped with tls.NewListener instead, since
+// ServeTLS serves a copy of the config and changes such as new session ticket
+// keys would never reach it.
+func addNextProtos(c *tls.Config, http2 bool) {
+    has := func(proto string) bool {
+        for _, p := range c.NextProtos {
+            if p == proto {
+                return true
+            }
+        }
+        return false
+    }
+    if http2 && !has("h2") {
+        c.NextProtos = append([]string{"h2"}, c.NextProtos...)
+    }
+    if !has("http/1.1") {
+        c.NextProtos = append(c.NextProtos, "http/1.1")
+    }
+}
+
+// disableHTTP2 keeps the TCP listener on HTTP/1.1 by removing h2 from ALPN and
+// giving the server an empty TLSNextProto map, as documented by net/http.
+func disableHTTP2(server *http.Server) {
+    server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+    if server.TLSConfig == nil {
+        return
+    }
+    var protos []string
+    for _, p := range server.TLSConfig.NextProtos {
+        if p != "h2" {
+            protos = append(protos, p)
+        }
+    }
+    server.TLSConfig.NextProtos = protos
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "time"
+)
+
+// httpSink POSTs each stored payload to a collector URL, as received or as
+// reshaped by -transform-template. Network errors, 429 and 5xx are retried;
+// any other non-2xx answer means the collector will never take the reading.
+type httpSink struct {
+    url    string
+    client *http.Client
+}
+
+func newHTTPSink(url string) *httpSink {
+    return &httpSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *httpSink) Store(ctx context.Context, j job) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(j.body))
+    if err != nil {
+        return permanent(err)
+    }
+    contentType := j.origin.MediaType
+    if contentType == "" {
+        contentType = mediaJSON
+    }
+    req.Header.Set("Content-Type", contentType)
+    req.Header.Set("X-Device-Type", j.dt.Name)
+    if j.reading.DeviceID != "" {
+        req.Header.Set("X-Device-ID", j.reading.DeviceID)
+    }
+    if j.origin.RequestID != "" {
+        req.Header.Set("X-Request-ID", j.origin.RequestID)
+    }
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return nil
+    case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+        return fmt.Errorf("collector answered %s", resp.Status)
+    }
+    return permanent(fmt.Errorf("collector refused reading: %s", resp.Status))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "crypto/sha256"
+    "encoding/hex"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// maxIdempotencyKey bounds the Idempotency-Key header so it cannot be used to bloat the cache.
+const maxIdempotencyKey = 255
+
+// idempotentResponse is the stored outcome of the first request made with a key.
+// It is pending until that request finishes.
+type idempotentResponse struct {
+    key         string
+    expires     time.Time
+    done        bool
+    status      int
+    contentType string
+    body        []byte
+}
+
+// idempotencyCache remembers the responses to recent requests carrying an
+// Idempotency-Key, evicting the least recently used once it holds size keys
+// and ignoring entries older than ttl.
+type idempotencyCache struct {
+    mu      sync.Mutex
+    size    int
+    ttl     time.Duration
+    order   *list.List // front is most recently used
+    entries map[string]*list.Element
+}
+
+// newIdempotencyCache returns a cache holding at most size keys for ttl each.
+func newIdempotencyCache(size int, ttl time.Duration) *idempotencyCache {
+    return &idempotencyCache{
+        size:    size,
+        ttl:     ttl,
+        order:   list.New(),
+        entries: make(map[string]*list.Element),
+    }
+}
+
+// begin looks up key. If a live entry exists it is returned with found set;
+// otherwise a pending entry is reserved for the caller to complete.
+func (c *idempotencyCache) begin(key string, now time.Time) (resp *idempotentResponse, found bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if el, ok := c.entries[key]; ok {
+        resp = el.Value.(*idempotentResponse)
+        if now.Before(resp.expires) {
+            c.order.MoveToFront(el)
+            return resp, true
+        }
+        c.order.Remove(el)
+        delete(c.entries, key)
+    }
+
+    resp = &idempotentResponse{key: key, expires: now.Add(c.ttl)}
+    c.entries[key] = c.order.PushFront(resp)
+    for c.order.Len() > c.size {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*idempotentResponse).key)
+    }
+    return resp, false
+}
+
+// finish records the response to a pending entry. Only successful responses
+// are kept; anything else is forgotten so the device's retry is processed.
+func (c *idempotencyCache) finish(resp *idempotentResponse, status int, contentType string, body []byte) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    el, ok := c.entries[resp.key]
+    if !ok || el.Value != resp {
+        return
+    }
+    if status < 200 || status > 299 {
+        c.order.Remove(el)
+        delete(c.entries, resp.key)
+        return
+    }
+    resp.done = true
+    resp.status = status
+    resp.contentType = contentType
+    resp.body = body
+}
+
+// bodyRecorder tees the response body into a buffer while still writing it to the client.
+type bodyRecorder struct {
+    statusRecorder
+    buf bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+    n, err := b.statusRecorder.Write(p)
+    b.buf.Write(p[:n])
+    return n, err
+}
+
+// idempotencyScope identifies the authenticated caller so two devices can
+// reuse the same key: the client certificate name if there is one, otherwise
+// a hash of the API key, otherwise nothing (all callers share one scope).
+func idempotencyScope(r *http.Request) string {
+    if cn := clientName(r); cn != "" {
+        return "cn:" + cn
+    }
+    if token, ok := bearerToken(r); ok {
+        sum := sha256.Sum256([]byte(token))
+        return "key:" + hex.EncodeToString(sum[:8])
+    }
+    return ""
+}
+
+// middleware replays the stored response when a request repeats an
+// Idempotency-Key seen within the TTL, instead of processing it again.
+// It must run after authentication so the scope reflects a verified caller.
+func (c *idempotencyCache) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("Idempotency-Key")
+        if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if len(key) > maxIdempotencyKey {
+            writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+            return
+        }
+
+        // Keys are scoped by caller and path so the same key on another endpoint is a new request
+        scoped := idempotencyScope(r) + "|" + r.URL.Path + "|" + key
+        resp, found := c.begin(scoped, time.Now())
+        if found {
+            c.mu.Lock()
+            done, status, contentType, body := resp.done, resp.status, resp.contentType, resp.body
+            c.mu.Unlock()
+            if !done {
+                slog.WarnContext(r.Context(), "idempotent request still in progress", "remote_addr", r.RemoteAddr, "key", key)
+                writeError(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+                return
+            }
+            slog.InfoContext(r.Context(), "replaying idempotent response", "remote_addr", r.RemoteAddr, "key", key, "status", status)
+            if contentType != "" {
+                w.Header().Set("Content-Type", contentType)
+            }
+            w.Header().Set("Idempotent-Replayed", "true")
+            w.WriteHeader(status)
+            w.Write(body)
+            return
+        }
+
+        rec := &bodyRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+        defer func() {
+            status := rec.status
+            if status == 0 {
+                status = http.StatusOK
+            }
+            c.finish(resp, status, rec.Header().Get("Content-Type"), rec.buf.Bytes())
+        }()
+        next.ServeHTTP(rec, r)
+    })
+}
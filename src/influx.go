@@ -0,0 +1,223 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// influxMeasurement is the measurement name readings are written under.
+const influxMeasurement = "sensor_reading"
+
+// influxSink batches readings as line protocol and writes them to InfluxDB v2.
+// Points that fail to write stay queued and are retried on the next flush, so a
+// database outage delays data instead of losing it (up to maxPending points).
+type influxSink struct {
+    writeURL   string
+    pingURL    string
+    token      string
+    client     *http.Client
+    batchSize  int
+    maxPending int
+
+    mu      sync.Mutex
+    pending []string
+
+    kick chan struct{}
+    done chan struct{}
+    wg   sync.WaitGroup
+}
+
+// newInfluxSink starts a sink writing to the bucket and org named in cfg.
+func newInfluxSink(cfg Config) (*influxSink, error) {
+    u, err := url.Parse(cfg.InfluxURL)
+    if err != nil || u.Scheme == "" || u.Host == "" {
+        return nil, fmt.Errorf("invalid -influx-url %q", cfg.InfluxURL)
+    }
+    if cfg.InfluxOrg == "" || cfg.InfluxBucket == "" {
+        return nil, fmt.Errorf("-influx-org and -influx-bucket are required with -influx-url")
+    }
+    base := strings.TrimSuffix(u.Path, "/")
+    ping := *u
+    ping.Path = base + "/ping"
+    u.Path = base + "/api/v2/write"
+    u.RawQuery = url.Values{
+        "org":       {cfg.InfluxOrg},
+        "bucket":    {cfg.InfluxBucket},
+        "precision": {"s"},
+    }.Encode()
+
+    s := &influxSink{
+        writeURL:   u.String(),
+        pingURL:    ping.String(),
+        token:      cfg.InfluxToken,
+        client:     &http.Client{Timeout: 10 * time.Second},
+        batchSize:  cfg.InfluxBatch,
+        maxPending: cfg.InfluxBuffer,
+        kick:       make(chan struct{}, 1),
+        done:       make(chan struct{}),
+    }
+    s.wg.Add(1)
+    go s.run(cfg.InfluxFlush)
+    return s, nil
+}
+
+// Add queues a reading for the next batch write. It never blocks on the network.
+// Readings without measurement fields, such as image uploads, are skipped.
+func (s *influxSink) Add(reading SensorReading) {
+    line, ok := influxLine(reading)
+    if !ok {
+        return
+    }
+
+    s.mu.Lock()
+    s.pending = append(s.pending, line)
+    if over := len(s.pending) - s.maxPending; over > 0 {
+        s.pending = s.pending[over:]
+        slog.Warn("InfluxDB buffer full, dropping oldest points", "dropped", over)
+    }
+    full := len(s.pending) >= s.batchSize
+    s.mu.Unlock()
+
+    if full {
+        select {
+        case s.kick <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// run flushes on every tick, whenever a full batch is waiting, and once more on Close.
+func (s *influxSink) run(every time.Duration) {
+    defer s.wg.Done()
+    ticker := time.NewTicker(every)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-s.kick:
+        case <-s.done:
+            if err := s.flush(); err != nil {
+                slog.Error("error flushing InfluxDB points on shutdown", "err", err)
+            }
+            return
+        }
+        if err := s.flush(); err != nil {
+            slog.Warn("error writing to InfluxDB, will retry", "err", err)
+        }
+    }
+}
+
+// flush writes everything pending in batches, requeueing whatever fails.
+func (s *influxSink) flush() error {
+    for {
+        s.mu.Lock()
+        n := len(s.pending)
+        if n > s.batchSize {
+            n = s.batchSize
+        }
+        batch := s.pending[:n:n]
+        s.pending = s.pending[n:]
+        s.mu.Unlock()
+        if n == 0 {
+            return nil
+        }
+
+        if err := s.write(batch); err != nil {
+            // Put the batch back in front so ordering is preserved on retry
+            s.mu.Lock()
+            s.pending = append(batch, s.pending...)
+            if over := len(s.pending) - s.maxPending; over > 0 {
+                s.pending = s.pending[over:]
+                slog.Warn("InfluxDB buffer full, dropping oldest points", "dropped", over)
+            }
+            s.mu.Unlock()
+            return err
+        }
+    }
+}
+
+// write sends one batch of line protocol to the write API.
+func (s *influxSink) write(lines []string) error {
+    body := strings.Join(lines, "\n")
+    req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewBufferString(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+    if s.token != "" {
+        req.Header.Set("Authorization", "Token "+s.token)
+    }
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+    }
+    return nil
+}
+
+// ready pings the server, which answers 204 once it is up.
+func (s *influxSink) ready(ctx context.Context) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.pingURL, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("InfluxDB returned %s", resp.Status)
+    }
+    return nil
+}
+
+// Close stops the background writer after a final flush.
+func (s *influxSink) Close() error {
+    close(s.done)
+    s.wg.Wait()
+    return nil
+}
+
+// influxTagEscaper escapes characters that are special in line protocol tag values.
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine renders a reading as a line protocol point tagged by device id.
+// It reports false when the reading has no fields to write.
+func influxLine(reading SensorReading) (string, bool) {
+    var fields []string
+    if reading.Temp != nil {
+        fields = append(fields, "temp="+strconv.FormatFloat(*reading.Temp, 'f', -1, 64))
+    }
+    if reading.Open != nil {
+        fields = append(fields, "open="+strconv.FormatBool(*reading.Open))
+    }
+    if len(fields) == 0 {
+        return "", false
+    }
+
+    var b strings.Builder
+    b.WriteString(influxMeasurement)
+    b.WriteString(",device_id=")
+    b.WriteString(influxTagEscaper.Replace(reading.DeviceID))
+    b.WriteByte(' ')
+    b.WriteString(strings.Join(fields, ","))
+    b.WriteByte(' ')
+    b.WriteString(strconv.FormatInt(reading.Timestamp, 10))
+    return b.String(), true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// cidrList is a repeatable flag of networks such as 10.0.0.0/8; a bare
+// address means just that host.
+type cidrList []*net.IPNet
+
+func (c *cidrList) String() string {
+    s := make([]string, len(*c))
+    for i, n := range *c {
+        s[i] = n.String()
+    }
+    return strings.Join(s, ",")
+}
+
+func (c *cidrList) Set(v string) error {
+    for _, part := range strings.Split(v, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        if !strings.Contains(part, "/") {
+            ip := net.ParseIP(part)
+            if ip == nil {
+                return fmt.Errorf("invalid address %q", part)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            *c = append(*c, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(part)
+        if err != nil {
+            return fmt.Errorf("invalid CIDR %q", part)
+        }
+        *c = append(*c, n)
+    }
+    return nil
+}
+
+// contains reports whether ip is in any of the networks.
+func (c cidrList) contains(ip net.IP) bool {
+    for _, n := range c {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the address of the client making r. With trustProxy it is
+// the last X-Forwarded-For entry, the one the proxy in front of us appended;
+// earlier entries come from the client and could be anything.
+func clientIP(r *http.Request, trustProxy bool) string {
+    if trustProxy {
+        if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+            hops := strings.Split(xff[len(xff)-1], ",")
+            if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+                return last
+            }
+        }
+    }
+    return remoteIP(r)
+}
+
+// ipFilter admits only clients whose address passes -allow-cidr and -deny-cidr.
+type ipFilter struct {
+    allow      cidrList
+    deny       cidrList
+    trustProxy bool
+}
+
+// permits reports whether ip may connect, and if not why: a deny match always
+// wins, and with an allowlist only listed networks get in.
+func (f *ipFilter) permits(ip net.IP) (bool, string) {
+    switch {
+    case ip == nil:
+        return false, "unparsable address"
+    case f.deny.contains(ip):
+        return false, "denied by -deny-cidr"
+    case len(f.allow) > 0 && !f.allow.contains(ip):
+        return false, "not in -allow-cidr"
+    }
+    return true, ""
+}
+
+// middleware answers 403 to disallowed clients before anything else looks at the request.
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        addr := clientIP(r, f.trustProxy)
+        if ok, reason := f.permits(net.ParseIP(addr)); !ok {
+            slog.WarnContext(r.Context(), "blocked request from disallowed address", "remote_addr", r.RemoteAddr, "client_ip", addr, "reason", reason)
+            writeError(w, http.StatusForbidden, "Forbidden")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+    "time"
+
+    "github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes each stored payload to a Kafka topic, keyed by device id
+// so one device's readings stay in order on one partition. Writes are batched
+// and asynchronous; messages the brokers never acknowledge are passed to failed,
+// which puts them in the dead-letter file.
+type kafkaSink struct {
+    w *kafka.Writer
+}
+
+// newKafkaSink creates a producer for the brokers and topic named in cfg. It
+// does not contact the brokers; connections are made on the first batch.
+func newKafkaSink(cfg Config, failed func(j job, err error)) (*kafkaSink, error) {
+    var brokers []string
+    for _, b := range strings.Split(cfg.KafkaBrokers, ",") {
+        if b = strings.TrimSpace(b); b != "" {
+            brokers = append(brokers, b)
+        }
+    }
+    if len(brokers) == 0 {
+        return nil, fmt.Errorf("invalid -kafka-brokers %q", cfg.KafkaBrokers)
+    }
+    if cfg.KafkaTopic == "" {
+        return nil, fmt.Errorf("-kafka-topic is required with -kafka-brokers")
+    }
+
+    w := &kafka.Writer{
+        Addr:         kafka.TCP(brokers...),
+        Topic:        cfg.KafkaTopic,
+        Balancer:     kafka.Murmur2Balancer{}, // the Java client's partitioner, so keys land where other producers put them
+        BatchSize:    cfg.KafkaBatch,
+        BatchTimeout: cfg.KafkaFlush,
+        RequiredAcks: kafka.RequireAll,
+        Async:        true,
+        ErrorLogger:  kafka.LoggerFunc(func(msg string, args ...any) { slog.Warn("kafka: " + fmt.Sprintf(msg, args...)) }),
+        Completion: func(messages []kafka.Message, err error) {
+            if err == nil {
+                return
+            }
+            slog.Error("error publishing to Kafka", "topic", cfg.KafkaTopic, "messages", len(messages), "err", err)
+            for _, m := range messages {
+                if j, ok := m.WriterData.(job); ok {
+                    failed(j, err)
+                }
+            }
+        },
+    }
+    return &kafkaSink{w: w}, nil
+}
+
+// Store hands the payload to the producer's next batch. Delivery happens in the
+// background; failing here means the brokers could not even be asked which
+// partitions the topic has, or the message is too large to ever be accepted.
+func (s *kafkaSink) Store(ctx context.Context, j job) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    err := s.w.WriteMessages(ctx, kafka.Message{
+        Key:   []byte(j.reading.DeviceID),
+        Value: j.body,
+        Headers: []kafka.Header{
+            {Key: "type", Value: []byte(j.dt.Name)},
+            {Key: "transport", Value: []byte(j.origin.Transport)},
+            {Key: "remote_addr", Value: []byte(j.origin.RemoteAddr)},
+            {Key: "content_type", Value: []byte(j.origin.MediaType)},
+        },
+        Time:       time.Now().UTC(),
+        WriterData: j,
+    })
+    var tooLarge kafka.MessageTooLargeError
+    if errors.As(err, &tooLarge) {
+        return permanent(err)
+    }
+    return err
+}
+
+// ready asks the brokers for the topic's partitions, which the producer needs
+// before it can publish anything.
+func (s *kafkaSink) ready(ctx context.Context) error {
+    client := &kafka.Client{Addr: s.w.Addr}
+    meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{s.w.Topic}})
+    if err != nil {
+        return err
+    }
+    for _, t := range meta.Topics {
+        if t.Error != nil {
+            return fmt.Errorf("topic %s: %v", t.Name, t.Error)
+        }
+    }
+    return nil
+}
+
+// Close flushes the messages still waiting in a batch and waits for their delivery reports.
+func (s *kafkaSink) Close() error {
+    slog.Info("flushing Kafka producer")
+    return s.w.Close()
+}
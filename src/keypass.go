@@ -0,0 +1,64 @@
+package main
+
+import (
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+
+    "github.com/youmark/pkcs8"
+)
+
+// decryptKeyPEM returns keyPEM with its private key block decrypted using
+// passphrase, ready for tls.X509KeyPair. Both the legacy OpenSSL format
+// (Proc-Type: 4,ENCRYPTED headers) and PKCS#8 "ENCRYPTED PRIVATE KEY" blocks
+// are supported. An unencrypted key is returned as is.
+func decryptKeyPEM(keyPEM []byte, passphrase string) ([]byte, error) {
+    rest := keyPEM
+    for {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            // No encrypted block: let tls.X509KeyPair report what is there
+            if passphrase != "" {
+                slog.Warn("-key-passphrase is set but the key is not encrypted")
+            }
+            return keyPEM, nil
+        }
+
+        switch {
+        case block.Type == "ENCRYPTED PRIVATE KEY":
+            if passphrase == "" {
+                return nil, errors.New("the key is encrypted: set -key-passphrase or $IOT_KEY_PASSPHRASE")
+            }
+            key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+            if err != nil && strings.Contains(err.Error(), "incorrect password") {
+                return nil, errors.New("incorrect key passphrase")
+            }
+            if err != nil {
+                return nil, fmt.Errorf("cannot decrypt PKCS#8 key: %v", err)
+            }
+            der, err := x509.MarshalPKCS8PrivateKey(key)
+            if err != nil {
+                return nil, err
+            }
+            return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+
+        // Legacy PEM encryption is deprecated as weak, but older tooling still produces it
+        case x509.IsEncryptedPEMBlock(block):
+            if passphrase == "" {
+                return nil, errors.New("the key is encrypted: set -key-passphrase or $IOT_KEY_PASSPHRASE")
+            }
+            der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+            if errors.Is(err, x509.IncorrectPasswordError) {
+                return nil, errors.New("incorrect key passphrase")
+            }
+            if err != nil {
+                return nil, fmt.Errorf("cannot decrypt key: %v", err)
+            }
+            return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+        }
+    }
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+    "html/template"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// endpoint describes one route on the landing page.
+type endpoint struct {
+    Path        string   `json:"path"`
+    Methods     []string `json:"methods"`
+    Description string   `json:"description"`
+}
+
+// landingPage is the body of GET /: what this server is and what it accepts.
+// It names the features that are switched on but never their settings.
+type landingPage struct {
+    Name      string     `json:"name"`
+    Version   string     `json:"version"`
+    Commit    string     `json:"commit"`
+    BuildDate string     `json:"build_date"`
+    Uptime    string     `json:"uptime"`
+    Features  []string   `json:"features"`
+    Sinks     []string   `json:"sinks"`
+    Endpoints []endpoint `json:"endpoints"`
+}
+
+// landingTemplate renders landingPage for browsers.
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}} {{.Version}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Version {{.Version}} ({{.Commit}}, built {{.BuildDate}}), up {{.Uptime}}.</p>
+<h2>Features</h2>
+<ul>{{range .Features}}<li>{{.}}</li>{{else}}<li>none</li>{{end}}</ul>
+<h2>Sinks</h2>
+<ul>{{range .Sinks}}<li>{{.}}</li>{{end}}</ul>
+<h2>Endpoints</h2>
+<table>
+{{range .Endpoints}}<tr><td><code>{{.Path}}</code></td><td>{{range $i, $m := .Methods}}{{if $i}}, {{end}}{{$m}}{{end}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// landing serves the landing page for GET and HEAD on the root and passes
+// everything else, such as the POSTs of existing firmware, to ingest. It sits
+// outside the ingestion middleware, so a browser needs no credentials to see it.
+func (a *app) landing(ingest http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            ingest.ServeHTTP(w, r)
+            return
+        }
+        page := a.landingPage()
+        if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+            writeJSON(w, http.StatusOK, page)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        landingTemplate.Execute(w, page)
+    })
+}
+
+// landingPage describes the running server.
+func (a *app) landingPage() landingPage {
+    page := landingPage{
+        Name:      "iot",
+        Version:   version,
+        Commit:    commit,
+        BuildDate: buildDate,
+        Uptime:    time.Since(a.started).Round(time.Second).String(),
+        Features:  a.features(),
+        Sinks:     a.cfg.Sinks.kinds(),
+    }
+    if a.cfg.Echo {
+        page.Sinks = []string{"none (echo mode)"}
+    } else {
+        if a.cfg.InfluxURL != "" {
+            page.Sinks = append(page.Sinks, "influxdb")
+        }
+        if a.cfg.KafkaBrokers != "" {
+            page.Sinks = append(page.Sinks, "kafka")
+        }
+        if a.cfg.SQLitePath != "" {
+            page.Sinks = append(page.Sinks, "sqlite")
+        }
+    }
+
+    page.Endpoints = []endpoint{
+        {"/", []string{"GET", "POST"}, "this page; POST a " + deviceTypes[0].Name + " reading"},
+    }
+    for _, dt := range deviceTypes {
+        page.Endpoints = append(page.Endpoints, endpoint{dt.Path, dt.methods(), dt.Name + " readings as " + strings.Join(a.types.forType(dt), " or ")})
+    }
+    page.Endpoints = append(page.Endpoints,
+        endpoint{"/upload/file/{name}", []string{"POST", "PUT"}, "file upload"},
+        endpoint{"/ws", []string{"GET"}, "WebSocket for readings and commands"},
+    )
+    if a.admin != nil {
+        page.Endpoints = append(page.Endpoints, endpoint{"/devices/{id}/commands", []string{"POST"}, "queue a command for a device (admin)"})
+    }
+    if a.recent != nil {
+        page.Endpoints = append(page.Endpoints, endpoint{"/devices/{id}/recent", []string{"GET"}, "latest readings from a device"})
+    }
+    if a.stats != nil {
+        page.Endpoints = append(page.Endpoints, endpoint{"/devices/{id}/stats", []string{"GET"}, "min, max and average of a device's readings over the last " + a.stats.window().String()})
+    }
+    page.Endpoints = append(page.Endpoints,
+        endpoint{"/healthz", []string{"GET"}, "health check"},
+        endpoint{"/readyz", []string{"GET"}, "readiness: 503 until the sinks have connected, and while shutting down"},
+        endpoint{"/version", []string{"GET"}, "build information"},
+        endpoint{"/metrics", []string{"GET"}, "Prometheus metrics"},
+        endpoint{"/stats/sizes", []string{"GET"}, "histogram of reading body sizes; ?reset=true zeroes it"},
+    )
+    if a.seq != nil {
+        page.Endpoints = append(page.Endpoints, endpoint{"/stats/gaps", []string{"GET"}, "devices that missed readings, by their seq numbers"})
+    }
+    return page
+}
+
+// features names the security and processing options that are switched on.
+func (a *app) features() []string {
+    cfg := a.cfg
+    var f []string
+    if cfg.Unix == "" {
+        f = append(f, "tls")
+    }
+    if cfg.HTTP3 {
+        f = append(f, "http3")
+    }
+    if cfg.Compress {
+        f = append(f, "gzip responses")
+    }
+    if cfg.Sniff {
+        f = append(f, "format sniffing")
+    }
+    if cfg.ClientCA != "" {
+        f = append(f, "client certificates")
+    }
+    if a.crl != nil {
+        f = append(f, "crl")
+    }
+    if a.pins != nil {
+        f = append(f, "certificate pinning")
+    }
+    if a.ocsp != nil {
+        f = append(f, "ocsp stapling")
+    }
+    if a.tickets != nil {
+        f = append(f, "session tickets")
+    }
+    if a.keys != nil {
+        f = append(f, "api keys")
+    }
+    if a.authdb != nil {
+        f = append(f, "device database")
+    }
+    if a.cfg.RouteAuth != "" {
+        f = append(f, "per-route auth")
+    }
+    if a.signer != nil {
+        f = append(f, "hmac signatures")
+    }
+    if a.respSign != nil {
+        f = append(f, "signed responses")
+    }
+    if a.filter != nil {
+        f = append(f, "ip filtering")
+    }
+    if a.limiter != nil {
+        f = append(f, "rate limiting")
+    }
+    if a.schema != nil {
+        f = append(f, "json schema")
+    }
+    if a.stale != nil {
+        f = append(f, "out-of-order filter")
+    }
+    if a.dedup != nil {
+        f = append(f, "deduplication")
+    }
+    if a.seq != nil {
+        f = append(f, "sequence gap detection")
+    }
+    if a.watch != nil {
+        f = append(f, "watchdog")
+    }
+    if a.redact != nil {
+        f = append(f, "field redaction")
+    }
+    if a.configs != nil {
+        f = append(f, "device config")
+    }
+    if a.fw != nil {
+        f = append(f, "firmware updates")
+    }
+    if a.fields != nil {
+        f = append(f, "vendor field mapping")
+    }
+    if a.enrich != nil {
+        f = append(f, "enrichment")
+    }
+    if a.admin != nil {
+        f = append(f, "admin reload")
+    }
+    if a.audit != nil {
+        f = append(f, "audit log")
+    }
+    if a.idem != nil {
+        f = append(f, "idempotency keys")
+    }
+    if a.queue != nil {
+        f = append(f, "async workers")
+        if a.queue.codel != nil {
+            f = append(f, "queue delay control")
+        }
+    }
+    if cfg.Echo {
+        f = append(f, "echo mode")
+    }
+    if cfg.Chaos {
+        f = append(f, "fault injection (TESTING ONLY)")
+    }
+    return f
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net"
+    "net/http"
+    "time"
+)
+
+// connStartKey is the context key under which a connection's accept time is stored.
+type connStartKey struct{}
+
+// withConnStart is the server's ConnContext: every request on c can tell how
+// long its connection has been open.
+func withConnStart(ctx context.Context, c net.Conn) context.Context {
+    return context.WithValue(ctx, connStartKey{}, time.Now())
+}
+
+// connEnd returns when the connection carrying r reaches -max-conn-lifetime.
+// Only HTTP/1 connections can be closed from a handler, so HTTP/2 and HTTP/3
+// requests, which share theirs, count from now instead. ok is false when
+// there is no limit.
+func (a *app) connEnd(r *http.Request, now time.Time) (time.Time, bool) {
+    if a.cfg.MaxConnLifetime <= 0 {
+        return time.Time{}, false
+    }
+    start := now
+    if r.ProtoMajor == 1 {
+        if t, ok := r.Context().Value(connStartKey{}).(time.Time); ok {
+            start = t
+        }
+    }
+    return start.Add(a.cfg.MaxConnLifetime), true
+}
+
+// capConnLifetime closes HTTP/1 keep-alive connections that have outlived
+// -max-conn-lifetime after their current response, so a device that reuses
+// one connection forever still lands on a new server during a rolling deploy.
+func (a *app) capConnLifetime(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if end, ok := a.connEnd(r, time.Now()); ok && r.ProtoMajor == 1 && !time.Now().Before(end) {
+            slog.DebugContext(r.Context(), "closing connection past its maximum lifetime", "remote_addr", r.RemoteAddr)
+            w.Header().Set("Connection", "close")
+        }
+        next.ServeHTTP(w, r)
+    })
+}
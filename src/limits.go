@@ -0,0 +1,122 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "sync"
+
+    "gopkg.in/yaml.v3"
+)
+
+// deviceLimit overrides the global limits for one device. Zero fields keep the global value.
+type deviceLimit struct {
+    MaxBody int64   `yaml:"maxbody"` // bytes, like -maxbody
+    Rate    float64 `yaml:"rate"`    // requests per second, like -rate
+    Burst   int     `yaml:"burst"`   // like -burst; 0 means the rate rounded up
+}
+
+// limitsFile is the -device-limits file. YAML is a superset of JSON, so either works:
+//
+//  devices:
+//    camera-01: {maxbody: 10485760, rate: 0.2}
+//    temp-07:   {maxbody: 512, rate: 20, burst: 40}
+type limitsFile struct {
+    Devices map[string]deviceLimit `yaml:"devices"`
+}
+
+// deviceLimits holds the per-device overrides, keyed by client certificate CN
+// or -authdb device id, and can be reloaded while the server runs.
+type deviceLimits struct {
+    path string
+
+    mu      sync.RWMutex
+    devices map[string]deviceLimit
+}
+
+// loadDeviceLimits reads the overrides from path.
+func loadDeviceLimits(path string) (*deviceLimits, error) {
+    l := &deviceLimits{path: path}
+    if err := l.reload(); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+// reload re-reads the file; on error the current overrides stay in effect.
+func (l *deviceLimits) reload() error {
+    devices, err := l.load()
+    if err != nil {
+        return err
+    }
+    l.set(devices)
+    return nil
+}
+
+// load reads and checks the file without applying it.
+func (l *deviceLimits) load() (map[string]deviceLimit, error) {
+    data, err := ioutil.ReadFile(l.path)
+    if err != nil {
+        return nil, err
+    }
+    var f limitsFile
+    if err := yaml.Unmarshal(data, &f); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", l.path, err)
+    }
+    for id, d := range f.Devices {
+        if d.MaxBody < 0 || d.Rate < 0 || d.Burst < 0 {
+            return nil, fmt.Errorf("invalid limits for device %q in %s: must not be negative", id, l.path)
+        }
+    }
+    return f.Devices, nil
+}
+
+// set replaces the overrides with devices.
+func (l *deviceLimits) set(devices map[string]deviceLimit) {
+    l.mu.Lock()
+    l.devices = devices
+    l.mu.Unlock()
+    slog.Info("loaded device limits", "file", l.path, "devices", len(devices))
+}
+
+// current returns the overrides in effect.
+func (l *deviceLimits) current() map[string]deviceLimit {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    return l.devices
+}
+
+// lookup returns the overrides for the device making r, if it has any. Only
+// a verified identity counts, so a client cannot take on another device's
+// limits by sending its X-Device-ID.
+func (l *deviceLimits) lookup(r *http.Request) (string, deviceLimit, bool) {
+    id := verifiedDevice(r)
+    if id == "" {
+        return "", deviceLimit{}, false
+    }
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    d, ok := l.devices[id]
+    return id, d, ok
+}
+
+// deviceIdentity names the device making r: its verified client certificate
+// CN, or else the X-Device-ID header. The header is a claim anyone can make;
+// use verifiedDevice for anything that trusts it.
+func deviceIdentity(r *http.Request) string {
+    if cn := clientName(r); cn != "" {
+        return cn
+    }
+    return r.Header.Get("X-Device-ID")
+}
+
+// maxBody returns the body size limit for r: the device override, or -maxbody.
+func (a *app) maxBody(r *http.Request) int64 {
+    if a.limits != nil {
+        if _, d, ok := a.limits.lookup(r); ok && d.MaxBody > 0 {
+            return d.MaxBody
+        }
+    }
+    return a.cfg.MaxBody
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+)
+
+func TestMaxBodyNeedsVerifiedDevice(t *testing.T) {
+    a := &app{cfg: Config{MaxBody: 1024}, limits: &deviceLimits{devices: map[string]deviceLimit{"camera-01": {MaxBody: 1 << 20}}}}
+
+    r := httptest.NewRequest("POST", "/upload/image", nil)
+    r.Header.Set("X-Device-ID", "camera-01")
+    if got := a.maxBody(r); got != 1024 {
+        t.Errorf("maxBody with only X-Device-ID = %d, want the global 1024", got)
+    }
+
+    r = r.WithContext(withVerifiedDevice(r.Context(), "camera-01"))
+    if got := a.maxBody(r); got != 1<<20 {
+        t.Errorf("maxBody for a verified device = %d, want its override %d", got, 1<<20)
+    }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/pires/go-proxyproto"
+)
+
+// listenTCP listens on addr with keep-alive probes every keepAlive, or none
+// when it is 0. Go already sets TCP_NODELAY on accepted connections; noDelay
+// false turns it back off so the kernel may coalesce small writes.
+func listenTCP(addr string, keepAlive time.Duration, noDelay bool) (net.Listener, error) {
+    lc := net.ListenConfig{KeepAlive: -1}
+    if keepAlive > 0 {
+        lc.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: keepAlive, Interval: keepAlive}
+    }
+    ln, err := lc.Listen(context.Background(), "tcp", addr)
+    if err != nil || noDelay {
+        return ln, err
+    }
+    return delayListener{ln}, nil
+}
+
+// delayListener turns TCP_NODELAY off on every accepted connection.
+type delayListener struct {
+    net.Listener
+}
+
+func (l delayListener) Accept() (net.Conn, error) {
+    c, err := l.Listener.Accept()
+    if tc, ok := c.(*net.TCPConn); ok {
+        tc.SetNoDelay(false)
+    }
+    return c, err
+}
+
+// proxyListener reads the PROXY protocol header (v1 or v2) a load balancer
+// sends ahead of each connection, before any TLS, so RemoteAddr is the
+// client's address instead of the balancer's. Every connection must carry the
+// header. With from set, only those networks may connect at all; anyone else
+// could claim to be any client.
+func proxyListener(ln net.Listener, from cidrList, timeout time.Duration) net.Listener {
+    pl := &proxyproto.Listener{Listener: ln, ReadHeaderTimeout: timeout}
+    if len(from) > 0 {
+        pl.ConnPolicy = func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+            addr, ok := opts.Upstream.(*net.TCPAddr)
+            if !ok || !from.contains(addr.IP) {
+                slog.Warn("refused connection from outside -proxy-protocol-from", "remote_addr", opts.Upstream.String())
+                return proxyproto.REJECT, proxyproto.ErrInvalidUpstream
+            }
+            return proxyproto.REQUIRE, nil
+        }
+    }
+    return pl
+}
+
+// listenUnix listens on a Unix domain socket at path, first removing a stale
+// socket left behind by an unclean exit. Anything at path that is not a socket
+// is left alone. The socket is readable and writable by owner and group only,
+// so the reverse proxy must run as the same user or share its group.
+func listenUnix(path string) (net.Listener, error) {
+    if fi, err := os.Lstat(path); err == nil {
+        if fi.Mode()&os.ModeSocket == 0 {
+            return nil, fmt.Errorf("%s exists and is not a socket", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, fmt.Errorf("error removing stale socket: %v", err)
+        }
+    }
+    ln, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(path, 0660); err != nil {
+        ln.Close()
+        return nil, err
+    }
+    return ln, nil
+}
+
+// limitListener accepts at most cap(sem) connections at once, like
+// netutil.LimitListener, but logs whenever the limit makes Accept wait.
+type limitListener struct {
+    net.Listener
+    sem  chan struct{}
+    done chan struct{}
+    once sync.Once
+}
+
+// newLimitListener wraps ln so that no more than n connections are open at a time.
+func newLimitListener(ln net.Listener, n int) *limitListener {
+    return &limitListener{Listener: ln, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+// acquire takes a connection slot, blocking while all of them are in use.
+// It reports false if the listener was closed while waiting.
+func (l *limitListener) acquire() bool {
+    select {
+    case l.sem <- struct{}{}:
+        return true
+    default:
+    }
+    slog.Warn("connection limit reached, waiting for a free slot", "maxconns", cap(l.sem))
+    select {
+    case l.sem <- struct{}{}:
+        return true
+    case <-l.done:
+        return false
+    }
+}
+
+func (l *limitListener) release() { <-l.sem }
+
+func (l *limitListener) Accept() (net.Conn, error) {
+    if !l.acquire() {
+        return nil, net.ErrClosed
+    }
+    c, err := l.Listener.Accept()
+    if err != nil {
+        l.release()
+        return nil, err
+    }
+    return &limitConn{Conn: c, release: l.release}, nil
+}
+
+func (l *limitListener) Close() error {
+    err := l.Listener.Close()
+    l.once.Do(func() { close(l.done) })
+    return err
+}
+
+// limitConn gives its slot back exactly once when closed.
+type limitConn struct {
+    net.Conn
+    once    sync.Once
+    release func()
+}
+
+func (c *limitConn) Close() error {
+    err := c.Conn.Close()
+    c.once.Do(c.release)
+    return err
+}
@@ -1,70 +1,298 @@
 package main
 
 import (
+    "context"
     "crypto/tls"
+    "errors"
+    "flag"
     "fmt"
-    "io/ioutil"
+    "log/slog"
+    "net"
     "net/http"
-    "path/filepath"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/quic-go/quic-go/http3"
 )
 
-func main() {
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        // Handle POST requests
-        if r.Method == http.MethodPost {
-            // Read the request body
-            body, err := ioutil.ReadAll(r.Body)
-            if err != nil {
-                http.Error(w, "Error reading request body", http.StatusInternalServerError)
-                return
-            }
+// newLogger builds the process logger from the -loglevel and -logjson flags.
+func newLogger(level string, jsonOut bool) (*slog.Logger, error) {
+    var lvl slog.Level
+    if err := lvl.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+        return nil, fmt.Errorf("invalid log level %q: use debug, info, warn or error", level)
+    }
+    opts := &slog.HandlerOptions{Level: lvl}
+    var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+    if jsonOut {
+        h = slog.NewJSONHandler(os.Stderr, opts)
+    }
+    // Records logged with a request's context carry its X-Request-ID
+    return slog.New(requestIDHandler{h}), nil
+}
 
-            // Print the received data on the server
-            fmt.Printf("Received data: %s\n", body)
+// fatal logs msg at error level and exits with a non-zero status.
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
 
-            // You can perform additional processing here if needed
+// newServer wires handler and the TLS configuration into an http.Server.
+//
+// ReadTimeout covers the headers and the whole body, so a POST that is still
+// trickling in when it fires has its next body read fail with a timeout; the
+// handler makes a best-effort 408 reply and the connection is then closed.
+func newServer(cfg Config, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+    return &http.Server{
+        Addr:              cfg.Addr,
+        Handler:           handler,
+        TLSConfig:         tlsConfig,
+        ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+        MaxHeaderBytes:    cfg.MaxHeaderBytes,
+        ReadTimeout:       cfg.ReadTimeout,
+        WriteTimeout:      cfg.WriteTimeout,
+        IdleTimeout:       cfg.IdleTimeout,
+        ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+    }
+}
 
-            // Respond to the client with a success status
-            w.WriteHeader(http.StatusOK)
-        } else {
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        }
-    })
+func main() {
+    // Subcommands come first; without one the server runs
+    if len(os.Args) > 1 && os.Args[1] == "replay" {
+        os.Exit(runReplay(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "audit" {
+        os.Exit(runAudit(os.Args[2:]))
+    }
 
-    // Load the certificate and key files from the same level directory
-    certFile, err := ioutil.ReadFile(filepath.Join("ssl", "server.crt"))
+    cfg, err := parseConfig(os.Args[1:])
+    if errors.Is(err, flag.ErrHelp) {
+        os.Exit(0)
+    }
     if err != nil {
-        fmt.Println("Error reading certificate file:", err)
-        return
+        fmt.Fprintln(os.Stderr, "Error parsing configuration:", err)
+        os.Exit(2)
     }
 
-    keyFile, err := ioutil.ReadFile(filepath.Join("ssl", "server.key"))
+    logger, err := newLogger(cfg.LogLevel, cfg.LogJSON)
     if err != nil {
-        fmt.Println("Error reading key file:", err)
-        return
+        fmt.Fprintln(os.Stderr, "Error configuring logger:", err)
+        os.Exit(2)
     }
+    slog.SetDefault(logger)
 
-    // Generate a certificate and key pair
-    cert, err := tls.X509KeyPair(certFile, keyFile)
+    // -check stops after validating; otherwise the same checks run before anything binds
+    if cfg.Check {
+        os.Exit(runCheck(cfg, os.Stdout))
+    }
+    a, tlsConfig, manager, err := setup(cfg)
     if err != nil {
-        fmt.Println("Error loading certificate and key:", err)
-        return
+        fatal("invalid configuration", "err", err)
+    }
+    defer a.Close()
+    if a.ocsp != nil {
+        a.ocsp.start()
     }
+    server := newServer(cfg, a.handler(), tlsConfig)
+
+    // Shutdown does not track hijacked connections, so WebSockets are told to go away here
+    server.RegisterOnShutdown(a.ws.Close)
+    server.RegisterOnShutdown(a.endStreams)
 
-    // Configure the TLS server with the loaded certificate and key
-    server := &http.Server{
-        Addr:    ":443",
-        Handler: http.DefaultServeMux,
-        TLSConfig: &tls.Config{
-            Certificates: []tls.Certificate{cert},
-        },
+    // Every request context derives from base, so cancelling it aborts processing still running at shutdown
+    base, cancelBase := context.WithCancel(context.Background())
+    defer cancelBase()
+    server.BaseContext = func(net.Listener) context.Context { return base }
+    if cfg.MaxConnLifetime > 0 {
+        server.ConnContext = withConnStart
     }
 
-    // Start the server with TLS
-    fmt.Printf("Server is running on https://localhost:%d...\n", 443)
-    err = server.ListenAndServeTLS("", "")
-    if err != nil {
-        fmt.Println("Error starting server:", err)
+    // Devices speaking MQTT share the same processing pipeline
+    var subscriber *mqttSubscriber
+    if cfg.MQTTBroker != "" {
+        subscriber, err = startMQTT(cfg, a)
+        if err != nil {
+            fatal("error starting MQTT subscriber", "err", err)
+        }
     }
-}
 
+    // Bind the listener first so the reported port reflects the actual bound address
+    var ln net.Listener
+    var port int
+    if cfg.Unix != "" {
+        ln, err = listenUnix(cfg.Unix)
+        if err != nil {
+            fatal("error listening on Unix socket", "path", cfg.Unix, "err", err)
+        }
+    } else {
+        ln, err = listenTCP(server.Addr, cfg.TCPKeepAlive, cfg.TCPNoDelay)
+        if err != nil {
+            fatal("error listening on address", "addr", server.Addr, "err", err)
+        }
+        port = ln.Addr().(*net.TCPAddr).Port
+    }
+
+    // Behind a load balancer the client address arrives in a PROXY header
+    if cfg.ProxyProtocol {
+        ln = proxyListener(ln, cfg.ProxyProtocolFrom, cfg.ReadHeaderTimeout)
+        slog.Info("PROXY protocol enabled", "from", cfg.ProxyProtocolFrom.String())
+    }
+
+    // Cap simultaneous connections so a burst of handshakes cannot exhaust file descriptors
+    if cfg.MaxConns > 0 {
+        ln = newLimitListener(ln, cfg.MaxConns)
+        slog.Info("connection limit enabled", "maxconns", cfg.MaxConns)
+    }
+
+    // Plain HTTP serves autocert's HTTP-01 challenges and, if asked, redirects
+    // everything else to HTTPS; it needs the bound port to build the redirect
+    var plain *http.Server
+    if manager != nil || cfg.HTTPRedirect {
+        var handler http.Handler
+        if cfg.HTTPRedirect {
+            handler = httpsRedirect(port)
+        }
+        if manager != nil {
+            handler = manager.HTTPHandler(handler)
+        }
+        plain = &http.Server{
+            Addr:              cfg.AutocertHTTP,
+            Handler:           handler,
+            ReadHeaderTimeout: 10 * time.Second,
+            MaxHeaderBytes:    cfg.MaxHeaderBytes,
+            ErrorLog:          server.ErrorLog,
+        }
+    }
+
+    // HTTP/2 is negotiated automatically under TLS unless turned off for debugging
+    if !cfg.HTTP2 {
+        disableHTTP2(server)
+        slog.Info("HTTP/2 disabled")
+    }
+
+    // HTTP/3 runs on UDP alongside the TCP listener and is advertised via Alt-Svc
+    var h3 *http3.Server
+    if cfg.HTTP3 {
+        h3Config := tlsConfig.Clone()
+        if a.tickets != nil {
+            a.tickets.apply(h3Config)
+        }
+        h3, err = startHTTP3(cfg, server.Handler, h3Config, ln.Addr().(*net.TCPAddr))
+        if err != nil {
+            fatal("error starting HTTP/3", "err", err)
+        }
+        server.Handler = advertiseHTTP3(h3, server.Handler)
+    }
+
+    // Start the server in the background so the main flow can wait for a signal
+    slog.Info("starting iot server", "version", version, "commit", commit, "build_date", buildDate)
+    serveErr := make(chan error, 1)
+    if cfg.Unix != "" {
+        slog.Info(fmt.Sprintf("Server is running on unix:%s...", cfg.Unix), "addr", ln.Addr().String())
+        go func() {
+            serveErr <- server.Serve(ln)
+        }()
+    } else {
+        slog.Info(fmt.Sprintf("Server is running on https://localhost:%d...", port), "addr", ln.Addr().String())
+        addNextProtos(server.TLSConfig, cfg.HTTP2)
+        tlsLn := newHandshakeListener(ln, server.TLSConfig, handshakeTimeout(cfg), a.metrics)
+        go func() {
+            serveErr <- server.Serve(tlsLn)
+        }()
+    }
+    if plain != nil {
+        slog.Info("plain HTTP listener enabled", "addr", plain.Addr, "redirect", cfg.HTTPRedirect, "acme", manager != nil)
+        go func() {
+            if err := plain.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                slog.Error("error serving plain HTTP", "addr", plain.Addr, "err", err)
+            }
+        }()
+    }
+
+    // Profiling gets its own loopback-only listener, never the public port
+    var profiler *http.Server
+    if cfg.PprofAddr != "" {
+        profiler = newPprofServer(cfg.PprofAddr)
+        slog.Warn("pprof enabled", "addr", profiler.Addr)
+        go func() {
+            if err := profiler.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                slog.Error("error serving pprof", "addr", profiler.Addr, "err", err)
+            }
+        }()
+    }
+
+    // SIGHUP reloads what can change without a restart
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            slog.Info("reloading configuration", "signal", "SIGHUP")
+            changes, err := a.reload()
+            if err != nil {
+                slog.Error("error reloading configuration, keeping previous configuration", "err", err)
+            }
+            if a.audit != nil {
+                e := auditEntry{Identity: "signal", Action: "SIGHUP", Result: "ok", Detail: reloadNotes(changes, err)}
+                if err != nil {
+                    e.Result = "failed"
+                }
+                if err := a.audit.record(e); err != nil {
+                    slog.Error("error writing audit log", "file", cfg.AuditLog, "action", e.Action, "err", err)
+                }
+            }
+        }
+    }()
+
+    // /readyz turns ready once the sinks that connect lazily have answered
+    a.ready.start(a.sinks)
+
+    // Block until we are told to stop, the sinks never connect or the listener fails on its own
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+    notReady := false
+    select {
+    case err = <-serveErr:
+        if err != nil && !errors.Is(err, http.ErrServerClosed) {
+            fatal("error starting server", "err", err)
+        }
+        return
+    case sig := <-stop:
+        slog.Info("shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout.String())
+    case waiting := <-a.ready.gaveUp:
+        slog.Error("sinks not ready in time, shutting down", "ready_timeout", cfg.ReadyTimeout.String(), "waiting", waiting)
+        notReady = true
+    }
+    a.ready.shutdown()
+
+    // Let in-flight requests finish reading their bodies before closing connections;
+    // once the grace period runs out, whatever is still processing is cancelled
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+    defer cancel()
+    context.AfterFunc(ctx, cancelBase)
+    if plain != nil {
+        plain.Shutdown(ctx)
+    }
+    if profiler != nil {
+        profiler.Shutdown(ctx)
+    }
+    if subscriber != nil {
+        subscriber.Close()
+    }
+    if h3 != nil {
+        h3.Shutdown(ctx)
+    }
+    if err := server.Shutdown(ctx); err != nil {
+        slog.Error("error shutting down server", "err", err)
+        return
+    }
+    if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+        slog.Error("error starting server", "err", err)
+    }
+    slog.Info("server stopped")
+    if notReady {
+        a.Close()
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// maintenanceRetryAfter is the Retry-After sent when POST /admin/maintenance
+// does not give one.
+const maintenanceRetryAfter = 60
+
+// errMaintenance is what accept fails with while ingestion is paused.
+var errMaintenance = errors.New("server is in maintenance mode")
+
+// maintenanceState describes a maintenance window in progress.
+type maintenanceState struct {
+    Since      time.Time `json:"since"`
+    Message    string    `json:"message,omitempty"`
+    RetryAfter int       `json:"retry_after"`
+}
+
+// maintenance pauses ingestion without stopping the server: readings get 503
+// with Retry-After while /healthz, /version and the admin endpoints keep
+// answering. It is switched with POST and DELETE /admin/maintenance.
+type maintenance struct {
+    state atomic.Pointer[maintenanceState] // nil while ingestion runs
+}
+
+// current returns the maintenance window in progress, or nil.
+func (m *maintenance) current() *maintenanceState {
+    return m.state.Load()
+}
+
+// refuse answers 503 with Retry-After and reports true while in maintenance.
+func (m *maintenance) refuse(w http.ResponseWriter) bool {
+    s := m.current()
+    if s == nil {
+        return false
+    }
+    msg := "Server in maintenance, retry later"
+    if s.Message != "" {
+        msg = "Server in maintenance: " + s.Message
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(s.RetryAfter))
+    writeError(w, http.StatusServiceUnavailable, msg)
+    return true
+}
+
+// maintenanceResponse is the body of every /admin/maintenance reply.
+type maintenanceResponse struct {
+    Status      string `json:"status"`
+    Maintenance bool   `json:"maintenance"`
+    *maintenanceState
+}
+
+// handleMaintenance reports the maintenance mode on GET, turns it on with
+// POST, taking an optional ?message= for devices and ?retry_after= in
+// seconds, and turns it off with DELETE.
+func (a *app) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+        return
+    }
+    switch r.Method {
+    case http.MethodPost:
+        s := &maintenanceState{Since: time.Now().UTC(), Message: r.URL.Query().Get("message"), RetryAfter: maintenanceRetryAfter}
+        if v := r.URL.Query().Get("retry_after"); v != "" {
+            secs, err := strconv.Atoi(v)
+            if err != nil || secs < 1 {
+                writeError(w, http.StatusBadRequest, "retry_after must be a positive number of seconds")
+                return
+            }
+            s.RetryAfter = secs
+        }
+        if !validHeaderValue(s.Message) {
+            writeError(w, http.StatusBadRequest, "message must not contain control characters")
+            return
+        }
+        if prev := a.maint.state.Swap(s); prev != nil {
+            s.Since = prev.Since
+        }
+        auditNote(r.Context(), "maintenance", "on")
+        auditNote(r.Context(), "message", s.Message)
+        auditNote(r.Context(), "retry_after", strconv.Itoa(s.RetryAfter))
+        slog.WarnContext(r.Context(), "maintenance mode on, refusing readings", "remote_addr", r.RemoteAddr, "client_cn", clientName(r), "message", s.Message, "retry_after", s.RetryAfter)
+    case http.MethodDelete:
+        auditNote(r.Context(), "maintenance", "off")
+        if prev := a.maint.state.Swap(nil); prev != nil {
+            slog.InfoContext(r.Context(), "maintenance mode off, accepting readings", "remote_addr", r.RemoteAddr, "client_cn", clientName(r), "duration", time.Since(prev.Since).Round(time.Second).String())
+        }
+    }
+    s := a.maint.current()
+    writeJSON(w, http.StatusOK, maintenanceResponse{Status: "ok", Maintenance: s != nil, maintenanceState: s})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors for the ingestion endpoint.
+type metrics struct {
+    registry      *prometheus.Registry
+    requests      prometheus.Counter
+    responses     *prometheus.CounterVec
+    receivedBytes prometheus.Counter
+    bodySize      prometheus.Histogram
+    duration      *prometheus.HistogramVec
+
+    handshakeFailures *prometheus.CounterVec
+}
+
+// newMetrics creates the collectors and registers them on a fresh registry.
+func newMetrics() *metrics {
+    m := &metrics{
+        registry: prometheus.NewRegistry(),
+        requests: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "iot_http_requests_total",
+            Help: "Total number of ingestion requests received.",
+        }),
+        responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "iot_http_responses_total",
+            Help: "Ingestion responses by HTTP status code.",
+        }, []string{"code"}),
+        receivedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "iot_received_bytes_total",
+            Help: "Total bytes of request body received.",
+        }),
+        bodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+            Name:    "iot_request_body_bytes",
+            Help:    "Size of ingestion request bodies in bytes.",
+            Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+        }),
+        duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "iot_http_request_duration_seconds",
+            Help:    "Time spent handling ingestion requests.",
+            Buckets: prometheus.DefBuckets,
+        }, nil),
+        handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "iot_tls_handshake_failures_total",
+            Help: "TLS handshakes that did not complete, by reason: version, cipher, certificate, client_alert, timeout, closed, not_tls or other.",
+        }, []string{"reason"}),
+    }
+    m.registry.MustRegister(
+        m.requests,
+        m.responses,
+        m.receivedBytes,
+        m.bodySize,
+        m.duration,
+        m.handshakeFailures,
+        prometheus.NewGoCollector(),
+        prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+    )
+    return m
+}
+
+// instrument wraps the ingestion handler so every request is counted and timed.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+    counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        m.requests.Inc()
+        next.ServeHTTP(w, r)
+    })
+    return promhttp.InstrumentHandlerDuration(m.duration, promhttp.InstrumentHandlerCounter(m.responses, counted))
+}
+
+// watchDataFile exports whether the data file writer is buffering in memory
+// because its disk is full, and how much it is holding.
+func (m *metrics) watchDataFile(d *dataWriter) {
+    m.registry.MustRegister(
+        prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+            Name: "iot_datafile_degraded",
+            Help: "1 while the data file's disk is full and records are buffered in memory.",
+        }, func() float64 {
+            if degraded, _ := d.overflowState(); degraded {
+                return 1
+            }
+            return 0
+        }),
+        prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+            Name: "iot_datafile_overflow_bytes",
+            Help: "Bytes of records buffered in memory waiting for disk space.",
+        }, func() float64 {
+            _, n := d.overflowState()
+            return float64(n)
+        }),
+    )
+}
+
+// watchLoad exports whether devices are being told to back off.
+func (m *metrics) watchLoad(l *loadMonitor) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "iot_overloaded",
+        Help: "1 while readings are refused with 503 because the queue is backed up or the sinks are failing.",
+    }, func() float64 {
+        if l.active() {
+            return 1
+        }
+        return 0
+    }))
+}
+
+// watchCodel exports whether -codel-target is refusing readings, and how many
+// it has refused.
+func (m *metrics) watchCodel(c *codel) {
+    m.registry.MustRegister(
+        prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+            Name: "iot_queue_delay_dropping",
+            Help: "1 while readings are refused because queued readings wait longer than -codel-target.",
+        }, func() float64 {
+            if c.active() {
+                return 1
+            }
+            return 0
+        }),
+        prometheus.NewCounterFunc(prometheus.CounterOpts{
+            Name: "iot_queue_delay_refused_total",
+            Help: "Readings refused with 503 because queued readings waited longer than -codel-target.",
+        }, func() float64 { return float64(c.refused.Load()) }),
+    )
+}
+
+// watchFaults exports how many faults -chaos has injected.
+func (m *metrics) watchFaults(f *faultInjector) {
+    help := "Faults injected into ingestion requests by -chaos, by fault: delay or status."
+    m.registry.MustRegister(
+        prometheus.NewCounterFunc(prometheus.CounterOpts{
+            Name:        "iot_injected_faults_total",
+            Help:        help,
+            ConstLabels: prometheus.Labels{"fault": "delay"},
+        }, func() float64 { return float64(f.delayed.Load()) }),
+        prometheus.NewCounterFunc(prometheus.CounterOpts{
+            Name:        "iot_injected_faults_total",
+            Help:        help,
+            ConstLabels: prometheus.Labels{"fault": "status"},
+        }, func() float64 { return float64(f.failed.Load()) }),
+    )
+}
+
+// watchMaintenance exports whether ingestion is paused.
+func (m *metrics) watchMaintenance(mt *maintenance) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "iot_maintenance",
+        Help: "1 while readings are refused with 503 because maintenance mode is on.",
+    }, func() float64 {
+        if mt.current() != nil {
+            return 1
+        }
+        return 0
+    }))
+}
+
+// watchBodies exports how much of -body-memory is reserved by bodies being read.
+func (m *metrics) watchBodies(b *bodyBudget) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "iot_body_bytes_in_flight",
+        Help: "Bytes of -body-memory reserved by request bodies currently being read.",
+    }, func() float64 {
+        return float64(b.inFlight.Load())
+    }))
+}
+
+// watchBreaker exports the state of the circuit breaker in front of one sink.
+func (m *metrics) watchBreaker(b *breakerSink) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name:        "iot_sink_breaker_state",
+        Help:        "State of the sink's circuit breaker: 0 closed, 1 half-open, 2 open.",
+        ConstLabels: prometheus.Labels{"sink": b.name},
+    }, func() float64 {
+        return float64(b.current())
+    }))
+}
+
+// watchStale exports how many readings arrived older than their device's newest.
+func (m *metrics) watchStale(t *staleTracker) {
+    m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+        Name: "iot_stale_readings_total",
+        Help: "Readings older than the newest from their device, rejected or flagged per -stale-readings.",
+    }, func() float64 {
+        return float64(t.staleCount())
+    }))
+}
+
+// watchSeq exports how many readings -seq-window found missing, and how often
+// a device started its sequence over.
+func (m *metrics) watchSeq(t *seqTracker) {
+    m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+        Name: "iot_missed_readings_total",
+        Help: "Readings missing from their device's seq numbers, counted once -seq-window later ones arrived.",
+    }, func() float64 {
+        return float64(t.missedCount())
+    }))
+    m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+        Name: "iot_sequence_restarts_total",
+        Help: "Times a device's seq numbers started over, as after a reboot.",
+    }, func() float64 {
+        return float64(t.restartCount())
+    }))
+}
+
+// watchDedup exports how many readings -dedup-threshold kept from the sinks.
+func (m *metrics) watchDedup(f *dedupFilter) {
+    m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+        Name: "iot_readings_deduplicated_total",
+        Help: "Readings answered but not stored because they were within -dedup-threshold of their device's last stored reading.",
+    }, func() float64 {
+        return float64(f.droppedCount())
+    }))
+}
+
+// watchWatchdog exports how many -watchdog devices are overdue.
+func (m *metrics) watchWatchdog(wd *watchdog) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "iot_silent_devices",
+        Help: "Devices in the -watchdog file silent for longer than their threshold.",
+    }, func() float64 {
+        return float64(wd.silentCount())
+    }))
+}
+
+// observeBody records the size of a body that was read in full.
+func (m *metrics) observeBody(n int) {
+    m.receivedBytes.Add(float64(n))
+    m.bodySize.Observe(float64(n))
+}
+
+// handler serves the registry in the Prometheus exposition format, gzipped
+// for scrapers that accept it unless plain is set. With -response-key it is,
+// so the signature covers the plain text as on every other route, and
+// -compress gzips it afterwards.
+func (m *metrics) handler(plain bool) http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{DisableCompression: plain})
+}
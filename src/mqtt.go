@@ -0,0 +1,69 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "time"
+
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttSubscriber feeds messages from an MQTT broker into the same pipeline as HTTP POSTs.
+type mqttSubscriber struct {
+    client mqtt.Client
+    topic  string
+}
+
+// startMQTT connects to the broker in cfg and subscribes to the configured topic.
+func startMQTT(cfg Config, a *app) (*mqttSubscriber, error) {
+    s := &mqttSubscriber{topic: cfg.MQTTTopic}
+
+    opts := mqtt.NewClientOptions().
+        AddBroker(cfg.MQTTBroker).
+        SetClientID(cfg.MQTTClientID).
+        SetUsername(cfg.MQTTUsername).
+        SetPassword(cfg.MQTTPassword).
+        SetAutoReconnect(true).
+        SetConnectTimeout(10 * time.Second)
+
+    // Resubscribe on every (re)connect so a broker restart does not silently stop ingestion
+    opts.SetOnConnectHandler(func(c mqtt.Client) {
+        token := c.Subscribe(s.topic, cfg.MQTTQoS, s.handle(a))
+        if token.Wait() && token.Error() != nil {
+            slog.Error("error subscribing to MQTT topic", "topic", s.topic, "err", token.Error())
+            return
+        }
+        slog.Info("subscribed to MQTT topic", "broker", cfg.MQTTBroker, "topic", s.topic)
+    })
+    opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+        slog.Warn("lost connection to MQTT broker", "broker", cfg.MQTTBroker, "err", err)
+    })
+
+    s.client = mqtt.NewClient(opts)
+    token := s.client.Connect()
+    if token.Wait() && token.Error() != nil {
+        return nil, fmt.Errorf("error connecting to MQTT broker %s: %v", cfg.MQTTBroker, token.Error())
+    }
+    return s, nil
+}
+
+// handle returns the message callback that runs each payload through app.accept
+// as a temperature reading, the same as a POST to the root endpoint.
+func (s *mqttSubscriber) handle(a *app) mqtt.MessageHandler {
+    return func(c mqtt.Client, msg mqtt.Message) {
+        o := origin{Transport: "mqtt", RemoteAddr: "mqtt:" + msg.Topic()}
+        if _, _, err := a.accept(context.Background(), o, deviceTypes[0], msg.Payload()); err != nil {
+            slog.Warn("error processing MQTT message", "topic", msg.Topic(), "bytes", len(msg.Payload()), "err", err)
+        }
+    }
+}
+
+// Close unsubscribes and disconnects from the broker.
+func (s *mqttSubscriber) Close() {
+    if token := s.client.Unsubscribe(s.topic); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+        slog.Warn("error unsubscribing from MQTT topic", "topic", s.topic, "err", token.Error())
+    }
+    s.client.Disconnect(250)
+    slog.Info("disconnected from MQTT broker")
+}
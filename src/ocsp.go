@@ -0,0 +1,218 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/ocsp"
+)
+
+// OCSP refresh settings.
+const (
+    ocspCheckEvery = time.Minute     // how often certificates are looked at for due staples
+    ocspRetry      = 5 * time.Minute // wait after a failed fetch
+    ocspNoNext     = 12 * time.Hour  // refresh interval when the responder gives no NextUpdate
+)
+
+// ocspStapler fetches an OCSP response for each served certificate from its
+// responder and attaches it to the handshake, so devices need not ask the CA
+// themselves. Responses are refreshed halfway to their NextUpdate. A failed
+// fetch is logged and the certificate is served without a staple.
+type ocspStapler struct {
+    certs  func() []tls.Certificate // the certificates currently served
+    client *http.Client
+
+    mu      sync.Mutex
+    staples map[[32]byte]*ocspStaple // by SHA-256 of the leaf
+
+    done chan struct{}
+}
+
+// ocspStaple is the latest response for one certificate.
+type ocspStaple struct {
+    der     []byte    // nil until a good response arrives
+    expires time.Time // NextUpdate; the staple is dropped after it
+    due     time.Time // next fetch
+}
+
+// newOCSPStapler returns a stapler for certs. Nothing is fetched until start.
+func newOCSPStapler(certs func() []tls.Certificate) *ocspStapler {
+    return &ocspStapler{
+        certs:   certs,
+        client:  &http.Client{Timeout: 30 * time.Second},
+        staples: make(map[[32]byte]*ocspStaple),
+        done:    make(chan struct{}),
+    }
+}
+
+// start fetches the first staples in the background and keeps them fresh
+// until Close.
+func (s *ocspStapler) start() {
+    go s.refresh()
+}
+
+// wrap returns a GetCertificate callback that staples the certificate chosen
+// by get.
+func (s *ocspStapler) wrap(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+        cert, err := get(hello)
+        if err != nil || len(cert.Certificate) == 0 {
+            return cert, err
+        }
+        s.mu.Lock()
+        st := s.staples[sha256.Sum256(cert.Certificate[0])]
+        s.mu.Unlock()
+        if st == nil || st.der == nil || !time.Now().Before(st.expires) {
+            return cert, nil
+        }
+        // The served certificate is shared, so the staple goes on a copy
+        stapled := *cert
+        stapled.OCSPStaple = st.der
+        return &stapled, nil
+    }
+}
+
+// staticCertificate picks from a fixed list the way crypto/tls does, for
+// certificates that are not reloaded.
+func staticCertificate(certs []tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+        return pickCertificate(certs, hello), nil
+    }
+}
+
+// update fetches a response for every certificate whose staple is due, and
+// forgets the staples of certificates no longer served.
+func (s *ocspStapler) update() {
+    now := time.Now()
+    served := make(map[[32]byte]bool)
+    for _, cert := range s.certs() {
+        if len(cert.Certificate) == 0 {
+            continue
+        }
+        key := sha256.Sum256(cert.Certificate[0])
+        served[key] = true
+        s.mu.Lock()
+        st := s.staples[key]
+        if st == nil {
+            st = &ocspStaple{}
+            s.staples[key] = st
+        }
+        due := !now.Before(st.due)
+        s.mu.Unlock()
+        if !due {
+            continue
+        }
+
+        resp, err := s.fetch(cert)
+        s.mu.Lock()
+        if err != nil {
+            st.due = now.Add(ocspRetry)
+            s.mu.Unlock()
+            slog.Warn("error fetching OCSP response, serving certificate without a staple", "names", leafNames(cert), "err", err)
+            continue
+        }
+        st.der, st.expires = resp.Raw, resp.NextUpdate
+        if resp.NextUpdate.IsZero() {
+            st.expires = now.Add(ocspNoNext)
+        }
+        st.due = resp.ThisUpdate.Add(st.expires.Sub(resp.ThisUpdate) / 2)
+        if st.due.Before(now.Add(ocspCheckEvery)) {
+            st.due = now.Add(ocspCheckEvery)
+        }
+        s.mu.Unlock()
+        slog.Info("stapling OCSP response", "names", leafNames(cert), "this_update", resp.ThisUpdate, "next_update", resp.NextUpdate)
+    }
+
+    s.mu.Lock()
+    for key := range s.staples {
+        if !served[key] {
+            delete(s.staples, key)
+        }
+    }
+    s.mu.Unlock()
+}
+
+// fetch asks the certificate's responder for its status. The issuer must be
+// the second certificate in the chain. Only a "good" answer is stapled.
+func (s *ocspStapler) fetch(cert tls.Certificate) (*ocsp.Response, error) {
+    leaf, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        return nil, err
+    }
+    if len(leaf.OCSPServer) == 0 {
+        return nil, errors.New("certificate names no OCSP responder")
+    }
+    if len(cert.Certificate) < 2 {
+        return nil, errors.New("certificate chain does not include the issuer")
+    }
+    issuer, err := x509.ParseCertificate(cert.Certificate[1])
+    if err != nil {
+        return nil, fmt.Errorf("parsing issuer: %v", err)
+    }
+    req, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{})
+    if err != nil {
+        return nil, err
+    }
+
+    httpResp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+    if err != nil {
+        return nil, err
+    }
+    defer httpResp.Body.Close()
+    if httpResp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s answered %s", leaf.OCSPServer[0], httpResp.Status)
+    }
+    body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+    if err != nil {
+        return nil, err
+    }
+    resp, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+    if err != nil {
+        return nil, err
+    }
+    switch resp.Status {
+    case ocsp.Good:
+        return resp, nil
+    case ocsp.Revoked:
+        return nil, fmt.Errorf("certificate was REVOKED at %s", resp.RevokedAt)
+    }
+    return nil, errors.New("responder does not know the certificate")
+}
+
+// leafNames returns the DNS names of a certificate, for logging.
+func leafNames(cert tls.Certificate) []string {
+    if cert.Leaf != nil {
+        return cert.Leaf.DNSNames
+    }
+    return nil
+}
+
+// refresh updates the staples every ocspCheckEvery until Close.
+func (s *ocspStapler) refresh() {
+    s.update()
+    ticker := time.NewTicker(ocspCheckEvery)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            s.update()
+        case <-s.done:
+            return
+        }
+    }
+}
+
+// Close stops the refresh goroutine.
+func (s *ocspStapler) Close() {
+    close(s.done)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// decryptError is a body that cannot be decrypted because of what the device
+// sent; it is answered with 400 and dead-lettered.
+type decryptError struct {
+    reason string
+}
+
+func (e *decryptError) Error() string { return e.reason }
+
+// decryptBody opens a body sealed with AES-GCM under the sending device's
+// payload key, using the hex nonce in X-Nonce. A device without a key in the
+// database sends plaintext, which is returned unchanged; a device with one
+// must encrypt every body. It returns errAuthUnavailable when the key cannot be looked up.
+func (a *app) decryptBody(r *http.Request, body []byte) ([]byte, error) {
+    device := deviceIdentity(r)
+    entry, err := a.authdb.lookup(device)
+    if err != nil {
+        return nil, err
+    }
+    nonceHex := strings.TrimSpace(r.Header.Get("X-Nonce"))
+    switch {
+    case entry.key == "" && nonceHex == "":
+        return body, nil
+    case entry.key == "":
+        return nil, &decryptError{"device has no payload key but sent X-Nonce"}
+    case nonceHex == "":
+        return nil, &decryptError{"body must be encrypted: X-Nonce is missing"}
+    }
+
+    key, err := hex.DecodeString(entry.key)
+    if err != nil {
+        return nil, fmt.Errorf("payload key for device %s is not hex: %v", device, err)
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, fmt.Errorf("payload key for device %s: %v", device, err)
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+    nonce, err := hex.DecodeString(nonceHex)
+    if err != nil || len(nonce) != gcm.NonceSize() {
+        return nil, &decryptError{fmt.Sprintf("X-Nonce must be %d hex-encoded bytes", gcm.NonceSize())}
+    }
+    plain, err := gcm.Open(nil, nonce, body, nil)
+    if err != nil {
+        return nil, &decryptError{"decryption failed: wrong key, nonce or corrupted body"}
+    }
+    return plain, nil
+}
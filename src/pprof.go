@@ -0,0 +1,42 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/pprof"
+    "time"
+)
+
+// loopbackAddr checks that addr, such as 127.0.0.1:6060, only listens on the
+// loopback interface, so profiles are never reachable from the network.
+func loopbackAddr(addr string) error {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    if host == "localhost" {
+        return nil
+    }
+    if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+        return nil
+    }
+    return fmt.Errorf("host %q is not a loopback address; use 127.0.0.1 or [::1]", host)
+}
+
+// newPprofServer serves the net/http/pprof handlers under /debug/pprof/ on
+// addr. It has its own mux so nothing is registered on http.DefaultServeMux
+// or reachable through the TLS listener.
+func newPprofServer(addr string) *http.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    return &http.Server{
+        Addr:              addr,
+        Handler:           mux,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+// mediaProblem is the media type of every error response.
+const mediaProblem = "application/problem+json"
+
+// problem is an RFC 7807 error body. Type is always about:blank, so Title is
+// the status text and clients can switch on Status; Detail says what went
+// wrong in words meant for a person.
+type problem struct {
+    Type      string `json:"type"`
+    Title     string `json:"title"`
+    Status    int    `json:"status"`
+    Detail    string `json:"detail,omitempty"`
+    RequestID string `json:"request_id,omitempty"`
+
+    // Details lists each problem found, for a reading that breaks the schema
+    Details []string `json:"details,omitempty"`
+}
+
+// writeProblem fills in what p leaves out and writes it with its status. The
+// request ID is read back from the response header withRequestID set.
+func writeProblem(w http.ResponseWriter, p problem) {
+    if p.Type == "" {
+        p.Type = "about:blank"
+    }
+    if p.Title == "" {
+        p.Title = http.StatusText(p.Status)
+    }
+    p.RequestID = w.Header().Get("X-Request-ID")
+    h := w.Header()
+    h.Set("Content-Type", mediaProblem)
+    h.Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(p.Status)
+    json.NewEncoder(w).Encode(p)
+}
+
+// writeError answers with status and a problem body whose detail is msg; every
+// error response goes through here so clients can parse them all the same way.
+func writeError(w http.ResponseWriter, status int, msg string) {
+    writeProblem(w, problem{Status: status, Detail: msg})
+}
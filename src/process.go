@@ -0,0 +1,306 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// origin describes where a payload came from.
+type origin struct {
+    Transport  string      // "https" or "mqtt"
+    RemoteAddr string
+    ClientCN   string
+    DeviceID   string      // device id sent out of band (X-Device-ID), if any
+    MediaType  string      // Content-Type without parameters; "" for MQTT, meaning JSON
+    Header     http.Header // request headers, kept with dead letters; nil for MQTT
+    RequestID  string      // X-Request-ID of the HTTP request or WebSocket upgrade
+}
+
+// invalidReadingError marks a payload rejected for its content rather than a server fault.
+type invalidReadingError struct {
+    err error
+}
+
+func (e *invalidReadingError) Error() string { return e.err.Error() }
+func (e *invalidReadingError) Unwrap() error { return e.err }
+
+// outcome is what accept did with a reading it took.
+type outcome int
+
+const (
+    outcomeStored       outcome = iota // every required sink has it
+    outcomeQueued                      // handed to the workers, not stored yet
+    outcomeDeduplicated                // too close to the last one stored, dropped
+)
+
+// accept decodes one payload of the given device type and then either stores it
+// right away or, when the worker queue is enabled, hands it to the workers, and
+// reports which it did. Every transport goes through here so the data file and logs
+// look the same regardless of how a reading arrived. With -dedup-threshold, a
+// reading that has not changed enough since the last one stored from its
+// device is dropped instead. If ctx is cancelled, because
+// the client went away or shutdown ran out of time, processing stops with ctx.Err().
+func (a *app) accept(ctx context.Context, o origin, dt deviceType, body []byte) (reading SensorReading, out outcome, err error) {
+    if err := ctx.Err(); err != nil {
+        return reading, 0, err
+    }
+
+    // Connections already open when maintenance began are refused line by line.
+    // MQTT keeps flowing, since the broker would not deliver a refused message again
+    if o.Transport != "mqtt" && a.maint.current() != nil {
+        return reading, 0, errMaintenance
+    }
+
+    // Rename a vendor's keys to the reading fields before anything reads them,
+    // the schema included; raw bytes kept by -sniff have no keys to rename
+    structured := o.MediaType != mediaOctetStream
+    var vendor string
+    if a.fields != nil && structured && dt.accepts(mediaJSON) {
+        out, v, err := a.fields.apply(originDevice(o), body, o.MediaType)
+        if err != nil {
+            a.deadLetter(o, dt, err.Error(), body)
+            return reading, 0, &invalidReadingError{err}
+        }
+        body, vendor = out, v
+    }
+
+    // Check structured payloads against the configured schema before decoding
+    // them, or reshaping them below
+    if a.schema != nil && structured && dt.accepts(mediaJSON) {
+        if err := a.schema.validate(body, o.MediaType); err != nil {
+            a.deadLetter(o, dt, err.Error(), body)
+            return reading, 0, err
+        }
+    }
+
+    // Decode and validate the reading, or only identify the device of raw bytes
+    if structured {
+        reading, err = dt.Decode(body, o)
+    } else {
+        reading, err = decodeRaw(body, o)
+    }
+    if err != nil {
+        if vendor != "" {
+            err = fmt.Errorf("%v after mapping the keys of vendor %s", err, vendor)
+        }
+        a.deadLetter(o, dt, err.Error(), body)
+        return reading, 0, &invalidReadingError{err}
+    }
+
+    // Reshape JSON readings for the downstream sinks; a template fault keeps the raw payload
+    if a.transform != nil && structured && dt.accepts(mediaJSON) {
+        out, err := a.transform.apply(dt, reading)
+        if err != nil {
+            err = &transformError{err}
+            a.deadLetter(o, dt, err.Error(), body)
+            return reading, 0, err
+        }
+        body = out
+    }
+
+    if err := ctx.Err(); err != nil {
+        return reading, 0, err
+    }
+
+    // -echo stops here: the caller reports the reading instead of it being stored
+    if a.cfg.Echo {
+        return reading, 0, nil
+    }
+
+    // Any reading decoded counts as contact, even one not stored in the end
+    if a.watch != nil {
+        a.watch.seen(readingDevice(o, reading), time.Now())
+    }
+
+    // Like contact, a seq number counts as arrived even if the reading is not stored
+    if a.seq != nil && reading.Seq != nil {
+        if gap := a.seq.arrived(readingDevice(o, reading), *reading.Seq); gap != nil {
+            slog.WarnContext(ctx, "readings missing from device sequence", "remote_addr", o.RemoteAddr, "device_id", gap.DeviceID, "expected", gap.Expected, "received", gap.Received, "missed", gap.Missed)
+        }
+    }
+
+    // Old buffered readings resent after a reconnect must not overwrite fresher ones
+    if a.stale != nil {
+        if err := a.stale.check(readingDevice(o, reading), reading.Timestamp, time.Now()); err != nil {
+            if a.cfg.StaleReadings == "reject" {
+                a.deadLetter(o, dt, err.Error(), body)
+                return reading, 0, err
+            }
+            slog.WarnContext(ctx, "storing out-of-order reading", "remote_addr", o.RemoteAddr, "err", err)
+        }
+    }
+
+    // Near-identical repeats are answered as usual but never reach the sinks
+    if a.dedup != nil && a.dedup.duplicate(readingDevice(o, reading), reading) {
+        slog.DebugContext(ctx, "dropping unchanged reading", "remote_addr", o.RemoteAddr, "device_id", reading.DeviceID)
+        return reading, outcomeDeduplicated, nil
+    }
+
+    // Add the device's metadata, so the sinks need no join to find it
+    if a.enrich != nil {
+        body = a.enrich.apply(readingDevice(o, reading), body, o.MediaType, time.Now())
+    }
+    j := job{origin: o, dt: dt, reading: reading, body: body}
+    if a.queue != nil {
+        return reading, outcomeQueued, a.queue.enqueue(j)
+    }
+    return reading, 0, a.store(ctx, j)
+}
+
+// originDevice names the device a payload came from before it is decoded:
+// its certificate CN, or the X-Device-ID it sent.
+func originDevice(o origin) string {
+    if o.ClientCN != "" {
+        return o.ClientCN
+    }
+    return o.DeviceID
+}
+
+// readingDevice names the device a reading came from: its certificate CN, or
+// the device_id it reported without one.
+func readingDevice(o origin, reading SensorReading) string {
+    if o.ClientCN != "" {
+        return o.ClientCN
+    }
+    return reading.DeviceID
+}
+
+// deadLetter preserves a payload that was refused or could not be processed,
+// if a dead-letter file is configured. The write happens in the background.
+func (a *app) deadLetter(o origin, dt deviceType, reason string, body []byte) {
+    if a.dead == nil || a.cfg.Echo {
+        return
+    }
+    a.dead.Add(deadLetter{
+        Timestamp:  time.Now().UTC(),
+        Transport:  o.Transport,
+        RemoteAddr: o.RemoteAddr,
+        Type:       dt.Name,
+        Reason:     reason,
+        RequestID:  o.RequestID,
+        Headers:    deadLetterHeaders(o.Header),
+        Payload:    body,
+    })
+}
+
+// fanOut hands j to every sink concurrently and waits for all of them. It
+// returns the first failure of a required sink; optional sinks only log theirs.
+func (a *app) fanOut(ctx context.Context, j job) error {
+    // The common single-sink setup needs neither goroutines nor result slices
+    if len(a.sinks) == 1 {
+        start := time.Now()
+        err := storeWithRetry(ctx, a.sinks[0], j, a.cfg.SinkRetries, a.cfg.SinkBackoff)
+        return sinkResult(ctx, a.sinks[0], j, err, time.Since(start))
+    }
+
+    errs := make([]error, len(a.sinks))
+    took := make([]time.Duration, len(a.sinks))
+    var wg sync.WaitGroup
+    for i := range a.sinks {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            start := time.Now()
+            errs[i] = storeWithRetry(ctx, a.sinks[i], j, a.cfg.SinkRetries, a.cfg.SinkBackoff)
+            took[i] = time.Since(start)
+        }(i)
+    }
+    wg.Wait()
+
+    var failed error
+    for i, sink := range a.sinks {
+        if err := sinkResult(ctx, sink, j, errs[i], took[i]); err != nil && failed == nil {
+            failed = err
+        }
+    }
+    return failed
+}
+
+// sinkResult logs how one sink did with j and returns the error that fails
+// the reading, if any.
+func sinkResult(ctx context.Context, sink configuredSink, j job, err error, took time.Duration) error {
+    debug := slog.Default().Enabled(ctx, slog.LevelDebug)
+    switch {
+    case err == nil:
+        if debug {
+            slog.Debug("stored reading", "sink", sink.name, "device_id", j.reading.DeviceID, "request_id", j.origin.RequestID, "duration", took.String())
+        }
+        return nil
+    case sink.optional:
+        slog.Warn("optional sink failed, reading stored without it", "sink", sink.name, "device_id", j.reading.DeviceID, "request_id", j.origin.RequestID, "err", err)
+        return nil
+    default:
+        if debug {
+            slog.Debug("required sink failed", "sink", sink.name, "device_id", j.reading.DeviceID, "request_id", j.origin.RequestID, "duration", took.String(), "err", err)
+        }
+        return fmt.Errorf("error storing reading in %s: %w", sink.name, err)
+    }
+}
+
+// store logs a decoded reading and writes it through every sink.
+func (a *app) store(ctx context.Context, j job) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    reading := j.reading
+
+    // Log the received reading, tagged with the device certificate when mTLS
+    // is on; the attributes are only built when info is logged at all
+    if slog.Default().Enabled(ctx, slog.LevelInfo) {
+        attrs := make([]slog.Attr, 0, 10)
+        attrs = append(attrs,
+            slog.String("type", j.dt.Name),
+            slog.String("transport", j.origin.Transport),
+            slog.String("remote_addr", j.origin.RemoteAddr),
+            slog.String("client_cn", j.origin.ClientCN),
+            slog.String("request_id", j.origin.RequestID),
+            slog.Int("bytes", len(j.body)),
+            a.redact.attr(slog.String("device_id", reading.DeviceID)),
+            a.redact.attr(slog.Int64("ts", reading.Timestamp)),
+        )
+        if reading.Temp != nil {
+            attrs = append(attrs, a.redact.attr(slog.Float64("temp", *reading.Temp)))
+        }
+        if reading.Open != nil {
+            attrs = append(attrs, a.redact.attr(slog.Bool("open", *reading.Open)))
+        }
+        slog.LogAttrs(context.Background(), slog.LevelInfo, "received reading", attrs...)
+    }
+
+    // Persist the reading through every sink at once, retrying transient
+    // failures. Only the required sinks decide the outcome, and a reading one
+    // of them would not take is kept in the dead-letter file
+    if err := a.fanOut(ctx, j); err != nil {
+        if a.load != nil && ctx.Err() == nil {
+            a.load.observe(false)
+        }
+        var unavailable *sinkUnavailableError
+        if errors.As(err, &unavailable) {
+            a.deadLetter(j.origin, j.dt, err.Error(), j.body)
+        }
+        return err
+    }
+
+    if a.load != nil {
+        a.load.observe(true)
+    }
+    if a.dedup != nil {
+        a.dedup.stored(readingDevice(j.origin, reading), reading)
+    }
+
+    // Keep it in memory so recent readings can be inspected without a database
+    if a.recent != nil {
+        a.recent.add(reading)
+    }
+    if a.stats != nil {
+        a.stats.add(reading, time.Now())
+    }
+
+    // You can perform additional processing here if needed
+    return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// countingSink counts the readings it stored, per device, after failing the
+// first failures calls with a transient error.
+type countingSink struct {
+    mu       sync.Mutex
+    failures int
+    calls    int
+    stored   map[string]int
+}
+
+func (s *countingSink) Store(ctx context.Context, j job) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.calls++
+    if s.failures > 0 {
+        s.failures--
+        return errors.New("connection reset")
+    }
+    if s.stored == nil {
+        s.stored = make(map[string]int)
+    }
+    s.stored[j.reading.DeviceID]++
+    return nil
+}
+
+func TestAcceptStoresOnce(t *testing.T) {
+    a := newTestApp(t, "-sink-retries", "3", "-sink-backoff", "1ms", "-dedup-threshold", "0.5")
+    flaky, steady := &countingSink{failures: 2}, &countingSink{}
+    a.sinks = []configuredSink{{Sink: flaky, name: "flaky"}, {Sink: steady, name: "steady"}}
+
+    readings := []struct {
+        body  string
+        out   outcome
+        store bool
+    }{
+        {`{"device_id":"t1","temp":20.0,"ts":1700000000}`, outcomeStored, true},
+        {`{"device_id":"t1","temp":20.1,"ts":1700000001}`, outcomeDeduplicated, false},
+        {`{"device_id":"t1","temp":25.0,"ts":1700000002}`, outcomeStored, true},
+        {`{"device_id":"t2","temp":20.0,"ts":1700000003}`, outcomeStored, true},
+    }
+    want := map[string]int{}
+    for i, tt := range readings {
+        reading, out, err := a.accept(context.Background(), origin{Transport: "https", MediaType: mediaJSON}, deviceTypes[0], []byte(tt.body))
+        if err != nil {
+            t.Fatalf("reading %d: accept: %v", i, err)
+        }
+        if out != tt.out {
+            t.Errorf("reading %d: outcome = %v, want %v", i, out, tt.out)
+        }
+        if tt.store {
+            want[reading.DeviceID]++
+        }
+    }
+
+    for _, s := range []*countingSink{flaky, steady} {
+        for id, n := range want {
+            if s.stored[id] != n {
+                t.Errorf("stored %d readings from %s, want %d", s.stored[id], id, n)
+            }
+        }
+    }
+    if flaky.calls != 3+2 {
+        t.Errorf("flaky sink called %d times, want 5: 3 readings and 2 retries", flaky.calls)
+    }
+    if steady.calls != 3 {
+        t.Errorf("steady sink called %d times, want 3", steady.calls)
+    }
+}
+
+// slowSink blocks every Store until ctx is done, as a backend that stopped
+// answering would, and records any reading it was let write.
+type slowSink struct {
+    started chan struct{}
+    written int
+}
+
+func (s *slowSink) Store(ctx context.Context, j job) error {
+    s.started <- struct{}{}
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-time.After(10 * time.Second):
+        s.written++
+        return nil
+    }
+}
+
+func TestAcceptCancelled(t *testing.T) {
+    a := newTestApp(t)
+    sink := &slowSink{started: make(chan struct{}, 1)}
+    a.sinks = []configuredSink{{Sink: sink, name: "slow"}}
+    body := []byte(`{"device_id":"t1","temp":20.0,"ts":1700000000}`)
+    o := origin{Transport: "https", MediaType: mediaJSON}
+
+    t.Run("while storing", func(t *testing.T) {
+        ctx, cancel := context.WithCancel(context.Background())
+        go func() {
+            <-sink.started
+            cancel()
+        }()
+        done := make(chan error, 1)
+        go func() {
+            _, _, err := a.accept(ctx, o, deviceTypes[0], body)
+            done <- err
+        }()
+        select {
+        case err := <-done:
+            if !errors.Is(err, context.Canceled) {
+                t.Fatalf("accept = %v, want context.Canceled", err)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("accept kept waiting for the sink after it was cancelled")
+        }
+    })
+
+    t.Run("before storing", func(t *testing.T) {
+        ctx, cancel := context.WithCancel(context.Background())
+        cancel()
+        if _, _, err := a.accept(ctx, o, deviceTypes[0], body); !errors.Is(err, context.Canceled) {
+            t.Errorf("accept = %v, want context.Canceled", err)
+        }
+        reading, _ := deviceTypes[0].Decode(body, o)
+        if err := a.store(ctx, job{origin: o, dt: deviceTypes[0], reading: reading, body: body}); !errors.Is(err, context.Canceled) {
+            t.Errorf("store = %v, want context.Canceled", err)
+        }
+        if len(sink.started) != 0 {
+            t.Error("the sink was called with a cancelled context")
+        }
+    })
+
+    if sink.written != 0 {
+        t.Errorf("the sink wrote %d readings, want none", sink.written)
+    }
+    if got := a.recent.get("t1"); len(got) != 0 {
+        t.Errorf("%d cancelled readings kept as recent, want none", len(got))
+    }
+}
+
+func TestAcceptFutureReading(t *testing.T) {
+    a := newTestApp(t, "-stale-readings", "reject", "-stale-max-skew", "1m")
+    now := time.Now().Unix()
+    accept := func(o origin, body string) error {
+        _, _, err := a.accept(context.Background(), o, deviceTypes[0], []byte(body))
+        return err
+    }
+    o := origin{Transport: "https", MediaType: mediaJSON}
+
+    var invalid *invalidReadingError
+    if err := accept(o, fmt.Sprintf(`{"device_id":"t1","temp":20.0,"ts":%d}`, now+365*24*3600)); !errors.As(err, &invalid) {
+        t.Fatalf("far-future reading: accept = %v, want an invalid reading", err)
+    }
+    if err := accept(o, fmt.Sprintf(`{"device_id":"t1","temp":20.1,"ts":%d}`, now)); err != nil {
+        t.Fatalf("current reading after a far-future one: accept = %v, want it stored", err)
+    }
+
+    // A body naming another device moves the certificate holder's newest, not its
+    cert := origin{Transport: "https", MediaType: mediaJSON, ClientCN: "t2"}
+    if err := accept(cert, fmt.Sprintf(`{"device_id":"t3","temp":20.2,"ts":%d}`, now)); err != nil {
+        t.Fatalf("reading from t2: accept = %v", err)
+    }
+    if err := accept(o, fmt.Sprintf(`{"device_id":"t3","temp":20.3,"ts":%d}`, now-60)); err != nil {
+        t.Errorf("older reading from t3: accept = %v, want it stored", err)
+    }
+}
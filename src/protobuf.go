@@ -0,0 +1,43 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "mime"
+
+    "google.golang.org/protobuf/proto"
+
+    "github.com/mytechnotalent/IoT/sensor/sensorpb"
+)
+
+// mediaProtobuf is a sensorpb.Reading in the protobuf wire format, as
+// described in sensor/sensorpb/reading.proto. Like a legacy record it is
+// converted to the equivalent JSON reading as soon as it is read.
+const mediaProtobuf = "application/x-protobuf"
+
+// protobufMessage is the only message a protobuf reading may hold.
+var protobufMessage = string((&sensorpb.Reading{}).ProtoReflect().Descriptor().FullName())
+
+// protobufToJSON converts a protobuf reading to the JSON reading it stands
+// for. A Content-Type that names the message, with the messageType or proto
+// parameter senders commonly use, must name iot.sensor.v1.Reading.
+func protobufToJSON(body []byte, contentType string) ([]byte, error) {
+    if _, params, err := mime.ParseMediaType(contentType); err == nil {
+        for _, name := range []string{"messagetype", "proto"} {
+            if msg, ok := params[name]; ok && msg != protobufMessage {
+                return nil, fmt.Errorf("unsupported protobuf message %q: want %s", msg, protobufMessage)
+            }
+        }
+    }
+    var m sensorpb.Reading
+    if err := proto.Unmarshal(body, &m); err != nil {
+        return nil, fmt.Errorf("malformed protobuf: %v", err)
+    }
+    return json.Marshal(SensorReading{
+        DeviceID:  m.DeviceId,
+        Temp:      m.Temp,
+        Open:      m.Open,
+        Seq:       m.Seq,
+        Timestamp: m.Ts,
+    })
+}
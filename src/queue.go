@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// errQueueFull is returned when the worker queue cannot take another reading.
+var errQueueFull = errors.New("processing queue is full")
+
+// job is a decoded reading waiting to be stored.
+type job struct {
+    origin  origin
+    dt      deviceType
+    reading SensorReading
+    body    []byte
+    queued  time.Time // when it entered the worker queue
+}
+
+// workQueue decouples receiving readings from storing them: handlers enqueue
+// and return immediately while a fixed pool of workers drains the channel.
+type workQueue struct {
+    jobs   chan job
+    wg     sync.WaitGroup
+    ctx    context.Context
+    cancel context.CancelFunc
+    lost   atomic.Int64
+    codel  *codel // nil without -codel-target
+
+    mu     sync.RWMutex
+    closed bool
+}
+
+// newWorkQueue starts workers goroutines that call handle for each job. Jobs
+// that fail because Close gave up waiting for them are passed to drop instead.
+// With c, new jobs are refused while queued ones wait too long.
+func newWorkQueue(depth, workers int, c *codel, handle func(context.Context, job) error, drop func(job)) *workQueue {
+    q := &workQueue{jobs: make(chan job, depth), codel: c}
+    q.ctx, q.cancel = context.WithCancel(context.Background())
+    for i := 0; i < workers; i++ {
+        q.wg.Add(1)
+        go func() {
+            defer q.wg.Done()
+            for j := range q.jobs {
+                if q.codel != nil {
+                    now := time.Now()
+                    q.codel.dequeued(now.Sub(j.queued), len(q.jobs) == 0, now)
+                }
+                err := handle(q.ctx, j)
+                switch {
+                case err != nil && q.ctx.Err() != nil:
+                    q.lost.Add(1)
+                    drop(j)
+                case err != nil:
+                    slog.Error("error storing queued reading", "remote_addr", j.origin.RemoteAddr, "device_id", j.reading.DeviceID, "err", err)
+                }
+            }
+        }()
+    }
+    return q
+}
+
+// enqueue adds j without blocking, returning errQueueFull when there is no room,
+// or errQueueDelay when -codel-target refuses it, so devices are told to back
+// off instead of waiting.
+func (q *workQueue) enqueue(j job) error {
+    q.mu.RLock()
+    defer q.mu.RUnlock()
+    if q.closed {
+        return errQueueFull
+    }
+    j.queued = time.Now()
+    if q.codel != nil && !q.codel.admit() {
+        return errQueueDelay
+    }
+    select {
+    case q.jobs <- j:
+        return nil
+    default:
+        return errQueueFull
+    }
+}
+
+// Close stops accepting jobs and waits up to timeout for the workers to drain
+// what is queued. After that the jobs in progress are cancelled and everything
+// still queued goes to drop, so the sinks can be closed straight afterwards.
+func (q *workQueue) Close(timeout time.Duration) {
+    q.mu.Lock()
+    if q.closed {
+        q.mu.Unlock()
+        return
+    }
+    q.closed = true
+    close(q.jobs)
+    q.mu.Unlock()
+
+    slog.Info("draining processing queue", "pending", len(q.jobs), "timeout", timeout.String())
+    drained := make(chan struct{})
+    go func() {
+        q.wg.Wait()
+        close(drained)
+    }()
+    t := time.NewTimer(timeout)
+    defer t.Stop()
+    select {
+    case <-drained:
+        q.cancel()
+        return
+    case <-t.C:
+    }
+
+    q.cancel()
+    <-drained
+    if lost := q.lost.Load(); lost > 0 {
+        slog.Error("processing queue did not drain in time, readings not stored", "lost", lost)
+    }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "golang.org/x/time/rate"
+)
+
+// limiterIdle is how long a client IP may go quiet before its bucket is forgotten.
+const limiterIdle = 10 * time.Minute
+
+// clientLimiter is the token bucket for one client IP.
+type clientLimiter struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// ipLimiter keeps a token bucket per remote IP, or per device for devices
+// with a rate in the -device-limits file.
+type ipLimiter struct {
+    mu      sync.Mutex
+    limit   rate.Limit
+    burst   int
+    clients map[string]*clientLimiter
+    devices *deviceLimits
+    done    chan struct{}
+
+    trustProxy bool // key clients by X-Forwarded-For, as for -allow-cidr
+}
+
+// newIPLimiter returns a limiter allowing perSecond requests with the given burst
+// per client IP, and starts the goroutine that forgets idle clients.
+func newIPLimiter(perSecond float64, burst int) *ipLimiter {
+    burst = defaultBurst(perSecond, burst)
+    l := &ipLimiter{
+        limit:   rate.Limit(perSecond),
+        burst:   burst,
+        clients: make(map[string]*clientLimiter),
+        done:    make(chan struct{}),
+    }
+    go l.collect(time.Minute)
+    return l
+}
+
+// defaultBurst is burst, or the rate rounded up when burst is not set.
+func defaultBurst(perSecond float64, burst int) int {
+    if burst <= 0 {
+        burst = int(math.Max(1, math.Ceil(perSecond)))
+    }
+    return burst
+}
+
+// bucket returns the token bucket of the client with the given key at the
+// given rate.
+func (l *ipLimiter) bucket(key string, limit rate.Limit, burst int) *rate.Limiter {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    c, ok := l.clients[key]
+    if !ok {
+        c = &clientLimiter{limiter: rate.NewLimiter(limit, burst)}
+        l.clients[key] = c
+    } else if c.limiter.Limit() != limit || c.limiter.Burst() != burst {
+        // A reloaded device override applies to the existing bucket
+        c.limiter.SetLimit(limit)
+        c.limiter.SetBurst(burst)
+    }
+    c.lastSeen = time.Now()
+    return c.limiter
+}
+
+// allow reports whether the client with the given key may make a request now
+// at the given rate, and if not how long it should wait.
+func (l *ipLimiter) allow(key string, limit rate.Limit, burst int) (bool, time.Duration) {
+    res := l.bucket(key, limit, burst).Reserve()
+    if delay := res.Delay(); delay > 0 {
+        res.Cancel()
+        return false, delay
+    }
+    return true, 0
+}
+
+// peek is allow without taking a token.
+func (l *ipLimiter) peek(key string, limit rate.Limit, burst int) (bool, time.Duration) {
+    tokens := l.bucket(key, limit, burst).Tokens()
+    if tokens >= 1 {
+        return true, 0
+    }
+    return false, time.Duration((1 - tokens) / float64(limit) * float64(time.Second))
+}
+
+// collect periodically drops clients that have been idle so the map stays bounded.
+func (l *ipLimiter) collect(every time.Duration) {
+    ticker := time.NewTicker(every)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-l.done:
+            return
+        case now := <-ticker.C:
+            l.mu.Lock()
+            for ip, c := range l.clients {
+                if now.Sub(c.lastSeen) > limiterIdle {
+                    delete(l.clients, ip)
+                }
+            }
+            l.mu.Unlock()
+        }
+    }
+}
+
+// Close stops the idle-client collector.
+func (l *ipLimiter) Close() {
+    close(l.done)
+}
+
+// pendingRateKey is the context key of a request's pendingRate.
+type pendingRateKey struct{}
+
+// pendingRate is a request from a client claiming to be a device with a rate
+// of its own. The claim is not verified before authentication, so the request
+// is only let through if its IP's bucket could pay for it; once authenticate
+// has checked the claim, settle or charge bills the right bucket.
+type pendingRate struct {
+    device string
+    ip     string
+}
+
+// middleware rejects requests from clients that exceeded their rate with 429.
+func (l *ipLimiter) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // Devices with their own rate get a bucket of their own instead of
+        // their IP's. A certificate CN is verified already; a device that
+        // authenticates by secret is not yet, so it waits for settle
+        ip := clientIP(r, l.trustProxy)
+        if l.devices != nil {
+            if id, d, ok := l.devices.lookup(r); ok && d.Rate > 0 {
+                if ok, wait := l.allow("device:"+id, rate.Limit(d.Rate), defaultBurst(d.Rate, d.Burst)); !ok {
+                    refuseRate(w, r, wait)
+                    return
+                }
+                next.ServeHTTP(w, r)
+                return
+            }
+            if id := deviceIdentity(r); id != "" && l.devices.current()[id].Rate > 0 {
+                if l.limit != 0 {
+                    if ok, wait := l.peek(ip, l.limit, l.burst); !ok {
+                        refuseRate(w, r, wait)
+                        return
+                    }
+                }
+                next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pendingRateKey{}, pendingRate{device: id, ip: ip})))
+                return
+            }
+        }
+        if l.limit == 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if ok, wait := l.allow(ip, l.limit, l.burst); !ok {
+            refuseRate(w, r, wait)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// settle bills a request that claimed a device with its own rate, now that
+// authentication passed: to the device's bucket if the claim was verified,
+// else to its IP's. It answers 429 and returns false if that bucket is empty.
+func (l *ipLimiter) settle(w http.ResponseWriter, r *http.Request) bool {
+    p, ok := r.Context().Value(pendingRateKey{}).(pendingRate)
+    if !ok {
+        return true
+    }
+    key, limit, burst := p.ip, l.limit, l.burst
+    if id, d, ok := l.devices.lookup(r); ok && d.Rate > 0 && id == p.device {
+        key, limit, burst = "device:"+id, rate.Limit(d.Rate), defaultBurst(d.Rate, d.Burst)
+    }
+    if limit == 0 {
+        return true
+    }
+    if ok, wait := l.allow(key, limit, burst); !ok {
+        refuseRate(w, r, wait)
+        return false
+    }
+    return true
+}
+
+// charge bills a request that claimed a device with its own rate and then
+// failed authentication to its IP's bucket, so guessing secrets costs as much
+// as any other request.
+func (l *ipLimiter) charge(r *http.Request) {
+    if p, ok := r.Context().Value(pendingRateKey{}).(pendingRate); ok && l.limit != 0 {
+        l.allow(p.ip, l.limit, l.burst)
+    }
+}
+
+// refuseRate answers 429, telling the client how long to wait.
+func refuseRate(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+    secs := int(math.Ceil(wait.Seconds()))
+    slog.WarnContext(r.Context(), "rate limit exceeded", "remote_addr", r.RemoteAddr, "retry_after", secs)
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+}
+
+// remoteIP returns the IP part of the request's remote address.
+func remoteIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
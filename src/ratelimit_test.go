@@ -0,0 +1,64 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestDeviceRateNeedsVerifiedDevice(t *testing.T) {
+    l := newIPLimiter(1, 1)
+    defer l.Close()
+    l.devices = &deviceLimits{devices: map[string]deviceLimit{"camera-01": {Rate: 100, Burst: 100}}}
+
+    // Stands in for authenticate, passing the device's secret or not
+    handler := func(verified bool) http.Handler {
+        return l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Header.Get("Authorization") == "" {
+                l.charge(r)
+                w.WriteHeader(http.StatusUnauthorized)
+                return
+            }
+            if verified {
+                r = r.WithContext(withVerifiedDevice(r.Context(), deviceIdentity(r)))
+            }
+            if l.settle(w, r) {
+                w.WriteHeader(http.StatusOK)
+            }
+        }))
+    }
+    send := func(h http.Handler, addr string) int {
+        r := httptest.NewRequest(http.MethodPost, "/sensor/temp", nil)
+        r.RemoteAddr = addr
+        r.Header.Set("X-Device-ID", "camera-01")
+        if addr != "192.0.2.3:1234" {
+            r.Header.Set("Authorization", "Bearer secret")
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        return w.Code
+    }
+
+    verified := handler(true)
+    for i := 0; i < 5; i++ {
+        if code := send(verified, "192.0.2.1:1234"); code != http.StatusOK {
+            t.Fatalf("verified request %d: status %d, want 200 from the device's own bucket", i, code)
+        }
+    }
+
+    spoofed := handler(false)
+    if code := send(spoofed, "192.0.2.2:1234"); code != http.StatusOK {
+        t.Fatalf("first spoofed request: status %d, want 200", code)
+    }
+    if code := send(spoofed, "192.0.2.2:1234"); code != http.StatusTooManyRequests {
+        t.Errorf("second spoofed request: status %d, want 429 from the IP's bucket", code)
+    }
+
+    // Failed secrets are paid for by the IP, so guessing is rate limited
+    if code := send(spoofed, "192.0.2.3:1234"); code != http.StatusUnauthorized {
+        t.Fatalf("first request without a secret: status %d, want 401", code)
+    }
+    if code := send(spoofed, "192.0.2.3:1234"); code != http.StatusTooManyRequests {
+        t.Errorf("second request without a secret: status %d, want 429", code)
+    }
+}
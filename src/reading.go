@@ -0,0 +1,51 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "mime"
+    "net/http"
+
+    "github.com/fxamacker/cbor/v2"
+    "github.com/mytechnotalent/IoT/sensor"
+)
+
+// SensorReading is the document a device POSTs. It lives in the sensor
+// package so cmd/mockdevice sends exactly what the server decodes.
+type SensorReading = sensor.Reading
+
+// missingField is the error for a required field absent from a reading.
+var missingField = sensor.MissingField
+
+// Media types a structured reading may be encoded in.
+const (
+    mediaJSON = "application/json"
+    mediaCBOR = "application/cbor"
+)
+
+// parseReading decodes a JSON or CBOR sensor reading, depending on mediaType,
+// and checks the fields every device type needs. An empty mediaType means JSON.
+// CBOR maps use the same keys as the JSON document.
+func parseReading(body []byte, mediaType string) (SensorReading, error) {
+    var reading SensorReading
+    if mediaType == mediaCBOR {
+        if err := cbor.Unmarshal(body, &reading); err != nil {
+            return reading, fmt.Errorf("malformed CBOR: %v", err)
+        }
+    } else if err := json.Unmarshal(body, &reading); err != nil {
+        return reading, fmt.Errorf("malformed JSON: %v", err)
+    }
+    if err := reading.Validate(); err != nil {
+        return reading, err
+    }
+    return reading, nil
+}
+
+// mediaType returns the request's Content-Type without parameters, or "" if it is absent or malformed.
+func mediaType(r *http.Request) string {
+    mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil {
+        return ""
+    }
+    return mt
+}
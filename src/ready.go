@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// readyRetryMax is the longest wait between two checks of a sink that is not
+// ready yet; the first retry comes after a second, then twice as long each time.
+const readyRetryMax = 30 * time.Second
+
+// readyChecker is implemented by sinks that connect to a backend lazily, so
+// opening them at startup does not tell whether it can be reached. ready
+// returns nil once it can.
+type readyChecker interface {
+    ready(ctx context.Context) error
+}
+
+// readiness is what GET /readyz reports: not ready from startup until every
+// required sink has connected, and again once shutdown begins, while liveness
+// on /healthz is unaffected. A load balancer that waits for it sends no
+// readings the sinks cannot take yet, and none to a server that is draining.
+type readiness struct {
+    timeout  time.Duration
+    required []string // the sinks waited for, by name
+
+    mu       sync.Mutex
+    waiting  map[string]string // sink name: why it is not ready
+    stopping bool
+    done     chan struct{}
+    gaveUp   chan string
+}
+
+// newReadiness returns a readiness that is waiting for the sinks that say
+// whether they are ready, optional ones aside: they do not fail a request, so
+// they do not hold up traffic either.
+func newReadiness(sinks []configuredSink, timeout time.Duration) *readiness {
+    r := &readiness{
+        timeout: timeout,
+        waiting: make(map[string]string),
+        done:    make(chan struct{}),
+        gaveUp:  make(chan string, 1),
+    }
+    for _, s := range sinks {
+        if _, ok := s.Sink.(readyChecker); ok && !s.optional {
+            r.waiting[s.name] = "not checked yet"
+            r.required = append(r.required, s.name)
+        }
+    }
+    return r
+}
+
+// start checks every sink in the background, retrying those not ready with
+// backoff until they are, or until Close. If the required ones are not ready
+// within timeout, the names of those still waiting are sent on gaveUp.
+func (r *readiness) start(sinks []configuredSink) {
+    if _, waiting := r.status(); len(waiting) == 0 {
+        slog.Info("server ready")
+    }
+    for _, s := range sinks {
+        if c, ok := s.Sink.(readyChecker); ok {
+            go r.check(s, c)
+        }
+    }
+    if r.timeout > 0 {
+        go func() {
+            t := time.NewTimer(r.timeout)
+            defer t.Stop()
+            select {
+            case <-t.C:
+                if _, waiting := r.status(); len(waiting) > 0 {
+                    r.gaveUp <- strings.Join(waiting, ", ")
+                }
+            case <-r.done:
+            }
+        }()
+    }
+}
+
+// check retries one sink until it is ready.
+func (r *readiness) check(s configuredSink, c readyChecker) {
+    wait := time.Second
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        err := c.ready(ctx)
+        cancel()
+        if err == nil {
+            slog.Info("sink ready", "sink", s.name)
+            r.mu.Lock()
+            _, required := r.waiting[s.name]
+            delete(r.waiting, s.name)
+            last := required && len(r.waiting) == 0
+            r.mu.Unlock()
+            if last {
+                slog.Info("server ready")
+            }
+            return
+        }
+        r.mu.Lock()
+        if _, required := r.waiting[s.name]; required {
+            r.waiting[s.name] = err.Error()
+        }
+        r.mu.Unlock()
+        slog.Warn("sink not ready, will check again", "sink", s.name, "optional", s.optional, "retry_in", wait.String(), "err", err)
+        select {
+        case <-time.After(wait):
+        case <-r.done:
+            return
+        }
+        if wait *= 2; wait > readyRetryMax {
+            wait = readyRetryMax
+        }
+    }
+}
+
+// status reports whether shutdown has begun, and lists the required sinks
+// not ready yet, by name, each with why.
+func (r *readiness) status() (stopping bool, waiting []string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for name, why := range r.waiting {
+        waiting = append(waiting, name+" ("+why+")")
+    }
+    sort.Strings(waiting)
+    return r.stopping, waiting
+}
+
+// shutdown marks the server not ready for good, so traffic moves elsewhere
+// while the requests in flight finish.
+func (r *readiness) shutdown() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.stopping = true
+}
+
+// Close stops the checks still running.
+func (r *readiness) Close() error {
+    close(r.done)
+    return nil
+}
+
+// handleReadyz serves GET /readyz: 200 once the server can take readings,
+// 503 naming what it waits for until then, and 503 again while shutting down.
+func (a *app) handleReadyz(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    stopping, waiting := a.ready.status()
+    if stopping {
+        writeError(w, http.StatusServiceUnavailable, "Not ready: shutting down")
+        return
+    }
+    if len(waiting) > 0 {
+        w.Header().Set("Retry-After", "1")
+        writeError(w, http.StatusServiceUnavailable, "Not ready: waiting for "+strings.Join(waiting, ", "))
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintln(w, "ready")
+}
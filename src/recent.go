@@ -0,0 +1,131 @@
+package main
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// exportFlushEvery is how many lines /export writes between flushes.
+const exportFlushEvery = 100
+
+// recentReadings keeps the last few readings of every device in memory for debugging.
+type recentReadings struct {
+    mu      sync.Mutex
+    depth   int
+    devices map[string]*readingRing
+}
+
+// readingRing is a fixed-size circular buffer of one device's readings.
+type readingRing struct {
+    buf  []SensorReading
+    next int  // index the next reading is written to
+    full bool // whether buf has wrapped at least once
+}
+
+// newRecentReadings returns a store keeping depth readings per device.
+func newRecentReadings(depth int) *recentReadings {
+    return &recentReadings{depth: depth, devices: make(map[string]*readingRing)}
+}
+
+// add records reading as the newest for its device, overwriting the oldest once the ring is full.
+func (r *recentReadings) add(reading SensorReading) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    ring, ok := r.devices[reading.DeviceID]
+    if !ok {
+        ring = &readingRing{buf: make([]SensorReading, r.depth)}
+        r.devices[reading.DeviceID] = ring
+    }
+    ring.buf[ring.next] = reading
+    ring.next = (ring.next + 1) % len(ring.buf)
+    if ring.next == 0 {
+        ring.full = true
+    }
+}
+
+// get returns a copy of the device's buffered readings, oldest first. A device
+// that has sent nothing yields an empty, non-nil slice.
+func (r *recentReadings) get(deviceID string) []SensorReading {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    ring, ok := r.devices[deviceID]
+    if !ok {
+        return []SensorReading{}
+    }
+    if !ring.full {
+        return append([]SensorReading{}, ring.buf[:ring.next]...)
+    }
+    return append(append([]SensorReading{}, ring.buf[ring.next:]...), ring.buf[:ring.next]...)
+}
+
+// ids returns the devices with buffered readings, sorted.
+func (r *recentReadings) ids() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    ids := make([]string, 0, len(r.devices))
+    for id := range r.devices {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// handleRecent answers GET /devices/{id}/recent with the device's buffered readings.
+func (a *app) handleRecent(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    writeJSON(w, http.StatusOK, a.recent.get(r.PathValue("id")))
+}
+
+// handleExport answers GET /export with every buffered reading as NDJSON,
+// device by device and oldest first, or only those of the ?device= ids. Each
+// device's readings are copied out on their own and written as they are
+// encoded, so the buffer is never locked while the client reads and the reply
+// is never held in memory whole.
+func (a *app) handleExport(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    ids := r.URL.Query()["device"]
+    if len(ids) == 0 {
+        ids = a.recent.ids()
+    } else {
+        auditNote(r.Context(), "devices", strings.Join(ids, ","))
+    }
+    w.Header().Set("Content-Type", mediaNDJSON)
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(http.StatusOK)
+    if r.Method == http.MethodHead {
+        return
+    }
+
+    rc := http.NewResponseController(w)
+    enc := json.NewEncoder(w)
+    lines := 0
+    for _, id := range ids {
+        for _, reading := range a.recent.get(id) {
+            if err := enc.Encode(reading); err != nil {
+                slog.WarnContext(r.Context(), "export aborted", "remote_addr", r.RemoteAddr, "lines", lines, "err", err)
+                return
+            }
+            lines++
+            if lines%exportFlushEvery == 0 {
+                // A long export keeps going as long as the client keeps reading
+                if a.cfg.WriteTimeout > 0 {
+                    rc.SetWriteDeadline(time.Now().Add(a.cfg.WriteTimeout))
+                }
+                rc.Flush()
+            }
+        }
+    }
+    slog.InfoContext(r.Context(), "exported recent readings", "remote_addr", r.RemoteAddr, "devices", len(ids), "lines", lines)
+}
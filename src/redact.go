@@ -0,0 +1,135 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "strings"
+
+    "github.com/fxamacker/cbor/v2"
+)
+
+// redactedValue replaces every redacted field.
+const redactedValue = "[REDACTED]"
+
+// redactor masks the -redact fields of readings before they reach the logs,
+// stdout or the data file. The other sinks still get the full payload.
+type redactor struct {
+    paths [][]string // each field as its path from the top of the reading
+}
+
+// newRedactor parses a comma-separated list of dotted field paths, e.g.
+// "lat,lon,owner.user_id". A path is followed into arrays, so "points.lat"
+// masks lat in every element of points.
+func newRedactor(list string) (*redactor, error) {
+    r := &redactor{}
+    for _, field := range strings.Split(list, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        path := strings.Split(field, ".")
+        for _, name := range path {
+            if name == "" {
+                return nil, fmt.Errorf("invalid -redact field %q", field)
+            }
+        }
+        r.paths = append(r.paths, path)
+    }
+    if len(r.paths) == 0 {
+        return nil, fmt.Errorf("-redact lists no fields")
+    }
+    return r, nil
+}
+
+// attr returns a, or a with the redacted placeholder when its key is a
+// redacted top-level field, for the reading fields logged one by one.
+func (r *redactor) attr(a slog.Attr) slog.Attr {
+    if r == nil {
+        return a
+    }
+    for _, path := range r.paths {
+        if len(path) == 1 && path[0] == a.Key {
+            return slog.String(a.Key, redactedValue)
+        }
+    }
+    return a
+}
+
+// apply returns body with the redacted fields masked. JSON and CBOR readings
+// keep their encoding; other payloads, such as images, are returned as they
+// are. A nil redactor returns body unchanged.
+func (r *redactor) apply(body []byte, mediaType string) []byte {
+    if r == nil {
+        return body
+    }
+    switch mediaType {
+    case mediaJSON, mediaNDJSON, "":
+        dec := json.NewDecoder(bytes.NewReader(body))
+        dec.UseNumber()
+        var doc any
+        if err := dec.Decode(&doc); err != nil {
+            return body
+        }
+        if !r.mask(doc) {
+            return body
+        }
+        out, err := json.Marshal(doc)
+        if err != nil {
+            return body
+        }
+        return out
+    case mediaCBOR:
+        var doc any
+        if err := cborToJSON.Unmarshal(body, &doc); err != nil {
+            return body
+        }
+        if !r.mask(doc) {
+            return body
+        }
+        out, err := cbor.Marshal(doc)
+        if err != nil {
+            return body
+        }
+        return out
+    }
+    return body
+}
+
+// mask redacts every path in doc and reports whether anything was masked.
+func (r *redactor) mask(doc any) bool {
+    masked := false
+    for _, path := range r.paths {
+        if maskPath(doc, path) {
+            masked = true
+        }
+    }
+    return masked
+}
+
+// maskPath replaces the value at path in v, descending through objects and
+// into every element of arrays.
+func maskPath(v any, path []string) bool {
+    switch v := v.(type) {
+    case map[string]any:
+        child, ok := v[path[0]]
+        if !ok {
+            return false
+        }
+        if len(path) == 1 {
+            v[path[0]] = redactedValue
+            return true
+        }
+        return maskPath(child, path[1:])
+    case []any:
+        masked := false
+        for _, elem := range v {
+            if maskPath(elem, path) {
+                masked = true
+            }
+        }
+        return masked
+    }
+    return false
+}
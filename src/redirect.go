@@ -0,0 +1,35 @@
+package main
+
+import (
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// httpsRedirect answers plain HTTP requests with a 308 to the same path on the
+// HTTPS listener at port. Unlike 301/302, a 308 tells clients to repeat the
+// request with the same method and body, but most devices will not resend a
+// POST body automatically, so this mainly helps interactive clients.
+func httpsRedirect(port int) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if host == "" {
+            writeError(w, http.StatusBadRequest, "Missing Host header")
+            return
+        }
+        if port != 443 {
+            host = net.JoinHostPort(host, strconv.Itoa(port))
+        } else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+            host = "[" + host + "]"
+        }
+
+        target := "https://" + host + r.URL.RequestURI()
+        slog.Debug("redirecting plain HTTP request", "remote_addr", r.RemoteAddr, "method", r.Method, "target", target)
+        http.Redirect(w, r, target, http.StatusPermanentRedirect)
+    })
+}
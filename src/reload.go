@@ -0,0 +1,265 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "sort"
+)
+
+// reloadChange is what a reload changed in one part of the configuration.
+// Keys and certificates are named by a short SHA-256 fingerprint, never by
+// their contents.
+type reloadChange struct {
+    Part    string   `json:"part"`
+    Added   []string `json:"added,omitempty"`
+    Removed []string `json:"removed,omitempty"`
+    Changed []string `json:"changed,omitempty"`
+}
+
+// reload re-reads the files that can change without a restart: the -keyfile,
+// the -device-limits, -enrich, -field-map, -device-config, -firmware,
+// -watchdog and -cert-fingerprints files,
+// the certificate files and the session ticket keys.
+// It is called on SIGHUP and by POST /admin/reload. Every file is read and
+// checked before any is applied, so one that fails to load leaves the whole
+// previous configuration in place.
+func (a *app) reload() ([]reloadChange, error) {
+    a.reloadMu.Lock()
+    defer a.reloadMu.Unlock()
+
+    var (
+        keys    keySet
+        limits  map[string]deviceLimit
+        certs   []tls.Certificate
+        tickets [][32]byte
+        enrich  enrichFile
+        fields  fieldMapFile
+        configs map[string]deviceConfig
+        fw      *firmwareManifest
+        pins    map[string]string
+        watched map[string]watchedDevice
+        err     error
+    )
+    if a.keys != nil {
+        if keys, err = loadKeys(a.keys.path); err != nil {
+            return nil, fmt.Errorf("error loading key file %s: %v", a.keys.path, err)
+        }
+    }
+    if a.limits != nil {
+        if limits, err = a.limits.load(); err != nil {
+            return nil, fmt.Errorf("error loading device limits: %v", err)
+        }
+    }
+    if a.enrich != nil {
+        if enrich, err = a.enrich.load(); err != nil {
+            return nil, fmt.Errorf("error loading enrichment rules: %v", err)
+        }
+    }
+    if a.fields != nil {
+        if fields, err = a.fields.load(); err != nil {
+            return nil, fmt.Errorf("error loading field mapping: %v", err)
+        }
+    }
+    if a.configs != nil {
+        if configs, err = a.configs.load(); err != nil {
+            return nil, fmt.Errorf("error loading device configuration: %v", err)
+        }
+    }
+    if a.fw != nil {
+        if fw, err = a.fw.load(); err != nil {
+            return nil, fmt.Errorf("error loading firmware manifest: %v", err)
+        }
+    }
+    if a.watch != nil {
+        if watched, err = a.watch.load(); err != nil {
+            return nil, fmt.Errorf("error loading watchdog devices: %v", err)
+        }
+    }
+    if a.pins != nil {
+        if pins, err = a.pins.load(); err != nil {
+            return nil, fmt.Errorf("error loading certificate fingerprints: %v", err)
+        }
+    }
+    if a.certs != nil {
+        if certs, err = a.certs.load(); err != nil {
+            return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+        }
+    }
+    if a.tickets != nil {
+        if tickets, err = a.tickets.load(); err != nil {
+            return nil, fmt.Errorf("error loading session ticket keys: %v", err)
+        }
+    }
+
+    changes := []reloadChange{}
+    add := func(c reloadChange) {
+        if len(c.Added)+len(c.Removed)+len(c.Changed) > 0 {
+            slog.Info("configuration changed", "part", c.Part, "added", len(c.Added), "removed", len(c.Removed), "changed", len(c.Changed))
+            changes = append(changes, c)
+        }
+    }
+    if a.keys != nil {
+        add(diffSets("api keys", keyNames(a.keys.current()), keyNames(keys)))
+        a.keys.set.Store(&keys)
+    }
+    if a.limits != nil {
+        add(diffSets("device limits", limitNames(a.limits.current()), limitNames(limits)))
+        a.limits.set(limits)
+    }
+    if a.enrich != nil {
+        add(diffSets("enrichment", enrichNames(a.enrich.current()), enrichNames(enrich)))
+        a.enrich.set(enrich)
+    }
+    if a.fields != nil {
+        add(diffSets("field map", fieldMapNames(a.fields.current()), fieldMapNames(fields)))
+        a.fields.set(fields)
+    }
+    if a.configs != nil {
+        add(diffSets("device config", configNames(a.configs.current()), configNames(configs)))
+        a.configs.set(configs)
+    }
+    if a.fw != nil {
+        add(diffSets("firmware", firmwareNames(a.fw.current()), firmwareNames(fw)))
+        a.fw.set(fw)
+    }
+    if a.watch != nil {
+        add(diffSets("watchdog", watchNames(a.watch.current()), watchNames(watched)))
+        a.watch.set(watched)
+    }
+    if a.pins != nil {
+        add(diffSets("certificate pins", pinNames(a.pins.current()), pinNames(pins)))
+        a.pins.set(pins)
+    }
+    if a.certs != nil {
+        add(diffSets("certificates", certNames(a.certs.current()), certNames(certs)))
+        a.certs.commit(certs)
+    }
+    if a.tickets != nil {
+        old := a.tickets.current()
+        c := diffSets("session ticket keys", ticketNames(old), ticketNames(tickets))
+        if len(old) > 0 && old[0] != tickets[0] {
+            c.Changed = append(c.Changed, "primary key is now "+fingerprint(tickets[0][:]))
+        }
+        add(c)
+        a.tickets.set(tickets)
+    }
+    return changes, nil
+}
+
+// diffSets compares two sets of named entries. Entries only in next are
+// added, only in prev removed, and in both with different values changed.
+func diffSets(part string, prev, next map[string]string) reloadChange {
+    c := reloadChange{Part: part}
+    for name, v := range next {
+        old, ok := prev[name]
+        switch {
+        case !ok:
+            c.Added = append(c.Added, name)
+        case old != v:
+            c.Changed = append(c.Changed, name)
+        }
+    }
+    for name := range prev {
+        if _, ok := next[name]; !ok {
+            c.Removed = append(c.Removed, name)
+        }
+    }
+    sort.Strings(c.Added)
+    sort.Strings(c.Removed)
+    sort.Strings(c.Changed)
+    return c
+}
+
+// fingerprint names a secret or certificate by the start of its SHA-256.
+func fingerprint(b []byte) string {
+    sum := sha256.Sum256(b)
+    return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+func keyNames(keys keySet) map[string]string {
+    names := make(map[string]string, len(keys))
+    for key := range keys {
+        names[fingerprint([]byte(key))] = ""
+    }
+    return names
+}
+
+func limitNames(devices map[string]deviceLimit) map[string]string {
+    names := make(map[string]string, len(devices))
+    for id, d := range devices {
+        names[id] = fmt.Sprintf("%+v", d)
+    }
+    return names
+}
+
+func enrichNames(rules enrichFile) map[string]string {
+    names := make(map[string]string, len(rules.Devices)+len(rules.Patterns))
+    for id, fields := range rules.Devices {
+        names[id] = fmt.Sprint(fields)
+    }
+    for i, p := range rules.Patterns {
+        names["pattern "+p.Match] = fmt.Sprint(i, p.Fields)
+    }
+    return names
+}
+
+func fieldMapNames(rules fieldMapFile) map[string]string {
+    names := make(map[string]string, len(rules.Vendors)+len(rules.Devices)+len(rules.Patterns))
+    for vendor, keys := range rules.Vendors {
+        names["vendor "+vendor] = fmt.Sprint(keys)
+    }
+    for id, vendor := range rules.Devices {
+        names[id] = vendor
+    }
+    for i, p := range rules.Patterns {
+        names["pattern "+p.Match] = fmt.Sprint(i, p.Vendor)
+    }
+    return names
+}
+
+func configNames(devices map[string]deviceConfig) map[string]string {
+    names := make(map[string]string, len(devices))
+    for id, d := range devices {
+        names[id] = fmt.Sprintf("%d %s", d.Version, d.encoded)
+    }
+    return names
+}
+
+func firmwareNames(m *firmwareManifest) map[string]string {
+    return map[string]string{"version": m.Version, "url": m.URL, "sha256": m.SHA256, "min_version": m.MinVersion}
+}
+
+func watchNames(devices map[string]watchedDevice) map[string]string {
+    names := make(map[string]string, len(devices))
+    for id, d := range devices {
+        names[id] = d.Silence.String()
+    }
+    return names
+}
+
+func pinNames(pins map[string]string) map[string]string {
+    names := make(map[string]string, len(pins))
+    for fp, label := range pins {
+        names["sha256:"+fp[:12]] = label
+    }
+    return names
+}
+
+func certNames(certs []tls.Certificate) map[string]string {
+    names := make(map[string]string, len(certs))
+    for _, cert := range certs {
+        names[fmt.Sprintf("%s %v until %s", fingerprint(cert.Certificate[0]), cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format("2006-01-02"))] = ""
+    }
+    return names
+}
+
+func ticketNames(keys [][32]byte) map[string]string {
+    names := make(map[string]string, len(keys))
+    for _, key := range keys {
+        names[fingerprint(key[:])] = ""
+    }
+    return names
+}
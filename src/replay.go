@@ -0,0 +1,228 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "golang.org/x/time/rate"
+)
+
+// replayConfig holds the settings of the replay subcommand.
+type replayConfig struct {
+    DataFile    string
+    Target      string
+    Concurrency int
+    Rate        float64
+    Offset      int
+    Key         string
+    Insecure    bool
+    Timeout     time.Duration
+}
+
+// parseReplayConfig parses the arguments following "replay".
+func parseReplayConfig(args []string) (replayConfig, error) {
+    var cfg replayConfig
+    fs := flag.NewFlagSet("iot replay", flag.ContinueOnError)
+    fs.StringVar(&cfg.DataFile, "datafile", "", "data file written by -datafile to read records from")
+    fs.StringVar(&cfg.Target, "target", "", "server to re-POST payloads to; a URL without a path gets each record's device endpoint, e.g. https://localhost")
+    fs.IntVar(&cfg.Concurrency, "concurrency", 4, "requests in flight at once")
+    fs.Float64Var(&cfg.Rate, "rate", 0, "maximum requests per second (0 is unlimited)")
+    fs.IntVar(&cfg.Offset, "offset", 0, "number of records to skip, to resume an interrupted replay")
+    fs.StringVar(&cfg.Key, "key", os.Getenv("IOT_API_KEY"), "API key sent as \"Authorization: Bearer <key>\", falls back to $IOT_API_KEY")
+    fs.BoolVar(&cfg.Insecure, "insecure", false, "skip TLS certificate verification, e.g. for the self-signed ssl/ certificate")
+    fs.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "timeout for each request")
+    if err := fs.Parse(args); err != nil {
+        return cfg, err
+    }
+
+    if cfg.DataFile == "" || cfg.Target == "" {
+        return cfg, errors.New("-datafile and -target are required")
+    }
+    u, err := url.Parse(cfg.Target)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return cfg, fmt.Errorf("invalid -target %q: want an http or https URL", cfg.Target)
+    }
+    if cfg.Concurrency < 1 || cfg.Rate < 0 || cfg.Offset < 0 {
+        return cfg, errors.New("invalid -concurrency/-rate/-offset: concurrency must be at least 1, rate and offset not negative")
+    }
+    return cfg, nil
+}
+
+// replayRecord is one record to send, numbered by its line in the data file.
+type replayRecord struct {
+    line int
+    rec  dataRecord
+}
+
+// replayURL returns where a record is sent: the target itself if it has a
+// path, otherwise the endpoint of the record's device type.
+func replayURL(target string, rec dataRecord) string {
+    u, _ := url.Parse(target)
+    if u.Path != "" && u.Path != "/" {
+        return target
+    }
+    for _, dt := range deviceTypes {
+        if dt.Name == rec.Type {
+            return strings.TrimSuffix(target, "/") + dt.Path
+        }
+    }
+    return strings.TrimSuffix(target, "/") + deviceTypes[0].Path
+}
+
+// replayContentType guesses the media type of a payload, which the data file does not record.
+func replayContentType(payload []byte) string {
+    trimmed := bytes.TrimLeft(payload, " \t\r\n")
+    if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+        return mediaJSON
+    }
+    if ct := http.DetectContentType(payload); strings.HasPrefix(ct, "image/") {
+        return ct
+    }
+    return mediaCBOR
+}
+
+// runReplay re-POSTs every payload in a data file to a server, e.g. to backfill
+// a new sink. Lines that are not valid records are skipped. It returns the
+// process exit status.
+func runReplay(args []string) int {
+    cfg, err := parseReplayConfig(args)
+    if errors.Is(err, flag.ErrHelp) {
+        return 0
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error parsing replay configuration:", err)
+        return 2
+    }
+
+    f, err := os.Open(cfg.DataFile)
+    if err != nil {
+        slog.Error("error opening data file", "file", cfg.DataFile, "err", err)
+        return 1
+    }
+    defer f.Close()
+
+    client := &http.Client{
+        Timeout:   cfg.Timeout,
+        Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.Insecure}},
+    }
+    limiter := rate.NewLimiter(rate.Inf, 1)
+    if cfg.Rate > 0 {
+        limiter = rate.NewLimiter(rate.Limit(cfg.Rate), 1)
+    }
+
+    // Stop reading on a signal; records already handed to workers still finish
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    var sent, failed, skipped atomic.Int64
+    var mu sync.Mutex
+    firstFailed := 0 // lowest failed line, so a resume offset never skips one
+    fail := func(line int) {
+        failed.Add(1)
+        mu.Lock()
+        if firstFailed == 0 || line < firstFailed {
+            firstFailed = line
+        }
+        mu.Unlock()
+    }
+    records := make(chan replayRecord)
+    var wg sync.WaitGroup
+    for i := 0; i < cfg.Concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for r := range records {
+                if err := limiter.Wait(ctx); err != nil {
+                    fail(r.line)
+                    continue
+                }
+                if err := replayOne(ctx, client, cfg, r.rec); err != nil {
+                    slog.Warn("error replaying record", "line", r.line, "err", err)
+                    fail(r.line)
+                    continue
+                }
+                sent.Add(1)
+            }
+        }()
+    }
+
+    // Lines are numbered from 1; -offset N resumes at line N+1
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 64<<20)
+    line := 0
+read:
+    for scanner.Scan() {
+        line++
+        if line <= cfg.Offset {
+            continue
+        }
+        var rec dataRecord
+        if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || len(rec.Payload) == 0 {
+            slog.Warn("skipping undecodable record", "line", line, "err", err)
+            skipped.Add(1)
+            continue
+        }
+        select {
+        case records <- replayRecord{line: line, rec: rec}:
+        case <-ctx.Done():
+            line--
+            break read
+        }
+    }
+    close(records)
+    wg.Wait()
+    if err := scanner.Err(); err != nil {
+        slog.Error("error reading data file", "file", cfg.DataFile, "line", line, "err", err)
+    }
+
+    resume := line
+    if firstFailed > 0 {
+        resume = firstFailed - 1
+    }
+    slog.Info("replay finished", "sent", sent.Load(), "failed", failed.Load(), "skipped", skipped.Load(), "resume_offset", resume)
+    if failed.Load() > 0 || ctx.Err() != nil {
+        return 1
+    }
+    return 0
+}
+
+// replayOne POSTs a single record's payload and checks for a 2xx answer.
+func replayOne(ctx context.Context, client *http.Client, cfg replayConfig, rec dataRecord) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, replayURL(cfg.Target, rec), bytes.NewReader(rec.Payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", replayContentType(rec.Payload))
+    if cfg.Key != "" {
+        req.Header.Set("Authorization", "Bearer "+cfg.Key)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+    }
+    io.Copy(ioutil.Discard, resp.Body)
+    return nil
+}
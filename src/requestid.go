@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "log/slog"
+    "net/http"
+)
+
+// requestIDKey is the context key under which the request ID is stored.
+type requestIDKey struct{}
+
+// maxRequestIDLen bounds a client-supplied X-Request-ID, which ends up in every log.
+const maxRequestIDLen = 128
+
+// withRequestID gives every request an ID for correlating device and server
+// logs: the client's X-Request-ID if it sent a usable one, otherwise a new
+// UUID. The ID is stored in the request context and echoed in the response.
+func withRequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newUUID()
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+    })
+}
+
+// requestID returns the ID stored by withRequestID, or "" outside a request.
+func requestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// validRequestID accepts printable ASCII without spaces or quotes, so a client
+// ID cannot break a log line apart.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLen {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if c := id[i]; c <= ' ' || c > '~' || c == '"' {
+            return false
+        }
+    }
+    return true
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    var out [36]byte
+    hex.Encode(out[0:8], b[0:4])
+    out[8] = '-'
+    hex.Encode(out[9:13], b[4:6])
+    out[13] = '-'
+    hex.Encode(out[14:18], b[6:8])
+    out[18] = '-'
+    hex.Encode(out[19:23], b[8:10])
+    out[23] = '-'
+    hex.Encode(out[24:], b[10:])
+    return string(out[:])
+}
+
+// requestIDHandler adds a request_id attribute to records logged with the
+// context of a request, i.e. through slog.InfoContext and friends.
+type requestIDHandler struct {
+    slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+    if id := requestID(ctx); id != "" {
+        rec.AddAttrs(slog.String("request_id", id))
+    }
+    return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+    return requestIDHandler{h.Handler.WithGroup(name)}
+}
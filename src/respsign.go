@@ -0,0 +1,97 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+)
+
+// responseSigner adds an X-Response-Signature header to every response: the
+// base64 ed25519 signature of the response body, which firmware can check
+// against the pinned public key to be sure the answer came from this server.
+type responseSigner struct {
+    key ed25519.PrivateKey
+}
+
+// loadResponseKey reads an ed25519 private key in PKCS#8 PEM, as written by
+// "openssl genpkey -algorithm ed25519", from file if one is named, otherwise
+// from pemValue ($IOT_RESPONSE_KEY).
+func loadResponseKey(file, pemValue string) (ed25519.PrivateKey, error) {
+    data := []byte(pemValue)
+    if file != "" {
+        var err error
+        if data, err = ioutil.ReadFile(file); err != nil {
+            return nil, err
+        }
+    }
+    block, _ := pem.Decode(data)
+    if block == nil || block.Type != "PRIVATE KEY" {
+        return nil, errors.New("no PRIVATE KEY PEM block found")
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    edKey, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("key is %T, not ed25519", key)
+    }
+    return edKey, nil
+}
+
+// publicKey returns the base64 public key devices should pin.
+func (s *responseSigner) publicKey() string {
+    return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// middleware buffers each response so its body can be signed before the
+// headers go out. WebSocket upgrades are passed through unsigned.
+func (s *responseSigner) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Upgrade") != "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        buf := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(buf, r)
+        sig := ed25519.Sign(s.key, buf.body.Bytes())
+        w.Header().Set("X-Response-Signature", base64.StdEncoding.EncodeToString(sig))
+        if buf.body.Len() > 0 {
+            w.Header().Set("Content-Length", strconv.Itoa(buf.body.Len()))
+        }
+        w.WriteHeader(buf.status)
+        w.Write(buf.body.Bytes())
+    })
+}
+
+// bufferedResponse holds back the status and body of a response until the
+// handler has finished writing it.
+type bufferedResponse struct {
+    http.ResponseWriter
+    status      int
+    wroteHeader bool
+    body        bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+    if !b.wroteHeader {
+        b.status, b.wroteHeader = status, true
+    }
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+    b.wroteHeader = true
+    return b.body.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines.
+func (b *bufferedResponse) Unwrap() http.ResponseWriter {
+    return b.ResponseWriter
+}
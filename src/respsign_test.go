@@ -0,0 +1,85 @@
+package main
+
+import (
+    "compress/gzip"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestResponseSignature(t *testing.T) {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyFile := filepath.Join(t.TempDir(), "response.key")
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    h := newTestApp(t, "-response-key", keyFile, "-compress", "-compress-min", "16").handler()
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        body   string
+        gzip   bool
+    }{
+        {"reading", http.MethodPost, "/sensor/temp", `{"device_id":"t1","temp":21.5,"ts":1700000000}`, false},
+        {"error", http.MethodPost, "/sensor/temp", `{"device_id":`, false},
+        {"plain", http.MethodGet, "/metrics", "", false},
+        {"compressed", http.MethodGet, "/metrics", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+            r.Header.Set("Content-Type", "application/json")
+            if tt.gzip {
+                r.Header.Set("Accept-Encoding", "gzip")
+            }
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+
+            // The signature covers the body as the handler wrote it, before compression
+            body := w.Body.Bytes()
+            if enc := w.Header().Get("Content-Encoding"); enc != "" {
+                if !tt.gzip || enc != "gzip" {
+                    t.Fatalf("Content-Encoding = %q, want none", enc)
+                }
+                zr, err := gzip.NewReader(w.Body)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if body, err = io.ReadAll(zr); err != nil {
+                    t.Fatal(err)
+                }
+            } else if tt.gzip {
+                t.Fatal("response was not compressed")
+            }
+
+            sig, err := base64.StdEncoding.DecodeString(w.Header().Get("X-Response-Signature"))
+            if err != nil {
+                t.Fatalf("X-Response-Signature: %v", err)
+            }
+            if !ed25519.Verify(pub, body, sig) {
+                t.Errorf("signature does not verify over the %d body bytes", len(body))
+            }
+            if ed25519.Verify(pub, append(body, '\n'), sig) {
+                t.Error("signature verifies over a changed body")
+            }
+        })
+    }
+}
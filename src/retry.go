@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "math/rand"
+    "time"
+)
+
+// permanentError marks a sink failure that retrying cannot fix, such as a
+// record the backend rejects outright. Sinks wrap such errors with permanent.
+type permanentError struct {
+    err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent marks err as not worth retrying.
+func permanent(err error) error {
+    return &permanentError{err}
+}
+
+// sinkUnavailableError is returned once a sink has failed every retry; the
+// device is told to try again later rather than that the server is broken.
+type sinkUnavailableError struct {
+    err error
+}
+
+func (e *sinkUnavailableError) Error() string { return "sink unavailable: " + e.err.Error() }
+func (e *sinkUnavailableError) Unwrap() error { return e.err }
+
+// retryable reports whether a failed Store may succeed if tried again. A sink
+// that already reports itself unavailable, such as one behind an open circuit
+// breaker, is not retried either.
+func retryable(err error) bool {
+    var perm *permanentError
+    var unavailable *sinkUnavailableError
+    return !errors.As(err, &perm) && !errors.As(err, &unavailable) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff returns the wait before retry number attempt (from 0): exponential
+// from base with full jitter, so devices failing together do not retry together.
+func backoff(base time.Duration, attempt int) time.Duration {
+    max := base << attempt
+    if max <= 0 || attempt > 30 {
+        max = 30 * time.Second
+    }
+    return time.Duration(rand.Int63n(int64(max)) + 1)
+}
+
+// storeWithRetry calls sink.Store, retrying transient failures up to retries
+// more times. It gives up early when ctx is cancelled or the error is permanent.
+func storeWithRetry(ctx context.Context, sink configuredSink, j job, retries int, base time.Duration) error {
+    for attempt := 0; ; attempt++ {
+        err := sink.Store(ctx, j)
+        if err == nil || !retryable(err) {
+            return err
+        }
+        if attempt >= retries {
+            return &sinkUnavailableError{err}
+        }
+
+        wait := backoff(base, attempt)
+        slog.Warn("sink write failed, retrying", "sink", sink.name, "device_id", j.reading.DeviceID, "attempt", attempt+1, "wait", wait, "err", err)
+        t := time.NewTimer(wait)
+        select {
+        case <-t.C:
+        case <-ctx.Done():
+            t.Stop()
+            return ctx.Err()
+        }
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Authentication methods a route can require. A route listing several needs
+// all of them; one listing none is open.
+const (
+    authMTLS   = "mtls"   // a client certificate verified against -clientca
+    authAPIKey = "apikey" // a -keyfile key as "Authorization: Bearer <key>"
+    authDevice = "device" // the device's -authdb secret as a bearer token
+)
+
+// authList is a route's methods; YAML may give one as a plain string, and
+// "none" or an empty list leaves the route open.
+type authList []string
+
+func (l *authList) UnmarshalYAML(n *yaml.Node) error {
+    var methods []string
+    if n.Kind == yaml.ScalarNode {
+        methods = []string{n.Value}
+    } else if err := n.Decode(&methods); err != nil {
+        return err
+    }
+    *l = nil
+    for _, m := range methods {
+        if m != "none" {
+            *l = append(*l, m)
+        }
+    }
+    return nil
+}
+
+func (l authList) String() string {
+    if len(l) == 0 {
+        return "none"
+    }
+    return strings.Join(l, "+")
+}
+
+// routeRule is the authentication a path requires. Path is an exact path, or
+// a prefix ending in "/*" that covers everything below it.
+type routeRule struct {
+    Path string   `yaml:"path"`
+    Auth authList `yaml:"auth"`
+}
+
+// matches reports whether the rule covers path, and how specific it is.
+func (rr routeRule) matches(path string) (bool, int) {
+    if prefix, ok := strings.CutSuffix(rr.Path, "*"); ok {
+        return strings.HasPrefix(path, prefix), len(prefix)
+    }
+    return path == rr.Path, len(rr.Path) + 1
+}
+
+// routeAuth is the -route-auth table on top of the defaults. A path takes the
+// most specific rule covering it, and a path no rule covers needs every method
+// the server is configured with, as if there were no table.
+type routeAuth struct {
+    rules    []routeRule
+    fallback routeRule
+}
+
+// defaultRouteAuth is the table used without -route-auth: health, readiness,
+// version and metrics are open and everything else needs every configured method.
+func defaultRouteAuth(cfg Config) *routeAuth {
+    return &routeAuth{
+        rules: []routeRule{
+            {Path: "/healthz"},
+            {Path: "/readyz"},
+            {Path: "/version"},
+            {Path: "/metrics"},
+        },
+        fallback: routeRule{Path: "/*", Auth: configuredAuth(cfg)},
+    }
+}
+
+// configuredAuth lists the methods the flags turn on.
+func configuredAuth(cfg Config) authList {
+    var methods authList
+    if cfg.ClientCA != "" {
+        methods = append(methods, authMTLS)
+    }
+    if cfg.KeyFile != "" {
+        methods = append(methods, authAPIKey)
+    }
+    if cfg.AuthDB != "" {
+        methods = append(methods, authDevice)
+    }
+    return methods
+}
+
+// loadRouteAuth reads the table from path and checks that every method it
+// names is configured:
+//
+//  - {path: /healthz, auth: none}
+//  - {path: /sensor/*, auth: apikey}
+//  - {path: /admin/*, auth: mtls}
+func loadRouteAuth(path string, cfg Config) (*routeAuth, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var rules []routeRule
+    if err := yaml.Unmarshal(data, &rules); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    needs := map[string]string{authMTLS: cfg.ClientCA, authAPIKey: cfg.KeyFile, authDevice: cfg.AuthDB}
+    flags := map[string]string{authMTLS: "-clientca", authAPIKey: "-keyfile", authDevice: "-authdb"}
+    for _, rr := range rules {
+        prefix := strings.TrimSuffix(rr.Path, "/*")
+        if !strings.HasPrefix(rr.Path, "/") || strings.Contains(prefix, "*") {
+            return nil, fmt.Errorf("invalid path %q in %s: want /exact or /prefix/*", rr.Path, path)
+        }
+        for _, m := range rr.Auth {
+            set, known := needs[m]
+            if !known {
+                return nil, fmt.Errorf("unknown auth %q for %s in %s: use none, mtls, apikey or device", m, rr.Path, path)
+            }
+            if set == "" {
+                return nil, fmt.Errorf("%s in %s requires %s, which needs %s", rr.Path, path, m, flags[m])
+            }
+        }
+    }
+    // Defaults stay for the paths the file leaves out
+    ra := defaultRouteAuth(cfg)
+    listed := make(map[string]bool)
+    for _, rr := range rules {
+        listed[rr.Path] = true
+    }
+    for _, rr := range ra.rules {
+        if !listed[rr.Path] {
+            rules = append(rules, rr)
+        }
+    }
+    ra.rules = rules
+    return ra, nil
+}
+
+// lookup returns the rule for path.
+func (ra *routeAuth) lookup(path string) routeRule {
+    best, score := ra.fallback, -1
+    for _, rr := range ra.rules {
+        if ok, n := rr.matches(path); ok && n > score {
+            best, score = rr, n
+        }
+    }
+    return best
+}
+
+// authenticate enforces the methods the request's route requires, answering
+// 401 for missing or wrong credentials and 403 for valid ones the route does
+// not accept. A device that passed its secret is
+// noted on the request, for verifiedDevice, and billed to its own rate bucket.
+func (a *app) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rule := a.routeAuth.lookup(r.URL.Path)
+        for _, m := range rule.Auth {
+            var ok bool
+            switch m {
+            case authMTLS:
+                ok = a.checkClientCert(w, r, rule)
+            case authAPIKey:
+                ok = a.checkAPIKey(w, r, rule)
+            case authDevice:
+                ok = a.checkDeviceSecret(w, r, rule)
+            }
+            if !ok {
+                if a.limiter != nil {
+                    a.limiter.charge(r)
+                }
+                return
+            }
+            if m == authDevice {
+                r = r.WithContext(withVerifiedDevice(r.Context(), deviceIdentity(r)))
+            }
+        }
+        if a.limiter != nil && !a.limiter.settle(w, r) {
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// checkClientCert requires a verified client certificate.
+func (a *app) checkClientCert(w http.ResponseWriter, r *http.Request, rule routeRule) bool {
+    if hasClientCert(r) {
+        return true
+    }
+    slog.WarnContext(r.Context(), "rejected request without client certificate", "remote_addr", r.RemoteAddr, "route", rule.Path)
+    a.refuseAuth(w, r, rule, false, "Client certificate required")
+    return false
+}
+
+// checkAPIKey requires one of the -keyfile keys as the bearer token.
+func (a *app) checkAPIKey(w http.ResponseWriter, r *http.Request, rule routeRule) bool {
+    if token, ok := bearerToken(r); ok && a.keys.valid(token) {
+        return true
+    }
+    slog.WarnContext(r.Context(), "rejected request with missing or invalid API key", "remote_addr", r.RemoteAddr, "route", rule.Path)
+    a.refuseAuth(w, r, rule, true, "Missing or invalid API key")
+    return false
+}
+
+// checkDeviceSecret requires the bearer token to be the secret -authdb holds
+// for the device sending.
+func (a *app) checkDeviceSecret(w http.ResponseWriter, r *http.Request, rule routeRule) bool {
+    token, ok := bearerToken(r)
+    device := deviceIdentity(r)
+    valid := false
+    if ok && device != "" {
+        var err error
+        valid, err = a.authdb.valid(device, token)
+        if err != nil {
+            w.Header().Set("Retry-After", "5")
+            writeError(w, http.StatusServiceUnavailable, "Authentication unavailable, retry later")
+            return false
+        }
+    }
+    if !valid {
+        slog.WarnContext(r.Context(), "rejected request with missing or invalid device secret", "remote_addr", r.RemoteAddr, "device_id", device, "route", rule.Path)
+        a.refuseAuth(w, r, rule, true, "Missing or invalid device secret")
+    }
+    return valid
+}
+
+// refuseAuth answers a request that failed one of rule's methods: 401 with
+// msg, and a Bearer challenge if that method takes a token, when it has no
+// valid credentials of another kind either, so it should send some; and 403
+// when it authenticated in a way this route does not accept, such as an API
+// key on a route that needs a client certificate.
+func (a *app) refuseAuth(w http.ResponseWriter, r *http.Request, rule routeRule, bearer bool, msg string) {
+    if other := a.otherCredential(r, rule); other != "" {
+        writeError(w, http.StatusForbidden, fmt.Sprintf("%s is not accepted on %s, which requires %s", other, r.URL.Path, rule.Auth))
+        return
+    }
+    if bearer {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="iot"`)
+    }
+    writeError(w, http.StatusUnauthorized, msg)
+}
+
+// otherCredential names a valid credential r carries for a method rule does
+// not list, or returns "".
+func (a *app) otherCredential(r *http.Request, rule routeRule) string {
+    listed := func(m string) bool {
+        for _, l := range rule.Auth {
+            if l == m {
+                return true
+            }
+        }
+        return false
+    }
+    if !listed(authMTLS) && hasClientCert(r) {
+        return "A client certificate"
+    }
+    token, ok := bearerToken(r)
+    if !ok {
+        return ""
+    }
+    if !listed(authAPIKey) && a.keys != nil && a.keys.valid(token) {
+        return "An API key"
+    }
+    if !listed(authDevice) && a.authdb != nil {
+        if device := deviceIdentity(r); device != "" {
+            if valid, err := a.authdb.valid(device, token); err == nil && valid {
+                return "A device secret"
+            }
+        }
+    }
+    return ""
+}
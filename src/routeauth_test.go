@@ -0,0 +1,58 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestRouteAuthStatus(t *testing.T) {
+    keyFile := filepath.Join(t.TempDir(), "keys.txt")
+    if err := os.WriteFile(keyFile, []byte("good-key\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    a := newTestApp(t, "-keyfile", keyFile)
+    a.routeAuth = &routeAuth{
+        rules: []routeRule{
+            {Path: "/sensor/*", Auth: authList{authAPIKey}},
+            {Path: "/version", Auth: authList{authMTLS}},
+        },
+        fallback: routeRule{Path: "/*", Auth: authList{authAPIKey}},
+    }
+    h := a.handler()
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        key    string
+        status int
+    }{
+        {"valid key", http.MethodPost, "/sensor/temp", "good-key", http.StatusOK},
+        {"missing key", http.MethodPost, "/sensor/temp", "", http.StatusUnauthorized},
+        {"wrong key", http.MethodPost, "/sensor/temp", "bad-key", http.StatusUnauthorized},
+        {"no certificate", http.MethodGet, "/version", "", http.StatusUnauthorized},
+        {"key where a certificate is needed", http.MethodGet, "/version", "good-key", http.StatusForbidden},
+        {"wrong key where a certificate is needed", http.MethodGet, "/version", "bad-key", http.StatusUnauthorized},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"device_id":"t1","temp":21.5,"ts":1700000000}`))
+            r.Header.Set("Content-Type", "application/json")
+            if tt.key != "" {
+                r.Header.Set("Authorization", "Bearer "+tt.key)
+            }
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+            }
+            if challenge := w.Header().Get("WWW-Authenticate"); (challenge != "") != (tt.status == http.StatusUnauthorized && tt.path != "/version") {
+                t.Errorf("WWW-Authenticate = %q", challenge)
+            }
+        })
+    }
+}
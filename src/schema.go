@@ -0,0 +1,84 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+
+    "github.com/fxamacker/cbor/v2"
+    "github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// cborToJSON decodes CBOR maps with string keys so the result can be marshalled as JSON.
+var cborToJSON, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+
+// readingSchema is a JSON Schema compiled once at startup and applied to every JSON reading.
+type readingSchema struct {
+    schema *jsonschema.Schema
+}
+
+// compileSchema loads and compiles the JSON Schema file at path.
+func compileSchema(path string) (*readingSchema, error) {
+    schema, err := jsonschema.NewCompiler().Compile(path)
+    if err != nil {
+        return nil, err
+    }
+    return &readingSchema{schema: schema}, nil
+}
+
+// schemaError lists every way a payload failed the schema, one entry per violation.
+type schemaError struct {
+    Details []string
+}
+
+func (e *schemaError) Error() string { return strings.Join(e.Details, "; ") }
+
+// validate checks body, JSON or CBOR according to mediaType, against the schema.
+// A body that cannot be decoded at all is reported as an invalid reading; schema
+// violations come back as *schemaError.
+func (s *readingSchema) validate(body []byte, mediaType string) error {
+    // CBOR is converted to the equivalent JSON so one schema covers both encodings
+    if mediaType == mediaCBOR {
+        var v any
+        if err := cborToJSON.Unmarshal(body, &v); err != nil {
+            return &invalidReadingError{fmt.Errorf("malformed CBOR: %v", err)}
+        }
+        converted, err := json.Marshal(v)
+        if err != nil {
+            return &invalidReadingError{fmt.Errorf("CBOR has no JSON equivalent: %v", err)}
+        }
+        body = converted
+    }
+    doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+    if err != nil {
+        return &invalidReadingError{fmt.Errorf("malformed JSON: %v", err)}
+    }
+    err = s.schema.Validate(doc)
+    var ve *jsonschema.ValidationError
+    if !errors.As(err, &ve) {
+        return err
+    }
+    return &schemaError{Details: schemaDetails(ve.BasicOutput())}
+}
+
+// schemaDetails flattens the basic output into "location: message" strings.
+func schemaDetails(out *jsonschema.OutputUnit) []string {
+    var details []string
+    for _, unit := range out.Errors {
+        if unit.Error == nil {
+            continue
+        }
+        loc := unit.InstanceLocation
+        if loc == "" {
+            loc = "/"
+        }
+        details = append(details, loc+": "+unit.Error.String())
+    }
+    if len(details) == 0 && out.Error != nil {
+        details = append(details, "/: "+out.Error.String())
+    }
+    return details
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+    "container/list"
+    "log/slog"
+    "net/http"
+    "sort"
+    "sync"
+)
+
+// seqMaxWindow is the largest -seq-window: the sequence numbers seen are
+// kept as the bits of a uint64.
+const seqMaxWindow = 64
+
+// seqGap is a run of sequence numbers from one device that did not arrive
+// within the window: Expected was the next number due, and Received the one
+// that pushed it out of the window.
+type seqGap struct {
+    DeviceID string
+    Expected uint64
+    Received uint64
+    Missed   uint64
+}
+
+// deviceSeq is the sequence numbers seen lately from one device.
+type deviceSeq struct {
+    DeviceID string `json:"device_id"`
+    Highest  uint64 `json:"last_seq"`
+    Missed   uint64 `json:"missed"`
+
+    seen uint64 // bit i set: Highest-i arrived
+}
+
+// seqTracker notices readings missing from devices that number theirs in
+// seq. A number may arrive up to window places late, behind higher ones,
+// before it counts as missed, so readings reordered by retries or by
+// different transports are not mistaken for loss. It remembers size devices,
+// forgetting the least recently heard from along with what they missed.
+type seqTracker struct {
+    window uint64
+    size   int
+
+    mu        sync.Mutex
+    order     *list.List // front is most recently heard from
+    entries   map[string]*list.Element
+    missed    uint64
+    restarted uint64
+}
+
+// newSeqTracker returns a tracker for size devices that waits window places
+// for late readings.
+func newSeqTracker(window, size int) *seqTracker {
+    return &seqTracker{
+        window:  uint64(window),
+        size:    size,
+        order:   list.New(),
+        entries: make(map[string]*list.Element),
+    }
+}
+
+// arrived records seq from device and returns the gap it confirms, or nil.
+// A number far below the highest seen, nearer 0 than to it, means the device
+// restarted counting, after a reboot or a wrap, and starts its sequence
+// afresh; a repeat of a number already seen is ignored, as resent readings
+// are. A number that arrives after it was counted missed stays counted.
+func (t *seqTracker) arrived(device string, seq uint64) *seqGap {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    el, ok := t.entries[device]
+    if !ok {
+        t.entries[device] = t.order.PushFront(&deviceSeq{DeviceID: device, Highest: seq, seen: t.full()})
+        for t.order.Len() > t.size {
+            oldest := t.order.Back()
+            t.order.Remove(oldest)
+            delete(t.entries, oldest.Value.(*deviceSeq).DeviceID)
+        }
+        return nil
+    }
+    t.order.MoveToFront(el)
+    d := el.Value.(*deviceSeq)
+
+    if seq <= d.Highest {
+        back := d.Highest - seq
+        switch {
+        case back < t.window:
+            d.seen |= 1 << back
+        case seq < back:
+            t.restarted++
+            slog.Info("device restarted its sequence numbers", "device_id", device, "seq", seq, "last_seq", d.Highest)
+            d.Highest, d.seen = seq, t.full()
+        default:
+            slog.Debug("reading arrived after it was counted missed", "device_id", device, "seq", seq, "last_seq", d.Highest)
+        }
+        return nil
+    }
+
+    // Moving the window up by ahead pushes the oldest numbers out of it; those
+    // not seen by now are missed, and so are new ones that never fit in it
+    ahead := seq - d.Highest
+    gap := &seqGap{DeviceID: device, Received: seq}
+    for i := t.window; i > 0 && i-1+ahead >= t.window; i-- {
+        if d.seen&(1<<(i-1)) == 0 {
+            if gap.Missed == 0 {
+                gap.Expected = d.Highest - (i - 1)
+            }
+            gap.Missed++
+        }
+    }
+    if ahead > t.window {
+        if gap.Missed == 0 {
+            gap.Expected = d.Highest + 1
+        }
+        gap.Missed += ahead - t.window
+    }
+    if ahead >= t.window {
+        d.seen = 1
+    } else {
+        d.seen = (d.seen<<ahead | 1) & t.full()
+    }
+    d.Highest = seq
+    if gap.Missed == 0 {
+        return nil
+    }
+    d.Missed += gap.Missed
+    t.missed += gap.Missed
+    return gap
+}
+
+// full is the seen bits with every number in the window seen.
+func (t *seqTracker) full() uint64 {
+    if t.window == seqMaxWindow {
+        return ^uint64(0)
+    }
+    return 1<<t.window - 1
+}
+
+// missedCount returns how many readings have been counted missed.
+func (t *seqTracker) missedCount() uint64 {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.missed
+}
+
+// restartCount returns how many times a device restarted its sequence.
+func (t *seqTracker) restartCount() uint64 {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.restarted
+}
+
+// gaps returns the devices that missed readings, the most missed first.
+func (t *seqTracker) gaps() []deviceSeq {
+    t.mu.Lock()
+    devices := []deviceSeq{}
+    for el := t.order.Front(); el != nil; el = el.Next() {
+        if d := el.Value.(*deviceSeq); d.Missed > 0 {
+            devices = append(devices, *d)
+        }
+    }
+    t.mu.Unlock()
+    sort.Slice(devices, func(i, j int) bool {
+        if devices[i].Missed != devices[j].Missed {
+            return devices[i].Missed > devices[j].Missed
+        }
+        return devices[i].DeviceID < devices[j].DeviceID
+    })
+    return devices
+}
+
+// gapsResponse is the body of GET /stats/gaps.
+type gapsResponse struct {
+    Window  uint64      `json:"window"`
+    Missed  uint64      `json:"missed"`
+    Devices []deviceSeq `json:"devices"`
+}
+
+// handleGaps serves GET /stats/gaps: the devices the server knows missed
+// readings, with how many, most first.
+func (a *app) handleGaps(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    writeJSON(w, http.StatusOK, gapsResponse{
+        Window:  a.seq.window,
+        Missed:  a.seq.missedCount(),
+        Devices: a.seq.gaps(),
+    })
+}
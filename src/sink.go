@@ -0,0 +1,172 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "strings"
+)
+
+// Sink is where stored readings go. Each accepted reading is handed to every
+// configured sink exactly once, after it has been decoded and validated; a new
+// backend such as S3 or Kafka only needs to implement Store and be added to
+// newSink. Store should give up and return ctx.Err() once ctx is cancelled
+// rather than keep blocking on a slow backend. Failed calls are retried with
+// backoff unless the sink wraps the error with permanent. Sinks that hold
+// resources may also implement io.Closer.
+type Sink interface {
+    Store(ctx context.Context, j job) error
+}
+
+// sinkNames lists the kinds accepted by -sink.
+var sinkNames = []string{"stdout", "file", "noop", "http"}
+
+// validSink reports whether name is one of sinkNames.
+func validSink(name string) bool {
+    for _, n := range sinkNames {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
+
+// sinkSpec is one -sink value: kind[=target][,optional], e.g. file or
+// http=https://collector.example/readings,optional.
+type sinkSpec struct {
+    Kind     string
+    Target   string // the URL for http
+    Optional bool   // a failure is logged but does not fail the request
+}
+
+func (s sinkSpec) String() string {
+    v := s.Kind
+    if s.Target != "" {
+        v += "=" + s.Target
+    }
+    if s.Optional {
+        v += ",optional"
+    }
+    return v
+}
+
+// name is how the sink appears in logs and -check, without any password in
+// an http URL.
+func (s sinkSpec) name() string {
+    if u, err := url.Parse(s.Target); err == nil && s.Target != "" {
+        return s.Kind + "=" + u.Redacted()
+    }
+    return s.Kind
+}
+
+// sinkList is the repeatable -sink flag.
+type sinkList []sinkSpec
+
+func (l *sinkList) String() string {
+    s := make([]string, len(*l))
+    for i, spec := range *l {
+        s[i] = spec.String()
+    }
+    return strings.Join(s, " ")
+}
+
+func (l *sinkList) Set(v string) error {
+    spec := sinkSpec{}
+    if rest, ok := strings.CutSuffix(v, ",optional"); ok {
+        v, spec.Optional = rest, true
+    }
+    spec.Kind, spec.Target, _ = strings.Cut(v, "=")
+    if !validSink(spec.Kind) {
+        return fmt.Errorf("unknown sink %q: use one of %s", spec.Kind, strings.Join(sinkNames, ", "))
+    }
+    switch {
+    case spec.Kind == "http":
+        u, err := url.Parse(spec.Target)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("sink http needs a URL: http=https://host/path")
+        }
+    case spec.Target != "":
+        return fmt.Errorf("sink %s takes no target", spec.Kind)
+    }
+    for _, other := range *l {
+        if other.Kind == spec.Kind && spec.Kind != "http" {
+            return fmt.Errorf("sink %s given twice", spec.Kind)
+        }
+    }
+    *l = append(*l, spec)
+    return nil
+}
+
+// kinds lists the sink kinds without their targets, for the landing page.
+func (l sinkList) kinds() []string {
+    s := make([]string, len(l))
+    for i, spec := range l {
+        s[i] = spec.Kind
+    }
+    return s
+}
+
+// configuredSink is a sink with the name it is logged under and whether the
+// request may succeed without it.
+type configuredSink struct {
+    Sink
+    name     string
+    optional bool
+}
+
+// newSink builds one sink selected by -sink.
+func newSink(cfg Config, spec sinkSpec) (Sink, error) {
+    switch spec.Kind {
+    case "stdout":
+        return &dataWriter{f: nopWriteCloser{os.Stdout}}, nil
+    case "file":
+        data, err := openDataWriter(cfg.DataFile, rotation{
+            MaxSize:    cfg.MaxSize,
+            MaxAge:     cfg.MaxAge,
+            MaxBackups: cfg.MaxBackups,
+        }, cfg.OverflowBuffer)
+        if err != nil {
+            return nil, fmt.Errorf("error opening data file %s: %v", cfg.DataFile, err)
+        }
+        return data, nil
+    case "noop":
+        return noopSink{}, nil
+    case "http":
+        return newHTTPSink(spec.Target), nil
+    }
+    return nil, fmt.Errorf("unknown sink %q", spec.Kind)
+}
+
+// Store appends the raw payload to the data file, or stdout for -sink stdout,
+// with the -redact fields masked.
+func (d *dataWriter) Store(ctx context.Context, j job) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return d.Write(j.origin.RemoteAddr, j.origin.RequestID, j.dt.Name, d.redact.apply(j.body, j.origin.MediaType))
+}
+
+// Store queues the reading for the next InfluxDB batch; outages are retried in
+// the background so the device still gets its 200.
+func (s *influxSink) Store(ctx context.Context, j job) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.Add(j.reading)
+    return nil
+}
+
+// noopSink discards readings, for measuring the server without storage or when
+// only the other sinks matter.
+type noopSink struct{}
+
+func (noopSink) Store(ctx context.Context, j job) error { return nil }
+
+// nopWriteCloser keeps Close from closing a shared stream such as stdout.
+type nopWriteCloser struct {
+    io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
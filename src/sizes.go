@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// sizeHistogram counts reading bodies by size for GET /stats/sizes, so
+// -maxbody can be set from real traffic. Every counter is atomic, so
+// observing a body costs a search of the bounds and two additions.
+type sizeHistogram struct {
+    bounds  []int64        // upper bound of each bucket, ascending
+    counts  []atomic.Int64 // one per bound, and one more for larger bodies
+    largest atomic.Int64
+    since   atomic.Int64 // Unix nanoseconds of the start or last reset
+}
+
+// newSizeHistogram returns a histogram with the comma-separated byte bounds
+// in list, or powers of two from 64 bytes up to maxBody when list is empty.
+func newSizeHistogram(list string, maxBody int64) (*sizeHistogram, error) {
+    var bounds []int64
+    if strings.TrimSpace(list) == "" {
+        for b := int64(64); b < maxBody; b *= 2 {
+            bounds = append(bounds, b)
+        }
+        bounds = append(bounds, maxBody)
+    } else {
+        for _, s := range strings.Split(list, ",") {
+            b, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+            if err != nil || b <= 0 {
+                return nil, fmt.Errorf("invalid -size-buckets %q: want positive byte counts separated by commas", list)
+            }
+            bounds = append(bounds, b)
+        }
+        sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+        for i := 1; i < len(bounds); i++ {
+            if bounds[i] == bounds[i-1] {
+                return nil, fmt.Errorf("invalid -size-buckets %q: %d given twice", list, bounds[i])
+            }
+        }
+    }
+    h := &sizeHistogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+    h.since.Store(time.Now().UnixNano())
+    return h, nil
+}
+
+// observe counts a body of n bytes.
+func (h *sizeHistogram) observe(n int) {
+    size := int64(n)
+    i := sort.Search(len(h.bounds), func(i int) bool { return size <= h.bounds[i] })
+    h.counts[i].Add(1)
+    for {
+        max := h.largest.Load()
+        if size <= max || h.largest.CompareAndSwap(max, size) {
+            return
+        }
+    }
+}
+
+// sizeBucket is one bucket in a /stats/sizes reply: bodies of min to max
+// bytes. The last bucket has no max.
+type sizeBucket struct {
+    Min   int64  `json:"min"`
+    Max   *int64 `json:"max,omitempty"`
+    Count int64  `json:"count"`
+}
+
+// sizeSummary is the reply to GET /stats/sizes.
+type sizeSummary struct {
+    Since   time.Time    `json:"since"`
+    Count   int64        `json:"count"`
+    Largest int64        `json:"largest"`
+    Buckets []sizeBucket `json:"buckets"`
+}
+
+// snapshot returns the counts, zeroing them as they are read if reset is set.
+func (h *sizeHistogram) snapshot(reset bool) sizeSummary {
+    var since int64
+    if reset {
+        since = h.since.Swap(time.Now().UnixNano())
+    } else {
+        since = h.since.Load()
+    }
+    s := sizeSummary{Since: time.Unix(0, since).UTC(), Buckets: make([]sizeBucket, len(h.counts))}
+    var min int64
+    for i := range h.counts {
+        var n int64
+        if reset {
+            n = h.counts[i].Swap(0)
+        } else {
+            n = h.counts[i].Load()
+        }
+        b := sizeBucket{Min: min, Count: n}
+        if i < len(h.bounds) {
+            b.Max = &h.bounds[i]
+            min = h.bounds[i] + 1
+        }
+        s.Buckets[i] = b
+        s.Count += n
+    }
+    if reset {
+        s.Largest = h.largest.Swap(0)
+    } else {
+        s.Largest = h.largest.Load()
+    }
+    return s
+}
+
+// handleSizes answers GET /stats/sizes with the histogram of reading body
+// sizes since startup, or since the last ?reset=true, which zeroes it after
+// reporting.
+func (a *app) handleSizes(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    reset := false
+    if v := r.URL.Query().Get("reset"); v != "" && r.Method == http.MethodGet {
+        var err error
+        if reset, err = strconv.ParseBool(v); err != nil {
+            writeError(w, http.StatusBadRequest, "reset must be true or false")
+            return
+        }
+    }
+    s := a.sizes.snapshot(reset)
+    if reset {
+        slog.InfoContext(r.Context(), "reset payload size histogram", "remote_addr", r.RemoteAddr, "client_cn", clientName(r), "count", s.Count)
+    }
+    writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// mediaLegacy is the fixed-width binary record of older firmware:
+//
+//  offset  size  field
+//  0       4     magic "IOT\x01"
+//  4       16    device_id, ASCII, padded with NULs
+//  20      8     ts, seconds since the Unix epoch, big-endian
+//  28      4     temp in hundredths of a degree, big-endian two's complement
+//  32      1     flags: 0x01 temp is set, 0x02 open is set, 0x04 the door is open
+//
+// It is converted to the equivalent JSON reading as soon as it is read, so
+// everything after that, from the schema to the sinks, sees ordinary JSON.
+const mediaLegacy = "application/vnd.iot.legacy"
+
+const (
+    legacyMagic = "IOT\x01"
+    legacySize  = 33
+
+    legacyHasTemp = 0x01
+    legacyHasOpen = 0x02
+    legacyOpen    = 0x04
+)
+
+// sniffMediaType guesses the format of a body sent without a usable
+// Content-Type from its first bytes: the legacy magic, an object or array for
+// JSON, or a CBOR map, optionally behind the self-describe tag. It returns ""
+// when none of them match.
+func sniffMediaType(body []byte) string {
+    if len(body) == legacySize && bytes.HasPrefix(body, []byte(legacyMagic)) {
+        return mediaLegacy
+    }
+    if trimmed := bytes.TrimLeft(body, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+        return mediaJSON
+    }
+    if bytes.HasPrefix(body, []byte{0xd9, 0xd9, 0xf7}) {
+        body = body[3:]
+    }
+    // Major type 5 is a map, of a length that fits the first byte or follows it
+    if len(body) > 0 && (body[0] >= 0xa1 && body[0] <= 0xbb || body[0] == 0xbf) {
+        return mediaCBOR
+    }
+    return ""
+}
+
+// legacyToJSON converts a legacy record to the JSON reading it stands for.
+func legacyToJSON(body []byte) ([]byte, error) {
+    if len(body) != legacySize || !bytes.HasPrefix(body, []byte(legacyMagic)) {
+        return nil, fmt.Errorf("malformed legacy record: want %d bytes starting with the IOT\\x01 magic", legacySize)
+    }
+    id := bytes.TrimRight(body[4:20], "\x00")
+    for _, c := range id {
+        if c < ' ' || c > '~' {
+            return nil, errors.New("malformed legacy record: device_id is not printable ASCII")
+        }
+    }
+    reading := SensorReading{
+        DeviceID:  string(id),
+        Timestamp: int64(binary.BigEndian.Uint64(body[20:28])),
+    }
+    flags := body[32]
+    if flags&legacyHasTemp != 0 {
+        temp := float64(int32(binary.BigEndian.Uint32(body[28:32]))) / 100
+        reading.Temp = &temp
+    }
+    if flags&legacyHasOpen != 0 {
+        open := flags&legacyOpen != 0
+        reading.Open = &open
+    }
+    return json.Marshal(reading)
+}
+
+// decodeRaw takes a body whose format could not be sniffed as an opaque
+// payload, as decodeImage does, so it is stored rather than lost.
+func decodeRaw(body []byte, o origin) (SensorReading, error) {
+    deviceID, err := opaqueDevice(o)
+    if err != nil {
+        return SensorReading{}, err
+    }
+    if deviceID == "" {
+        return SensorReading{}, errors.New("unrecognized payload format and no X-Device-ID header")
+    }
+    if len(body) == 0 {
+        return SensorReading{}, errors.New("empty body")
+    }
+    return SensorReading{DeviceID: deviceID, Timestamp: time.Now().Unix()}, nil
+}
+
+// sniffBody sets o.MediaType from the body of a request sent without a usable
+// Content-Type, and reports false if it has already answered. A body in none
+// of the sniffed formats is stored as it is, with a warning, rather than lost.
+func (a *app) sniffBody(w http.ResponseWriter, r *http.Request, o *origin, dt deviceType, body []byte) bool {
+    mt := sniffMediaType(body)
+    raw := mt == ""
+    if raw {
+        mt = mediaOctetStream
+    }
+    o.MediaType = mt
+    // Raw bytes are only held to -accept-types when it was given
+    switch {
+    case raw && (!a.types.explicit || a.types.allows(mt)):
+        slog.WarnContext(r.Context(), "unrecognized payload format, storing raw bytes", "remote_addr", r.RemoteAddr, "content_type", r.Header.Get("Content-Type"), "bytes", len(body))
+        return true
+    case !raw && a.types.allows(mt):
+        slog.DebugContext(r.Context(), "sniffed payload format", "remote_addr", r.RemoteAddr, "type", mt)
+        return true
+    }
+    a.deadLetter(*o, dt, "unaccepted sniffed Content-Type "+mt, body)
+    writeError(w, http.StatusUnsupportedMediaType, a.types.refusal("Content-Type must be one of: ", dt))
+    return false
+}
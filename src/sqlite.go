@@ -0,0 +1,189 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/url"
+    "sync"
+    "time"
+)
+
+// sqliteBatch is the most readings inserted in one transaction.
+const sqliteBatch = 500
+
+// sqliteSchema is created on first use, so an empty path is enough to start.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+    id          INTEGER PRIMARY KEY,
+    device_id   TEXT    NOT NULL,
+    ts          INTEGER NOT NULL,
+    type        TEXT    NOT NULL,
+    received_at TEXT    NOT NULL,
+    data        TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS readings_device_ts ON readings (device_id, ts);
+`
+
+// sqliteSink stores readings in a local SQLite file, for a gateway that has
+// no database server to write to. Readings arriving together are inserted in
+// one transaction, and Store returns once that transaction has committed, so
+// a device is only answered once its reading is on disk.
+type sqliteSink struct {
+    db     *sql.DB
+    insert *sql.Stmt
+    redact *redactor
+
+    rows chan sqliteRow
+    done chan struct{}
+    wg   sync.WaitGroup
+}
+
+// sqliteRow is one reading waiting for the next transaction.
+type sqliteRow struct {
+    deviceID string
+    ts       int64
+    kind     string
+    received string
+    data     string
+    result   chan error
+}
+
+// openSQLiteSink opens or creates the database at path and its readings table.
+func openSQLiteSink(path string) (*sqliteSink, error) {
+    // WAL lets readers query the file while readings are written
+    dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)"
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(1)
+    if _, err := db.Exec(sqliteSchema); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating readings table in %s: %v", path, err)
+    }
+    insert, err := db.Prepare("INSERT INTO readings (device_id, ts, type, received_at, data) VALUES (?, ?, ?, ?, ?)")
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    s := &sqliteSink{
+        db:     db,
+        insert: insert,
+        rows:   make(chan sqliteRow, sqliteBatch),
+        done:   make(chan struct{}),
+    }
+    s.wg.Add(1)
+    go s.run()
+    return s, nil
+}
+
+// Store inserts the reading with the next transaction and waits for it to
+// commit.
+func (s *sqliteSink) Store(ctx context.Context, j job) error {
+    row := sqliteRow{
+        deviceID: j.reading.DeviceID,
+        ts:       j.reading.Timestamp,
+        kind:     j.dt.Name,
+        received: time.Now().UTC().Format(time.RFC3339Nano),
+        data:     sqliteData(s.redact.apply(j.body, j.origin.MediaType), j.origin.MediaType),
+        result:   make(chan error, 1),
+    }
+    select {
+    case s.rows <- row:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    select {
+    case err := <-row.result:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// sqliteData returns the fields of a JSON or CBOR reading other than
+// device_id and ts, which have their own columns, as a JSON object. Other
+// payloads, such as images, are stored as {}.
+func sqliteData(body []byte, mediaType string) string {
+    var obj map[string]any
+    switch mediaType {
+    case mediaJSON, mediaNDJSON, "":
+        var raw map[string]json.RawMessage
+        if err := json.Unmarshal(body, &raw); err == nil && raw != nil {
+            delete(raw, "device_id")
+            delete(raw, "ts")
+            if out, err := json.Marshal(raw); err == nil {
+                return string(out)
+            }
+        }
+    case mediaCBOR:
+        if err := cborToJSON.Unmarshal(body, &obj); err == nil && obj != nil {
+            delete(obj, "device_id")
+            delete(obj, "ts")
+            if out, err := json.Marshal(obj); err == nil {
+                return string(out)
+            }
+        }
+    }
+    return "{}"
+}
+
+// run inserts readings until Close. Each transaction takes whatever has
+// queued up while the last one committed, so a busy server writes large
+// batches and an idle one writes each reading at once.
+func (s *sqliteSink) run() {
+    defer s.wg.Done()
+    for {
+        var batch []sqliteRow
+        select {
+        case row := <-s.rows:
+            batch = append(batch, row)
+        case <-s.done:
+            return
+        }
+    fill:
+        for len(batch) < sqliteBatch {
+            select {
+            case row := <-s.rows:
+                batch = append(batch, row)
+            default:
+                break fill
+            }
+        }
+        err := s.write(batch)
+        if err != nil {
+            slog.Warn("error writing readings to SQLite", "readings", len(batch), "err", err)
+        }
+        for _, row := range batch {
+            row.result <- err
+        }
+    }
+}
+
+// write inserts batch in one transaction; on error none of it is kept.
+func (s *sqliteSink) write(batch []sqliteRow) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    insert := tx.Stmt(s.insert)
+    for _, row := range batch {
+        if _, err := insert.Exec(row.deviceID, row.ts, row.kind, row.received, row.data); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// Close stops the writer and closes the database. It is called once the
+// queue has drained, so no Store is waiting.
+func (s *sqliteSink) Close() error {
+    close(s.done)
+    s.wg.Wait()
+    s.insert.Close()
+    return s.db.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "container/list"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// staleSaveEvery is how often a changed -stale-state file is rewritten.
+const staleSaveEvery = 30 * time.Second
+
+// staleReadingError means a reading is older than the newest one already
+// accepted from its device, by more than -stale-tolerance.
+type staleReadingError struct {
+    DeviceID string
+    TS       int64
+    Newest   int64
+}
+
+func (e *staleReadingError) Error() string {
+    return fmt.Sprintf("reading ts %d is older than %d, the newest from device %s", e.TS, e.Newest, e.DeviceID)
+}
+
+// deviceNewest is the newest ts accepted from one device.
+type deviceNewest struct {
+    DeviceID string `json:"device_id"`
+    TS       int64  `json:"ts"`
+}
+
+// staleTracker remembers the newest ts seen from each device, forgetting the
+// least recently heard from once it holds size devices. With a state file the
+// timestamps survive a restart.
+type staleTracker struct {
+    tolerance int64 // seconds a reading may go back in time
+    maxSkew   int64 // seconds a reading may be ahead of the server clock
+    size      int
+    file      string
+
+    mu      sync.Mutex
+    order   *list.List // front is most recently heard from
+    entries map[string]*list.Element
+    dirty   bool
+    stale   uint64
+    done    chan struct{}
+    wg      sync.WaitGroup
+}
+
+// newStaleTracker returns a tracker for size devices, loading file if it
+// exists and saving it in the background until Close.
+func newStaleTracker(size int, tolerance, maxSkew time.Duration, file string) (*staleTracker, error) {
+    t := &staleTracker{
+        tolerance: int64(tolerance / time.Second),
+        maxSkew:   int64(maxSkew / time.Second),
+        size:      size,
+        file:      file,
+        order:     list.New(),
+        entries:   make(map[string]*list.Element),
+        done:      make(chan struct{}),
+    }
+    if file != "" {
+        if err := t.load(); err != nil {
+            return nil, fmt.Errorf("error loading %s: %v", file, err)
+        }
+        t.wg.Add(1)
+        go t.saveLoop()
+    }
+    return t, nil
+}
+
+// check records ts for device and returns a *staleReadingError if it is too
+// far behind the newest one. A stale ts is not recorded, and neither is an
+// older one within the tolerance, so the newest only ever moves forward. A ts
+// more than maxSkew ahead of now is not recorded either, since it would make
+// every honest reading look stale until the clock caught up; it comes back
+// as an *invalidReadingError.
+func (t *staleTracker) check(device string, ts int64, now time.Time) error {
+    if ts > now.Unix()+t.maxSkew {
+        return &invalidReadingError{fmt.Errorf("reading ts %d is %s ahead of the server clock", ts, time.Unix(ts, 0).Sub(now).Round(time.Second))}
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if el, ok := t.entries[device]; ok {
+        e := el.Value.(*deviceNewest)
+        t.order.MoveToFront(el)
+        if ts < e.TS-t.tolerance {
+            t.stale++
+            return &staleReadingError{DeviceID: device, TS: ts, Newest: e.TS}
+        }
+        if ts > e.TS {
+            e.TS, t.dirty = ts, true
+        }
+        return nil
+    }
+    t.entries[device] = t.order.PushFront(&deviceNewest{DeviceID: device, TS: ts})
+    t.dirty = true
+    for t.order.Len() > t.size {
+        oldest := t.order.Back()
+        t.order.Remove(oldest)
+        delete(t.entries, oldest.Value.(*deviceNewest).DeviceID)
+    }
+    return nil
+}
+
+// staleCount returns how many readings have been found stale.
+func (t *staleTracker) staleCount() uint64 {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.stale
+}
+
+// load reads the state file written by save; a missing file is an empty state.
+func (t *staleTracker) load() error {
+    data, err := ioutil.ReadFile(t.file)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var devices []deviceNewest
+    if err := json.Unmarshal(data, &devices); err != nil {
+        return err
+    }
+    // The file lists the least recently heard from first
+    for i := range devices {
+        d := devices[i]
+        if el, ok := t.entries[d.DeviceID]; ok {
+            t.order.Remove(el)
+        }
+        t.entries[d.DeviceID] = t.order.PushFront(&d)
+    }
+    for t.order.Len() > t.size {
+        oldest := t.order.Back()
+        t.order.Remove(oldest)
+        delete(t.entries, oldest.Value.(*deviceNewest).DeviceID)
+    }
+    return nil
+}
+
+// save writes the state file if anything changed since the last save. The
+// file is replaced by a rename so a crash never leaves half of it behind.
+func (t *staleTracker) save() error {
+    t.mu.Lock()
+    if !t.dirty {
+        t.mu.Unlock()
+        return nil
+    }
+    devices := make([]deviceNewest, 0, t.order.Len())
+    for el := t.order.Back(); el != nil; el = el.Prev() {
+        devices = append(devices, *el.Value.(*deviceNewest))
+    }
+    t.dirty = false
+    t.mu.Unlock()
+
+    data, err := json.Marshal(devices)
+    if err != nil {
+        return err
+    }
+    tmp, err := ioutil.TempFile(filepath.Dir(t.file), ".stale-*")
+    if err != nil {
+        return err
+    }
+    _, err = tmp.Write(data)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), t.file)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        // Try again on the next tick
+        t.mu.Lock()
+        t.dirty = true
+        t.mu.Unlock()
+    }
+    return err
+}
+
+// saveLoop saves the state every staleSaveEvery until Close.
+func (t *staleTracker) saveLoop() {
+    defer t.wg.Done()
+    ticker := time.NewTicker(staleSaveEvery)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if err := t.save(); err != nil {
+                slog.Error("error saving stale reading state", "file", t.file, "err", err)
+            }
+        case <-t.done:
+            return
+        }
+    }
+}
+
+// Close stops the background saves and writes the final state.
+func (t *staleTracker) Close() error {
+    close(t.done)
+    t.wg.Wait()
+    if t.file == "" {
+        return nil
+    }
+    return t.save()
+}
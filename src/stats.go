@@ -0,0 +1,233 @@
+package main
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// statFields are the reading fields aggregated by GET /devices/{id}/stats.
+// A door's open is counted as 1 and closed as 0, so its avg is the share of
+// readings that found it open.
+var statFields = []struct {
+    name  string
+    value func(SensorReading) (float64, bool)
+}{
+    {"temp", func(r SensorReading) (float64, bool) {
+        if r.Temp == nil {
+            return 0, false
+        }
+        return *r.Temp, true
+    }},
+    {"open", func(r SensorReading) (float64, bool) {
+        if r.Open == nil {
+            return 0, false
+        }
+        if *r.Open {
+            return 1, true
+        }
+        return 0, true
+    }},
+}
+
+// fieldStats summarizes the values of one field.
+type fieldStats struct {
+    count    int
+    sum      float64
+    min, max float64
+}
+
+func (f *fieldStats) add(v float64) {
+    if f.count == 0 || v < f.min {
+        f.min = v
+    }
+    if f.count == 0 || v > f.max {
+        f.max = v
+    }
+    f.count++
+    f.sum += v
+}
+
+func (f *fieldStats) merge(o fieldStats) {
+    if o.count == 0 {
+        return
+    }
+    if f.count == 0 || o.min < f.min {
+        f.min = o.min
+    }
+    if f.count == 0 || o.max > f.max {
+        f.max = o.max
+    }
+    f.count += o.count
+    f.sum += o.sum
+}
+
+// statsBucket holds what one device stored during one bucket of time.
+type statsBucket struct {
+    slot   int64 // the bucket's start in units of the bucket length since the epoch
+    count  int
+    fields []fieldStats // indexed like statFields
+}
+
+// aggregator keeps a sliding window of per-device statistics in memory, as
+// a ring of buckets per device: a reading goes into the bucket of the time it
+// was stored, and a bucket is reused once it has fallen out of the window.
+// Devices with nothing left in the window are swept away.
+type aggregator struct {
+    bucket time.Duration
+    n      int // buckets per device, the window rounded up to whole buckets
+
+    mu      sync.Mutex
+    devices map[string][]statsBucket
+
+    done chan struct{}
+    wg   sync.WaitGroup
+}
+
+// newAggregator returns an aggregator over window in buckets of bucket.
+func newAggregator(window, bucket time.Duration) *aggregator {
+    g := &aggregator{
+        bucket:  bucket,
+        n:       int((window + bucket - 1) / bucket),
+        devices: make(map[string][]statsBucket),
+        done:    make(chan struct{}),
+    }
+    g.wg.Add(1)
+    go g.run()
+    return g
+}
+
+// window is the time the statistics cover.
+func (g *aggregator) window() time.Duration {
+    return time.Duration(g.n) * g.bucket
+}
+
+func (g *aggregator) slot(t time.Time) int64 {
+    return t.UnixNano() / int64(g.bucket)
+}
+
+// add counts reading, stored at now, for its device.
+func (g *aggregator) add(reading SensorReading, now time.Time) {
+    slot := g.slot(now)
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    buckets, ok := g.devices[reading.DeviceID]
+    if !ok {
+        buckets = make([]statsBucket, g.n)
+        g.devices[reading.DeviceID] = buckets
+    }
+    b := &buckets[slot%int64(g.n)]
+    if b.slot != slot || b.fields == nil {
+        *b = statsBucket{slot: slot, fields: make([]fieldStats, len(statFields))}
+    }
+    b.count++
+    for i, f := range statFields {
+        if v, ok := f.value(reading); ok {
+            b.fields[i].add(v)
+        }
+    }
+}
+
+// fieldSummary is one field's statistics in a /devices/{id}/stats reply.
+type fieldSummary struct {
+    Count int     `json:"count"`
+    Min   float64 `json:"min"`
+    Max   float64 `json:"max"`
+    Avg   float64 `json:"avg"`
+}
+
+// statsSummary is the reply to GET /devices/{id}/stats.
+type statsSummary struct {
+    DeviceID string                  `json:"device_id"`
+    Window   string                  `json:"window"`
+    Bucket   string                  `json:"bucket"`
+    From     time.Time               `json:"from"`
+    To       time.Time               `json:"to"`
+    Count    int                     `json:"count"`
+    Fields   map[string]fieldSummary `json:"fields"` // only fields the device sent in the window
+}
+
+// stats sums the device's buckets still in the window at now. A device that
+// has stored nothing in the window has a count of 0 and no fields.
+func (g *aggregator) stats(deviceID string, now time.Time) statsSummary {
+    slot := g.slot(now)
+    oldest := slot - int64(g.n) + 1
+    s := statsSummary{
+        DeviceID: deviceID,
+        Window:   g.window().String(),
+        Bucket:   g.bucket.String(),
+        From:     time.Unix(0, oldest*int64(g.bucket)).UTC(),
+        To:       now.UTC(),
+        Fields:   map[string]fieldSummary{},
+    }
+    totals := make([]fieldStats, len(statFields))
+
+    g.mu.Lock()
+    for _, b := range g.devices[deviceID] {
+        if b.fields == nil || b.slot < oldest || b.slot > slot {
+            continue
+        }
+        s.Count += b.count
+        for i := range totals {
+            totals[i].merge(b.fields[i])
+        }
+    }
+    g.mu.Unlock()
+
+    for i, t := range totals {
+        if t.count > 0 {
+            s.Fields[statFields[i].name] = fieldSummary{Count: t.count, Min: t.min, Max: t.max, Avg: t.sum / float64(t.count)}
+        }
+    }
+    return s
+}
+
+// sweep forgets devices with nothing left in the window at now.
+func (g *aggregator) sweep(now time.Time) {
+    oldest := g.slot(now) - int64(g.n) + 1
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    for id, buckets := range g.devices {
+        live := false
+        for _, b := range buckets {
+            if b.fields != nil && b.slot >= oldest {
+                live = true
+                break
+            }
+        }
+        if !live {
+            delete(g.devices, id)
+        }
+    }
+}
+
+// run sweeps once per bucket until Close.
+func (g *aggregator) run() {
+    defer g.wg.Done()
+    ticker := time.NewTicker(g.bucket)
+    defer ticker.Stop()
+    for {
+        select {
+        case now := <-ticker.C:
+            g.sweep(now)
+        case <-g.done:
+            return
+        }
+    }
+}
+
+// Close stops the sweeper.
+func (g *aggregator) Close() {
+    close(g.done)
+    g.wg.Wait()
+}
+
+// handleStats answers GET /devices/{id}/stats with the device's statistics
+// over the -stats-window.
+func (a *app) handleStats(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    writeJSON(w, http.StatusOK, a.stats.stats(r.PathValue("id"), time.Now()))
+}
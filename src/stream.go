@@ -0,0 +1,172 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    mediaNDJSON = "application/x-ndjson"
+
+    streamProgressEvery = 1000 // lines between progress log entries
+    streamMaxErrors     = 20   // rejected lines listed in the summary
+)
+
+// streamSummary is the response to an NDJSON stream once it ends, cleanly or not.
+type streamSummary struct {
+    Status       string        `json:"status"` // "ok", or "error" when the stream was aborted
+    Lines        int           `json:"lines"`
+    Accepted     int           `json:"accepted"`
+    Deduplicated int           `json:"deduplicated,omitempty"` // accepted lines dropped by -dedup-threshold
+    Rejected     int           `json:"rejected"`
+    Error        string        `json:"error,omitempty"`
+    Reconnect    bool          `json:"reconnect,omitempty"` // the server ended the stream; send the rest on a new one
+    Line         int           `json:"line,omitempty"`      // the line that aborted the stream
+    Errors       []batchResult `json:"errors,omitempty"`    // the first rejected lines, by line number
+}
+
+// handleStream accepts a body of newline-delimited JSON readings one line at
+// a time as it arrives, so a long-lived POST from an aggregator needs memory
+// for one line rather than the whole stream. Each line is limited to the body
+// size of a single reading and must arrive within -read-timeout of the last.
+// Readings that fail validation are dead-lettered and counted while the stream
+// goes on; a line that is not JSON, or storage that stops taking readings,
+// ends it. Lines accepted before that point stay stored.
+func (a *app) handleStream(w http.ResponseWriter, r *http.Request, o origin, dt deviceType, encoding string, maxBody int64) {
+    rc := http.NewResponseController(w)
+    var src io.Reader = r.Body
+    if encoding == "gzip" {
+        gz, err := gzip.NewReader(r.Body)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Malformed gzip request body")
+            return
+        }
+        defer gz.Close()
+        src = gz
+    }
+    scanner := bufio.NewScanner(src)
+    scanner.Buffer(make([]byte, 0, 64<<10), int(maxBody))
+
+    o.MediaType = mediaJSON
+    summary := streamSummary{Status: "ok"}
+    status := http.StatusOK
+    started := time.Now()
+
+    // At -max-conn-lifetime or shutdown the stream ends after the line being
+    // read; a read still waiting for the next line is cut short
+    var ending atomic.Pointer[string]
+    end := func(reason string) {
+        if ending.CompareAndSwap(nil, &reason) {
+            rc.SetReadDeadline(time.Now())
+        }
+    }
+    if deadline, ok := a.connEnd(r, started); ok {
+        t := time.AfterFunc(time.Until(deadline), func() { end("max-conn-lifetime") })
+        defer t.Stop()
+    }
+    defer context.AfterFunc(a.streamsEnd, func() { end("shutdown") })()
+
+    for {
+        if a.cfg.ReadTimeout > 0 {
+            rc.SetReadDeadline(time.Now().Add(a.cfg.ReadTimeout))
+        }
+        // Checked after the deadline is reset, so an end racing it still interrupts the read
+        if ending.Load() != nil || !scanner.Scan() {
+            break
+        }
+        summary.Lines++
+        line := bytes.TrimSpace(scanner.Bytes())
+        if len(line) == 0 {
+            continue
+        }
+        // The scanner reuses its buffer, and a queued job keeps the body
+        line = append([]byte(nil), line...)
+        if !json.Valid(line) {
+            a.deadLetter(o, dt, "malformed NDJSON line", line)
+            status, summary.Error = http.StatusBadRequest, "Malformed JSON"
+            break
+        }
+
+        _, out, err := a.accept(r.Context(), o, dt, line)
+        if err == nil {
+            summary.Accepted++
+            if out == outcomeDeduplicated {
+                summary.Deduplicated++
+            }
+        } else {
+            result := a.batchElementResult(summary.Lines, out, err)
+            if result.Status == http.StatusServiceUnavailable {
+                status, summary.Error = result.Status, result.Error
+                break
+            }
+            summary.Rejected++
+            if len(summary.Errors) < streamMaxErrors {
+                summary.Errors = append(summary.Errors, result)
+            }
+        }
+        if summary.Lines%streamProgressEvery == 0 {
+            slog.InfoContext(r.Context(), "NDJSON stream progress", "remote_addr", r.RemoteAddr, "type", dt.Name, "lines", summary.Lines, "accepted", summary.Accepted, "rejected", summary.Rejected)
+        }
+    }
+
+    reason := ending.Load()
+    if status == http.StatusOK {
+        var netErr net.Error
+        err := scanner.Err()
+        switch {
+        case reason != nil && (err == nil || errors.As(err, &netErr) && netErr.Timeout()):
+            // A line cut off by the interrupted read is not counted, so the
+            // device resends it
+            summary.Reconnect = true
+            if r.ProtoMajor == 1 {
+                w.Header().Set("Connection", "close")
+            }
+        case err != nil:
+            status, summary.Error = streamReadError(err, encoding, maxBody)
+            summary.Lines++
+        }
+    }
+    switch {
+    case status != http.StatusOK:
+        summary.Status, summary.Line = "error", summary.Lines
+        slog.WarnContext(r.Context(), "NDJSON stream aborted", "remote_addr", r.RemoteAddr, "type", dt.Name, "line", summary.Line, "accepted", summary.Accepted, "err", summary.Error)
+    case summary.Reconnect:
+        slog.InfoContext(r.Context(), "NDJSON stream ended by the server, device asked to reconnect", "remote_addr", r.RemoteAddr, "type", dt.Name, "reason", *reason, "lines", summary.Lines, "accepted", summary.Accepted, "rejected", summary.Rejected, "duration", time.Since(started).Round(time.Millisecond).String())
+    default:
+        slog.InfoContext(r.Context(), "NDJSON stream complete", "remote_addr", r.RemoteAddr, "type", dt.Name, "lines", summary.Lines, "accepted", summary.Accepted, "rejected", summary.Rejected, "duration", time.Since(started).Round(time.Millisecond).String())
+    }
+
+    // The write timeout started with the request, so give the summary its own
+    if a.cfg.WriteTimeout > 0 {
+        rc.SetWriteDeadline(time.Now().Add(a.cfg.WriteTimeout))
+    }
+    writeJSON(w, status, summary)
+}
+
+// streamReadError maps a failure reading the stream to a status and message.
+func streamReadError(err error, encoding string, maxBody int64) (int, string) {
+    var netErr net.Error
+    switch {
+    case errors.Is(err, bufio.ErrTooLong):
+        return http.StatusRequestEntityTooLarge, fmt.Sprintf("Line exceeds %d bytes", maxBody)
+    case errors.As(err, &netErr) && netErr.Timeout():
+        return http.StatusRequestTimeout, "Timed out waiting for the next line"
+    case encoding == "gzip" && isCorruptGzip(err):
+        return http.StatusBadRequest, "Malformed gzip request body"
+    case errors.Is(err, context.Canceled):
+        return http.StatusServiceUnavailable, "Processing cancelled"
+    }
+    slog.Error("error reading NDJSON stream", "err", err)
+    return http.StatusInternalServerError, "Error reading request body"
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "strings"
+    "sync"
+)
+
+// ticketKeys supplies the keys TLS session tickets are encrypted with, so a
+// device can resume its session after the server restarts or with another
+// replica. The first key encrypts new tickets; the others are only tried on
+// tickets presented by devices, which lets a key be rotated out gradually.
+type ticketKeys struct {
+    file  string // -session-tickets
+    value string // $IOT_SESSION_TICKET_KEYS, used when file is empty
+
+    mu      sync.Mutex
+    configs []*tls.Config
+    keys    [][32]byte
+}
+
+// newTicketKeys loads the keys from file, or from value when file is empty.
+func newTicketKeys(file, value string) (*ticketKeys, error) {
+    t := &ticketKeys{file: file, value: value}
+    keys, err := t.load()
+    if err != nil {
+        return nil, err
+    }
+    t.keys = keys
+    slog.Info("loaded session ticket keys", "keys", len(keys))
+    return t, nil
+}
+
+// load parses one key per line (or per word in the environment): 32 bytes as
+// hex, e.g. from "openssl rand -hex 32", or base64. Blank lines and lines
+// starting with # are skipped.
+func (t *ticketKeys) load() ([][32]byte, error) {
+    data, source := t.value, "$IOT_SESSION_TICKET_KEYS"
+    if t.file != "" {
+        b, err := ioutil.ReadFile(t.file)
+        if err != nil {
+            return nil, err
+        }
+        data, source = string(b), t.file
+    }
+    var keys [][32]byte
+    for i, line := range strings.Fields(stripComments(data)) {
+        b, err := hex.DecodeString(line)
+        if err != nil {
+            b, err = base64.StdEncoding.DecodeString(line)
+        }
+        if err != nil || len(b) != 32 {
+            return nil, fmt.Errorf("%s: key %d is not 32 bytes of hex or base64", source, i+1)
+        }
+        var key [32]byte
+        copy(key[:], b)
+        keys = append(keys, key)
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("%s holds no session ticket keys", source)
+    }
+    return keys, nil
+}
+
+// stripComments drops the lines of s that start with #.
+func stripComments(s string) string {
+    lines := strings.Split(s, "\n")
+    for i, line := range lines {
+        if strings.HasPrefix(strings.TrimSpace(line), "#") {
+            lines[i] = ""
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// apply makes c use the keys, now and after every reload.
+func (t *ticketKeys) apply(c *tls.Config) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    c.SetSessionTicketKeys(t.keys)
+    t.configs = append(t.configs, c)
+}
+
+// set hands keys to every config.
+func (t *ticketKeys) set(keys [][32]byte) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.keys = keys
+    for _, c := range t.configs {
+        c.SetSessionTicketKeys(keys)
+    }
+    slog.Info("reloaded session ticket keys", "keys", len(keys))
+}
+
+// current returns the keys in use.
+func (t *ticketKeys) current() [][32]byte {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.keys
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// tlsVersions maps the -tls-min values to crypto/tls constants.
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion converts a -tls-min value such as "1.2" to a TLS version constant.
+func parseTLSVersion(v string) (uint16, error) {
+    version, ok := tlsVersions[v]
+    if !ok {
+        return 0, fmt.Errorf("invalid -tls-min %q: use 1.0, 1.1, 1.2 or 1.3", v)
+    }
+    return version, nil
+}
+
+// cipherSuites is the curated list offered for TLS 1.2 and below: forward-secret
+// AEAD suites only, with CBC suites appended solely for legacy fleets that drop
+// below TLS 1.2. TLS 1.3 suites are fixed by crypto/tls and not configurable.
+var cipherSuites = []uint16{
+    tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+    tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+    tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+    tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+    tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// legacyCipherSuites are added only when -tls-min is below 1.2, since TLS 1.0
+// and 1.1 cannot negotiate the AEAD suites above.
+var legacyCipherSuites = []uint16{
+    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+    tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+    tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// logConnection records the negotiated parameters of each handshake at debug level.
+func logConnection(cs tls.ConnectionState) error {
+    slog.Debug("TLS handshake complete",
+        "version", tls.VersionName(cs.Version),
+        "cipher", tls.CipherSuiteName(cs.CipherSuite),
+        "server_name", cs.ServerName,
+        "resumed", cs.DidResume,
+    )
+    return nil
+}
+
+// defaultCertPair is the certificate the makefile generates in the ssl directory.
+var defaultCertPair = certPair{
+    CertFile: filepath.Join("ssl", "server.crt"),
+    KeyFile:  filepath.Join("ssl", "server.key"),
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+// loadCertificate reads a server certificate and its key, decrypting the key
+// with passphrase if it is encrypted.
+func loadCertificate(pair certPair, passphrase string) (tls.Certificate, error) {
+    certFile, err := ioutil.ReadFile(pair.CertFile)
+    if err != nil {
+        return tls.Certificate{}, fmt.Errorf("error reading certificate file: %v", err)
+    }
+
+    keyFile, err := ioutil.ReadFile(pair.KeyFile)
+    if err != nil {
+        return tls.Certificate{}, fmt.Errorf("error reading key file: %v", err)
+    }
+    keyFile, err = decryptKeyPEM(keyFile, passphrase)
+    if err != nil {
+        return tls.Certificate{}, fmt.Errorf("%s: %v", pair.KeyFile, err)
+    }
+
+    // Generate a certificate and key pair
+    cert, err := tls.X509KeyPair(certFile, keyFile)
+    if err != nil {
+        return tls.Certificate{}, fmt.Errorf("error loading certificate and key: %v", err)
+    }
+    return cert, nil
+}
+
+// loadCertificates returns the server certificates in order of precedence:
+// PEM contents from $IOT_TLS_CERT/$IOT_TLS_KEY, then the -cert files, then the
+// ssl directory. crypto/tls picks the certificate matching the client's SNI
+// name and falls back to the first when none match.
+func loadCertificates(cfg Config) ([]tls.Certificate, error) {
+    if cfg.TLSCertPEM != "" || cfg.TLSKeyPEM != "" {
+        if cfg.TLSCertPEM == "" || cfg.TLSKeyPEM == "" {
+            return nil, fmt.Errorf("IOT_TLS_CERT and IOT_TLS_KEY must be set together")
+        }
+        key, err := decryptKeyPEM([]byte(cfg.TLSKeyPEM), cfg.KeyPassphrase)
+        if err != nil {
+            return nil, fmt.Errorf("IOT_TLS_KEY: %v", err)
+        }
+        cert, err := tls.X509KeyPair([]byte(cfg.TLSCertPEM), key)
+        if err != nil {
+            return nil, fmt.Errorf("error loading certificate and key from environment: %v", err)
+        }
+        slog.Info("loaded TLS certificate", "source", "environment (IOT_TLS_CERT, IOT_TLS_KEY)")
+        return []tls.Certificate{cert}, nil
+    }
+
+    pairs := cfg.Certs
+    source := "-cert flags"
+    if len(pairs) == 0 {
+        pairs = []certPair{defaultCertPair}
+        source = "ssl directory"
+
+        // Without the generated ssl files, -dev falls back to a throwaway self-signed certificate
+        if cfg.Dev && !fileExists(defaultCertPair.CertFile) && !fileExists(defaultCertPair.KeyFile) {
+            cert, err := selfSignedCertificate()
+            if err != nil {
+                return nil, fmt.Errorf("error generating self-signed certificate: %v", err)
+            }
+            slog.Warn("INSECURE: serving an in-memory self-signed certificate for localhost; for development only, never use -dev in production",
+                "missing", defaultCertPair.CertFile)
+            return []tls.Certificate{cert}, nil
+        }
+    }
+    var certs []tls.Certificate
+    for _, pair := range pairs {
+        cert, err := loadCertificate(pair, cfg.KeyPassphrase)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", pair.CertFile, err)
+        }
+        certs = append(certs, cert)
+        slog.Debug("loaded certificate", "file", pair.CertFile, "names", cert.Leaf.DNSNames)
+    }
+    slog.Info("loaded TLS certificate", "source", source, "count", len(certs))
+    return certs, nil
+}
+
+// loadClientCAs reads a PEM bundle of CA certificates used to verify device certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+    pem, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificates found in %s", path)
+    }
+    return pool, nil
+}
+
+// newTLSConfig builds the server TLS configuration. When autocert is enabled it
+// also returns the manager whose HTTP handler must be served over plain HTTP for
+// ACME challenges.
+func newTLSConfig(cfg Config) (*tls.Config, *autocert.Manager, error) {
+    var tlsConfig *tls.Config
+    var manager *autocert.Manager
+    if cfg.AutocertDomain != "" {
+        // Let autocert obtain and renew certificates; HTTP-01 challenges arrive over plain HTTP
+        manager = &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(strings.Split(cfg.AutocertDomain, ",")...),
+            Cache:      autocert.DirCache(cfg.AutocertCache),
+        }
+        tlsConfig = manager.TLSConfig()
+        slog.Info("using autocert", "domains", cfg.AutocertDomain, "cache", cfg.AutocertCache)
+    } else {
+        certs, err := loadCertificates(cfg)
+        if err != nil {
+            return nil, nil, err
+        }
+        tlsConfig = &tls.Config{Certificates: certs}
+    }
+
+    // Apply the version and cipher policy
+    tlsConfig.MinVersion = cfg.TLSMin
+    tlsConfig.CipherSuites = cipherSuites
+    if cfg.TLSMin < tls.VersionTLS12 {
+        tlsConfig.CipherSuites = append(append([]uint16{}, cipherSuites...), legacyCipherSuites...)
+        slog.Warn("allowing TLS versions below 1.2 for legacy devices", "min", tls.VersionName(cfg.TLSMin))
+    }
+    if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+        tlsConfig.VerifyConnection = logConnection
+    }
+
+    // Verify device certificates against the client CA; the certificate itself is
+    // enforced per route so probes like /healthz keep working without one
+    if cfg.ClientCA != "" {
+        pool, err := loadClientCAs(cfg.ClientCA)
+        if err != nil {
+            return nil, nil, fmt.Errorf("error loading client CA %s: %v", cfg.ClientCA, err)
+        }
+        tlsConfig.ClientCAs = pool
+        tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+    return tlsConfig, manager, nil
+}
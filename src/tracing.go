@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "time"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/trace"
+    "go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracing exports a span per request to an OTLP collector. With no endpoint
+// configured the tracer is a no-op and the middleware is never installed.
+type tracing struct {
+    provider   *sdktrace.TracerProvider
+    tracer     trace.Tracer
+    propagator propagation.TextMapPropagator
+}
+
+// newTracing sets up OTLP/HTTP export to endpoint, e.g. http://localhost:4318.
+// An endpoint without a path gets the standard /v1/traces.
+func newTracing(endpoint string) (*tracing, error) {
+    if endpoint == "" {
+        return &tracing{tracer: noop.NewTracerProvider().Tracer("")}, nil
+    }
+    u, err := url.Parse(endpoint)
+    if err != nil || u.Scheme == "" || u.Host == "" {
+        return nil, fmt.Errorf("invalid OTLP endpoint %q: want a URL such as http://localhost:4318", endpoint)
+    }
+    if u.Path == "" || u.Path == "/" {
+        u.Path = "/v1/traces"
+    }
+
+    // Export failures are reported through slog like every other background error
+    otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+        slog.Warn("error exporting traces", "err", err)
+    }))
+    exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+    if err != nil {
+        return nil, fmt.Errorf("error creating OTLP exporter for %s: %v", endpoint, err)
+    }
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "iot-server"))),
+    )
+    return &tracing{
+        provider:   provider,
+        tracer:     provider.Tracer("github.com/mytechnotalent/IoT"),
+        propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+    }, nil
+}
+
+// enabled reports whether spans are exported.
+func (t *tracing) enabled() bool {
+    return t.provider != nil
+}
+
+// child starts a span for one step of handling a request. Without an exporter
+// it returns a no-op span without touching ctx, which saves two allocations
+// per step on the hot path.
+func (t *tracing) child(ctx context.Context, name string) trace.Span {
+    if !t.enabled() {
+        return trace.SpanFromContext(context.Background())
+    }
+    _, span := t.tracer.Start(ctx, name)
+    return span
+}
+
+// middleware starts a server span per request, continuing the trace named by
+// an incoming traceparent header, and records the response status on it.
+func (t *tracing) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        ctx, span := t.tracer.Start(ctx, r.Method+" "+r.URL.Path,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                attribute.String("http.request.method", r.Method),
+                attribute.String("url.path", r.URL.Path),
+                attribute.String("client.address", r.RemoteAddr),
+            ),
+        )
+        defer span.End()
+
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r.WithContext(ctx))
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+        span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+        if rec.status >= 500 {
+            span.SetStatus(codes.Error, http.StatusText(rec.status))
+        }
+    })
+}
+
+// Close flushes buffered spans to the collector.
+func (t *tracing) Close() error {
+    if t.provider == nil {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    return t.provider.Shutdown(ctx)
+}
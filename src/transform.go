@@ -0,0 +1,74 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "path/filepath"
+    "text/template"
+)
+
+// transformData is what a transform template is executed with: the parsed
+// reading's fields plus the device type, e.g. {{.DeviceID}}, {{.Temp}}, {{.Type}}.
+type transformData struct {
+    SensorReading
+    Type string
+}
+
+// transformFuncs are the helpers available to transform templates beyond the builtins.
+var transformFuncs = template.FuncMap{
+    // json renders a value as JSON, e.g. {"id":{{json .DeviceID}}}
+    "json": func(v any) (string, error) {
+        b, err := json.Marshal(v)
+        return string(b), err
+    },
+    // deref reads an optional field, e.g. {{with .Temp}}{{deref .}}{{end}}
+    "deref": func(v any) (any, error) {
+        switch p := v.(type) {
+        case *float64:
+            if p != nil {
+                return *p, nil
+            }
+        case *bool:
+            if p != nil {
+                return *p, nil
+            }
+        default:
+            return v, nil
+        }
+        return nil, errors.New("field is not set")
+    },
+}
+
+// transform reshapes readings with a text/template before they are stored.
+type transform struct {
+    tmpl *template.Template
+}
+
+// loadTransform parses the template file at path. Referencing a field that does
+// not exist is an error at execution time rather than a silent "<no value>".
+func loadTransform(path string) (*transform, error) {
+    tmpl, err := template.New(filepath.Base(path)).Funcs(transformFuncs).Option("missingkey=error").ParseFiles(path)
+    if err != nil {
+        return nil, err
+    }
+    return &transform{tmpl: tmpl}, nil
+}
+
+// apply renders the reading through the template.
+func (t *transform) apply(dt deviceType, reading SensorReading) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := t.tmpl.Execute(&buf, transformData{SensorReading: reading, Type: dt.Name}); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// transformError marks a reading that was valid but could not be transformed,
+// which is a server-side configuration fault rather than the device's.
+type transformError struct {
+    err error
+}
+
+func (e *transformError) Error() string { return "error transforming reading: " + e.err.Error() }
+func (e *transformError) Unwrap() error { return e.err }
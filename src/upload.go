@@ -0,0 +1,162 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// handleUpload streams a large body such as a firmware image or camera snapshot
+// straight to disk instead of buffering it in memory. The body is written to a
+// temporary file in the upload directory and only renamed into place once it
+// is complete and, when the client sent X-Content-SHA256, its checksum matches.
+func (a *app) handleUpload(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost, http.MethodPut) {
+        return
+    }
+    if a.maint.refuse(w) {
+        return
+    }
+
+    // With -accept-types, uploads are held to the list as well
+    if a.types.explicit {
+        mt := mediaType(r)
+        if r.Header.Get("Content-Type") == "" {
+            mt = mediaOctetStream
+        }
+        if !a.types.allows(mt) {
+            slog.WarnContext(r.Context(), "rejected upload with unaccepted Content-Type", "remote_addr", r.RemoteAddr, "content_type", r.Header.Get("Content-Type"))
+            writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be one of: "+a.types.String())
+            return
+        }
+    }
+
+    // Refuse anything that could escape the upload directory
+    name := r.PathValue("name")
+    if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+        writeError(w, http.StatusBadRequest, "Invalid file name")
+        return
+    }
+    var sig []byte
+    if a.signer != nil {
+        var ok bool
+        if sig, ok = signature(r); !ok {
+            slog.WarnContext(r.Context(), "rejected upload without a valid X-Signature", "remote_addr", r.RemoteAddr, "name", name)
+            writeError(w, http.StatusUnauthorized, "Missing or malformed X-Signature")
+            return
+        }
+    }
+    digests, ok := requestDigests(w, r)
+    if !ok {
+        return
+    }
+    want := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Content-SHA256")))
+    if want != "" {
+        if b, err := hex.DecodeString(want); err != nil || len(b) != sha256.Size {
+            writeError(w, http.StatusBadRequest, "X-Content-SHA256 must be a hex-encoded SHA-256 digest")
+            return
+        }
+    }
+
+    // The temporary file lives next to its destination so the rename stays on one filesystem
+    err := os.MkdirAll(a.cfg.UploadDir, 0755)
+    var tmp *os.File
+    if err == nil {
+        tmp, err = ioutil.TempFile(a.cfg.UploadDir, ".upload-*")
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "error creating upload file", "dir", a.cfg.UploadDir, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error storing upload")
+        return
+    }
+    // Until the rename succeeds the temporary file is removed on every exit path
+    committed := false
+    defer func() {
+        if !committed {
+            tmp.Close()
+            os.Remove(tmp.Name())
+        }
+    }()
+
+    // Hash while copying so the file is read only once
+    digest := sha256.New()
+    dst := io.MultiWriter(tmp, digest)
+    var mac hash.Hash
+    if a.signer != nil {
+        mac = a.signer.newMAC()
+        dst = io.MultiWriter(tmp, digest, mac)
+    }
+    if digests != nil {
+        dst = io.MultiWriter(dst, digests.writer())
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, a.cfg.UploadMax)
+    n, err := io.Copy(dst, r.Body)
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            slog.WarnContext(r.Context(), "upload too large", "remote_addr", r.RemoteAddr, "name", name, "limit", tooLarge.Limit)
+            writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds %d bytes", tooLarge.Limit))
+            return
+        }
+        slog.ErrorContext(r.Context(), "error receiving upload", "remote_addr", r.RemoteAddr, "name", name, "bytes", n, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error receiving upload")
+        return
+    }
+    a.metrics.observeBody(int(n))
+
+    if alg, got, ok := digests.verify(); !ok {
+        slog.WarnContext(r.Context(), "rejected upload not matching its Digest", "remote_addr", r.RemoteAddr, "name", name, "algorithm", alg)
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("Digest mismatch: %s of the upload received is %s", alg, got))
+        return
+    }
+    if a.signer != nil && !a.signer.verify(mac, sig) {
+        slog.WarnContext(r.Context(), "rejected upload with mismatched X-Signature", "remote_addr", r.RemoteAddr, "name", name)
+        writeError(w, http.StatusUnauthorized, "Invalid X-Signature")
+        return
+    }
+    got := hex.EncodeToString(digest.Sum(nil))
+    if want != "" && got != want {
+        slog.WarnContext(r.Context(), "upload checksum mismatch", "remote_addr", r.RemoteAddr, "name", name, "want", want, "got", got)
+        writeError(w, http.StatusUnprocessableEntity, "SHA-256 mismatch: received "+got)
+        return
+    }
+
+    // -echo checks everything but keeps nothing; the deferred cleanup removes the file
+    if a.cfg.Echo {
+        slog.WarnContext(r.Context(), "ECHO MODE: upload not stored", "remote_addr", r.RemoteAddr, "name", name, "bytes", n)
+        writeJSON(w, http.StatusOK, withServerTime(response{Status: "echo", Received: int(n), SHA256: got}, 0))
+        return
+    }
+
+    // Flush to disk before the rename so a crash never leaves a complete-looking partial file
+    if err := tmp.Sync(); err == nil {
+        err = tmp.Close()
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), filepath.Join(a.cfg.UploadDir, name))
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "error storing upload", "name", name, "err", err)
+        writeError(w, http.StatusInternalServerError, "Error storing upload")
+        return
+    }
+    committed = true
+
+    slog.InfoContext(r.Context(), "received upload",
+        "remote_addr", r.RemoteAddr,
+        "client_cn", clientName(r),
+        "name", name,
+        "bytes", n,
+        "sha256", got,
+    )
+    writeJSON(w, http.StatusOK, withServerTime(response{Status: "ok", Received: int(n), SHA256: got}, 0))
+}
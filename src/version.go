@@ -0,0 +1,29 @@
+package main
+
+import (
+    "net/http"
+)
+
+// Build metadata, set at link time, e.g.
+//
+//  go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+    version   = "dev"
+    commit    = "unknown"
+    buildDate = "unknown"
+)
+
+// versionInfo is the body of GET /version.
+type versionInfo struct {
+    Version   string `json:"version"`
+    Commit    string `json:"commit"`
+    BuildDate string `json:"build_date"`
+}
+
+// handleVersion reports which build is running; like /healthz it needs no credentials.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    writeJSON(w, http.StatusOK, versionInfo{Version: version, Commit: commit, BuildDate: buildDate})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+const (
+    // watchdogInterval is how often the watchdog looks for silent devices, so
+    // an alert fires at most this long after a device's silence is up.
+    watchdogInterval = 5 * time.Second
+
+    // watchdogPending bounds the alerts waiting for the webhook; beyond it
+    // they are only logged.
+    watchdogPending = 256
+
+    // watchdogAttempts is how many times an alert is sent to the webhook.
+    watchdogAttempts = 3
+)
+
+// watchedDevice is one monitored device in the -watchdog file.
+type watchedDevice struct {
+    Silence time.Duration `yaml:"silence"` // longest the device may go without a reading
+}
+
+// watchdogFile is the -watchdog file:
+//
+//  devices:
+//    temp-07: {silence: 10m}
+//    camera-01: {silence: 1h}
+type watchdogFile struct {
+    Devices map[string]watchedDevice `yaml:"devices"`
+}
+
+// deviceWatch is what the watchdog knows about one monitored device.
+type deviceWatch struct {
+    silence  time.Duration
+    since    time.Time // last reading, or when monitoring began
+    seen     bool      // whether since is a reading
+    alerting bool
+}
+
+// watchdogEvent is an alert, logged and POSTed to -watchdog-webhook as JSON.
+type watchdogEvent struct {
+    Event    string     `json:"event"` // "silent", or "resumed" once it reports again
+    DeviceID string     `json:"device_id"`
+    Silence  string     `json:"silence"`
+    LastSeen *time.Time `json:"last_seen,omitempty"` // absent if not heard from since the server started
+    Time     time.Time  `json:"time"`
+}
+
+// watchdog raises an alert when a monitored device has sent no reading for
+// longer than its silence, and clears it when the device reports again. The
+// device list can be reloaded while the server runs.
+type watchdog struct {
+    path    string
+    webhook string
+    client  *http.Client
+
+    mu      sync.Mutex
+    devices map[string]*deviceWatch // keyed by client certificate CN or device_id
+    config  map[string]watchedDevice
+
+    events chan watchdogEvent
+    done   chan struct{}
+    wg     sync.WaitGroup
+}
+
+// newWatchdog reads the devices to monitor from path and starts watching.
+// Alerts are logged, and POSTed to webhook if it is set.
+func newWatchdog(path, webhook string) (*watchdog, error) {
+    wd := &watchdog{
+        path:    path,
+        webhook: webhook,
+        client:  &http.Client{Timeout: 10 * time.Second},
+        devices: make(map[string]*deviceWatch),
+        events:  make(chan watchdogEvent, watchdogPending),
+        done:    make(chan struct{}),
+    }
+    devices, err := wd.load()
+    if err != nil {
+        return nil, err
+    }
+    wd.set(devices)
+    wd.wg.Add(1)
+    go wd.run()
+    if webhook != "" {
+        wd.wg.Add(1)
+        go wd.send()
+    }
+    return wd, nil
+}
+
+// load reads and checks the file without applying it.
+func (wd *watchdog) load() (map[string]watchedDevice, error) {
+    data, err := ioutil.ReadFile(wd.path)
+    if err != nil {
+        return nil, err
+    }
+    var f watchdogFile
+    if err := yaml.Unmarshal(data, &f); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", wd.path, err)
+    }
+    for id, d := range f.Devices {
+        if d.Silence < watchdogInterval {
+            return nil, fmt.Errorf("invalid silence for device %q in %s: must be at least %s", id, wd.path, watchdogInterval)
+        }
+    }
+    return f.Devices, nil
+}
+
+// set replaces the monitored devices. Devices still listed keep their last
+// reading and alert; new ones are given their silence from now.
+func (wd *watchdog) set(devices map[string]watchedDevice) {
+    now := time.Now()
+    wd.mu.Lock()
+    watches := make(map[string]*deviceWatch, len(devices))
+    for id, d := range devices {
+        w, ok := wd.devices[id]
+        if !ok {
+            w = &deviceWatch{since: now}
+        }
+        w.silence = d.Silence
+        watches[id] = w
+    }
+    wd.devices, wd.config = watches, devices
+    wd.mu.Unlock()
+    slog.Info("loaded watchdog devices", "file", wd.path, "devices", len(devices))
+}
+
+// current returns the monitored devices as configured.
+func (wd *watchdog) current() map[string]watchedDevice {
+    wd.mu.Lock()
+    defer wd.mu.Unlock()
+    return wd.config
+}
+
+// seen records a reading from device, clearing its alert if it had one.
+func (wd *watchdog) seen(device string, now time.Time) {
+    wd.mu.Lock()
+    w, ok := wd.devices[device]
+    if !ok {
+        wd.mu.Unlock()
+        return
+    }
+    last, wasSeen, resumed := w.since, w.seen, w.alerting
+    w.since, w.seen, w.alerting = now, true, false
+    wd.mu.Unlock()
+
+    if resumed {
+        e := watchdogEvent{Event: "resumed", DeviceID: device, Silence: w.silence.String(), Time: now.UTC()}
+        if wasSeen {
+            t := last.UTC()
+            e.LastSeen = &t
+        }
+        slog.Info("watchdog: device reporting again", "device_id", device, "silent_for", now.Sub(last).Round(time.Second).String())
+        wd.alert(e)
+    }
+}
+
+// check raises an alert for every device that has been silent too long.
+func (wd *watchdog) check(now time.Time) {
+    var fired []watchdogEvent
+    wd.mu.Lock()
+    for id, w := range wd.devices {
+        if w.alerting || now.Sub(w.since) <= w.silence {
+            continue
+        }
+        w.alerting = true
+        e := watchdogEvent{Event: "silent", DeviceID: id, Silence: w.silence.String(), Time: now.UTC()}
+        if w.seen {
+            t := w.since.UTC()
+            e.LastSeen = &t
+        }
+        fired = append(fired, e)
+    }
+    wd.mu.Unlock()
+
+    for _, e := range fired {
+        args := []any{"device_id", e.DeviceID, "silence", e.Silence}
+        if e.LastSeen != nil {
+            args = append(args, "last_seen", *e.LastSeen)
+        }
+        slog.Warn("watchdog: device has gone silent", args...)
+        wd.alert(e)
+    }
+}
+
+// silentCount returns how many monitored devices are alerting.
+func (wd *watchdog) silentCount() int {
+    wd.mu.Lock()
+    defer wd.mu.Unlock()
+    n := 0
+    for _, w := range wd.devices {
+        if w.alerting {
+            n++
+        }
+    }
+    return n
+}
+
+// alert queues e for the webhook, if there is one, without blocking.
+func (wd *watchdog) alert(e watchdogEvent) {
+    if wd.webhook == "" {
+        return
+    }
+    select {
+    case wd.events <- e:
+    default:
+        slog.Error("watchdog webhook backlog full, alert only logged", "device_id", e.DeviceID, "event", e.Event)
+    }
+}
+
+// run checks for silent devices every watchdogInterval until Close.
+func (wd *watchdog) run() {
+    defer wd.wg.Done()
+    ticker := time.NewTicker(watchdogInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case now := <-ticker.C:
+            wd.check(now)
+        case <-wd.done:
+            return
+        }
+    }
+}
+
+// send POSTs queued alerts to the webhook one at a time until Close,
+// retrying each a few times with backoff.
+func (wd *watchdog) send() {
+    defer wd.wg.Done()
+    for {
+        select {
+        case e := <-wd.events:
+            var err error
+            for attempt := 0; attempt < watchdogAttempts; attempt++ {
+                if attempt > 0 {
+                    select {
+                    case <-time.After(backoff(time.Second, attempt-1)):
+                    case <-wd.done:
+                        return
+                    }
+                }
+                if err = wd.post(e); err == nil {
+                    break
+                }
+            }
+            if err != nil {
+                slog.Error("error sending watchdog alert", "webhook", redactedURL(wd.webhook), "device_id", e.DeviceID, "event", e.Event, "err", err)
+            }
+        case <-wd.done:
+            return
+        }
+    }
+}
+
+// post sends one alert; any 2xx reply counts as delivered.
+func (wd *watchdog) post(e watchdogEvent) error {
+    body, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    resp, err := wd.client.Post(wd.webhook, mediaJSON, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook replied %s", resp.Status)
+    }
+    return nil
+}
+
+// Close stops watching; alerts not yet sent are dropped.
+func (wd *watchdog) Close() {
+    close(wd.done)
+    wd.wg.Wait()
+}
+
+// redactedURL returns raw without any password, for logs.
+func redactedURL(raw string) string {
+    if u, err := url.Parse(raw); err == nil {
+        return u.Redacted()
+    }
+    return raw
+}
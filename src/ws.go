@@ -0,0 +1,370 @@
+package main
+
+import (
+    "container/list"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// WebSocket keepalive and delivery settings.
+const (
+    wsWriteWait     = 10 * time.Second    // time allowed to write one message
+    wsPongWait      = 60 * time.Second    // a connection with no pong for this long is dead
+    wsPingPeriod    = wsPongWait * 9 / 10 // ping often enough to beat wsPongWait
+    wsPendingLimit  = 64                  // commands held per device while it is offline
+    wsPendingTotal  = 10000               // commands held for all offline devices; the oldest go first
+    wsMaxCommandLen = 64 << 10
+)
+
+// wsCommand is a message pushed to a device, e.g. {"type":"command","id":"9f2c...","command":{"relay":"on"}}.
+type wsCommand struct {
+    Type    string          `json:"type"`
+    ID      string          `json:"id"`
+    Command json.RawMessage `json:"command"`
+}
+
+// wsAck answers each reading frame in order, with the status the same reading
+// would get from a POST, e.g. {"type":"ack","index":0,"status":200}.
+type wsAck struct {
+    Type string `json:"type"`
+    batchResult
+}
+
+// wsHub tracks the open device WebSockets and the commands waiting for devices
+// that are not connected.
+type wsHub struct {
+    upgrader websocket.Upgrader
+
+    mu      sync.Mutex
+    conns   map[string]*wsConn
+    pending map[string][]*list.Element // a device's elements of queued, oldest first
+    queued  *list.List                 // every pendingCommand, oldest first
+    closed  bool
+    wg      sync.WaitGroup
+}
+
+// pendingCommand is a command held for a device that is not connected.
+type pendingCommand struct {
+    device string
+    cmd    wsCommand
+}
+
+// wsConn is one device's connection. Every write goes through its writer
+// goroutine, since a WebSocket allows only one writer at a time.
+type wsConn struct {
+    ws     *websocket.Conn
+    device string
+    send   chan any
+    done   chan struct{}
+    once   sync.Once
+}
+
+func newWSHub(cors *corsPolicy) *wsHub {
+    h := &wsHub{
+        conns:   make(map[string]*wsConn),
+        pending: make(map[string][]*list.Element),
+        queued:  list.New(),
+    }
+    // Devices send no Origin; browsers must be allowed by -cors-origins, as for POSTs
+    h.upgrader.CheckOrigin = func(r *http.Request) bool {
+        origin := r.Header.Get("Origin")
+        return origin == "" || (cors != nil && cors.allowed(origin))
+    }
+    return h
+}
+
+// handleWS upgrades /ws to a WebSocket. Text frames are JSON readings and binary
+// frames CBOR readings, both of the device type named by ?type= (temp by default);
+// each one goes through app.accept and is answered with a wsAck. Commands queued
+// for the device through /devices/{id}/commands are pushed on the same connection.
+func (a *app) handleWS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+    if a.maint.refuse(w) {
+        return
+    }
+    dt, ok := wsDeviceType(r.URL.Query().Get("type"))
+    if !ok {
+        writeError(w, http.StatusBadRequest, "Unknown or unstructured device type")
+        return
+    }
+    // Commands for the device go to whoever holds its socket, so the device
+    // must have proved who it is, not only claimed it in X-Device-ID
+    device := verifiedDevice(r)
+    if device == "" {
+        slog.WarnContext(r.Context(), "rejected WebSocket without a verified device", "remote_addr", r.RemoteAddr, "device_id", r.Header.Get("X-Device-ID"))
+        writeError(w, http.StatusForbidden, "WebSocket needs a client certificate or a device secret")
+        return
+    }
+
+    ws, err := a.ws.upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // The upgrader has already replied
+        slog.WarnContext(r.Context(), "error upgrading to WebSocket", "remote_addr", r.RemoteAddr, "err", err)
+        return
+    }
+    c := &wsConn{ws: ws, device: device, send: make(chan any, wsPendingLimit), done: make(chan struct{})}
+    if !a.ws.register(c) {
+        c.closeWith(websocket.CloseGoingAway, "server shutting down")
+        return
+    }
+    defer a.ws.unregister(c)
+    slog.InfoContext(r.Context(), "WebSocket connected", "device_id", device, "type", dt.Name, "remote_addr", r.RemoteAddr)
+
+    go c.writeLoop()
+    a.wsReadLoop(c, r, dt)
+    slog.InfoContext(r.Context(), "WebSocket disconnected", "device_id", device, "remote_addr", r.RemoteAddr)
+}
+
+// wsDeviceType finds the device type for ?type=; only types with JSON readings
+// can arrive as frames.
+func wsDeviceType(name string) (deviceType, bool) {
+    if name == "" {
+        return deviceTypes[0], true
+    }
+    for _, dt := range deviceTypes {
+        if dt.Name == name && dt.accepts(mediaJSON) {
+            return dt, true
+        }
+    }
+    return deviceType{}, false
+}
+
+// wsReadLoop processes reading frames until the device closes the connection,
+// stops answering pings, or the hub is closed.
+func (a *app) wsReadLoop(c *wsConn, r *http.Request, dt deviceType) {
+    c.ws.SetReadLimit(a.maxBody(r))
+    c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+    c.ws.SetPongHandler(func(string) error {
+        return c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+    })
+
+    o := origin{
+        Transport:  "websocket",
+        RemoteAddr: r.RemoteAddr,
+        ClientCN:   clientName(r),
+        DeviceID:   r.Header.Get("X-Device-ID"),
+        RequestID:  requestID(r.Context()),
+    }
+    for i := 0; ; i++ {
+        kind, data, err := c.ws.ReadMessage()
+        if err != nil {
+            if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && !c.closing() {
+                slog.WarnContext(r.Context(), "error reading WebSocket frame", "device_id", c.device, "remote_addr", r.RemoteAddr, "err", err)
+            }
+            return
+        }
+        // Any frame shows the device is alive, not just a pong
+        c.ws.SetReadDeadline(time.Now().Add(wsPongWait))
+
+        o.MediaType = mediaJSON
+        if kind == websocket.BinaryMessage {
+            o.MediaType = mediaCBOR
+        }
+        a.metrics.observeBody(len(data))
+        a.sizes.observe(len(data))
+        _, out, err := a.accept(r.Context(), o, dt, data)
+        if !c.push(wsAck{Type: "ack", batchResult: a.batchElementResult(i, out, err)}) {
+            return
+        }
+    }
+}
+
+// writeLoop sends queued messages and keepalive pings until the connection closes.
+func (c *wsConn) writeLoop() {
+    ticker := time.NewTicker(wsPingPeriod)
+    defer ticker.Stop()
+    for {
+        select {
+        case msg := <-c.send:
+            c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+            if err := c.ws.WriteJSON(msg); err != nil {
+                slog.Warn("error writing WebSocket message", "device_id", c.device, "err", err)
+                c.closeWith(websocket.CloseInternalServerErr, "write failed")
+                return
+            }
+        case <-ticker.C:
+            if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+                c.closeWith(websocket.CloseGoingAway, "ping failed")
+                return
+            }
+        case <-c.done:
+            return
+        }
+    }
+}
+
+// push queues msg for the writer, reporting false if the connection is closed
+// or too far behind to keep.
+func (c *wsConn) push(msg any) bool {
+    select {
+    case <-c.done:
+        return false
+    default:
+    }
+    select {
+    case c.send <- msg:
+        return true
+    case <-c.done:
+        return false
+    default:
+        slog.Warn("WebSocket client too slow, disconnecting", "device_id", c.device)
+        c.closeWith(websocket.CloseTryAgainLater, "too slow")
+        return false
+    }
+}
+
+// closeWith sends a close frame with code and reason and closes the connection,
+// which ends both loops. Only the first call has any effect.
+func (c *wsConn) closeWith(code int, reason string) {
+    c.once.Do(func() {
+        close(c.done)
+        c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+        c.ws.Close()
+    })
+}
+
+// closing reports whether the server closed the connection.
+func (c *wsConn) closing() bool {
+    select {
+    case <-c.done:
+        return true
+    default:
+        return false
+    }
+}
+
+// register makes c the device's connection, replacing any older one, and hands
+// it the commands that were waiting. It reports false once the hub is closed.
+func (h *wsHub) register(c *wsConn) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.closed {
+        return false
+    }
+    if old, ok := h.conns[c.device]; ok {
+        old.closeWith(websocket.ClosePolicyViolation, "replaced by a newer connection")
+    }
+    h.conns[c.device] = c
+    for _, el := range h.pending[c.device] {
+        c.send <- el.Value.(pendingCommand).cmd
+        h.queued.Remove(el)
+    }
+    delete(h.pending, c.device)
+    h.wg.Add(1)
+    return true
+}
+
+// unregister forgets c, unless a newer connection for the device has replaced it.
+func (h *wsHub) unregister(c *wsConn) {
+    c.closeWith(websocket.CloseNormalClosure, "")
+    h.mu.Lock()
+    if h.conns[c.device] == c {
+        delete(h.conns, c.device)
+    }
+    h.mu.Unlock()
+    h.wg.Done()
+}
+
+// errCommandQueueFull means a device already has wsPendingLimit undelivered commands.
+var errCommandQueueFull = errors.New("command queue is full")
+
+// enqueue delivers cmd to the device now if it is connected, or holds it until
+// it next connects. It reports whether the command was sent straight away.
+// Once wsPendingTotal commands are held, the oldest of all is dropped to make
+// room, so commands for devices that never connect cannot use up memory.
+func (h *wsHub) enqueue(device string, cmd wsCommand) (bool, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if c, ok := h.conns[device]; ok && c.push(cmd) {
+        return true, nil
+    }
+    if len(h.pending[device]) >= wsPendingLimit {
+        return false, errCommandQueueFull
+    }
+    if h.queued.Len() >= wsPendingTotal {
+        oldest := h.queued.Remove(h.queued.Front()).(pendingCommand)
+        if rest := h.pending[oldest.device][1:]; len(rest) > 0 {
+            h.pending[oldest.device] = rest
+        } else {
+            delete(h.pending, oldest.device)
+        }
+        slog.Warn("dropping oldest undelivered WebSocket command", "device_id", oldest.device, "id", oldest.cmd.ID)
+    }
+    h.pending[device] = append(h.pending[device], h.queued.PushBack(pendingCommand{device: device, cmd: cmd}))
+    return false, nil
+}
+
+// Close tells every connected device the server is going away, then waits for
+// their in-flight readings to finish. Commands not yet delivered are dropped.
+// It is safe to call more than once; every call waits.
+func (h *wsHub) Close() {
+    h.mu.Lock()
+    if !h.closed {
+        h.closed = true
+        for _, c := range h.conns {
+            c.closeWith(websocket.CloseGoingAway, "server shutting down")
+        }
+        if dropped := h.queued.Len(); dropped > 0 {
+            slog.Warn("dropping undelivered WebSocket commands", "commands", dropped)
+        }
+    }
+    h.mu.Unlock()
+    h.wg.Wait()
+}
+
+// handleCommand queues the JSON body of a POST to /devices/{id}/commands for
+// delivery to that device over its WebSocket. It is admitted by -admin and
+// audited like the other admin endpoints, since it controls devices.
+func (a *app) handleCommand(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+    if mediaType(r) != mediaJSON {
+        writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+        return
+    }
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, wsMaxCommandLen))
+    if err != nil {
+        writeError(w, http.StatusRequestEntityTooLarge, "Command too large")
+        return
+    }
+    if !json.Valid(body) {
+        writeError(w, http.StatusBadRequest, "Command must be valid JSON")
+        return
+    }
+
+    device := r.PathValue("id")
+    cmd := wsCommand{Type: "command", ID: commandID(), Command: body}
+    sent, err := a.ws.enqueue(device, cmd)
+    if err != nil {
+        w.Header().Set("Retry-After", "60")
+        writeError(w, http.StatusServiceUnavailable, "Too many undelivered commands for device")
+        return
+    }
+    slog.InfoContext(r.Context(), "queued device command", "device_id", device, "id", cmd.ID, "sent", sent)
+    auditNote(r.Context(), "device_id", device)
+    auditNote(r.Context(), "command_id", cmd.ID)
+    status := "queued"
+    if sent {
+        status = "sent"
+    }
+    writeJSON(w, http.StatusAccepted, map[string]string{"status": status, "id": cmd.ID})
+}
+
+// commandID returns a random identifier the device can echo back in replies.
+func commandID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestWSNeedsVerifiedDevice(t *testing.T) {
+    a := newTestApp(t)
+    r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+    r.Header.Set("X-Device-ID", "dev1")
+    w := httptest.NewRecorder()
+    a.handler().ServeHTTP(w, r)
+    if w.Code != http.StatusForbidden {
+        t.Errorf("status = %d, want 403 for a device known only by X-Device-ID", w.Code)
+    }
+}
+
+func TestCommandsNeedAdmin(t *testing.T) {
+    send := func(a *app, addr string) int {
+        r := httptest.NewRequest(http.MethodPost, "/devices/dev1/commands", strings.NewReader(`{"relay":"on"}`))
+        r.RemoteAddr = addr
+        r.Header.Set("Content-Type", "application/json")
+        w := httptest.NewRecorder()
+        a.handler().ServeHTTP(w, r)
+        return w.Code
+    }
+    if code := send(newTestApp(t), "127.0.0.1:1234"); code != http.StatusNotFound {
+        t.Errorf("without -admin: status %d, want 404", code)
+    }
+    a := newTestApp(t, "-admin", "local")
+    if code := send(a, "192.0.2.1:1234"); code != http.StatusForbidden {
+        t.Errorf("from a client -admin does not list: status %d, want 403", code)
+    }
+    if code := send(a, "127.0.0.1:1234"); code != http.StatusAccepted {
+        t.Errorf("from an admin: status %d, want 202", code)
+    }
+}
+
+func TestPendingCommandsCapped(t *testing.T) {
+    h := newWSHub(nil)
+    for i := 0; i < wsPendingTotal+10; i++ {
+        if _, err := h.enqueue(fmt.Sprintf("dev%d", i), wsCommand{Type: "command", ID: fmt.Sprint(i)}); err != nil {
+            t.Fatalf("enqueue %d: %v", i, err)
+        }
+    }
+    if n := h.queued.Len(); n != wsPendingTotal {
+        t.Errorf("%d commands held, want %d", n, wsPendingTotal)
+    }
+    if len(h.pending) != wsPendingTotal {
+        t.Errorf("%d devices with commands held, want %d", len(h.pending), wsPendingTotal)
+    }
+    if _, ok := h.pending["dev0"]; ok {
+        t.Error("the oldest command was kept, want it dropped")
+    }
+    if first := h.queued.Front().Value.(pendingCommand); first.device != "dev10" {
+        t.Errorf("oldest command held is for %s, want dev10", first.device)
+    }
+}